@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//annotationKinds виды отметок на треке: комментарий — с текстом, маркер и глава —
+//	с названием. Главы выгружаются отдельно (см. Chapters)
+var annotationKinds = map[string]bool{"comment": true, "marker": true, "chapter": true}
+
+type tAnnotation struct {
+	AnnotationID int        `json:"id"`
+	Kind         string     `json:"kind"`
+	Start        float64    `json:"start"`
+	End          *float64   `json:"end,omitempty"`
+	Title        string     `json:"title,omitempty"`
+	Text         string     `json:"text,omitempty"`
+	AuthorID     int        `json:"author_id"`
+	AuthorName   string     `json:"author_name"`
+	IsAuthor     bool       `json:"is_author"`
+	Created      time.Time  `json:"created"`
+	Updated      *time.Time `json:"updated,omitempty"`
+}
+
+type tAnnotationList struct {
+	Count int            `json:"total_count"`
+	List  []*tAnnotation `json:"records"`
+}
+
+//timestampRe момент времени трека: секунды либо [hh:]mm:ss, с дробной частью
+var timestampRe = regexp.MustCompile(`^(\d+:){0,2}\d+(\.\d+)?$`)
+
+//parseTimestamp момент времени трека в миллисекундах из секунд с дробной частью
+//	либо [hh:]mm:ss[.fff]. Минуты и секунды после старшей части — меньше 60
+func parseTimestamp(s string) (ms int, err error) {
+	var secs float64
+
+	s = strings.TrimSpace(s)
+	if !timestampRe.MatchString(s) {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	for i, p := range strings.Split(s, ":") {
+		v, _ := strconv.ParseFloat(p, 64)
+		if i > 0 && v >= 60 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		secs = secs*60 + v
+	}
+	if secs*1000 > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return int(math.Round(secs * 1000)), nil
+}
+
+//annotationField проверка отметки вида kind с началом start и концом end (мс,
+//	-1 — без конца) на треке длительностью dur (мс, 0 — неизвестна)
+//Результат: параметр с ошибкой и ее причина, "" — отметка верна
+func annotationField(kind, title, text string, start, end, dur int) (field, reason string) {
+	switch {
+	case kind == "comment" && text == "":
+		return "text", "required"
+	case kind != "comment" && title == "":
+		return "title", "required"
+	case dur > 0 && start > dur:
+		return "start", "invalid"
+	case end >= 0 && (end <= start || dur > 0 && end > dur):
+		return "end", "invalid"
+	}
+	return "", ""
+}
+
+//Annotations класс для таблицы annotations: комментарии с привязкой ко времени,
+//	маркеры и главы трека. Добавляют и видят их все, кому трек доступен,
+//	изменяет и удаляет только автор
+type Annotations struct {
+	DB     *sql.DB
+	userID int
+}
+
+//NewAnnotations создание нового экземпляра класса Annotations
+func NewAnnotations(db *sql.DB) *Annotations {
+	return &Annotations{
+		DB: db,
+	}
+}
+
+//List отметки трека по времени начала. Метод GET, доступен тем, кому трек доступен
+//Параметры: track — id трека; kind — необязательный, comment|marker|chapter
+//Результат: статус ОК, json: количество и список отметок с автором
+//Ошибка: статус NotFound если трека нет или он недоступен, либо отметок нет
+func (an *Annotations) List(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		tr      int
+		kind    string
+		endMs   sql.NullInt64
+		updated sql.NullTime
+		qs      *sql.Rows
+		anLst   tAnnotationList
+	)
+
+	if an.userID, err = checkSession(an.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if kind = req.Form.Get("kind"); kind != "" && !annotationKinds[kind] {
+		fieldError(resp, "kind", "invalid")
+		return
+	}
+	if _, _, ok := an.trackInfo(tr, resp); !ok {
+		return
+	}
+
+	qs, err = an.DB.Query(`SELECT n.id_annotation, n.kind, n.start_ms, n.end_ms, n.title, n.text,
+			n.id_user, coalesce(nullif(u.name,''), u.login), n.id_user = $1, n.created, n.updated
+		FROM annotations n
+		INNER JOIN users u ON (u.id_user = n.id_user)
+		WHERE n.id_audio = $2 AND ($3::text = '' OR n.kind = $3)
+		ORDER BY n.start_ms, n.id_annotation`, an.userID, tr, kind)
+	if err != nil {
+		dbError(resp, err, "Annotations.List query failed:")
+		return
+	}
+	defer qs.Close()
+	for qs.Next() {
+		var startMs int
+		n := &tAnnotation{}
+		err = qs.Scan(&n.AnnotationID, &n.Kind, &startMs, &endMs, &n.Title, &n.Text,
+			&n.AuthorID, &n.AuthorName, &n.IsAuthor, &n.Created, &updated)
+		if err != nil {
+			dbError(resp, err, "Annotations.List scan error:")
+			return
+		}
+		n.Start = float64(startMs) / 1000
+		if endMs.Valid {
+			end := float64(endMs.Int64) / 1000
+			n.End = &end
+		}
+		if updated.Valid {
+			n.Updated = &updated.Time
+		}
+		anLst.List = append(anLst.List, n)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Annotations.List query iteration error:")
+		return
+	}
+	if len(anLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+	anLst.Count = len(anLst.List)
+
+	jsRes, err := json.Marshal(anLst)
+	if err != nil {
+		internalError(resp, err, "Annotations.List result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Add новая отметка на треке. Метод POST, доступен тем, кому трек доступен
+//Параметры: track — id трека; kind — comment|marker|chapter; start — начало,
+//	секунды либо [hh:]mm:ss[.fff], не дальше конца трека; end — необязательный,
+//	конец отрезка, после start; title — название маркера или главы (обязательно
+//	для них); text — текст комментария (обязательно для него)
+//Результат: статус Created, json: id отметки
+//Ошибка: статус NotFound если трека нет или он недоступен
+func (an *Annotations) Add(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		tr, id, dur  int
+		start        int
+		end          = -1
+		kind         string
+		title, text  string
+		ok           bool
+		field, cause string
+	)
+
+	if an.userID, err = checkSession(an.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if kind = req.Form.Get("kind"); kind == "" {
+		fieldError(resp, "kind", "required")
+		return
+	}
+	if !annotationKinds[kind] {
+		fieldError(resp, "kind", "invalid")
+		return
+	}
+	if s := req.Form.Get("start"); s == "" {
+		fieldError(resp, "start", "required")
+		return
+	} else if start, err = parseTimestamp(s); err != nil {
+		fieldError(resp, "start", "invalid")
+		return
+	}
+	if s := req.Form.Get("end"); s != "" {
+		if end, err = parseTimestamp(s); err != nil {
+			fieldError(resp, "end", "invalid")
+			return
+		}
+	}
+	title, text = strings.TrimSpace(req.Form.Get("title")), strings.TrimSpace(req.Form.Get("text"))
+	if _, dur, ok = an.trackInfo(tr, resp); !ok {
+		return
+	}
+	if field, cause = annotationField(kind, title, text, start, end, dur); field != "" {
+		fieldError(resp, field, cause)
+		return
+	}
+
+	err = an.DB.QueryRow(`INSERT INTO annotations (id_audio, id_user, kind, start_ms, end_ms, title, text)
+		VALUES ($1, $2, $3, $4, nullif($5, -1), $6, $7)
+		RETURNING id_annotation`, tr, an.userID, kind, start, end, title, text).Scan(&id)
+	if err != nil {
+		dbError(resp, err, "Annotations.Add query failed:")
+		return
+	}
+
+	jsRes, _ := json.Marshal(struct {
+		AnnotationID int `json:"id"`
+	}{id})
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(jsRes)
+}
+
+//Update изменение своей отметки. Метод PATCH, доступен только автору, пока трек
+//	ему доступен. Вид отметки не меняется
+//Параметры: track — id трека, annotation — id отметки; start, end, title, text —
+//	необязательные, но хотя бы один должен быть. Пустой end — отметка без конца
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не автор, NotFound если отметки нет
+func (an *Annotations) Update(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		tr, id, dur  int
+		start, end   int
+		kind         string
+		title, text  string
+		changed      bool
+		field, cause string
+		tx           *sql.Tx
+	)
+
+	if an.userID, err = checkSession(an.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, id, err = an.annotationParams(req, resp); err != nil {
+		return
+	}
+
+	if tx, err = an.DB.Begin(); err != nil {
+		dbError(resp, err, "Annotations.Update begin failed:")
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`SELECT n.kind, n.start_ms, coalesce(n.end_ms, -1), n.title, n.text,
+			extract(epoch FROM a.duration)::int * 1000
+		FROM annotations n
+		INNER JOIN audio a ON (a.id_audio = n.id_audio)
+		WHERE n.id_annotation = $2 AND n.id_audio = $3 AND n.id_user = $1 AND `+sqlAvailable+`
+		FOR UPDATE OF n`, an.userID, id, tr).Scan(&kind, &start, &end, &title, &text, &dur)
+	if err == sql.ErrNoRows {
+		an.checkAuthor(tr, id, resp)
+		return
+	} else if err != nil {
+		dbError(resp, err, "Annotations.Update query failed:")
+		return
+	}
+
+	if frmVal, ok := req.Form["start"]; ok {
+		if start, err = parseTimestamp(frmVal[0]); err != nil {
+			fieldError(resp, "start", "invalid")
+			return
+		}
+		changed = true
+	}
+	if frmVal, ok := req.Form["end"]; ok {
+		if end = -1; strings.TrimSpace(frmVal[0]) != "" {
+			if end, err = parseTimestamp(frmVal[0]); err != nil {
+				fieldError(resp, "end", "invalid")
+				return
+			}
+		}
+		changed = true
+	}
+	if frmVal, ok := req.Form["title"]; ok {
+		title, changed = strings.TrimSpace(frmVal[0]), true
+	}
+	if frmVal, ok := req.Form["text"]; ok {
+		text, changed = strings.TrimSpace(frmVal[0]), true
+	}
+	if !changed {
+		apiError(resp, http.StatusBadRequest, "nothing to update")
+		return
+	}
+	if field, cause = annotationField(kind, title, text, start, end, dur); field != "" {
+		fieldError(resp, field, cause)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE annotations SET start_ms = $2, end_ms = nullif($3, -1), title = $4, text = $5,
+			updated = now()
+		WHERE id_annotation = $1`, id, start, end, title, text)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(resp, err, "Annotations.Update query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Delete удаление своей отметки. Метод DELETE, доступен только автору, в том
+//	числе после закрытия ему доступа к треку
+//Параметры: track — id трека, annotation — id отметки
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не автор, NotFound если отметки нет
+func (an *Annotations) Delete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		tr, id int
+		qr     sql.Result
+	)
+
+	if an.userID, err = checkSession(an.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, id, err = an.annotationParams(req, resp); err != nil {
+		return
+	}
+
+	qr, err = an.DB.Exec(`DELETE FROM annotations
+		WHERE id_annotation = $2 AND id_audio = $3 AND id_user = $1`, an.userID, id, tr)
+	if err != nil {
+		dbError(resp, err, "Annotations.Delete query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		an.checkAuthor(tr, id, resp)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Chapters главы трека для плеера или встраивания в файл. Метод GET, доступен
+//	тем, кому трек доступен. Глава без конца длится до начала следующей, последняя —
+//	до конца трека
+//Параметры: track — id трека; type — json (Podcasting 2.0 chapters, по
+//	умолчанию), vtt (WebVTT) или id3 (тег ID3v2.4 с фреймами CTOC/CHAP)
+//Результат: статус ОК, файл глав
+//Ошибка: статус NotFound если трека нет или он недоступен, либо глав нет
+func (an *Annotations) Chapters(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		tr, dur   int
+		typ, name string
+		ok        bool
+		qs        *sql.Rows
+		list      []*tChapter
+	)
+
+	if an.userID, err = checkSession(an.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if typ, ok = chapterType(req); !ok {
+		fieldError(resp, "type", "invalid")
+		return
+	}
+	if name, dur, ok = an.trackInfo(tr, resp); !ok {
+		return
+	}
+
+	qs, err = an.DB.Query(`SELECT start_ms, coalesce(end_ms, -1), title FROM annotations
+		WHERE id_audio = $1 AND kind = 'chapter'
+		ORDER BY start_ms, id_annotation`, tr)
+	if err != nil {
+		dbError(resp, err, "Annotations.Chapters query failed:")
+		return
+	}
+	defer qs.Close()
+	for qs.Next() {
+		ch := &tChapter{}
+		if err = qs.Scan(&ch.Start, &ch.End, &ch.Title); err != nil {
+			dbError(resp, err, "Annotations.Chapters scan error:")
+			return
+		}
+		list = append(list, ch)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Annotations.Chapters query iteration error:")
+		return
+	}
+	if len(list) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+	chapterEnds(list, dur)
+
+	buf := &bytes.Buffer{}
+	if err = writeChapters(buf, typ, name, list); err == errChapterCount {
+		paramError(resp, err)
+		return
+	} else if err != nil {
+		internalError(resp, err, "Annotations.Chapters export error:")
+		return
+	}
+	resp.Header().Set("Content-Type", chapterTypes[typ])
+	resp.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": name + ".chapters." + typ}))
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(buf.Bytes())
+}
+
+//annotationParams параметры track и annotation из пути, ошибка уже отправлена клиенту
+func (an *Annotations) annotationParams(req *http.Request, resp http.ResponseWriter) (tr, id int, err error) {
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("annotation")); err != nil {
+		fieldError(resp, "annotation", "invalid")
+	}
+	return
+}
+
+//trackInfo название и длительность (мс) трека tr, если он доступен пользователю
+func (an *Annotations) trackInfo(tr int, resp http.ResponseWriter) (name string, dur int, ok bool) {
+	err := an.DB.QueryRow(`SELECT a.description, extract(epoch FROM a.duration)::int * 1000 FROM audio a
+		WHERE a.id_audio = $2 AND `+sqlAvailable, an.userID, tr).Scan(&name, &dur)
+	if err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "track not found")
+		return "", 0, false
+	} else if err != nil {
+		dbError(resp, err, "Annotations.trackInfo query failed:")
+		return "", 0, false
+	}
+	return name, dur, true
+}
+
+//checkAuthor ошибка для отметки id трека tr, которую пользователь не смог изменить:
+//	Forbidden если отметка чужая на доступном треке, иначе NotFound
+func (an *Annotations) checkAuthor(tr, id int, resp http.ResponseWriter) {
+	var exists bool
+
+	err := an.DB.QueryRow(`SELECT exists(SELECT n.id_annotation FROM annotations n
+		INNER JOIN audio a ON (a.id_audio = n.id_audio)
+		WHERE n.id_annotation = $2 AND n.id_audio = $3 AND `+sqlAvailable+`)`, an.userID, id, tr).Scan(&exists)
+	if err != nil {
+		dbError(resp, err, "Annotations.checkAuthor query failed:")
+		return
+	}
+	if exists {
+		apiError(resp, http.StatusForbidden, "access denied")
+		return
+	}
+	apiError(resp, http.StatusNotFound, "annotation not found")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		s  string
+		ms int
+		ok bool
+	}{
+		{"0", 0, true},
+		{"12.5", 12500, true},
+		{"90", 90000, true},
+		{"01:30", 90000, true},
+		{"1:02:03.004", 3723004, true},
+		{" 2:00 ", 120000, true},
+		{"1:60", 0, false},
+		{"1:2:3:4", 0, false},
+		{"-1", 0, false},
+		{"1e3", 0, false},
+		{"1.", 0, false},
+		{"", 0, false},
+		{"9999999", 0, false},
+	}
+	for _, tst := range tests {
+		ms, err := parseTimestamp(tst.s)
+		if (err == nil) != tst.ok || ms != tst.ms {
+			t.Errorf("parseTimestamp: %q wrong result %d %v", tst.s, ms, err)
+		}
+	}
+}
+
+func TestChapterFormats(t *testing.T) {
+	list := []*tChapter{{Start: 0, End: -1, Title: "Intro"}, {Start: 61500, End: 90000, Title: "Q & <A>"}, {Start: 120000, End: -1, Title: "Outro"}}
+	chapterEnds(list, 240000)
+	if list[0].End != 61500 || list[1].End != 90000 || list[2].End != 240000 {
+		t.Fatalf("chapterEnds: wrong ends %d %d %d", list[0].End, list[1].End, list[2].End)
+	}
+
+	buf := &bytes.Buffer{}
+	writeChapters(buf, "json", "song", list)
+	var doc struct {
+		Version  string
+		Chapters []struct {
+			StartTime, EndTime float64
+			Title              string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil || doc.Version != "1.2.0" || len(doc.Chapters) != 3 ||
+		doc.Chapters[1].StartTime != 61.5 || doc.Chapters[2].EndTime != 240 || doc.Chapters[1].Title != "Q & <A>" {
+		t.Errorf("writeChapters: wrong json %s", buf.Bytes())
+	}
+
+	buf.Reset()
+	writeChapters(buf, "vtt", "song", list)
+	if !strings.HasPrefix(buf.String(), "WEBVTT\n\n1\n00:00:00.000 --> 00:01:01.500\nIntro\n") ||
+		!strings.Contains(buf.String(), "\n2\n00:01:01.500 --> 00:01:30.000\nQ &amp; &lt;A&gt;\n") {
+		t.Errorf("writeChapters: wrong vtt %s", buf.Bytes())
+	}
+
+	//	разбор тега: CTOC с тремя записями, затем CHAP с временем и названием
+	buf.Reset()
+	writeChapters(buf, "id3", "song", list)
+	tag := buf.Bytes()
+	if !bytes.HasPrefix(tag, []byte("ID3\x04\x00\x00")) || syncsafe(tag[6:10]) != len(tag)-10 {
+		t.Fatalf("writeChapters: wrong id3 header % x", tag[:10])
+	}
+	var frames []string
+	for pos := 10; pos+10 <= len(tag); {
+		id, size := string(tag[pos:pos+4]), syncsafe(tag[pos+4:pos+8])
+		data := tag[pos+10 : pos+10+size]
+		switch id {
+		case "CTOC":
+			if !bytes.HasPrefix(data, []byte("toc\x00\x03\x03chp0\x00chp1\x00chp2\x00TIT2")) {
+				t.Errorf("writeChapters: wrong CTOC % x", data)
+			}
+		case "CHAP":
+			start, end := binary.BigEndian.Uint32(data[5:]), binary.BigEndian.Uint32(data[9:])
+			if title := string(data[5+16+11:]); string(data[:3]) != "chp" || int(start) != list[len(frames)-1].Start ||
+				int(end) != list[len(frames)-1].End || title != list[len(frames)-1].Title {
+				t.Errorf("writeChapters: wrong CHAP %d %d [%s]", start, end, title)
+			}
+		}
+		frames = append(frames, id)
+		pos += 10 + size
+	}
+	if strings.Join(frames, ",") != "CTOC,CHAP,CHAP,CHAP" {
+		t.Errorf("writeChapters: wrong id3 frames %v", frames)
+	}
+
+	if err := writeChapters(buf, "id3", "", make([]*tChapter, id3MaxChapters+1)); err != errChapterCount {
+		t.Errorf("writeChapters: too many chapters wrong result %v", err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	defer testDB.Exec(`DELETE FROM annotations`)
+
+	//	трек 1 админа (4 минуты) расшарен пользователю user
+	var ids []int
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodGet, "/tracks/1/annotations", "", cookUser, http.StatusNotFound, "no records found"},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "chapter", "start": "0", "title": "Intro"}`, cookAdmin, http.StatusCreated, ""},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "chapter", "start": "2:00", "title": "Solo"}`, cookAdmin, http.StatusCreated, ""},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "comment", "start": "1:05.5", "end": "70", "text": "too loud"}`, cookUser, http.StatusCreated, ""},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "comment", "start": "10"}`, cookUser, http.StatusBadRequest, "text required"},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "marker", "start": "10", "text": "x"}`, cookUser, http.StatusBadRequest, "title required"},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "note", "start": "10"}`, cookUser, http.StatusBadRequest, "invalid kind value"},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "marker", "start": "5:00", "title": "x"}`, cookUser, http.StatusBadRequest, "invalid start value"},
+		{http.MethodPost, "/tracks/1/annotations", `{"kind": "marker", "start": "10", "end": "5", "title": "x"}`, cookUser, http.StatusBadRequest, "invalid end value"},
+		{http.MethodPost, "/tracks/4/annotations", `{"kind": "marker", "start": "10", "title": "x"}`, cookAdmin, http.StatusNotFound, "track not found"},
+		{http.MethodGet, "/tracks/4/annotations", "", cookAdmin, http.StatusNotFound, "track not found"},
+	}
+	for idx, tst := range tests {
+		status, body := testDo(t, tst.method, tst.path, tst.body, tst.cook)
+		if status != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Annotations: test [%d] wrong result %d [%s], expected %d [%s]", idx, status, body, tst.status, tst.err)
+		}
+		if status == http.StatusCreated {
+			var res struct{ ID int }
+			json.Unmarshal(body, &res)
+			ids = append(ids, res.ID)
+		}
+	}
+	if len(ids) != 3 {
+		t.Fatalf("Annotations: created %d, expected 3", len(ids))
+	}
+
+	status, body := testDo(t, http.MethodGet, "/tracks/1/annotations", "", cookUser)
+	var anLst tAnnotationList
+	json.Unmarshal(body, &anLst)
+	if status != http.StatusOK || anLst.Count != 3 || anLst.List[0].AnnotationID != ids[0] || anLst.List[1].AnnotationID != ids[2] ||
+		anLst.List[1].Start != 65.5 || anLst.List[1].End == nil || *anLst.List[1].End != 70 ||
+		!anLst.List[1].IsAuthor || anLst.List[0].IsAuthor || anLst.List[0].AuthorID != 1 {
+		t.Errorf("Annotations: wrong list %d [%s]", status, body)
+	}
+	if status, body = testDo(t, http.MethodGet, "/tracks/1/annotations?kind=comment", "", cookAdmin); !strings.Contains(string(body), `"total_count":1`) {
+		t.Errorf("Annotations: wrong comments list %d [%s]", status, body)
+	}
+
+	comment, chapter := "/tracks/1/annotations/"+strconv.Itoa(ids[2]), "/tracks/1/annotations/"+strconv.Itoa(ids[1])
+	tests = []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodPatch, comment, `{"text": "fixed"}`, cookAdmin, http.StatusForbidden, "access denied"},
+		{http.MethodPatch, comment, `{}`, cookUser, http.StatusBadRequest, "nothing to update"},
+		{http.MethodPatch, comment, `{"text": ""}`, cookUser, http.StatusBadRequest, "text required"},
+		{http.MethodPatch, comment, `{"start": "80"}`, cookUser, http.StatusBadRequest, "invalid end value"},
+		{http.MethodPatch, comment, `{"start": "80", "end": ""}`, cookUser, http.StatusOK, ""},
+		{http.MethodPatch, "/tracks/2/annotations/" + strconv.Itoa(ids[2]), `{"text": "x"}`, cookUser, http.StatusNotFound, "annotation not found"},
+		{http.MethodPatch, chapter, `{"title": "Guitar solo"}`, cookAdmin, http.StatusOK, ""},
+		{http.MethodDelete, chapter, "", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodDelete, comment, "", cookUser, http.StatusOK, ""},
+		{http.MethodDelete, comment, "", cookUser, http.StatusNotFound, "annotation not found"},
+		{http.MethodGet, "/tracks/1/chapters?type=txt", "", cookUser, http.StatusBadRequest, "invalid type value"},
+		{http.MethodGet, "/tracks/2/chapters", "", cookUser, http.StatusNotFound, "no records found"},
+	}
+	for idx, tst := range tests {
+		status, body := testDo(t, tst.method, tst.path, tst.body, tst.cook)
+		if status != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Annotations: test [%d] wrong result %d [%s], expected %d [%s]", idx, status, body, tst.status, tst.err)
+		}
+	}
+
+	status, body = testDo(t, http.MethodGet, "/tracks/1/chapters?type=vtt", "", cookUser)
+	if status != http.StatusOK || string(body) != "WEBVTT\n\n1\n00:00:00.000 --> 00:02:00.000\nIntro\n"+
+		"\n2\n00:02:00.000 --> 00:04:00.000\nGuitar solo\n" {
+		t.Errorf("Annotations: wrong chapters %d [%s]", status, body)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+//artworkDir каталог обложек в mediaDir: встроенные в файл трека — <файл>.cover
+//	(производные, удаляются с файлом), загруженные — upload-*.cover (имя в
+//	audio.artwork). Уменьшенные копии — <обложка>.<размер>.jpg
+const artworkDir = "artwork"
+
+//artworkSizes размеры уменьшенных копий обложек (по большей стороне), пикселей
+var artworkSizes = []int{64, 128, 256, 512}
+
+//errArtworkPixels картинка больше artworkMaxPixels
+var errArtworkPixels = errors.New("artwork image too large")
+
+//checkArtwork проверка картинки обложки по заголовку, без декодирования: формат
+//	(JPEG, PNG, GIF) и число пикселей. Сжатая картинка небольшого размера может
+//	занимать в памяти гигабайты после декодирования
+//Ошибка: errArtworkPixels — больше artworkMaxPixels
+func checkArtwork(r io.Reader) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > int64(artworkMaxPixels) {
+		return errArtworkPixels
+	}
+	return nil
+}
+
+//embeddedArtworkPath путь к обложке, извлеченной из файла трека fileName
+func embeddedArtworkPath(fileName string) string {
+	return path.Join(mediaDir, artworkDir, fileName+".cover")
+}
+
+//thumbPath путь к уменьшенной копии обложки src
+func thumbPath(src string, size int) string {
+	return src + "." + strconv.Itoa(size) + ".jpg"
+}
+
+//extractArtwork сохранение обложки из метаданных файла трека. Картинки в форматах,
+//	которые не декодируются (не JPEG/PNG/GIF), и слишком большие пропускаются
+func extractArtwork(fileName string) error {
+	meta, err := readMediaMeta(path.Join(mediaDir, fileName))
+	if err == errNoMeta || (err == nil && meta.Picture == nil) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if checkArtwork(bytes.NewReader(meta.Picture.Data)) != nil {
+		return nil
+	}
+	return saveDerived(embeddedArtworkPath(fileName), func(w io.Writer) error {
+		_, err := w.Write(meta.Picture.Data)
+		return err
+	})
+}
+
+//scaleImage уменьшение картинки так, чтобы большая сторона была не больше size
+//	(усреднение по площади), прозрачность — на белом фоне
+func scaleImage(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := sw, sh
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, (sh*size+sw/2)/sw
+		} else {
+			w, h = (sw*size+sh/2)/sh, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i, v := range row {
+					sum[i&3] += int(v)
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			//	цвета premultiplied: на белом фоне — c + (255 - a)
+			a := sum[3] / n
+			p := dst.Pix[y*dst.Stride+x*4:]
+			for i := 0; i < 3; i++ {
+				p[i] = uint8(sum[i]/n + 255 - a)
+			}
+			p[3] = 0xFF
+		}
+	}
+	return dst
+}
+
+//makeThumb уменьшенная копия обложки src размера size в JPEG
+func makeThumb(src string, size int) error {
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err = checkArtwork(fd); err != nil {
+		return err
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(fd)
+	if err != nil {
+		return err
+	}
+	return saveDerived(thumbPath(src, size), func(w io.Writer) error {
+		return jpeg.Encode(w, scaleImage(img, size), &jpeg.Options{Quality: 85})
+	})
+}
+
+//artworkThumbs все уменьшенные копии обложки src. Ошибки только в лог — копия,
+//	которой нет, будет сделана при запросе
+func artworkThumbs(src string) {
+	for _, size := range artworkSizes {
+		if err := makeThumb(src, size); err != nil {
+			log.Println("Artwork.thumbs failed:", src, size, err.Error())
+			return
+		}
+	}
+}
+
+//removeArtwork удаление загруженной обложки name вместе с уменьшенными копиями
+func removeArtwork(name string) {
+	if name == "" {
+		return
+	}
+	files, _ := filepath.Glob(path.Join(mediaDir, artworkDir, name+"*"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+//artworkPlaceholder картинка вместо обложки, если ее нет: квадрат с нотой
+func artworkPlaceholder(size int) []byte {
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="%[1]d" viewBox="0 0 100 100">`+
+		`<rect width="100" height="100" fill="#d8dce3"/>`+
+		`<path d="M42 28v34.5a8 8 0 1 0 4 6.9V40l22-5v21.5a8 8 0 1 0 4 6.9V22z" fill="#8a93a3"/></svg>`, size))
+}
+
+//Artwork обложка трека. Метод GET, доступ — как у Get. Загруженная владельцем
+//	обложка важнее встроенной в файл, нет ни той, ни другой — заглушка (svg)
+//Параметры: track — id трека; size — уменьшенная копия (artworkSizes), без него —
+//	оригинал; token — необязательный
+//Результат: статус ОК, картинка с ETag (If-None-Match — статус NotModified)
+//Ошибка: статус BadRequest при неверном size
+func (afl *Audiofill) Artwork(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		ok       bool
+		tr, size int
+		fileName string
+		uploaded string
+		st       os.FileInfo
+		fd       *os.File
+	)
+
+	if _, tr, _, fileName, ok = afl.mediaAccess(resp, req); !ok {
+		return
+	}
+	if s := req.Form.Get("size"); s != "" {
+		size, _ = strconv.Atoi(s)
+		ok = false
+		for _, v := range artworkSizes {
+			ok = ok || v == size
+		}
+		if !ok {
+			fieldError(resp, "size", "invalid")
+			return
+		}
+	}
+	if err = afl.DB.QueryRow(`SELECT artwork FROM audio WHERE id_audio = $1`, tr).Scan(&uploaded); err != nil {
+		dbError(resp, err, "Audio.Artwork query failed:")
+		return
+	}
+
+	src := embeddedArtworkPath(fileName)
+	if uploaded != "" {
+		src = path.Join(mediaDir, artworkDir, uploaded)
+	}
+	if _, err = os.Stat(src); err != nil {
+		ph := size
+		if ph == 0 {
+			ph = artworkSizes[len(artworkSizes)-1]
+		}
+		resp.Header().Set("ETag", `"placeholder-`+strconv.Itoa(ph)+`"`)
+		resp.Header().Set("Cache-Control", "private, no-cache")
+		resp.Header().Set("Content-Type", "image/svg+xml")
+		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(artworkPlaceholder(ph)))
+		return
+	}
+
+	dst := src
+	if size > 0 {
+		dst = thumbPath(src, size)
+		if _, err = os.Stat(dst); os.IsNotExist(err) {
+			job := startJob(dst, func() error { return makeThumb(src, size) })
+			select {
+			case <-job.done:
+				err = job.err
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if err != nil {
+			internalError(resp, err, "Audio.Artwork thumbnail failed:")
+			return
+		}
+	}
+	if fd, err = os.Open(dst); err != nil {
+		internalError(resp, err, "Audio.Artwork open failed:")
+		return
+	}
+	defer fd.Close()
+	if st, err = fd.Stat(); err != nil {
+		internalError(resp, err, "Audio.Artwork stat failed:")
+		return
+	}
+
+	sum := sha1.Sum([]byte(path.Base(dst)))
+	resp.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	resp.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(resp, req, "", st.ModTime(), fd)
+}
+
+//SetArtwork загрузка обложки трека вместо встроенной в файл. Метод PUT, доступен
+//	только владельцу
+//Параметры: track — id трека, file — картинка JPEG, PNG или GIF до artworkMaxSize
+//	байт и artworkMaxPixels пикселей
+//Результат: статус ОК
+//Ошибка: статус BadRequest если файл не картинка или картинка слишком большая
+//	статус Forbidden если пользователь не владелец, NotFound если записи нет
+func (afl *Audiofill) SetArtwork(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		tr       int
+		data     []byte
+		tmpFile  *os.File
+		oldCover string
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseMultipartForm(2 << 10); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	fd, fh, err := req.FormFile("file")
+	if err != nil {
+		apiError(resp, http.StatusBadRequest, "file upload error")
+		return
+	}
+	defer fd.Close()
+	if fh.Size > int64(artworkMaxSize) {
+		fieldError(resp, "file", "invalid")
+		return
+	}
+	if data, err = ioutil.ReadAll(fd); err != nil {
+		apiError(resp, http.StatusBadRequest, "file upload error")
+		return
+	}
+	if err = checkArtwork(bytes.NewReader(data)); err != nil {
+		fieldError(resp, "file", "invalid")
+		return
+	}
+
+	if err = os.MkdirAll(path.Join(mediaDir, artworkDir), 0755); err == nil {
+		tmpFile, err = ioutil.TempFile(path.Join(mediaDir, artworkDir), "upload-*.cover")
+	}
+	if err != nil {
+		internalError(resp, err, "Audio.SetArtwork temp file creating error:")
+		return
+	}
+	_, err = tmpFile.Write(data)
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		internalError(resp, err, "Audio.SetArtwork temp file writing error:")
+		return
+	}
+
+	err = afl.DB.QueryRow(`UPDATE audio a SET artwork = $2
+		FROM (SELECT id_audio, artwork FROM audio WHERE id_audio = $1) old
+		WHERE a.id_audio = old.id_audio
+		RETURNING old.artwork`, tr, path.Base(tmpFile.Name())).Scan(&oldCover)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		dbError(resp, err, "Audio.SetArtwork query failed:")
+		return
+	}
+	removeArtwork(oldCover)
+	artworkThumbs(tmpFile.Name())
+
+	publishTrackEvent(afl.DB, eventTrackUpdated, tr, afl.userID, 0)
+	resp.WriteHeader(http.StatusOK)
+}
+
+//DeleteArtwork удаление загруженной обложки: снова видна встроенная в файл (если
+//	есть). Метод DELETE, доступен только владельцу
+//Параметры: track — id трека
+//Результат: статус ОК
+//Ошибка: статус NotFound если загруженной обложки нет
+func (afl *Audiofill) DeleteArtwork(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		tr       int
+		oldCover string
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	err = afl.DB.QueryRow(`UPDATE audio a SET artwork = ''
+		FROM (SELECT id_audio, artwork FROM audio WHERE id_audio = $1) old
+		WHERE a.id_audio = old.id_audio
+		RETURNING old.artwork`, tr).Scan(&oldCover)
+	if err != nil {
+		dbError(resp, err, "Audio.DeleteArtwork query failed:")
+		return
+	}
+	if oldCover == "" {
+		apiError(resp, http.StatusNotFound, "artwork not found")
+		return
+	}
+	removeArtwork(oldCover)
+
+	publishTrackEvent(afl.DB, eventTrackUpdated, tr, afl.userID, 0)
+	resp.WriteHeader(http.StatusOK)
+}
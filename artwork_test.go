@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+//testPNG картинка PNG w×h, заливка c
+func testPNG(w, h int, c color.NRGBA) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	buf := &bytes.Buffer{}
+	png.Encode(buf, img)
+	return buf.Bytes()
+}
+
+//testFLACPicture блок PICTURE FLAC (без заголовка блока)
+func testFLACPicture(typ int, mime string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(typ))
+	binary.Write(buf, binary.BigEndian, uint32(len(mime)))
+	buf.WriteString(mime)
+	binary.Write(buf, binary.BigEndian, uint32(5))
+	buf.WriteString("cover")
+	binary.Write(buf, binary.BigEndian, make([]uint32, 4))
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+//testFLAC файл FLAC из блоков метаданных: тип и содержимое
+func testFLAC(blocks map[byte][]byte, order ...byte) []byte {
+	data := []byte("fLaC")
+	for i, typ := range order {
+		b := blocks[typ]
+		if i == len(order)-1 {
+			typ |= 0x80
+		}
+		data = append(data, typ, byte(len(b)>>16), byte(len(b)>>8), byte(len(b)))
+		data = append(data, b...)
+	}
+	return data
+}
+
+func TestMediaPicture(t *testing.T) {
+	dir := t.TempDir()
+	read := func(data []byte) *tPicture {
+		name := path.Join(dir, "pic")
+		ioutil.WriteFile(name, data, 0644)
+		meta, err := readMediaMeta(name)
+		if err != nil {
+			t.Errorf("readMediaMeta: failed %s", err.Error())
+			return nil
+		}
+		return meta.Picture
+	}
+
+	//	2.3: "jpg" вместо MIME, картинка не обложка; 2.4: обложка с описанием в UTF-16
+	apic3 := append([]byte{0}, "jpg\x00\x08descr\x00art"...)
+	if pic := read(testID3v2(3, testID3Frame(3, "APIC", apic3))); pic == nil ||
+		pic.MIME != "image/jpeg" || pic.Type != 8 || string(pic.Data) != "art" {
+		t.Errorf("readMediaMeta: id3 2.3 wrong picture %+v", pic)
+	}
+	apic4 := append([]byte{1}, "image/png\x00\x03\xFF\xFEd\x00\x00\x00cover"...)
+	if pic := read(testID3v2(4, testID3Frame(4, "APIC", apic3), testID3Frame(4, "APIC", apic4))); pic == nil ||
+		pic.MIME != "image/png" || pic.Type != 3 || string(pic.Data) != "cover" {
+		t.Errorf("readMediaMeta: id3 2.4 wrong picture %+v", pic)
+	}
+	link := append([]byte{0}, "-->\x00\x03\x00http://example.com/cover.jpg"...)
+	if pic := read(testID3v2(4, testID3Frame(4, "TIT2", []byte{3, 'x'}), testID3Frame(4, "APIC", link))); pic != nil {
+		t.Errorf("readMediaMeta: id3 link wrong picture %+v", pic)
+	}
+
+	flac := testFLAC(map[byte][]byte{0: make([]byte, 34), 6: testFLACPicture(3, "image/png", []byte("flac art"))}, 0, 6)
+	if pic := read(flac); pic == nil || pic.MIME != "image/png" || string(pic.Data) != "flac art" {
+		t.Errorf("readMediaMeta: flac wrong picture %+v", pic)
+	}
+
+	block := base64.StdEncoding.EncodeToString(testFLACPicture(3, "image/jpeg", []byte("opus art")))
+	ogg := append(testOggPage(append([]byte("OpusHead"), make([]byte, 11)...)),
+		testOggPage(append([]byte("OpusTags"), testVorbisComment("TITLE=x", "METADATA_BLOCK_PICTURE="+block)...))...)
+	if pic := read(ogg); pic == nil || pic.MIME != "image/jpeg" || string(pic.Data) != "opus art" {
+		t.Errorf("readMediaMeta: opus wrong picture %+v", pic)
+	}
+}
+
+func TestArtworkFile(t *testing.T) {
+	if _, err := os.Stat(mediaDir); os.IsNotExist(err) {
+		os.Mkdir(mediaDir, 0755)
+		defer os.RemoveAll(mediaDir)
+	}
+	cover := testPNG(300, 200, color.NRGBA{0xFF, 0, 0, 0xFF})
+	flac := testFLAC(map[byte][]byte{0: make([]byte, 34), 6: testFLACPicture(3, "image/png", cover)}, 0, 6)
+	ioutil.WriteFile(path.Join(mediaDir, "artwork-flac"), flac, 0644)
+	defer removeMedia("artwork-flac")
+
+	if err := extractArtwork("artwork-flac"); err != nil {
+		t.Fatalf("extractArtwork: failed %s", err.Error())
+	}
+	src := embeddedArtworkPath("artwork-flac")
+	if data, _ := ioutil.ReadFile(src); !bytes.Equal(data, cover) {
+		t.Fatalf("extractArtwork: wrong artwork file")
+	}
+	artworkThumbs(src)
+	for _, tst := range []struct{ size, w, h int }{{64, 64, 43}, {512, 300, 200}} {
+		fd, err := os.Open(thumbPath(src, tst.size))
+		if err != nil {
+			t.Errorf("artworkThumbs: no thumbnail %d", tst.size)
+			continue
+		}
+		img, err := jpeg.Decode(fd)
+		fd.Close()
+		if err != nil || img.Bounds().Dx() != tst.w || img.Bounds().Dy() != tst.h {
+			t.Errorf("artworkThumbs: thumbnail %d wrong image %v", tst.size, err)
+		}
+	}
+
+	//	половина прозрачная — на белом фоне розовый
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{0xFF, 0, 0, 0x80})
+	}
+	if c := scaleImage(img, 2).RGBAAt(1, 1); c.R != 0xFF || c.G < 0x7E || c.G > 0x80 || c.A != 0xFF {
+		t.Errorf("scaleImage: wrong pixel %v", c)
+	}
+
+	//	не картинка — не сохраняется
+	bad := testFLAC(map[byte][]byte{0: make([]byte, 34), 6: testFLACPicture(3, "image/webp", []byte("RIFF"))}, 0, 6)
+	ioutil.WriteFile(path.Join(mediaDir, "artwork-bad"), bad, 0644)
+	defer removeMedia("artwork-bad")
+	if err := extractArtwork("artwork-bad"); err != nil {
+		t.Errorf("extractArtwork: bad picture failed %s", err.Error())
+	}
+	if _, err := os.Stat(embeddedArtworkPath("artwork-bad")); !os.IsNotExist(err) {
+		t.Errorf("extractArtwork: bad picture saved")
+	}
+
+	//	заголовок PNG 100000×100000 — отказ до декодирования
+	huge := testPNG(1, 1, color.NRGBA{A: 0xFF})
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if err := checkArtwork(bytes.NewReader(huge)); err != errArtworkPixels {
+		t.Errorf("checkArtwork: huge picture wrong result %v", err)
+	}
+	if err := checkArtwork(bytes.NewReader(cover)); err != nil {
+		t.Errorf("checkArtwork: failed %s", err.Error())
+	}
+	big := testFLAC(map[byte][]byte{0: make([]byte, 34), 6: testFLACPicture(3, "image/png", huge)}, 0, 6)
+	ioutil.WriteFile(path.Join(mediaDir, "artwork-bad"), big, 0644)
+	if err := extractArtwork("artwork-bad"); err != nil {
+		t.Errorf("extractArtwork: huge picture failed %s", err.Error())
+	}
+	if _, err := os.Stat(embeddedArtworkPath("artwork-bad")); !os.IsNotExist(err) {
+		t.Errorf("extractArtwork: huge picture saved")
+	}
+
+	removeMedia("artwork-flac")
+	if files, _ := ioutil.ReadDir(path.Join(mediaDir, artworkDir)); len(files) != 0 {
+		t.Errorf("removeMedia: artwork files left %d", len(files))
+	}
+}
+
+func TestArtwork(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	if _, err := os.Stat(mediaDir); os.IsNotExist(err) {
+		os.Mkdir(mediaDir, 0755)
+		defer os.RemoveAll(mediaDir)
+	}
+
+	upload := func(data []byte) (*bytes.Buffer, string) {
+		buf := &bytes.Buffer{}
+		frm := multipart.NewWriter(buf)
+		f, _ := frm.CreateFormFile("file", "cover.png")
+		f.Write(data)
+		frm.Close()
+		return buf, frm.FormDataContentType()
+	}
+	tests := []struct {
+		method string
+		path   string
+		cook   *http.Cookie
+		body   []byte
+		status int
+		res    string //	Content-Type ответа либо сообщение об ошибке
+	}{
+		{http.MethodGet, "/tracks/1/artwork", cookUser, nil, http.StatusOK, "image/svg+xml"},
+		{http.MethodGet, "/tracks/1/artwork?size=100", cookUser, nil, http.StatusBadRequest, "invalid size value"},
+		{http.MethodGet, "/tracks/4/artwork", cookAdmin, nil, http.StatusNotFound, "track not found"},
+		{http.MethodPut, "/tracks/1/artwork", cookUser, testPNG(8, 8, color.NRGBA{A: 0xFF}), http.StatusForbidden, "access denied"},
+		{http.MethodPut, "/tracks/1/artwork", cookAdmin, []byte("not an image"), http.StatusBadRequest, "invalid file value"},
+		{http.MethodPut, "/tracks/1/artwork", cookAdmin, testPNG(600, 600, color.NRGBA{A: 0xFF}), http.StatusOK, ""},
+		{http.MethodGet, "/tracks/1/artwork", cookUser, nil, http.StatusOK, "image/png"},
+		{http.MethodGet, "/tracks/1/artwork?size=256", cookUser, nil, http.StatusOK, "image/jpeg"},
+		{http.MethodDelete, "/tracks/1/artwork", cookAdmin, nil, http.StatusOK, ""},
+		{http.MethodDelete, "/tracks/1/artwork", cookAdmin, nil, http.StatusNotFound, "artwork not found"},
+		{http.MethodGet, "/tracks/1/artwork?size=64", cookUser, nil, http.StatusOK, "image/svg+xml"},
+	}
+	for idx, tst := range tests {
+		var req *http.Request
+		if tst.body != nil {
+			buf, typ := upload(tst.body)
+			req, _ = http.NewRequest(tst.method, testSrv.URL+tst.path, buf)
+			req.Header.Set("Content-Type", typ)
+		} else {
+			req, _ = http.NewRequest(tst.method, testSrv.URL+tst.path, nil)
+		}
+		req.AddCookie(tst.cook)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Artwork: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		res := resp.Header.Get("Content-Type")
+		if resp.StatusCode != http.StatusOK || tst.res == "" {
+			res = errMessage(body)
+		}
+		if resp.StatusCode != tst.status || res != tst.res {
+			t.Errorf("Artwork: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, res, tst.status, tst.res)
+		}
+	}
+}
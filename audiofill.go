@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -10,7 +11,9 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -19,10 +22,52 @@ import (
 
 const mediaDir = "media"
 
+//mediaDerived каталоги в mediaDir с файлами, производными от файла трека:
+//	имя производного — имя файла трека и расширение
+var mediaDerived = []string{renditionDir, peaksDir, imagesDir, artworkDir}
+
+//saveDerived запись производного файла dst через временный файл, чтобы
+//	незаконченная запись не попала на место готовой
+func saveDerived(dst string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(dst), "tmp-")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	if err = write(w); err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//removeMedia удаление файла трека вместе с производными
+func removeMedia(fileName string) {
+	os.Remove(path.Join(mediaDir, fileName))
+	for _, dir := range mediaDerived {
+		files, _ := filepath.Glob(path.Join(mediaDir, dir, fileName+".*"))
+		for _, name := range files {
+			os.Remove(name)
+		}
+	}
+}
+
 type tShare struct {
-	AudioID  int    `json:"audio,omitempty"`
-	UserID   int    `json:"id"`
-	UserName string `json:"name"`
+	AudioID  int        `json:"audio,omitempty"`
+	UserID   int        `json:"id"`
+	UserName string     `json:"name"`
+	Expires  *time.Time `json:"expires_at,omitempty"`
 }
 
 type tAudio struct {
@@ -33,13 +78,64 @@ type tAudio struct {
 	OwnerName string `json:"owner_name"`
 
 	Shared []*tShare `json:"shared_to"`
+	Tags   []*tTag   `json:"tags,omitempty"`
+	Folder int       `json:"folder,omitempty"` //	папка — только для владельца
+
+	//	отметки текущего пользователя (см. ratings.go)
+	Favorite bool       `json:"favorite,omitempty"`
+	Rating   int        `json:"rating,omitempty"`
+	Plays    int        `json:"plays,omitempty"`
+	PlayedAt *time.Time `json:"played_at,omitempty"`
+
+	Loudness *tLoudness `json:"loudness,omitempty"` //	после анализа загруженного файла
+	Lyrics   *tLyrics   `json:"lyrics,omitempty"`   //	только в Detail
+
+	cursor string //	json-массив значений ключей сортировки (для курсора списка)
+}
+
+//sortKeys значения ключей сортировки записи
+func (ad *tAudio) sortKeys() (keys []interface{}, err error) {
+	return cursorKeys(ad.cursor)
 }
 
 type tAudioList struct {
 	Count int       `json:"total_count"`
 	List  []*tAudio `json:"records"`
+	Next  string    `json:"next,omitempty"`
+	Prev  string    `json:"prev,omitempty"`
 }
 
+//sqlShareActive условие действующего "расшаривания" (алиас таблицы share — s):
+//	бессрочное, либо срок действия еще не истек
+const sqlShareActive = `(s.expires_at IS NULL OR s.expires_at > now())`
+
+//sqlAvailable условие доступности трека (алиас таблицы audio — a) пользователю $1:
+//	собственные и расшаренные другими, с действующим сроком доступа,
+//	и треки владельца плейлистов, открытых пользователю (см. Playlists.Share)
+const sqlAvailable = `(a.id_owner = $1 OR exists (
+		SELECT id_audio FROM share s
+		WHERE s.id_audio = a.id_audio AND s.id_user = $1 AND ` + sqlShareActive + `
+	) OR exists (
+		SELECT plt.id_audio FROM playlist_tracks plt
+		INNER JOIN playlists pl ON (pl.id_playlist = plt.id_playlist)
+		INNER JOIN playlist_share pls ON (pls.id_playlist = pl.id_playlist)
+		WHERE plt.id_audio = a.id_audio AND pl.id_owner = a.id_owner AND pls.id_user = $1
+	))`
+
+//sqlAudioTags теги трека (алиас audio — a) json-массивом в порядке названий. Теги
+//	видны всем, кому доступен трек, изменяет их только владелец (см. Tags)
+const sqlAudioTags = `SELECT json_agg(json_build_object('id', t.id_tag, 'name', t.name,
+				'is_owner', t.id_owner = $1, 'owner_id', t.id_owner) ORDER BY lower(t.name))::text
+			FROM audio_tags atg
+			INNER JOIN tags t ON (t.id_tag = atg.id_tag)
+			WHERE atg.id_audio = a.id_audio`
+
+//sqlAudioLoudness громкость трека (алиас audio — a) json-объектом tLoudness,
+//	NULL — файл еще не проанализирован
+const sqlAudioLoudness = `CASE WHEN a.loudness IS NOT NULL THEN json_build_object('integrated', a.loudness,
+			'true_peak', a.true_peak, 'range', a.loudness_range,
+			'replaygain_gain', a.replaygain_gain, 'replaygain_peak', a.replaygain_peak)::text END`
+
 //Audiofill класс для таблиц audio/share
 //	добавление/удаление аудиозаписей, просмотр списка записей, "расшаривание"
 //	получение (скачивание) файла аудиозаписи
@@ -56,162 +152,180 @@ func NewAudiofill(db *sql.DB) *Audiofill {
 }
 
 //List cписок доступных пользователю аудиозаписей. Метод GET, доступен только для авторизованных
-//Параметры: page_no номер страницы, on_page строк на странице, необязательные
-//	по умолчанию 1 и 10 соответственно.
-//	order_by поле сортировки, допустимые значения user|track, default — user
+//Параметры: cursor — курсор страницы из ссылок next/prev предыдущего ответа, либо
+//	page_no номер страницы; on_page строк на странице (не больше maxPageSize),
+//	необязательные, по умолчанию 1 и 10 соответственно.
+//	order_by поле сортировки, допустимые значения
+//	user|track|duration|duration_desc|uploaded|uploaded_desc, default — user;
+//	по отметкам пользователя: rating|plays (больше — выше), recently_played
+//	(недавно прослушанные первыми, не прослушанные — в конце)
+//	фильтры, все необязательные (см. listFilter):
+//	scope — own|shared_with_me|shared_by_me|all, default — all
+//	owner — id владельца; duration_from, duration_to — длительность в секундах
+//	либо [hh:]mm:ss; uploaded_from, uploaded_to — дата загрузки;
+//	format — формат файла (mp3, ogg…), можно несколько через запятую;
+//	favorite — флаг, только избранные; tag — id тега, можно несколько через запятую; folder — id собственной папки
+//	(вместе с вложенными), 0 — треки вне папок
 //Результат:
 //Ошибка:
 func (afl *Audiofill) List(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err      error
-		pg, ln   int
-		ord      string
+		pg       *tPage
+		ordName  string
+		ordKeys  []tSortKey
 		sqlQuery string
+		sqlWhere string
+		sqlParam []interface{}
+		first    []interface{}
+		last     []interface{}
 
-		qr      *sql.Row
-		qs      *sql.Rows
-		aLst    tAudioList
-		curAd   *tAudio
-		sqlID   sql.NullInt64
-		sqlName sql.NullString
-		jsRes   []byte
+		qr    *sql.Row
+		qs    *sql.Rows
+		aLst  tAudioList
+		jsRes []byte
 	)
 
-	orderBy := map[string]string{
-		"user":  "3 desc, 4, 2",
-		"track": "2",
+	//	ключи сортировки — колонки base, последний ключ (id_audio) делает порядок
+	//	однозначным, что нужно для курсора
+	orderBy := map[string][]tSortKey{
+		"user": {{"is_owner", true, "boolean"}, {"id_owner", false, "int"},
+			{"name", false, "text"}, {"id_audio", false, "int"}},
+		"track":           {{"name", false, "text"}, {"id_audio", false, "int"}},
+		"duration":        {{"duration", false, "interval"}, {"name", false, "text"}, {"id_audio", false, "int"}},
+		"duration_desc":   {{"duration", true, "interval"}, {"name", false, "text"}, {"id_audio", false, "int"}},
+		"uploaded":        {{"uploaded", false, "timestamptz"}, {"id_audio", false, "int"}},
+		"uploaded_desc":   {{"uploaded", true, "timestamptz"}, {"id_audio", true, "int"}},
+		"rating":          {{"rating", true, "int"}, {"name", false, "text"}, {"id_audio", false, "int"}},
+		"plays":           {{"plays", true, "int"}, {"name", false, "text"}, {"id_audio", false, "int"}},
+		"recently_played": {{"played", true, "timestamptz"}, {"id_audio", true, "int"}},
 	}
-	if req.Method != http.MethodGet {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
-
 	afl.userID, err = checkSession(afl.DB, req)
 	if err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+		apiError(resp, http.StatusUnauthorized, "access denied")
 		return
 	}
 
 	err = req.ParseForm()
 	if err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
-	pg, ln = getPageno(req)
 
+	ordName = "user"
 	if strVal, ok := req.Form["order_by"]; ok {
-		if ord, ok = orderBy[strVal[0]]; !ok {
-			http.Error(resp, "bad parameter order_by", http.StatusBadRequest)
-			return
-		}
-	} else {
-		ord = orderBy["user"]
+		ordName = strVal[0]
+	}
+	if ordKeys = orderBy[ordName]; ordKeys == nil {
+		fieldError(resp, "order_by", "invalid")
+		return
+	}
+	if pg, err = getPage(req, ordName, ordKeys); err != nil {
+		paramError(resp, err)
+		return
+	}
+
+	if sqlWhere, sqlParam, err = afl.listFilter(req); err != nil {
+		paramError(resp, err)
+		return
 	}
 
 	aLst = tAudioList{}
 	//	т.к.: cannot insert multiple commands into a prepared statement
-	//	получаем данные в два запроса:
+	//	получаем данные в два запроса с одинаковыми условиями отбора:
 	qr = afl.DB.QueryRow(`--общее количество доступных пользователю записей
-		SELECT count(distinct id_audio)
-		FROM audio
-		WHERE id_owner = $1	-- собственные
-			OR id_audio in ( -- расшаренные другими
-				SELECT id_audio FROM share WHERE id_user = $1
-			)
-		`, afl.userID)
+		SELECT count(*)
+		FROM audio a
+		WHERE `+sqlWhere, sqlParam...)
 	err = qr.Scan(&aLst.Count)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		//	если это ошибка постгреса, в логе можем сохранить более детальную информацию
-		if pgErr, ok := err.(*pq.Error); ok {
-			log.Println("Audio.List scan count failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			log.Println("Audio.List scan count failed:", err.Error())
-		}
+		dbError(resp, err, "Audio.List scan count failed:")
 		return
 	}
 
+	//	в available выбираем на одну запись больше страницы — есть ли следующая.
+	//	Условие курсора добавляет свои параметры — до подсчета их количества
+	sqlPage := pg.where(ordKeys, &sqlParam)
 	sqlQuery = fmt.Sprintf(`-- список записей с постраничной разбивкой
-		WITH available AS (
+		WITH base AS (
 			SELECT  a.id_audio, 
 				concat(a.description,' (',a.duration,')') as name, 
 				a.id_owner = $1 as is_owner,
 				a.id_owner,
-				coalesce(nullif(own.name,''), own.login) as owner_name
-				
+				coalesce(nullif(own.name,''), own.login) as owner_name,
+				a.duration,
+				a.created as uploaded,
+				(`+sqlAudioTags+`) as tags,
+				a.id_folder,
+				coalesce(ua.favorite, false) as favorite,
+				coalesce(ua.rating, 0) as rating,
+				coalesce(ua.plays, 0) as plays,
+				coalesce(ua.played_at, '-infinity') as played,
+				`+sqlAudioLoudness+` as loudness
+
 			FROM audio a
 			INNER JOIN users own on (a.id_owner = own.id_user)
+			LEFT JOIN user_audio ua on (ua.id_audio = a.id_audio AND ua.id_user = $1)
 
-			WHERE a.id_owner = $1	-- собственные
-				OR a.id_audio in ( -- расшаренные другими
-						SELECT id_audio FROM share WHERE id_user = $1
-				)
+			WHERE %s -- собственные и расшаренные другими + фильтры
+			), available AS (
+			SELECT * FROM base
+			WHERE %s -- после (до) курсора
 			ORDER BY %s
-			OFFSET $2 LIMIT $3
+			OFFSET $%d LIMIT $%d
 			)
-		SELECT av.*, usr.id_user,
-			coalesce(nullif(usr.name, ''), usr.login) as user_name
+		SELECT av.id_audio, av.name, av.is_owner, av.id_owner, av.owner_name,
+			usr.id_user,
+			coalesce(nullif(usr.name, ''), usr.login) as user_name,
+			s.expires_at,
+			av.tags,
+			CASE WHEN av.is_owner THEN av.id_folder END,
+			av.favorite, av.rating, av.plays, nullif(av.played, '-infinity'), av.loudness,
+			json_build_array(%s)::text
 		FROM available av
-		LEFT JOIN share sh ON (sh.id_audio = av.id_audio)
-		LEFT JOIN users usr ON (sh.id_user = usr.id_user)
+		LEFT JOIN share s ON (s.id_audio = av.id_audio AND %s)
+		LEFT JOIN users usr ON (s.id_user = usr.id_user)
 		ORDER BY %s, 6
-		`, ord, ord)
+		`, sqlWhere, sqlPage, pg.order(ordKeys), len(sqlParam)+1, len(sqlParam)+2,
+		sortKeyCols(ordKeys, "av."), sqlShareActive, sortOrder(ordKeys, false))
 
-	qs, err = afl.DB.Query(sqlQuery, afl.userID, pg*ln, ln)
+	qs, err = afl.DB.Query(sqlQuery, append(sqlParam, pg.Offset, pg.Limit+1)...)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		if pgErr, ok := err.(*pq.Error); ok {
-			log.Println("Audio.List query list failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			log.Println("Audio.List query list failed:", err.Error())
-		}
+		dbError(resp, err, "Audio.List query list failed:")
 		return
 	}
 	defer qs.Close()
 
+	if aLst.List, err = afl.scanAudioList(qs); err != nil {
+		dbError(resp, err, "Audio.List query scan error:")
+		return
+	}
 	//	sql.Rows в случае пустого списка не генерит ошибку ErrNoRows, проверяем сами
-	if !qs.Next() {
-		http.Error(resp, "", http.StatusNotFound)
+	if len(aLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
 		return
 	}
 
-	curAd = &tAudio{}
-	err = qs.Scan(&curAd.AudioID, &curAd.Descr, &curAd.IsOwn, &curAd.OwnerID, &curAd.OwnerName, &sqlID, &sqlName)
-	if err != nil {
-		http.Error(resp, "", http.StatusInternalServerError)
-		log.Println("Audio.List query scan error:", err.Error())
-		return
+	//	лишняя запись — самая дальняя от курсора: последняя, либо первая при чтении назад
+	more := len(aLst.List) > pg.Limit
+	if more && pg.isPrev() {
+		aLst.List = aLst.List[1:]
+	} else if more {
+		aLst.List = aLst.List[:pg.Limit]
 	}
-	if sqlID.Valid { //	null-значения не добавляем
-		afl.appendShare(curAd, sqlID, sqlName)
+	if first, err = aLst.List[0].sortKeys(); err == nil {
+		last, err = aLst.List[len(aLst.List)-1].sortKeys()
 	}
-
-	for qs.Next() {
-		ad := &tAudio{}
-		err = qs.Scan(&ad.AudioID, &ad.Descr, &ad.IsOwn, &ad.OwnerID, &ad.OwnerName, &sqlID, &sqlName)
-		if err != nil {
-			http.Error(resp, "", http.StatusInternalServerError)
-			log.Println("Audio.List query scan error:", err.Error())
-			return
-		}
-
-		if ad.AudioID == curAd.AudioID { //	добавляем список "расшаренных" в текущую запись
-			afl.appendShare(curAd, sqlID, sqlName)
-
-		} else { //	новая запись ­— сохраним "старую" и создадим новую
-			aLst.List = append(aLst.List, curAd)
-
-			afl.appendShare(ad, sqlID, sqlName)
-			curAd = &tAudio{}
-			afl.copyAudio(curAd, ad)
-		}
+	if err != nil {
+		internalError(resp, err, "Audio.List cursor keys error:")
+		return
 	}
-	aLst.List = append(aLst.List, curAd)
+	aLst.Next, aLst.Prev = pg.links(req, first, last, more)
+	setLinks(resp, aLst.Next, aLst.Prev)
 
 	jsRes, err = json.Marshal(aLst)
 	if err != nil {
-		http.Error(resp, "Audio.List result marshaling error", http.StatusInternalServerError)
-		log.Println("Audio.List result marshaling error", err.Error())
+		internalError(resp, err, "Audio.List result marshaling error:")
 		return
 	}
 	resp.WriteHeader(http.StatusOK)
@@ -221,6 +335,8 @@ func (afl *Audiofill) List(resp http.ResponseWriter, req *http.Request) {
 //Share “Расшарить” аудиозапись. Метод POST, доступен только авторизованным пользователям
 //Параметры: track — id аудиозаписи, к которой предоставляется доступ
 //	user — пользователь, которому предоставляется доступ
+//	expires_at — необязательный, срок действия доступа (RFC3339 либо 2006-01-02),
+//	по умолчанию бессрочно. Повторный запрос для той же пары track/user меняет срок
 //Результат: статус ОК
 //Ошибка:
 func (afl *Audiofill) Share(resp http.ResponseWriter, req *http.Request) {
@@ -230,62 +346,62 @@ func (afl *Audiofill) Share(resp http.ResponseWriter, req *http.Request) {
 
 		frmVal  []string
 		tr, usr int
+		expires pq.NullTime
 	)
-	if req.Method != http.MethodPost {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
 
 	if afl.userID, err = checkSession(afl.DB, req); err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+		apiError(resp, http.StatusUnauthorized, "access denied")
 		return
 	}
 
 	err = req.ParseForm()
 	if err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
 
 	if frmVal, ok = req.Form["track"]; !ok {
-		http.Error(resp, "track required", http.StatusBadRequest)
+		fieldError(resp, "track", "required")
 		return
 	}
 	if tr, err = strconv.Atoi(frmVal[0]); err != nil {
-		http.Error(resp, "invalid track value", http.StatusBadRequest)
+		fieldError(resp, "track", "invalid")
 		return
 	}
 
 	if frmVal, ok = req.Form["user"]; !ok {
-		http.Error(resp, "user required", http.StatusBadRequest)
+		fieldError(resp, "user", "required")
 		return
 	}
 	if usr, err = strconv.Atoi(frmVal[0]); err != nil {
-		http.Error(resp, "invalid user value", http.StatusBadRequest)
+		fieldError(resp, "user", "invalid")
 		return
 	}
 
+	if frmVal, ok = req.Form["expires_at"]; ok && frmVal[0] != "" {
+		if expires.Time, err = parseTime(frmVal[0]); err != nil || !expires.Time.After(time.Now()) {
+			fieldError(resp, "expires_at", "invalid")
+			return
+		}
+		expires.Valid = true
+	}
+
 	if !afl.checkAudioOwner(tr, resp) {
 		return
 	}
 
-	_, err = afl.DB.Exec(`INSERT INTO share (id_audio, id_user) VALUES ($1, $2)`, tr, usr)
+	_, err = afl.DB.Exec(`INSERT INTO share (id_audio, id_user, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id_audio, id_user) DO UPDATE SET expires_at = EXCLUDED.expires_at`, tr, usr, expires)
 	if err != nil {
-		if pgErr, ok := err.(*pq.Error); ok {
-			switch pgErr.Code {
-			case "23503": // foreign key constraint violation
-				http.Error(resp, "user not exists", http.StatusBadRequest)
-			default:
-				http.Error(resp, pgErr.Detail, http.StatusBadRequest)
-			}
-			log.Println("Audio.Share query failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			http.Error(resp, "internal error", http.StatusInternalServerError)
-			log.Println("Audio.Share query failed:", err.Error())
-		}
+		dbError(resp, err, "Audio.Share query failed:")
 		return
 	}
 
+	if err = addNotification(afl.DB, usr, notifyShare, tr, afl.userID); err != nil {
+		log.Println("Audio.Share notification failed:", err.Error())
+	}
+	publishTrackEvent(afl.DB, eventShareGranted, tr, afl.userID, usr)
+
 	resp.WriteHeader(http.StatusOK)
 	resp.Write([]byte(""))
 }
@@ -302,35 +418,31 @@ func (afl *Audiofill) Lock(resp http.ResponseWriter, req *http.Request) {
 		ok      bool
 		tr, usr int
 	)
-	if req.Method != http.MethodPost {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
 
 	if afl.userID, err = checkSession(afl.DB, req); err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+		apiError(resp, http.StatusUnauthorized, "access denied")
 		return
 	}
 
 	if err = req.ParseForm(); err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
 	if frmVal, ok = req.Form["track"]; !ok {
-		http.Error(resp, "track required", http.StatusBadRequest)
+		fieldError(resp, "track", "required")
 		return
 	}
 	if tr, err = strconv.Atoi(frmVal[0]); err != nil {
-		http.Error(resp, "invalid track value", http.StatusBadRequest)
+		fieldError(resp, "track", "invalid")
 		return
 	}
 
 	if frmVal, ok = req.Form["user"]; !ok {
-		http.Error(resp, "user required", http.StatusBadRequest)
+		fieldError(resp, "user", "required")
 		return
 	}
 	if usr, err = strconv.Atoi(frmVal[0]); err != nil {
-		http.Error(resp, "invalid user value", http.StatusBadRequest)
+		fieldError(resp, "user", "invalid")
 		return
 	}
 
@@ -340,89 +452,190 @@ func (afl *Audiofill) Lock(resp http.ResponseWriter, req *http.Request) {
 
 	qr, err := afl.DB.Exec(`DELETE FROM share WHERE id_audio = $1 AND id_user = $2`, tr, usr)
 	if err != nil {
-		if pgErr, ok := err.(*pq.Error); ok {
-			http.Error(resp, pgErr.Detail, http.StatusInternalServerError)
-			log.Println("Audio.Lock query failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			http.Error(resp, "internal error", http.StatusInternalServerError)
-			log.Println("Audio.Lock query failed:", err.Error())
-		}
+		dbError(resp, err, "Audio.Lock query failed:")
 		return
 	}
 	if res, _ := qr.RowsAffected(); res == 0 {
-		http.Error(resp, "no rows are deleted", http.StatusNotFound)
+		apiError(resp, http.StatusNotFound, "no rows are deleted")
 		return
 	}
+
+	if err = addNotification(afl.DB, usr, notifyLock, tr, afl.userID); err != nil {
+		log.Println("Audio.Lock notification failed:", err.Error())
+	}
+	publishTrackEvent(afl.DB, eventShareRevoked, tr, afl.userID, usr)
 	resp.WriteHeader(http.StatusOK)
 	resp.Write([]byte(""))
 }
 
 //Get получить файл с аудиозаписью. Метод GET, доступен только авторизованным пользователям
-//Параметры: track — id аудиозаписи
+//	либо по ссылке с токеном из выгруженного плейлиста (см. sendPlaylist). Выдача
+//	с начала файла (без Range, либо Range с 0) считается прослушиванием
+//Параметры: track — id аудиозаписи, token — необязательный, заменяет куку сессии;
+//	format — mp3|aac|ogg|opus, перекодированная копия (хранится в renditionDir),
+//	bitrate — ее битрейт, кбит/с, 32..320
 //Результат:
-//Ошибка:
+//Ошибка: статус ServiceUnavailable если перекодирование не дождалось очереди
 func (afl *Audiofill) Get(resp http.ResponseWriter, req *http.Request) {
 	var (
 		err    error
-		frmVal []string
 		ok     bool
 		tr     int
-		qr     *sql.Row
+		userID int
 		fd     *os.File
+		prof   *tRendition
 
 		fileDescr, fileName string
 	)
-	if req.Method != http.MethodGet {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
+
+	//	перекодирование долгое — userID держим локально, а не в общей структуре
+	if userID, tr, fileDescr, fileName, ok = afl.mediaAccess(resp, req); !ok {
 		return
 	}
-
-	if afl.userID, err = checkSession(afl.DB, req); err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+	if prof, err = transcodeProfile(req); err != nil {
+		paramError(resp, err)
+		return
+	}
+	filePath := path.Join(mediaDir, fileName)
+	if _, err = os.Stat(filePath); err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
 		return
 	}
+	if prof != nil {
+		if filePath, err = rendition(req.Context(), fileName, *prof); err == errTranscodeBusy {
+			apiError(resp, http.StatusServiceUnavailable, "transcoder busy")
+			return
+		} else if err != nil {
+			internalError(resp, err, "Audio.Get transcoding failed:")
+			return
+		}
+		resp.Header().Set("Content-Type", transcodeFormats[prof.Format].Type)
+	}
+	if fd, err = os.Open(filePath); err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
+		return
+	}
+
+	defer fd.Close()
+	if isPlayStart(req) {
+		countPlay(afl.DB, userID, tr)
+	}
+	http.ServeContent(resp, req, fileDescr, time.Now(), fd)
+}
+
+//mediaAccess проверка доступа к файлу трека: пользователь по куке сессии, либо
+//	по параметру token (ссылки из выгруженных плейлистов, сегменты HLS), трек
+//	должен быть ему доступен. Ошибка уже отправлена клиенту
+//Результат: id пользователя, id трека, название и имя файла в mediaDir
+func (afl *Audiofill) mediaAccess(resp http.ResponseWriter, req *http.Request) (userID, tr int, descr, fileName string, ok bool) {
+	var (
+		err    error
+		frmVal []string
+	)
+
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		if userID, err = checkSession(afl.DB, req); err != nil {
+			apiError(resp, http.StatusUnauthorized, "access denied")
+			return
+		}
+	}
 	if err = req.ParseForm(); err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
 	if frmVal, ok = req.Form["track"]; !ok {
-		http.Error(resp, "track required", http.StatusBadRequest)
+		fieldError(resp, "track", "required")
 		return
 	}
 	if tr, err = strconv.Atoi(frmVal[0]); err != nil {
-		http.Error(resp, "track invalid value", http.StatusBadRequest)
-		return
+		fieldError(resp, "track", "invalid")
+		return userID, tr, "", "", false
 	}
-
-	qr = afl.DB.QueryRow(`SELECT description, filename FROM audio a
-		WHERE id_audio = $2 AND (id_owner = $1
-			OR exists (SELECT id_audio FROM share s
-				WHERE s.id_audio = a.id_audio AND s.id_user = $1)
-			)
-		`, afl.userID, tr)
-	if err = qr.Scan(&fileDescr, &fileName); err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		if pgErr, ok := err.(*pq.Error); ok {
-			log.Println("Audio.Get query failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			log.Println("Audio.Get query failed:", err.Error())
+	if token != "" {
+		if userID, err = checkMediaToken(token, tr); err != nil {
+			apiError(resp, http.StatusUnauthorized, "access denied")
+			return userID, tr, "", "", false
 		}
-		return
 	}
 
-	if fd, err = os.Open(path.Join(mediaDir, fileName)); err != nil {
-		http.Error(resp, "file not found", http.StatusNotFound)
+	qr := afl.DB.QueryRow(`SELECT description, filename FROM audio a
+		WHERE id_audio = $2 AND `+sqlAvailable, userID, tr)
+	if err = qr.Scan(&descr, &fileName); err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "track not found")
+		return userID, tr, "", "", false
+	} else if err != nil {
+		dbError(resp, err, "Audio.Get query failed:")
+		return userID, tr, "", "", false
+	}
+	return userID, tr, descr, fileName, true
+}
+
+//Export выгрузка библиотеки — всех доступных пользователю треков в порядке загрузки —
+//	плейлистом для внешних плееров (VLC, foobar2000). Метод GET, доступен только
+//	авторизованным
+//Параметры: type — m3u8|pls|xspf, default — m3u8; auth — token|session, default —
+//	token: ссылки на файлы с токеном, плееру не нужна кука сессии.
+//	Фильтры — как в List (scope, owner, duration_from…)
+//Результат: статус ОК, файл плейлиста
+//Ошибка: статус NotFound если треков нет
+func (afl *Audiofill) Export(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		ok       bool
+		typ      string
+		sqlWhere string
+		sqlParam []interface{}
+		qs       *sql.Rows
+		list     []*tExportEntry
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if typ, ok = playlistType(req); !ok {
+		fieldError(resp, "type", "invalid")
+		return
+	}
+	if sqlWhere, sqlParam, err = afl.listFilter(req); err != nil {
+		paramError(resp, err)
 		return
 	}
 
-	defer fd.Close()
-	http.ServeContent(resp, req, fileDescr, time.Now(), fd)
+	qs, err = afl.DB.Query(`SELECT `+sqlExportSelect+`
+		FROM audio a
+		WHERE `+sqlWhere+`
+		ORDER BY a.created, a.id_audio`, sqlParam...)
+	if err != nil {
+		dbError(resp, err, "Audio.Export query failed:")
+		return
+	}
+	defer qs.Close()
+	if list, err = scanExportEntries(qs); err != nil {
+		dbError(resp, err, "Audio.Export scan error:")
+		return
+	}
+	if len(list) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+	sendPlaylist(resp, req, afl.userID, typ, "library", list)
 }
 
 //Add добавить новую аудиозапись. Метод PUT. Доступен только авторизованным пользователям
 //Параметры: file обязательный; name, duration — необязательные, по умолчанию
-//	name = file.Filename, duration = '00:00'
-//Результат:
+//	name = file.Filename, duration = '00:00'. Теги файла (исполнитель, альбом…)
+//	сохраняются для поиска (см. Search), встроенная обложка — для Artwork, текст
+//	песни (USLT/SYLT, LYRICS) — для Detail. Акустический отпечаток для Duplicates
+//	считается в фоне (см. analyzeUpload)
+//Результат: id записи; duplicates — предупреждение о возможных дубликатах среди
+//	доступных пользователю треков (см. Duplicates), если они есть и отпечаток
+//	готов за duplicatesWait
 //Ошибка:
 func (afl *Audiofill) Add(resp http.ResponseWriter, req *http.Request) {
 	var (
@@ -433,46 +646,44 @@ func (afl *Audiofill) Add(resp http.ResponseWriter, req *http.Request) {
 		sqlQuery string
 		sqlParam []interface{}
 		tmpFile  *os.File
+		audioID  int
+		userID   int
 	)
 
-	if req.Method != http.MethodPut {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	if afl.userID, err = checkSession(afl.DB, req); err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+	//	загрузка файла и ожидание отпечатка долгие — userID держим локально, а не
+	//	в общей структуре
+	if userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
 		return
 	}
 
 	if err = req.ParseMultipartForm(2 << 10); err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
 
-	sqlQuery = `INSERT INTO audio (id_audio, id_owner, filename, description, duration)
-		VALUES (default, $1, $2, $3, `
-	sqlParam = append(sqlParam, afl.userID)
+	sqlQuery = `INSERT INTO audio (id_audio, id_owner, filename, format, meta, lyrics, description, duration)
+		VALUES (default, $1, $2, $3, $4, $5, $6, `
+	sqlParam = append(sqlParam, userID)
 
 	fd, fh, err := req.FormFile("file")
 	if err != nil {
-		http.Error(resp, "file upload error", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "file upload error")
 		return
 	}
 	defer fd.Close()
 	if tmpFile, err = ioutil.TempFile(mediaDir, ""); err != nil {
-		http.Error(resp, "iternal error", http.StatusInternalServerError)
-		log.Println("Audio.Add temp file creating error:", err.Error())
+		internalError(resp, err, "Audio.Add temp file creating error:")
 		return
 	}
 
 	io.Copy(tmpFile, fd)
 	if err = tmpFile.Close(); err != nil {
-		http.Error(resp, "iternal error", http.StatusInternalServerError)
-		log.Println("Audio.Add temp file creating error:", err.Error())
+		internalError(resp, err, "Audio.Add temp file creating error:")
 		return
 	}
-	sqlParam = append(sqlParam, path.Base(tmpFile.Name()))
+	sqlParam = append(sqlParam, path.Base(tmpFile.Name()), fileFormat(fh.Filename), metaJSON(tmpFile.Name()),
+		fileLyricsJSON(tmpFile.Name()))
 
 	if frmVal, isSet = req.MultipartForm.Value["name"]; isSet {
 		sqlParam = append(sqlParam, frmVal[0])
@@ -482,43 +693,530 @@ func (afl *Audiofill) Add(resp http.ResponseWriter, req *http.Request) {
 
 	if frmVal, isSet = req.MultipartForm.Value["duration"]; isSet {
 		sqlParam = append(sqlParam, frmVal[0])
-		sqlQuery += "$4"
+		sqlQuery += "$7"
 	} else {
 		sqlQuery += "default"
 	}
-	sqlQuery += ")"
+	sqlQuery += ") RETURNING id_audio"
 
-	_, err = afl.DB.Exec(sqlQuery, sqlParam...)
+	err = afl.DB.QueryRow(sqlQuery, sqlParam...).Scan(&audioID)
 	if err != nil {
-		//	rollback — delete temp file from mediaDir
-		os.Remove(tmpFile.Name())
-		if pgErr, ok := err.(*pq.Error); ok {
-			http.Error(resp, pgErr.Detail, http.StatusInternalServerError)
-			log.Println("Audio.Add query failed:", pgErr.Message, pgErr.Detail)
+		//	rollback — delete temp file (and its wav copy) from mediaDir
+		removeMedia(path.Base(tmpFile.Name()))
+		dbError(resp, err, "Audio.Add query failed:")
+		return
+	}
+
+	if err = extractArtwork(path.Base(tmpFile.Name())); err != nil {
+		log.Println("Audio.Add artwork failed:", err.Error())
+	}
+	publishTrackEvent(afl.DB, eventTrackAdded, audioID, userID, 0)
+	fpDone := make(chan []uint32, 1)
+	go analyzeUpload(afl.DB, audioID, path.Base(tmpFile.Name()), fpDone)
+
+	//	предупреждение: у пользователя уже есть (доступна) та же запись. Долгий
+	//	отпечаток (большой файл, перекодирование) не задерживает ответ — дубликаты
+	//	тогда можно запросить позже
+	var dups []*tDuplicate
+	select {
+	case fp := <-fpDone:
+		if dups, err = findDuplicates(afl.DB, userID, audioID, fp); err != nil {
+			log.Println("Audio.Add duplicates query failed:", err.Error())
+		}
+	case <-time.After(duplicatesWait):
+	}
+
+	//	POST /tracks — создание ресурса, прежний PUT /audio/add отвечает как раньше
+	jsRes, _ := json.Marshal(struct {
+		AudioID    int           `json:"id"`
+		Duplicates []*tDuplicate `json:"duplicates,omitempty"`
+	}{audioID, dups})
+	if req.Method == http.MethodPost {
+		resp.Header().Set("Location", fmt.Sprintf("/tracks/%d", audioID))
+		resp.WriteHeader(http.StatusCreated)
+	} else {
+		resp.WriteHeader(http.StatusOK)
+	}
+	resp.Write(jsRes)
+}
+
+//Detail аудиозапись со списком "расшаренных". Метод GET, доступен только
+//	авторизованным пользователям, которым доступна запись
+//Параметры: track — id аудиозаписи
+//Результат: статус ОК, json записи (как в списке List) с текстом песни или
+//	расшифровкой, если есть
+//Ошибка: статус NotFound если запись не существует или недоступна
+func (afl *Audiofill) Detail(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		tr  int
+		ad  *tAudio
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+
+	if ad, err = afl.loadAudio(tr); err != nil {
+		if err == sql.ErrNoRows {
+			apiError(resp, http.StatusNotFound, "track not found")
 		} else {
-			http.Error(resp, "internal error", http.StatusInternalServerError)
-			log.Println("Audio.Add query failed:", err.Error())
+			dbError(resp, err, "Audio.Detail query failed:")
 		}
 		return
 	}
+	if ad.Lyrics, err = afl.loadLyrics(tr); err != nil {
+		dbError(resp, err, "Audio.Detail lyrics query failed:")
+		return
+	}
 
+	jsRes, err := json.Marshal(ad)
+	if err != nil {
+		internalError(resp, err, "Audio.Detail result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Update изменение аудиозаписи. Метод PATCH, доступен только владельцу
+//Параметры: track — id аудиозаписи; name, duration, file — необязательные, но
+//	хотя бы один должен быть. Новый file — новая версия записи, пользователи
+//	с доступом к ней получают уведомление
+//Результат: статус ОК
+//Ошибка: статус BadRequest при неверных параметрах
+//	статус Forbidden если пользователь не владелец, NotFound если записи нет
+func (afl *Audiofill) Update(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		tr, secs int
+		frmVal   []string
+		isSet    bool
+		oldFile  string
+		newFile  string
+		sqlQuery string
+		sqlParam []interface{}
+		qs       *sql.Rows
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		err = req.ParseMultipartForm(2 << 10)
+	} else {
+		err = req.ParseForm()
+	}
+	if err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	sqlParam = append(sqlParam, tr)
+	if frmVal, isSet = req.Form["name"]; isSet {
+		sqlParam = append(sqlParam, frmVal[0])
+		sqlQuery += fmt.Sprintf("description = $%d,", len(sqlParam))
+	}
+	if frmVal, isSet = req.Form["duration"]; isSet {
+		if secs, err = parseSeconds(frmVal[0]); err != nil {
+			fieldError(resp, "duration", "invalid")
+			return
+		}
+		sqlParam = append(sqlParam, fmt.Sprintf("%d seconds", secs))
+		sqlQuery += fmt.Sprintf("duration = $%d,", len(sqlParam))
+	}
+
+	if req.MultipartForm != nil && len(req.MultipartForm.File["file"]) > 0 {
+		fd, fh, err := req.FormFile("file")
+		if err != nil {
+			apiError(resp, http.StatusBadRequest, "file upload error")
+			return
+		}
+		defer fd.Close()
+		tmpFile, err := ioutil.TempFile(mediaDir, "")
+		if err != nil {
+			internalError(resp, err, "Audio.Update temp file creating error:")
+			return
+		}
+		_, err = io.Copy(tmpFile, fd)
+		if cerr := tmpFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			internalError(resp, err, "Audio.Update temp file writing error:")
+			return
+		}
+		newFile = path.Base(tmpFile.Name())
+		sqlParam = append(sqlParam, newFile, fileFormat(fh.Filename), metaJSON(tmpFile.Name()))
+		sqlQuery += fmt.Sprintf("filename = $%d, format = $%d, meta = $%d,", len(sqlParam)-2, len(sqlParam)-1, len(sqlParam))
+		//	громкость прежнего файла не годится — до нового анализа ее нет
+		sqlQuery += "loudness = NULL, true_peak = NULL, loudness_range = NULL, replaygain_gain = NULL, replaygain_peak = NULL,"
+		//	текст из тегов — из нового файла, загруженный владельцем остается
+		sqlParam = append(sqlParam, fileLyricsJSON(tmpFile.Name()))
+		sqlQuery += fmt.Sprintf("lyrics = CASE WHEN a.lyrics->>'source' = 'upload' THEN a.lyrics ELSE $%d END,", len(sqlParam))
+		//	отпечаток нового файла посчитает analyzeUpload
+		sqlQuery += "fingerprint = NULL,"
+	}
+
+	if sqlQuery == "" {
+		apiError(resp, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	//	старое имя файла возвращаем из подзапроса — UPDATE … RETURNING отдает уже новое
+	err = afl.DB.QueryRow(`UPDATE audio a SET `+strings.TrimRight(sqlQuery, ",")+`
+		FROM (SELECT id_audio, filename FROM audio WHERE id_audio = $1) old
+		WHERE a.id_audio = old.id_audio
+		RETURNING old.filename`, sqlParam...).Scan(&oldFile)
+	if err != nil {
+		if newFile != "" {
+			removeMedia(newFile)
+		}
+		dbError(resp, err, "Audio.Update query failed:")
+		return
+	}
+
+	if newFile != "" {
+		removeMedia(oldFile)
+		if err = extractArtwork(newFile); err != nil {
+			log.Println("Audio.Update artwork failed:", err.Error())
+		}
+		go analyzeUpload(afl.DB, tr, newFile, nil)
+		qs, err = afl.DB.Query(`SELECT id_user FROM share s
+			WHERE s.id_audio = $1 AND `+sqlShareActive, tr)
+		if err == nil {
+			var users []int
+			for qs.Next() {
+				var uid int
+				if qs.Scan(&uid) == nil {
+					users = append(users, uid)
+				}
+			}
+			qs.Close()
+			for _, uid := range users {
+				if err = addNotification(afl.DB, uid, notifyVersion, tr, afl.userID); err != nil {
+					log.Println("Audio.Update notification failed:", err.Error())
+				}
+			}
+		} else {
+			log.Println("Audio.Update query sharees failed:", err.Error())
+		}
+	}
+	publishTrackEvent(afl.DB, eventTrackUpdated, tr, afl.userID, 0)
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Delete удаление аудиозаписи вместе с файлом и всеми "расшариваниями". Метод DELETE,
+//	доступен только владельцу
+//Параметры: track — id аудиозаписи
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если записи нет
+func (afl *Audiofill) Delete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		tr       int
+		tx       *sql.Tx
+		fileName string
+		cover    string
+		ev       *tEvent
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	//	получателей события определяем до удаления, пока "расшаривания" на месте
+	if ev, err = newTrackEvent(afl.DB, eventTrackDeleted, tr, afl.userID, 0); err != nil {
+		log.Println("Audio.Delete event failed:", err.Error())
+	}
+
+	if tx, err = afl.DB.Begin(); err != nil {
+		dbError(resp, err, "Audio.Delete begin failed:")
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM share WHERE id_audio = $1`, tr); err == nil {
+		err = tx.QueryRow(`DELETE FROM audio WHERE id_audio = $1 RETURNING filename, artwork`, tr).Scan(&fileName, &cover)
+	}
+	if err == nil {
+		err = auditLog(tx, afl.userID, "track.deleted", map[string]interface{}{"audio": tr, "filename": fileName})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		dbError(resp, err, "Audio.Delete query failed:")
+		return
+	}
+
+	removeMedia(fileName)
+	removeArtwork(cover)
+	if ev != nil {
+		publishEvent(afl.DB, ev)
+	}
 	resp.WriteHeader(http.StatusOK)
 }
 
+//scanAudioList чтение списка аудиозаписей из результата запроса. Каждая строка —
+//	запись + один пользователь, которому она расшарена (или NULL), строки одной
+//	записи идут подряд: id, name, is_owner, id_owner, owner_name, id_user, user_name, expires_at,
+//	теги (json-массив, см. sqlAudioTags), папка, отметки пользователя: favorite, rating,
+//	plays, played_at; громкость (json, см. sqlAudioLoudness); ключи сортировки (json-массив)
+func (afl *Audiofill) scanAudioList(qs *sql.Rows) (list []*tAudio, err error) {
+	var (
+		curAd   *tAudio
+		sqlID   sql.NullInt64
+		sqlName sql.NullString
+		sqlExp  pq.NullTime
+		tags    sql.NullString
+		folder  sql.NullInt64
+		played  pq.NullTime
+		loud    sql.NullString
+	)
+
+	for qs.Next() {
+		ad := &tAudio{}
+		err = qs.Scan(&ad.AudioID, &ad.Descr, &ad.IsOwn, &ad.OwnerID, &ad.OwnerName, &sqlID, &sqlName, &sqlExp,
+			&tags, &folder, &ad.Favorite, &ad.Rating, &ad.Plays, &played, &loud, &ad.cursor)
+		if err != nil {
+			return nil, err
+		}
+		if tags.Valid {
+			if err = json.Unmarshal([]byte(tags.String), &ad.Tags); err != nil {
+				return nil, err
+			}
+		}
+		if loud.Valid {
+			if err = json.Unmarshal([]byte(loud.String), &ad.Loudness); err != nil {
+				return nil, err
+			}
+		}
+		ad.Folder = int(folder.Int64)
+		if played.Valid {
+			ad.PlayedAt = &played.Time
+		}
+
+		if curAd != nil && ad.AudioID == curAd.AudioID { //	добавляем список "расшаренных" в текущую запись
+			afl.appendShare(curAd, sqlID, sqlName, sqlExp)
+
+		} else { //	новая запись ­— сохраним "старую" и создадим новую
+			if curAd != nil {
+				list = append(list, curAd)
+			}
+			afl.appendShare(ad, sqlID, sqlName, sqlExp)
+			curAd = &tAudio{}
+			afl.copyAudio(curAd, ad)
+		}
+	}
+	if curAd != nil {
+		list = append(list, curAd)
+	}
+	return list, qs.Err()
+}
+
+//loadAudio аудиозапись id со списком "расшаренных", если она доступна текущему
+//	пользователю. Недоступная или несуществующая запись — sql.ErrNoRows
+func (afl *Audiofill) loadAudio(id int) (ad *tAudio, err error) {
+	var (
+		qs   *sql.Rows
+		list []*tAudio
+	)
+
+	qs, err = afl.DB.Query(`SELECT a.id_audio,
+			concat(a.description,' (',a.duration,')'),
+			a.id_owner = $1,
+			a.id_owner,
+			coalesce(nullif(own.name,''), own.login),
+			usr.id_user,
+			coalesce(nullif(usr.name, ''), usr.login),
+			s.expires_at,
+			(`+sqlAudioTags+`),
+			CASE WHEN a.id_owner = $1 THEN a.id_folder END,
+			coalesce(ua.favorite, false), coalesce(ua.rating, 0), coalesce(ua.plays, 0), ua.played_at,
+			`+sqlAudioLoudness+`,
+			''
+		FROM audio a
+		INNER JOIN users own ON (a.id_owner = own.id_user)
+		LEFT JOIN user_audio ua ON (ua.id_audio = a.id_audio AND ua.id_user = $1)
+		LEFT JOIN share s ON (s.id_audio = a.id_audio AND `+sqlShareActive+`)
+		LEFT JOIN users usr ON (s.id_user = usr.id_user)
+		WHERE a.id_audio = $2 AND `+sqlAvailable+`
+		ORDER BY usr.id_user`, afl.userID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer qs.Close()
+
+	if list, err = afl.scanAudioList(qs); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return list[0], nil
+}
+
+//listFilter условия отбора для списка аудиозаписей по параметрам запроса (алиас
+//	таблицы audio — a). Первым параметром запроса всегда идет текущий пользователь ($1),
+//	значения фильтров добавляются следом. Возвращает ошибку с текстом для клиента
+func (afl *Audiofill) listFilter(req *http.Request) (where string, param []interface{}, err error) {
+	var (
+		frmVal []string
+		isSet  bool
+		cond   string
+		secs   int
+		tm     time.Time
+	)
+
+	scopes := map[string]string{
+		"all":            "true",
+		"own":            "a.id_owner = $1",
+		"shared_with_me": "a.id_owner <> $1",
+		"shared_by_me": `a.id_owner = $1 AND exists (
+			SELECT id_audio FROM share s WHERE s.id_audio = a.id_audio AND ` + sqlShareActive + `)`,
+	}
+
+	where = sqlAvailable
+	param = append(param, afl.userID)
+
+	if frmVal, isSet = req.Form["scope"]; isSet {
+		if cond, isSet = scopes[frmVal[0]]; !isSet {
+			return "", nil, &tFieldError{Field: "scope", Reason: "invalid"}
+		}
+		where += "\n\t\t\tAND " + cond
+	}
+
+	if frmVal, isSet = req.Form["owner"]; isSet {
+		if secs, err = strconv.Atoi(frmVal[0]); err != nil {
+			return "", nil, &tFieldError{Field: "owner", Reason: "invalid"}
+		}
+		param = append(param, secs)
+		where += fmt.Sprintf("\n\t\t\tAND a.id_owner = $%d", len(param))
+	}
+
+	for _, flt := range []struct{ name, op string }{{"duration_from", ">="}, {"duration_to", "<="}} {
+		if frmVal, isSet = req.Form[flt.name]; isSet {
+			if secs, err = parseSeconds(frmVal[0]); err != nil {
+				return "", nil, &tFieldError{Field: flt.name, Reason: "invalid"}
+			}
+			param = append(param, secs)
+			where += fmt.Sprintf("\n\t\t\tAND extract(epoch from a.duration) %s $%d", flt.op, len(param))
+		}
+	}
+
+	for _, flt := range []struct{ name, op string }{{"uploaded_from", ">="}, {"uploaded_to", "<"}} {
+		if frmVal, isSet = req.Form[flt.name]; isSet {
+			if tm, err = parseTime(frmVal[0]); err != nil {
+				return "", nil, &tFieldError{Field: flt.name, Reason: "invalid"}
+			}
+			//	дата без времени в uploaded_to включает весь день
+			if flt.name == "uploaded_to" && len(frmVal[0]) == len("2006-01-02") {
+				tm = tm.AddDate(0, 0, 1)
+			}
+			param = append(param, tm)
+			where += fmt.Sprintf("\n\t\t\tAND a.created %s $%d", flt.op, len(param))
+		}
+	}
+
+	if formFlag(req, "favorite") {
+		where += "\n\t\t\tAND exists(SELECT id_audio FROM user_audio uf WHERE uf.id_audio = a.id_audio AND uf.id_user = $1 AND uf.favorite)"
+	}
+
+	//	теги — у трека должны быть все перечисленные
+	if frmVal, isSet = req.Form["tag"]; isSet {
+		for _, f := range strings.Split(frmVal[0], ",") {
+			if secs, err = strconv.Atoi(strings.TrimSpace(f)); err != nil {
+				return "", nil, &tFieldError{Field: "tag", Reason: "invalid"}
+			}
+			param = append(param, secs)
+			where += fmt.Sprintf(`
+			AND exists(SELECT id_tag FROM audio_tags atg WHERE atg.id_audio = a.id_audio AND atg.id_tag = $%d)`,
+				len(param))
+		}
+	}
+
+	//	папка со всеми вложенными, 0 — собственные треки вне папок
+	if frmVal, isSet = req.Form["folder"]; isSet {
+		if secs, err = strconv.Atoi(frmVal[0]); err != nil {
+			return "", nil, &tFieldError{Field: "folder", Reason: "invalid"}
+		}
+		if secs == 0 {
+			where += "\n\t\t\tAND a.id_owner = $1 AND a.id_folder IS NULL"
+		} else {
+			param = append(param, secs)
+			where += fmt.Sprintf(`
+			AND a.id_folder IN (`+sqlSubfolders+`)`, len(param))
+		}
+	}
+
+	if frmVal, isSet = req.Form["format"]; isSet {
+		var formats []string
+		for _, f := range strings.Split(frmVal[0], ",") {
+			if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+				formats = append(formats, f)
+			}
+		}
+		if len(formats) == 0 {
+			return "", nil, &tFieldError{Field: "format", Reason: "invalid"}
+		}
+		param = append(param, pq.Array(formats))
+		where += fmt.Sprintf("\n\t\t\tAND a.format = ANY($%d)", len(param))
+	}
+	return where, param, nil
+}
+
 //copyAudio глубокое копирование структуры tAudio из src в dst
 func (afl *Audiofill) copyAudio(dst, src *tAudio) {
 	dst.AudioID, dst.Descr, dst.IsOwn, dst.OwnerID, dst.OwnerName = src.AudioID, src.Descr, src.IsOwn, src.OwnerID, src.OwnerName
+	dst.Tags, dst.Folder, dst.cursor = src.Tags, src.Folder, src.cursor
+	dst.Favorite, dst.Rating, dst.Plays, dst.PlayedAt = src.Favorite, src.Rating, src.Plays, src.PlayedAt
+	dst.Loudness = src.Loudness
+	dst.Lyrics = src.Lyrics
 	for _, v := range src.Shared {
 		sh := &tShare{}
-		sh.UserID, sh.UserName = v.UserID, v.UserName
+		sh.UserID, sh.UserName, sh.Expires = v.UserID, v.UserName, v.Expires
 		dst.Shared = append(dst.Shared, sh)
 	}
 }
 
 //appendShare добваление в список Shared структуры tAudio ненулевых (не NULL) значений
-func (afl *Audiofill) appendShare(dst *tAudio, id sql.NullInt64, name sql.NullString) {
+func (afl *Audiofill) appendShare(dst *tAudio, id sql.NullInt64, name sql.NullString, exp pq.NullTime) {
 	if id.Valid {
-		dst.Shared = append(dst.Shared, &tShare{UserID: int(id.Int64), UserName: name.String})
+		sh := &tShare{UserID: int(id.Int64), UserName: name.String}
+		if exp.Valid {
+			sh.Expires = &exp.Time
+		}
+		dst.Shared = append(dst.Shared, sh)
 	}
 }
 
@@ -530,14 +1228,14 @@ func (afl *Audiofill) checkAudioOwner(id int, resp http.ResponseWriter) (ok bool
 	qr := afl.DB.QueryRow(`SELECT id_owner = $1 FROM audio WHERE id_audio = $2`, afl.userID, id)
 	if err := qr.Scan(&ok); err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(resp, "track not found", http.StatusNotFound)
+			apiError(resp, http.StatusNotFound, "track not found")
 		} else {
-			http.Error(resp, "Audio.Share qurey failed", http.StatusInternalServerError)
+			dbError(resp, err, "Audio.checkAudioOwner query failed:")
 		}
 		return false
 	}
 	if !ok {
-		http.Error(resp, "access denied", http.StatusForbidden)
+		apiError(resp, http.StatusForbidden, "access denied")
 	}
 	return ok
 }
@@ -559,19 +1257,19 @@ func main() {
 		return
 	}
 
-	ad := NewAudiofill(db)
-	usr := NewUsers(db)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/registration", usr.Registration)
-	mux.HandleFunc("/login", usr.Login)
-	mux.HandleFunc("/user/list", usr.List)
-	mux.HandleFunc("/user/share", usr.Share)
-	mux.HandleFunc("/audio/list", ad.List)
-	mux.HandleFunc("/audio/share", ad.Share)
-	mux.HandleFunc("/audio/lock", ad.Lock)
-	mux.HandleFunc("/audio/get", ad.Get)
-	mux.HandleFunc("/audio/add", ad.Add)
+	if notifySMTPAddr != "" {
+		registerNotifyChannel(emailChannel{Addr: notifySMTPAddr, From: notifyMailFrom})
+	}
+	if notifyWebhookURL != "" {
+		registerNotifyChannel(webhookChannel{URL: notifyWebhookURL})
+	}
 
+	mux := newRouter(db)
+
+	if err = events.Listen(db, connStr); err != nil {
+		log.Println("Events LISTEN failed, events are delivered locally only:", err.Error())
+	}
+	startJobs(db)
 	fmt.Println("Server listen on :8008")
 	http.ListenAndServe(":8008", mux)
 }
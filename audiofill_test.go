@@ -9,11 +9,13 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -69,13 +71,13 @@ func TestAudioList(t *testing.T) {
 			Path:   "/audio/list",
 			Cookie: cookAdmin,
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testAudio{ //	1 неавторизованный доступ
 			Method: http.MethodGet,
 			Path:   "/audio/list",
 			Status: http.StatusUnauthorized,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	2 параметры по умолчанию
 			Method: http.MethodGet,
@@ -176,7 +178,147 @@ func TestAudioList(t *testing.T) {
 			Query:  "order_by=wrong",
 			Cookie: cookUser,
 			Status: http.StatusBadRequest,
-			Error:  "bad parameter order_by\n",
+			Error:  "invalid order_by value",
+		},
+		testAudio{ //	6 только собственные
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "scope=own",
+			Cookie: cookAdmin,
+			Status: http.StatusOK,
+			Body: tAudioList{
+				Count: 2,
+				List: []*tAudio{
+					&tAudio{AudioID: 2,
+						Descr:     "best music (00:14:00)",
+						IsOwn:     true,
+						OwnerID:   1,
+						OwnerName: "admin",
+						Shared: []*tShare{
+							&tShare{UserID: 2, UserName: "Lorem Ipsum"},
+						},
+					},
+					&tAudio{AudioID: 1,
+						Descr:     "test music (00:04:00)",
+						IsOwn:     true,
+						OwnerID:   1,
+						OwnerName: "admin",
+						Shared: []*tShare{
+							&tShare{UserID: 2, UserName: "Lorem Ipsum"},
+							&tShare{UserID: 3, UserName: "Uninvited T"},
+						},
+					},
+				},
+			},
+		},
+		testAudio{ //	7 расшаренные другими
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "scope=shared_with_me",
+			Cookie: cookAdmin,
+			Status: http.StatusOK,
+			Body: tAudioList{
+				Count: 1,
+				List: []*tAudio{
+					&tAudio{AudioID: 3,
+						Descr:     "bad music (00:01:00)",
+						IsOwn:     false,
+						OwnerID:   2,
+						OwnerName: "Lorem Ipsum",
+						Shared: []*tShare{
+							&tShare{UserID: 1, UserName: "admin"},
+							&tShare{UserID: 3, UserName: "Uninvited T"},
+						},
+					},
+				},
+			},
+		},
+		testAudio{ //	8 собственные расшаренные, приватная запись не попадает
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "scope=shared_by_me",
+			Cookie: cookUser,
+			Status: http.StatusOK,
+			Body: tAudioList{
+				Count: 1,
+				List: []*tAudio{
+					&tAudio{AudioID: 3,
+						Descr:     "bad music (00:01:00)",
+						IsOwn:     true,
+						OwnerID:   2,
+						OwnerName: "Lorem Ipsum",
+						Shared: []*tShare{
+							&tShare{UserID: 1, UserName: "admin"},
+							&tShare{UserID: 3, UserName: "Uninvited T"},
+						},
+					},
+				},
+			},
+		},
+		testAudio{ //	9 фильтр и сортировка по длительности
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "duration_from=00:05:00&order_by=duration",
+			Cookie: cookUser,
+			Status: http.StatusOK,
+			Body: tAudioList{
+				Count: 2,
+				List: []*tAudio{
+					&tAudio{AudioID: 4,
+						Descr:     "private music (00:10:00)",
+						IsOwn:     true,
+						OwnerID:   2,
+						OwnerName: "Lorem Ipsum",
+					},
+					&tAudio{AudioID: 2,
+						Descr:     "best music (00:14:00)",
+						IsOwn:     false,
+						OwnerID:   1,
+						OwnerName: "admin",
+						Shared: []*tShare{
+							&tShare{UserID: 2, UserName: "Lorem Ipsum"},
+						},
+					},
+				},
+			},
+		},
+		testAudio{ //	10 неверный параметр scope
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "scope=everything",
+			Cookie: cookUser,
+			Status: http.StatusBadRequest,
+			Error:  "invalid scope value",
+		},
+		testAudio{ //	11 фильтр по дате загрузки и владельцу
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "uploaded_to=2019-07-01&owner=1",
+			Cookie: cookGuest,
+			Status: http.StatusOK,
+			Body: tAudioList{
+				Count: 1,
+				List: []*tAudio{
+					&tAudio{AudioID: 1,
+						Descr:     "test music (00:04:00)",
+						IsOwn:     false,
+						OwnerID:   1,
+						OwnerName: "admin",
+						Shared: []*tShare{
+							&tShare{UserID: 2, UserName: "Lorem Ipsum"},
+							&tShare{UserID: 3, UserName: "Uninvited T"},
+						},
+					},
+				},
+			},
+		},
+		testAudio{ //	12 фильтр по формату — нет записей
+			Method: http.MethodGet,
+			Path:   "/audio/list",
+			Query:  "format=mp3,flac",
+			Cookie: cookAdmin,
+			Status: http.StatusNotFound,
+			Error:  "no records found",
 		},
 	}
 
@@ -217,11 +359,12 @@ func TestAudioList(t *testing.T) {
 				t.Errorf("%s >>> unmarshaling result error [%s]", testName, err.Error())
 				continue
 			}
+			result.Next, result.Prev = "", "" //	ссылки на страницы проверяются в TestAudioListCursor
 			if !reflect.DeepEqual(tst.Body, result) {
 				t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, result.String(), tst.Body.String())
 			}
 
-		} else if tst.Error != string(respBody) {
+		} else if tst.Error != errMessage(respBody) {
 			t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Error)
 		}
 	}
@@ -249,20 +392,20 @@ func TestAudioShare(t *testing.T) {
 			Method: http.MethodGet,
 			Path:   "/audio/share",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testAudio{ //	1	неавторизованный доступ
 			Method: http.MethodPost,
 			Path:   "/audio/share",
 			Status: http.StatusUnauthorized,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	2	отсутствует обязательный параметр track
 			Method: http.MethodPost,
 			Path:   "/audio/share",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "track required\n",
+			Error:  "track required",
 		},
 		testAudio{ //	3	отсутствует обязательный параметр user
 			Method: http.MethodPost,
@@ -270,7 +413,7 @@ func TestAudioShare(t *testing.T) {
 			Cookie: cookUser,
 			Query:  "track=2",
 			Status: http.StatusBadRequest,
-			Error:  "user required\n",
+			Error:  "user required",
 		},
 		testAudio{ //	4	неверный параметр track
 			Method: http.MethodPost,
@@ -278,7 +421,7 @@ func TestAudioShare(t *testing.T) {
 			Query:  "track=%31%20or%20true&user=4",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "invalid track value\n",
+			Error:  "invalid track value",
 		},
 		testAudio{ //	5	неверный параметр user
 			Method: http.MethodPost,
@@ -286,7 +429,7 @@ func TestAudioShare(t *testing.T) {
 			Query:  "track=1&user=bad",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "invalid user value\n",
+			Error:  "invalid user value",
 		},
 		testAudio{ //	6	"чужой" трек
 			Method: http.MethodPost,
@@ -294,7 +437,7 @@ func TestAudioShare(t *testing.T) {
 			Query:  "track=1&user=4",
 			Cookie: cookGuest,
 			Status: http.StatusForbidden,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	7	несуществующий пользователь
 			Method: http.MethodPost,
@@ -302,7 +445,7 @@ func TestAudioShare(t *testing.T) {
 			Query:  "track=1&user=1000",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "user not exists\n",
+			Error:  "user not exists",
 		},
 		testAudio{ //	8	успешно
 			Method: http.MethodPost,
@@ -359,6 +502,22 @@ func TestAudioShare(t *testing.T) {
 			Cookie: cookAdmin,
 			Status: http.StatusOK,
 		},
+		testAudio{ //	11	срок действия доступа в прошлом
+			Method: http.MethodPost,
+			Path:   "/audio/share",
+			Query:  "track=2&user=3&expires_at=2000-01-01",
+			Cookie: cookAdmin,
+			Status: http.StatusBadRequest,
+			Error:  "invalid expires_at value",
+		},
+		testAudio{ //	12	неверный формат срока действия
+			Method: http.MethodPost,
+			Path:   "/audio/share",
+			Query:  "track=2&user=3&expires_at=tomorrow",
+			Cookie: cookAdmin,
+			Status: http.StatusBadRequest,
+			Error:  "invalid expires_at value",
+		},
 	}
 
 	for idx, tst := range tests {
@@ -398,11 +557,12 @@ func TestAudioShare(t *testing.T) {
 				t.Errorf("%s >>> unmarshaling result error [%s]", testName, err.Error())
 				continue
 			}
+			result.Next, result.Prev = "", "" //	ссылки на страницы проверяются в TestAudioListCursor
 			if !reflect.DeepEqual(tst.Body, result) {
 				t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, result.String(), tst.Body.String())
 			}
 
-		} else if tst.Error != string(respBody) {
+		} else if tst.Error != errMessage(respBody) {
 			t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Error)
 		}
 	}
@@ -429,20 +589,20 @@ func TestAudioLock(t *testing.T) {
 			Method: http.MethodGet,
 			Path:   "/audio/lock",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testAudio{ //	1	неавторизованный доступ
 			Method: http.MethodPost,
 			Path:   "/audio/lock",
 			Status: http.StatusUnauthorized,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	2	отсутствует обязательный параметр track
 			Method: http.MethodPost,
 			Path:   "/audio/lock",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "track required\n",
+			Error:  "track required",
 		},
 		testAudio{ //	3	отсутствует обязательный параметр user
 			Method: http.MethodPost,
@@ -450,7 +610,7 @@ func TestAudioLock(t *testing.T) {
 			Cookie: cookUser,
 			Query:  "track=2",
 			Status: http.StatusBadRequest,
-			Error:  "user required\n",
+			Error:  "user required",
 		},
 		testAudio{ //	4	неверный параметр track
 			Method: http.MethodPost,
@@ -458,7 +618,7 @@ func TestAudioLock(t *testing.T) {
 			Query:  "track=%31%20or%20true&user=4",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "invalid track value\n",
+			Error:  "invalid track value",
 		},
 		testAudio{ //	5	неверный параметр user
 			Method: http.MethodPost,
@@ -466,7 +626,7 @@ func TestAudioLock(t *testing.T) {
 			Query:  "track=1&user=bad",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "invalid user value\n",
+			Error:  "invalid user value",
 		},
 		testAudio{ //	6	"чужой" трек
 			Method: http.MethodPost,
@@ -474,7 +634,7 @@ func TestAudioLock(t *testing.T) {
 			Query:  "track=1&user=4",
 			Cookie: cookGuest,
 			Status: http.StatusForbidden,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	7	несуществующий пользователь
 			Method: http.MethodPost,
@@ -482,7 +642,7 @@ func TestAudioLock(t *testing.T) {
 			Query:  "track=1&user=1000",
 			Cookie: cookAdmin,
 			Status: http.StatusNotFound,
-			Error:  "no rows are deleted\n",
+			Error:  "no rows are deleted",
 		},
 		testAudio{ //	8	успешно
 			Method: http.MethodPost,
@@ -526,7 +686,7 @@ func TestAudioLock(t *testing.T) {
 			Path:   "/audio/list",
 			Cookie: cookGuest,
 			Status: http.StatusNotFound,
-			Error:  "\n",
+			Error:  "no records found",
 		},
 	}
 
@@ -567,11 +727,12 @@ func TestAudioLock(t *testing.T) {
 				t.Errorf("%s >>> unmarshaling result error [%s]", testName, err.Error())
 				continue
 			}
+			result.Next, result.Prev = "", "" //	ссылки на страницы проверяются в TestAudioListCursor
 			if !reflect.DeepEqual(tst.Body, result) {
 				t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, result.String(), tst.Body.String())
 			}
 
-		} else if tst.Error != string(respBody) {
+		} else if tst.Error != errMessage(respBody) {
 			t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Error)
 		}
 	}
@@ -593,20 +754,20 @@ func TestAudioGet(t *testing.T) {
 			Method: http.MethodPut,
 			Path:   "/audio/get",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testAudio{ //	1 unauthorized
 			Method: http.MethodGet,
 			Path:   "/audio/get",
 			Status: http.StatusUnauthorized,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	2 parameter track required
 			Method: http.MethodGet,
 			Path:   "/audio/get",
 			Cookie: cookAdmin,
 			Status: http.StatusBadRequest,
-			Error:  "track required\n",
+			Error:  "track required",
 		},
 		testAudio{ //	3 parameter track invalid
 			Method: http.MethodGet,
@@ -614,7 +775,7 @@ func TestAudioGet(t *testing.T) {
 			Cookie: cookAdmin,
 			Query:  "track=1'and%20true",
 			Status: http.StatusBadRequest,
-			Error:  "track invalid value\n",
+			Error:  "invalid track value",
 		},
 		testAudio{ //	4 file not exists
 			Method: http.MethodGet,
@@ -622,7 +783,7 @@ func TestAudioGet(t *testing.T) {
 			Cookie: cookAdmin,
 			Query:  "track=2",
 			Status: http.StatusNotFound,
-			Error:  "file not found\n",
+			Error:  "file not found",
 		},
 	}
 
@@ -654,7 +815,7 @@ func TestAudioGet(t *testing.T) {
 		respBody, _ := ioutil.ReadAll(resp.Body)
 		if resp.StatusCode == http.StatusOK {
 
-		} else if tst.Error != string(respBody) {
+		} else if tst.Error != errMessage(respBody) {
 			t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Error)
 		}
 	}
@@ -700,19 +861,19 @@ func TestAudioAdd(t *testing.T) {
 			Method: http.MethodGet,
 			Path:   "/audio/add",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testAudio{ //	1 unauthorized
 			Method: http.MethodPut,
 			Path:   "/audio/add",
 			Status: http.StatusUnauthorized,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 		testAudio{ //	1 unauthorized
 			Method: http.MethodPut,
 			Path:   "/audio/add",
 			Status: http.StatusUnauthorized,
-			Error:  "access denied\n",
+			Error:  "access denied",
 		},
 	}
 
@@ -744,7 +905,7 @@ func TestAudioAdd(t *testing.T) {
 		respBody, _ := ioutil.ReadAll(resp.Body)
 		if resp.StatusCode == http.StatusOK {
 
-		} else if tst.Error != string(respBody) {
+		} else if tst.Error != errMessage(respBody) {
 			t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Error)
 		}
 	}
@@ -800,3 +961,155 @@ func TestAudioAdd(t *testing.T) {
 		t.Error("cant open file wings.mp3. Test failed")
 	}
 }
+
+func TestShareExpire(t *testing.T) {
+	var (
+		err    error
+		req    *http.Request
+		resp   *http.Response
+		result tAudioList
+		cnt    int
+	)
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookGuest := &http.Cookie{Name: "session_id", Value: "0414d6d5d923b0f4998556df2fe2e351"}
+
+	//	временный доступ гостю к треку 2
+	expires := time.Now().Add(7 * 24 * time.Hour).Format(time.RFC3339)
+	req, _ = http.NewRequest(http.MethodPost, testSrv.URL+"/audio/share",
+		strings.NewReader("track=2&user=3&expires_at="+url.QueryEscape(expires)))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookAdmin)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatalf("Share.Expire: share query failed %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Share.Expire: share wrong status %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, testSrv.URL+"/audio/list", nil)
+	req.AddCookie(cookGuest)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatalf("Share.Expire: list query failed %s", err.Error())
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		t.Fatalf("Share.Expire: unmarshaling result error [%s]", err.Error())
+	}
+	if result.Count != 1 || result.List[0].AudioID != 2 {
+		t.Fatalf("Share.Expire: wrong list [%s], expected track 2", result.String())
+	}
+	for _, sh := range result.List[0].Shared {
+		if (sh.UserID == 3) != (sh.Expires != nil) {
+			t.Errorf("Share.Expire: wrong expires_at for user %d: %v", sh.UserID, sh.Expires)
+		}
+	}
+
+	//	срок истек — трек пропадает из списка, но запись в share остается до очистки
+	_, err = testDB.Exec(`UPDATE share SET expires_at = now() - interval '1 minute'
+		WHERE id_audio = 2 AND id_user = 3`)
+	if err != nil {
+		t.Fatalf("Share.Expire: update expires_at failed %s", err.Error())
+	}
+	req, _ = http.NewRequest(http.MethodGet, testSrv.URL+"/audio/list", nil)
+	req.AddCookie(cookGuest)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatalf("Share.Expire: list query failed %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Share.Expire: expired list wrong status %d, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	if cnt, err = expireShares(testDB); err != nil {
+		t.Fatalf("Share.Expire: expireShares failed %s", err.Error())
+	}
+	if cnt != 1 {
+		t.Errorf("Share.Expire: expireShares removed %d grants, expected 1", cnt)
+	}
+	err = testDB.QueryRow(`SELECT count(*) FROM audit_log
+		WHERE action = 'share.expired' AND details->>'audio' = '2' AND details->>'user' = '3'`).Scan(&cnt)
+	if err != nil || cnt != 1 {
+		t.Errorf("Share.Expire: audit log records %d, expected 1 (%v)", cnt, err)
+	}
+}
+
+func TestAudioListCursor(t *testing.T) {
+	var (
+		all, page tAudioList
+		ids, back []int
+	)
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	get := func(path string, dst *tAudioList) int {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+path, nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Audio.List cursor: query failed %s", err.Error())
+		}
+		defer resp.Body.Close()
+		*dst = tAudioList{}
+		json.NewDecoder(resp.Body).Decode(dst)
+		return resp.StatusCode
+	}
+
+	for _, ord := range []string{"user", "track", "duration_desc", "uploaded_desc"} {
+		if st := get("/tracks?on_page=100&order_by="+ord, &all); st != http.StatusOK || all.Next != "" || all.Prev != "" {
+			t.Fatalf("Audio.List cursor: full list %s wrong result %d next [%s] prev [%s]", ord, st, all.Next, all.Prev)
+		}
+
+		//	вперед по одной записи до конца, затем назад до начала
+		ids, back = nil, nil
+		next := "/tracks?on_page=1&order_by=" + ord
+		for next != "" && len(ids) <= len(all.List) {
+			if st := get(next, &page); st != http.StatusOK || len(page.List) != 1 {
+				t.Fatalf("Audio.List cursor: %s wrong status %d", next, st)
+			}
+			ids = append(ids, page.List[0].AudioID)
+			next = page.Next
+		}
+		prev := page.Prev
+		for prev != "" && len(back) <= len(all.List) {
+			if st := get(prev, &page); st != http.StatusOK || len(page.List) != 1 {
+				t.Fatalf("Audio.List cursor: %s wrong status %d", prev, st)
+			}
+			back = append([]int{page.List[0].AudioID}, back...)
+			prev = page.Prev
+		}
+		back = append(back, ids[len(ids)-1])
+
+		var expected []int
+		for _, ad := range all.List {
+			expected = append(expected, ad.AudioID)
+		}
+		if !reflect.DeepEqual(ids, expected) || !reflect.DeepEqual(back, expected) {
+			t.Errorf("Audio.List cursor: order %s forward %v backward %v, expected %v", ord, ids, back, expected)
+		}
+	}
+
+	//	курсор другой сортировки и испорченный курсор
+	get("/tracks?on_page=1&order_by=track", &page)
+	cursor := page.Next[strings.Index(page.Next, "cursor=")+len("cursor="):]
+	if i := strings.Index(cursor, "&"); i >= 0 {
+		cursor = cursor[:i]
+	}
+	for _, path := range []string{"/tracks?order_by=user&cursor=" + cursor, "/tracks?cursor=not-a-cursor"} {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+path, nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Audio.List cursor: query failed %s", err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || errMessage(body) != "invalid cursor value" {
+			t.Errorf("Audio.List cursor: %s wrong result %d [%s]", path, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+//sqlExecer общий интерфейс *sql.DB и *sql.Tx для записи в журнал как в рамках
+//	транзакции, так и без нее
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+//auditLog запись события в журнал аудита (таблица audit_log)
+//	userID — инициатор события, 0 для системных (фоновых) заданий
+//	details — произвольная структура, сохраняется в json
+func auditLog(db sqlExecer, userID int, action string, details interface{}) error {
+	var usr sql.NullInt64
+
+	js, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	if userID > 0 {
+		usr = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	_, err = db.Exec(`INSERT INTO audit_log (id_user, action, details) VALUES ($1, $2, $3)`,
+		usr, action, string(js))
+	return err
+}
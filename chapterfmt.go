@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//chapterTypes форматы выгрузки глав трека и их Content-Type
+var chapterTypes = map[string]string{
+	"json": "application/json+chapters; charset=utf-8",
+	"vtt":  "text/vtt; charset=utf-8",
+	"id3":  "application/octet-stream",
+}
+
+//id3MaxChapters наибольшее количество глав в теге ID3: счетчик записей CTOC — один байт
+const id3MaxChapters = 255
+
+//errChapterCount глав больше, чем помещается в оглавление ID3
+var errChapterCount = fmt.Errorf("too many chapters for id3, at most %d", id3MaxChapters)
+
+//tChapter глава трека для выгрузки, время в миллисекундах
+type tChapter struct {
+	Start int
+	End   int
+	Title string
+}
+
+//chapterEnds конец глав без явного конца — начало следующей главы, у последней —
+//	конец трека dur (мс, 0 — длительность неизвестна, глава без протяженности)
+func chapterEnds(list []*tChapter, dur int) {
+	for i, ch := range list {
+		if ch.End > ch.Start {
+			continue
+		}
+		switch {
+		case i+1 < len(list):
+			ch.End = list[i+1].Start
+		case dur > ch.Start:
+			ch.End = dur
+		default:
+			ch.End = ch.Start
+		}
+	}
+}
+
+//vttTime время WebVTT hh:mm:ss.ttt из миллисекунд
+func vttTime(ms int) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+//vttEscape текст реплики WebVTT: одна строка, &, <, > — сущностями (в том числе
+//	не дает тексту содержать "-->")
+var vttEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+//id3Frame фрейм ID3v2.4: id, размер 7-битными байтами, флаги, данные
+func id3Frame(id string, data []byte) []byte {
+	frame := make([]byte, 10, 10+len(data))
+	copy(frame, id)
+	putSyncsafe(frame[4:8], len(data))
+	return append(frame, data...)
+}
+
+//id3Text текстовый фрейм ID3v2.4 в UTF-8
+func id3Text(id, text string) []byte {
+	return id3Frame(id, append([]byte{3}, text...))
+}
+
+//writeChapters запись глав в формате typ: json — главы Podcasting 2.0
+//	(podcast:chapters), vtt — WebVTT с репликой на главу, id3 — тег ID3v2.4 с
+//	оглавлением CTOC и фреймами CHAP (ID3v2 Chapter Frame Addendum). name —
+//	название трека, для заголовка оглавления
+func writeChapters(w io.Writer, typ, name string, list []*tChapter) error {
+	buf := &bytes.Buffer{}
+
+	switch typ {
+	case "json":
+		type jsChapter struct {
+			StartTime float64 `json:"startTime"`
+			EndTime   float64 `json:"endTime"`
+			Title     string  `json:"title"`
+		}
+		doc := struct {
+			Version  string      `json:"version"`
+			Chapters []jsChapter `json:"chapters"`
+		}{Version: "1.2.0", Chapters: []jsChapter{}}
+		for _, ch := range list {
+			doc.Chapters = append(doc.Chapters, jsChapter{float64(ch.Start) / 1000, float64(ch.End) / 1000, ch.Title})
+		}
+		enc := json.NewEncoder(buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	case "vtt":
+		buf.WriteString("WEBVTT\n")
+		for i, ch := range list {
+			fmt.Fprintf(buf, "\n%d\n%s --> %s\n%s\n", i+1, vttTime(ch.Start), vttTime(ch.End),
+				vttEscape.Replace(strings.Join(strings.Fields(ch.Title), " ")))
+		}
+	case "id3":
+		if len(list) > id3MaxChapters {
+			return errChapterCount
+		}
+		//	CTOC: верхний уровень, упорядоченное; CHAP: смещения в файле не заданы
+		toc := append([]byte("toc\x00"), 0x03, byte(len(list)))
+		var frames []byte
+		for i, ch := range list {
+			id := fmt.Sprintf("chp%d\x00", i)
+			toc = append(toc, id...)
+			chap := append([]byte(id), make([]byte, 16)...)
+			binary.BigEndian.PutUint32(chap[len(id):], uint32(ch.Start))
+			binary.BigEndian.PutUint32(chap[len(id)+4:], uint32(ch.End))
+			binary.BigEndian.PutUint64(chap[len(id)+8:], 1<<64-1)
+			frames = append(frames, id3Frame("CHAP", append(chap, id3Text("TIT2", ch.Title)...))...)
+		}
+		if name != "" {
+			toc = append(toc, id3Text("TIT2", name)...)
+		}
+		frames = append(id3Frame("CTOC", toc), frames...)
+
+		tag := make([]byte, 10, 10+len(frames))
+		copy(tag, "ID3\x04\x00\x00")
+		putSyncsafe(tag[6:10], len(frames))
+		buf.Write(append(tag, frames...))
+	default:
+		return fmt.Errorf("unknown chapters format %q", typ)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+//chapterType формат выгрузки глав из параметра type, по умолчанию json
+func chapterType(req *http.Request) (typ string, ok bool) {
+	if typ = strings.ToLower(req.Form.Get("type")); typ == "" {
+		typ = "json"
+	}
+	_, ok = chapterTypes[typ]
+	return typ, ok
+}
@@ -1,6 +1,81 @@
 package main
 
+import "time"
+
 var (
 	//  параметры соединения с базой данных
 	connStr = "host=localhost port=5432 dbname=backend user=eugeni sslmode=disable"
+
+	//	максимальный размер страницы списков (on_page)
+	maxPageSize = 100
+
+	//	периодичность удаления просроченных "расшариваний"
+	shareExpireInterval = time.Minute
+
+	//	каналы доставки уведомлений, пустое значение — канал отключен
+	//	SMTP-сервер (напр. локальный MailHog на :1025) и адрес отправителя
+	notifySMTPAddr = ""
+	notifyMailFrom = "audiofill@localhost"
+	//	URL, на который POST-запросом отправляются уведомления в json
+	notifyWebhookURL = ""
+
+	//	интервал пинга в потоке событий /events (держит соединение через прокси)
+	eventPing = 15 * time.Second
+
+	//	очередь доставки webhook'ов: интервал опроса, размер пачки, таймаут запроса,
+	//	количество попыток и начальная задержка повтора (удваивается с каждой попыткой)
+	webhookPoll        = 5 * time.Second
+	webhookBatch       = 20
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 8
+	webhookBackoff     = 30 * time.Second
+
+	//	доставка webhook'ов на адреса локальной сети (loopback, частные, link-local):
+	//	по умолчанию запрещена, чтобы через сервер нельзя было обратиться к
+	//	внутренним службам
+	webhookAllowPrivate = false
+
+	//	ключ подписи ссылок на файлы в выгруженных плейлистах (пустой — случайный
+	//	при каждом запуске) и срок действия таких ссылок
+	mediaTokenSecret = ""
+	mediaTokenTTL    = 30 * 24 * time.Hour
+
+	//	HLS: минимальная длительность сегмента и количество индексов сегментов
+	//	файлов, хранимых в памяти
+	hlsSegmentTime = 10 * time.Second
+	hlsCacheSize   = 256
+
+	//	перекодирование (format в /tracks/{track}/file): программа ffmpeg, битрейт
+	//	по умолчанию (кбит/с), одновременных перекодирований, сколько ждать
+	//	свободного слота и предельное время одного перекодирования
+	ffmpegPath       = "ffmpeg"
+	transcodeBitrate = 192
+	transcodeMax     = 2
+	transcodeWait    = 30 * time.Second
+	transcodeTimeout = 10 * time.Minute
+
+	//	фрагменты для прослушивания (/tracks/{track}/preview): длительность по
+	//	умолчанию и наибольшая
+	previewTime    = 30 * time.Second
+	previewMaxTime = 2 * time.Minute
+
+	//	наибольший размер загружаемой обложки трека, байт, и наибольшее число
+	//	пикселей обложки (загруженной или встроенной в файл трека)
+	artworkMaxSize   = 10 << 20
+	artworkMaxPixels = 16 << 20
+
+	//	сколько картинок трека (waveform, spectrogram с разными параметрами) хранится
+	//	в кэше, давно не запрошенные сверх этого удаляются
+	imagesPerTrack = 8
+
+	//	наибольший размер загружаемого текста трека (lyrics, расшифровка), байт
+	lyricsMaxSize = 1 << 20
+
+	//	наименьшее сходство акустических отпечатков (доля совпавших бит), при
+	//	котором треки считаются возможными дубликатами; у разных записей ~0.5
+	fingerprintMatch = 0.8
+
+	//	сколько загрузка трека ждет его акустический отпечаток, чтобы предупредить
+	//	о возможных дубликатах в ответе
+	duplicatesWait = 5 * time.Second
 )
@@ -13,13 +13,27 @@ package main
 //	Все остальные записи в БД фиктивные (можно проверять ошибку доступа к несуществ. файлу)
 
 var pgDump = `
+DROP TABLE IF EXISTS audit_log CASCADE;
+DROP TABLE IF EXISTS annotations CASCADE;
+DROP TABLE IF EXISTS user_audio CASCADE;
+DROP TABLE IF EXISTS audio_tags CASCADE;
+DROP TABLE IF EXISTS tags CASCADE;
+DROP TABLE IF EXISTS playlist_share CASCADE;
+DROP TABLE IF EXISTS playlist_tracks CASCADE;
+DROP TABLE IF EXISTS playlists CASCADE;
+DROP TABLE IF EXISTS webhook_deliveries CASCADE;
+DROP TABLE IF EXISTS webhooks CASCADE;
+DROP TABLE IF EXISTS notifications CASCADE;
 DROP TABLE IF EXISTS share CASCADE;
 DROP TABLE IF EXISTS audio CASCADE;
+DROP TABLE IF EXISTS folders CASCADE;
 DROP TABLE IF EXISTS sessions CASCADE;
 DROP TABLE IF EXISTS users CASCADE;
 DROP SEQUENCE IF EXISTS user_id_seq;
 DROP SEQUENCE IF EXISTS audio_id_seq;
 
+CREATE EXTENSION IF NOT EXISTS pg_trgm;	-- нечеткий поиск (Audiofill.Search)
+
 CREATE SEQUENCE user_id_seq;
 CREATE SEQUENCE audio_id_seq;
 
@@ -27,36 +41,190 @@ CREATE TABLE users (
     id_user integer DEFAULT nextval('user_id_seq'::regclass) NOT NULL PRIMARY KEY,
     login character varying(255) NOT NULL UNIQUE,
     name character varying(255) NOT NULL default '',
-    password character varying(48) NOT NULL
+    password character varying(48) NOT NULL,
+    email character varying(255) NOT NULL default '',
+    is_admin boolean NOT NULL default false,
+	searchable boolean NOT NULL default true	-- виден в списке и поиске пользователей
 );
+CREATE INDEX users_by_login ON users (lower(login) text_pattern_ops);	-- for search by login prefix
 
 CREATE TABLE sessions (
 	id_user integer not null UNIQUE REFERENCES users(id_user),
 	id_session varchar(32) not null
 );
 
+CREATE TABLE folders (
+	id_folder serial PRIMARY KEY,
+	id_owner integer not null REFERENCES users(id_user),
+	id_parent integer null REFERENCES folders(id_folder) ON DELETE CASCADE,	-- null — в корне
+	name varchar not null CHECK (name <> '')
+);
+CREATE UNIQUE INDEX folders_owner_name ON folders (id_owner, coalesce(id_parent, 0), lower(name));
+CREATE INDEX ON folders (id_parent);
+
 CREATE TABLE audio (
     id_audio integer DEFAULT nextval('audio_id_seq'::regclass) NOT NULL PRIMARY KEY,
     description character varying DEFAULT '' NOT NULL,
     duration interval(0) DEFAULT '00:00:00'::interval NOT NULL,
 	id_owner integer NOT NULL REFERENCES users(id_user),
-	filename varchar not null default ''
+	filename varchar not null default '',
+	format varchar(16) not null default '',	-- расширение загруженного файла: mp3, ogg…
+	created timestamptz not null default now(),
+	meta jsonb not null default '{}',	-- теги файла: title, artist, album, genre, year, comment
+	-- полнотекстовый индекс: конфигурация russian стеммит и английские слова
+	-- (english_stem для латиницы), simple — имена исполнителей/альбомов как есть
+	search tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('russian', description), 'A') ||
+		setweight(to_tsvector('russian', coalesce(meta->>'title','') || ' ' ||
+			coalesce(meta->>'artist','') || ' ' || coalesce(meta->>'album','')), 'B') ||
+		setweight(to_tsvector('simple', coalesce(meta->>'artist','') || ' ' ||
+			coalesce(meta->>'album','')), 'B') ||
+		setweight(to_tsvector('russian', coalesce(meta->>'genre','') || ' ' ||
+			coalesce(meta->>'comment','')), 'C')
+	) STORED,
+	id_folder integer null REFERENCES folders(id_folder) ON DELETE SET NULL,	-- папка владельца
+	-- громкость BS.1770 (см. loudness.go), NULL — файл еще не проанализирован
+	loudness numeric(6,2) null,	-- интегральная, LUFS
+	true_peak numeric(6,2) null,	-- dBTP
+	loudness_range numeric(6,2) null,	-- LRA, LU
+	replaygain_gain numeric(6,2) null,	-- ReplayGain 2.0, дБ
+	replaygain_peak numeric(9,6) null,	-- true-peak, линейный
+	artwork varchar not null default '',	-- загруженная обложка в media/artwork, '' — встроенная в файл
+	lyrics jsonb null,	-- текст песни или расшифровка (tLyrics в lyrics.go), null — нет
+	fingerprint bytea null	-- акустический отпечаток (fingerprint.go), null — еще не посчитан
 );
 CREATE INDEX audio_by_name ON audio (description);	-- for fast ORDER BY name|user
+CREATE INDEX audio_search ON audio USING gin (search);	-- for full-text search
+CREATE INDEX audio_name_trgm ON audio USING gin (description gin_trgm_ops);	-- for fuzzy search
 CREATE INDEX audio_by_owner ON audio (id_owner);
+CREATE INDEX audio_by_created ON audio (created);	-- for ORDER BY/filter uploaded
+CREATE INDEX audio_by_folder ON audio (id_folder);	-- for filter by folder
 
 CREATE TABLE share (
 	id_audio integer not null REFERENCES audio(id_audio),
-	id_user  integer not null REFERENCES users(id_user)
+	id_user  integer not null REFERENCES users(id_user),
+	expires_at timestamptz null,	-- null — бессрочный доступ
+	UNIQUE (id_audio, id_user)
 );
 CREATE INDEX ON share (id_audio);	-- for JOIN audio ON (id_audio)
 CREATE INDEX ON share (id_user);	-- for search shared tracks by id_user
+CREATE INDEX ON share (expires_at) WHERE expires_at IS NOT NULL;	-- for expired grants cleanup
+
+CREATE TABLE tags (
+	id_tag serial PRIMARY KEY,
+	id_owner integer not null REFERENCES users(id_user),
+	name varchar not null CHECK (name <> '')
+);
+CREATE UNIQUE INDEX tags_owner_name ON tags (id_owner, lower(name));
+
+CREATE TABLE audio_tags (
+	id_audio integer not null REFERENCES audio(id_audio) ON DELETE CASCADE,
+	id_tag integer not null REFERENCES tags(id_tag) ON DELETE CASCADE,
+	UNIQUE (id_audio, id_tag)
+);
+CREATE INDEX ON audio_tags (id_tag);
+
+CREATE TABLE user_audio (	-- отметки пользователя на доступных ему треках
+	id_user integer not null REFERENCES users(id_user),
+	id_audio integer not null REFERENCES audio(id_audio) ON DELETE CASCADE,
+	favorite boolean not null default false,
+	rating smallint null CHECK (rating BETWEEN 1 AND 5),
+	plays integer not null default 0,	-- прослушивания: выдача файла с начала (Audiofill.Get)
+	played_at timestamptz null,
+	PRIMARY KEY (id_user, id_audio)
+);
+CREATE INDEX ON user_audio (id_audio);
+
+CREATE TABLE annotations (	-- комментарии, маркеры и главы с привязкой ко времени трека
+	id_annotation serial PRIMARY KEY,
+	id_audio integer not null REFERENCES audio(id_audio) ON DELETE CASCADE,
+	id_user integer not null REFERENCES users(id_user),	-- автор
+	kind varchar(16) not null CHECK (kind IN ('comment', 'marker', 'chapter')),
+	start_ms integer not null CHECK (start_ms >= 0),
+	end_ms integer null CHECK (end_ms > start_ms),	-- null — отметка без протяженности
+	title varchar not null default '',	-- маркер и глава
+	text varchar not null default '',	-- комментарий
+	created timestamptz not null default now(),
+	updated timestamptz null
+);
+CREATE INDEX ON annotations (id_audio, start_ms);
+
+CREATE TABLE playlists (
+	id_playlist serial PRIMARY KEY,
+	id_owner integer not null REFERENCES users(id_user),
+	name varchar not null CHECK (name <> ''),
+	created timestamptz not null default now()
+);
+CREATE INDEX ON playlists (id_owner);
+
+CREATE TABLE playlist_tracks (
+	id_playlist integer not null REFERENCES playlists(id_playlist) ON DELETE CASCADE,
+	id_audio integer not null REFERENCES audio(id_audio) ON DELETE CASCADE,
+	position integer not null,	-- 1…n без пропусков, при перестановке сдвигаются соседи
+	UNIQUE (id_playlist, id_audio),
+	UNIQUE (id_playlist, position) DEFERRABLE INITIALLY DEFERRED
+);
+CREATE INDEX ON playlist_tracks (id_audio);	-- for access check in sqlAvailable
+
+CREATE TABLE playlist_share (
+	id_playlist integer not null REFERENCES playlists(id_playlist) ON DELETE CASCADE,
+	id_user integer not null REFERENCES users(id_user),
+	UNIQUE (id_playlist, id_user)
+);
+CREATE INDEX ON playlist_share (id_user);
+
+CREATE TABLE notifications (
+	id_notify serial PRIMARY KEY,
+	id_user integer not null REFERENCES users(id_user),	-- получатель
+	kind varchar(16) not null,	-- share|lock|version
+	id_audio integer null REFERENCES audio(id_audio) ON DELETE CASCADE,
+	id_from integer null REFERENCES users(id_user),	-- инициатор события
+	created timestamptz not null default now(),
+	read_at timestamptz null	-- null — не прочитано
+);
+CREATE INDEX ON notifications (id_user, created);
+CREATE INDEX ON notifications (id_user) WHERE read_at IS NULL;	-- for unread count
+
+CREATE TABLE webhooks (
+	id_hook serial PRIMARY KEY,
+	id_user integer not null REFERENCES users(id_user),
+	url varchar not null,
+	secret varchar(128) not null,	-- ключ подписи HMAC-SHA256
+	events varchar(32)[] not null default '{}',	-- пустой — все события
+	global boolean not null default false,	-- события всех пользователей (только админ)
+	created timestamptz not null default now()
+);
+CREATE INDEX ON webhooks (id_user);
+
+CREATE TABLE webhook_deliveries (
+	id_delivery serial PRIMARY KEY,
+	id_hook integer not null REFERENCES webhooks(id_hook) ON DELETE CASCADE,
+	event varchar(32) not null,
+	payload jsonb not null,
+	status varchar(16) not null default 'pending',	-- pending|delivered|failed
+	attempts integer not null default 0,
+	next_try timestamptz not null default now(),
+	response_code integer null,
+	last_error varchar not null default '',
+	created timestamptz not null default now(),
+	delivered timestamptz null
+);
+CREATE INDEX ON webhook_deliveries (id_hook);
+CREATE INDEX ON webhook_deliveries (next_try) WHERE status = 'pending';	-- for queue polling
+
+CREATE TABLE audit_log (
+	id_log serial PRIMARY KEY,
+	created timestamptz not null default now(),
+	id_user integer null REFERENCES users(id_user),	-- null — системное событие
+	action varchar(64) not null,
+	details jsonb not null default '{}'
+);
 
 INSERT INTO users
-VALUES  (default, 'admin', '', 'ea847988ba59727dbf4e34ee75726dc3'),
-		(default, 'user', 'Lorem Ipsum', '5ebe2294ecd0e0f08eab7690d2a6ee69'),
-		(default, 'guest', 'Uninvited T', 'a32c3d3cec20f5a09595b857e45b477f'),
-		(default, 'ghost', 'Dutchman Flying', 'e10adc3949ba59abbe56e057f20f883e');
+VALUES  (default, 'admin', '', 'ea847988ba59727dbf4e34ee75726dc3', 'admin@localhost', true),
+		(default, 'user', 'Lorem Ipsum', '5ebe2294ecd0e0f08eab7690d2a6ee69', default, default),
+		(default, 'guest', 'Uninvited T', 'a32c3d3cec20f5a09595b857e45b477f', default, default),
+		(default, 'ghost', 'Dutchman Flying', 'e10adc3949ba59abbe56e057f20f883e', default, default);
 
 INSERT INTO sessions
 VALUES  (1, '3d73274ac8b18ab09528075c7fee1213'),
@@ -64,10 +232,29 @@ VALUES  (1, '3d73274ac8b18ab09528075c7fee1213'),
 		(3, '0414d6d5d923b0f4998556df2fe2e351');
 
 INSERT INTO audio 
-VALUES  (default, 'test music', '00:04:00', 1, 'sample.ogg'),
-		(default, 'best music', '00:14:00', 1, 'rock.ogg'),
-		(default, 'bad music', '00:01:00', 2, 'pop.ogg'),
-		(default, 'private music', '00:10:00', 2, 'never_to_share.ogr');
+VALUES  (default, 'test music', '00:04:00', 1, 'sample.ogg', 'ogg', '2019-07-01 10:00', default),
+		(default, 'best music', '00:14:00', 1, 'rock.ogg', 'ogg', '2019-07-02 10:00', default),
+		(default, 'bad music', '00:01:00', 2, 'pop.ogg', 'ogg', '2019-07-03 10:00',
+			'{"title": "Группа крови", "artist": "Кино", "genre": "рок"}'),
+		(default, 'private music', '00:10:00', 2, 'never_to_share.ogr', 'ogr', '2019-07-04 10:00', default);
 
 INSERT INTO share VALUES (1,2),(1,3),(2,2),(3,1),(3,3);
+
+INSERT INTO tags
+VALUES  (default, 1, 'rock'),
+		(default, 1, 'chill'),
+		(default, 2, 'favorite');
+
+INSERT INTO folders
+VALUES  (default, 1, null, 'Albums'),
+		(default, 1, 1, 'Rock'),
+		(default, 2, null, 'Inbox');
+
+INSERT INTO playlists
+VALUES  (default, 1, 'admin mix', '2019-07-05 10:00'),
+		(default, 2, 'user mix', '2019-07-06 10:00');
+
+INSERT INTO playlist_tracks VALUES (1,2,1),(1,1,2),(1,3,3),(2,3,1);
+
+INSERT INTO playlist_share VALUES (1,2);
 `
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//коды ошибок API — стабильные, клиенты могут на них полагаться
+const (
+	errBadRequest   = "bad_request"        //	неразбираемый запрос
+	errValidation   = "validation_failed"  //	неверные или отсутствующие параметры, подробности в fields
+	errUnauthorized = "unauthorized"       //	нет сессии
+	errForbidden    = "forbidden"          //	нет прав на ресурс
+	errNotFound     = "not_found"          //	ресурс не найден или пустой список
+	errMethod       = "method_not_allowed" //	метод не поддерживается ресурсом
+	errConflict     = "conflict"           //	нарушение уникальности
+	errInternal     = "internal_error"     //	прочие ошибки сервера
+)
+
+//errorCodes код ошибки по умолчанию для статуса ответа
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          errBadRequest,
+	http.StatusUnauthorized:        errUnauthorized,
+	http.StatusForbidden:           errForbidden,
+	http.StatusNotFound:            errNotFound,
+	http.StatusMethodNotAllowed:    errMethod,
+	http.StatusConflict:            errConflict,
+	http.StatusInternalServerError: errInternal,
+}
+
+//tAPIError ошибка в ответе клиенту: {"error": {...}}
+type tAPIError struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+//tFieldError ошибка значения параметра запроса. Reason — required, invalid,
+//	not_exists, already_used
+type tFieldError struct {
+	Field  string
+	Reason string
+}
+
+func (fe *tFieldError) Error() string {
+	switch fe.Reason {
+	case "required":
+		return fe.Field + " required"
+	case "invalid":
+		return "invalid " + fe.Field + " value"
+	}
+	return fe.Field + " " + strings.Replace(fe.Reason, "_", " ", -1)
+}
+
+//writeError отправка ошибки клиенту. Идентификатор запроса берется из заголовка
+//	ответа X-Request-ID, который выставляет Router
+func writeError(resp http.ResponseWriter, status int, apiErr *tAPIError) {
+	apiErr.RequestID = resp.Header().Get(requestIDHeader)
+	jsRes, _ := json.Marshal(struct {
+		Error *tAPIError `json:"error"`
+	}{apiErr})
+
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(status)
+	resp.Write(jsRes)
+}
+
+//apiError ошибка со статусом status и кодом по умолчанию для него
+func apiError(resp http.ResponseWriter, status int, msg string) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = errInternal
+	}
+	writeError(resp, status, &tAPIError{Code: code, Message: msg})
+}
+
+//fieldError ошибка параметра field: статус BadRequest, код validation_failed
+func fieldError(resp http.ResponseWriter, field, reason string) {
+	fe := &tFieldError{Field: field, Reason: reason}
+	writeError(resp, http.StatusBadRequest, &tAPIError{
+		Code:    errValidation,
+		Message: fe.Error(),
+		Fields:  map[string]string{field: reason},
+	})
+}
+
+//paramError ошибка разбора параметров: tFieldError — как fieldError, прочие —
+//	BadRequest с текстом ошибки
+func paramError(resp http.ResponseWriter, err error) {
+	if fe, ok := err.(*tFieldError); ok {
+		fieldError(resp, fe.Field, fe.Reason)
+		return
+	}
+	apiError(resp, http.StatusBadRequest, err.Error())
+}
+
+//pgFields имена параметров API для колонок БД — в ошибках клиент видит
+//	параметры, а не колонки
+var pgFields = map[string]string{
+	"id_user":     "user",
+	"id_audio":    "track",
+	"id_owner":    "owner",
+	"id_hook":     "id",
+	"id_playlist": "playlist",
+	"id_tag":      "tag",
+	"id_folder":   "folder",
+	"id_parent":   "parent",
+}
+
+//pgConstraints параметры API для уникальных индексов по выражениям — колонку
+//	из Detail таких ошибок не выделить
+var pgConstraints = map[string]string{
+	"tags_owner_name":    "name",
+	"folders_owner_name": "name",
+}
+
+//pgKeyRe колонка из pq.Error.Detail: Key (login)=(admin) already exists.
+var pgKeyRe = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+
+//pgField параметр API, к которому относится ошибка Postgres
+func pgField(pgErr *pq.Error) string {
+	if name, ok := pgConstraints[pgErr.Constraint]; ok {
+		return name
+	}
+	field := pgErr.Column
+	if m := pgKeyRe.FindStringSubmatch(pgErr.Detail); m != nil {
+		field = m[1]
+	}
+	if name, ok := pgFields[field]; ok {
+		return name
+	}
+	return field
+}
+
+//dbError ответ на ошибку запроса к БД. Коды Postgres сводятся к ошибкам API
+//	в одном месте: 23505 — Conflict, 23503 — несуществующая ссылка, 23502, 23514
+//	и ошибки преобразования данных — ошибка параметра, sql.ErrNoRows — NotFound.
+//	Детали ошибки Postgres клиенту не отдаются, только в лог с префиксом where
+func dbError(resp http.ResponseWriter, err error, where string) {
+	if err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "not found")
+		return
+	}
+	pgErr, ok := err.(*pq.Error)
+	if !ok {
+		internalError(resp, err, where)
+		return
+	}
+
+	log.Println(where, pgErr.Code, pgErr.Message, pgErr.Detail)
+	field := pgField(pgErr)
+	switch pgErr.Code {
+	case "23505": // unique_violation
+		fe := &tFieldError{Field: field, Reason: "already_used"}
+		writeError(resp, http.StatusConflict, &tAPIError{Code: errConflict, Message: fe.Error(),
+			Fields: map[string]string{field: fe.Reason}})
+	case "23503": // foreign_key_violation
+		fieldError(resp, field, "not_exists")
+	case "23502": // not_null_violation
+		fieldError(resp, field, "required")
+	case "23514", "22P02", "22003", "22007", "22008": // check_violation, неверный формат или диапазон
+		if field == "" {
+			apiError(resp, http.StatusBadRequest, "invalid parameter value")
+		} else {
+			fieldError(resp, field, "invalid")
+		}
+	default:
+		apiError(resp, http.StatusInternalServerError, "internal error")
+	}
+}
+
+//internalError ошибка сервера: клиенту — internal error, в лог — подробности
+func internalError(resp http.ResponseWriter, err error, where string) {
+	log.Println(where, err.Error())
+	apiError(resp, http.StatusInternalServerError, "internal error")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//виды событий библиотеки
+const (
+	eventTrackAdded   = "track.added"
+	eventTrackUpdated = "track.updated"
+	eventTrackDeleted = "track.deleted"
+	eventShareGranted = "share.granted"
+	eventShareRevoked = "share.revoked"
+)
+
+//eventChannel канал postgres LISTEN/NOTIFY для рассылки событий между экземплярами сервера
+const eventChannel = "audiofill_events"
+
+type tEvent struct {
+	Kind     string    `json:"type"`
+	AudioID  int       `json:"audio"`
+	UserID   int       `json:"user,omitempty"`   //	инициатор
+	TargetID int       `json:"target,omitempty"` //	пользователь, которому открыт/закрыт доступ
+	Time     time.Time `json:"time"`
+
+	Recipients []int `json:"recipients,omitempty"` //	кому доставлять, клиентам не отправляется
+}
+
+//eventBus внутрипроцессная шина событий. Подписчики — открытые SSE-соединения
+//	пользователей. Если запущен Listen, события публикуются через postgres NOTIFY
+//	и доставляются всеми экземплярами сервера (в т.ч. отправившим) из LISTEN,
+//	иначе — сразу локальным подписчикам
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[int]map[chan *tEvent]struct{}
+	db   *sql.DB //	не nil — события идут через NOTIFY
+	lsn  *pq.Listener
+}
+
+//events шина событий сервера
+var events = newEventBus()
+
+//newEventBus создание новой шины событий
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[int]map[chan *tEvent]struct{}),
+	}
+}
+
+//Subscribe подписка на события пользователя userID
+func (b *eventBus) Subscribe(userID int) chan *tEvent {
+	ch := make(chan *tEvent, 16)
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan *tEvent]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+//Unsubscribe отписка от событий, канал ch больше не используется
+func (b *eventBus) Unsubscribe(userID int, ch chan *tEvent) {
+	b.mu.Lock()
+	delete(b.subs[userID], ch)
+	if len(b.subs[userID]) == 0 {
+		delete(b.subs, userID)
+	}
+	b.mu.Unlock()
+}
+
+//Publish публикация события
+func (b *eventBus) Publish(ev *tEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.RLock()
+	db := b.db
+	b.mu.RUnlock()
+	if db == nil {
+		b.dispatch(ev)
+		return
+	}
+
+	js, err := json.Marshal(ev)
+	if err == nil {
+		_, err = db.Exec(`SELECT pg_notify($1, $2)`, eventChannel, string(js))
+	}
+	if err != nil {
+		//	NOTIFY не прошел — хотя бы локальные подписчики получат событие
+		log.Println("Events.Publish notify failed:", err.Error())
+		b.dispatch(ev)
+	}
+}
+
+//dispatch доставка события локальным подписчикам-получателям. Медленные
+//	подписчики (переполнен буфер канала) событие пропускают
+func (b *eventBus) dispatch(ev *tEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, uid := range ev.Recipients {
+		for ch := range b.subs[uid] {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+//Listen запуск приема событий через postgres LISTEN. После успешного запуска
+//	Publish отправляет события через NOTIFY
+func (b *eventBus) Listen(db *sql.DB, conn string) error {
+	onError := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Events.Listen:", err.Error())
+		}
+	}
+	lsn := pq.NewListener(conn, 10*time.Second, time.Minute, onError)
+	if err := lsn.Listen(eventChannel); err != nil {
+		lsn.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.db, b.lsn = db, lsn
+	b.mu.Unlock()
+
+	go func() {
+		for n := range lsn.Notify {
+			if n == nil { //	переподключение, часть событий могла потеряться
+				continue
+			}
+			ev := &tEvent{}
+			if err := json.Unmarshal([]byte(n.Extra), ev); err != nil {
+				log.Println("Events.Listen bad payload:", err.Error())
+				continue
+			}
+			b.dispatch(ev)
+		}
+	}()
+	return nil
+}
+
+//Close остановка приема событий через LISTEN, дальше события только локальные
+func (b *eventBus) Close() error {
+	b.mu.Lock()
+	lsn := b.lsn
+	b.db, b.lsn = nil, nil
+	b.mu.Unlock()
+	if lsn == nil {
+		return nil
+	}
+	return lsn.Close()
+}
+
+//newTrackEvent событие по треку audioID. Получатели — владелец и пользователи
+//	с действующим доступом, а также target (для share.revoked его доступа уже нет).
+//	Для track.deleted вызывать до удаления
+func newTrackEvent(db *sql.DB, kind string, audioID, userID, target int) (ev *tEvent, err error) {
+	var (
+		qs  *sql.Rows
+		uid int
+	)
+
+	ev = &tEvent{Kind: kind, AudioID: audioID, UserID: userID, TargetID: target}
+	qs, err = db.Query(`SELECT id_owner FROM audio WHERE id_audio = $1
+		UNION
+		SELECT id_user FROM share s WHERE s.id_audio = $1 AND `+sqlShareActive, audioID)
+	if err != nil {
+		return nil, err
+	}
+	defer qs.Close()
+	for qs.Next() {
+		if err = qs.Scan(&uid); err != nil {
+			return nil, err
+		}
+		if uid != target {
+			ev.Recipients = append(ev.Recipients, uid)
+		}
+	}
+	if target > 0 {
+		ev.Recipients = append(ev.Recipients, target)
+	}
+	return ev, qs.Err()
+}
+
+//publishEvent публикация события: очередь webhook'ов и шина событий. Webhook'и
+//	ставятся в очередь один раз, экземпляром-источником события
+func publishEvent(db *sql.DB, ev *tEvent) {
+	enqueueWebhooks(db, ev)
+	events.Publish(ev)
+}
+
+//publishTrackEvent формирование и публикация события по треку audioID
+func publishTrackEvent(db *sql.DB, kind string, audioID, userID, target int) {
+	ev, err := newTrackEvent(db, kind, audioID, userID, target)
+	if err != nil {
+		log.Println("Events.publishTrackEvent query failed:", err.Error())
+		return
+	}
+	publishEvent(db, ev)
+}
+
+//Events класс потока событий для клиентов (Server-Sent Events)
+type Events struct {
+	DB *sql.DB
+}
+
+//NewEvents создание нового экземпляра класса Events
+func NewEvents(db *sql.DB) *Events {
+	return &Events{
+		DB: db,
+	}
+}
+
+//Stream поток событий для пользователя. Метод GET, доступен только авторизованным
+//	пользователям. Соединение держится открытым, события отправляются по мере
+//	появления: добавление, изменение, удаление трека, открытие и закрытие доступа.
+//	Раз в eventPing отправляется комментарий-пинг
+//Результат: поток text/event-stream, "event: <тип>", "data: <json tEvent>"
+//Ошибка: статус Unauthorized если пользователь не авторизован
+func (evs *Events) Stream(resp http.ResponseWriter, req *http.Request) {
+	//	соединение долгое — userID держим локально, а не в общей структуре
+	userID, err := checkSession(evs.DB, req)
+	if err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		apiError(resp, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	ch := events.Subscribe(userID)
+	defer events.Unsubscribe(userID, ch)
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	fmt.Fprint(resp, ": connected\n\n")
+	flusher.Flush()
+
+	ping := time.NewTicker(eventPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(resp, ": ping\n\n")
+		case ev := <-ch:
+			out := *ev
+			out.Recipients = nil
+			js, _ := json.Marshal(out)
+			fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", ev.Kind, js)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsStream(t *testing.T) {
+	var (
+		err  error
+		req  *http.Request
+		resp *http.Response
+	)
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookGuest := &http.Cookie{Name: "session_id", Value: "0414d6d5d923b0f4998556df2fe2e351"}
+
+	//	неавторизованный доступ
+	resp, err = client.Get(testSrv.URL + "/events")
+	if err != nil {
+		t.Fatalf("Events.Stream: query failed %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Events.Stream: wrong status %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ = http.NewRequest(http.MethodGet, testSrv.URL+"/events", nil)
+	req = req.WithContext(ctx)
+	req.AddCookie(cookGuest)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatalf("Events.Stream: query failed %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Events.Stream: wrong content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	//	читаем поток до первого события
+	got := make(chan [2]string, 4)
+	go func() {
+		var kind string
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				kind = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				got <- [2]string{kind, strings.TrimPrefix(line, "data: ")}
+			}
+		}
+		close(got)
+	}()
+
+	//	подписка оформлена до отправки заголовков ответа — события не потеряются
+	for _, path := range []string{"/audio/share", "/audio/lock"} {
+		req, _ = http.NewRequest(http.MethodPost, testSrv.URL+path, strings.NewReader("track=2&user=3"))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookAdmin)
+		if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Events.Stream: %s failed %v", path, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+
+	for _, kind := range []string{eventShareGranted, eventShareRevoked} {
+		ev, ok := <-got
+		if !ok {
+			t.Fatalf("Events.Stream: stream closed, expected %s", kind)
+		}
+		res := tEvent{}
+		if err = json.Unmarshal([]byte(ev[1]), &res); err != nil {
+			t.Fatalf("Events.Stream: unmarshaling event error [%s]", err.Error())
+		}
+		if ev[0] != kind || res.Kind != kind || res.AudioID != 2 || res.UserID != 1 ||
+			res.TargetID != 3 || res.Recipients != nil {
+			t.Errorf("Events.Stream: wrong event %s %s, expected %s", ev[0], ev[1], kind)
+		}
+	}
+}
+
+func TestEventsNotify(t *testing.T) {
+	//	два экземпляра сервера: событие, опубликованное одним, через NOTIFY
+	//	получают подписчики обоих
+	pub, sub := newEventBus(), newEventBus()
+	for _, b := range []*eventBus{pub, sub} {
+		if err := b.Listen(testDB, connStr); err != nil {
+			t.Fatalf("Events.Listen: failed %s", err.Error())
+		}
+		defer b.Close()
+	}
+	chPub, chSub, chOther := pub.Subscribe(2), sub.Subscribe(2), sub.Subscribe(3)
+
+	pub.Publish(&tEvent{Kind: eventTrackUpdated, AudioID: 1, UserID: 1, Recipients: []int{2}})
+	for name, ch := range map[string]chan *tEvent{"publisher": chPub, "listener": chSub} {
+		select {
+		case ev := <-ch:
+			if ev.Kind != eventTrackUpdated || ev.AudioID != 1 || ev.UserID != 1 || ev.Time.IsZero() {
+				t.Errorf("Events.Listen: %s wrong event %+v", name, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Events.Listen: %s event not received", name)
+		}
+	}
+	select {
+	case ev := <-chOther:
+		t.Errorf("Events.Listen: event for other user %+v", ev)
+	default:
+	}
+}
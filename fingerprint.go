@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+//Акустический отпечаток трека в духе Chromaprint: поток сводится в моно 11025 Гц,
+//	окна БПФ по 4096 сэмплов с перекрытием 2/3, энергия спектра 28 Гц..3520 Гц
+//	собирается в 12 классов высоты (хрома), хрома нормируется и сглаживается по
+//	времени. Код окна — 30 бит сравнений классов между собой: он почти не меняется
+//	при перекодировании с другим битрейтом и в другой формат, в отличие от хеша файла
+
+const (
+	fpRate      = 11025  //	частота дискретизации анализа, Гц
+	fpFrame     = 4096   //	окно БПФ, сэмплов
+	fpHop       = 1365   //	шаг окон — треть окна, ~8 кодов в секунду
+	fpMinFreq   = 28.0   //	диапазон частот хромы, Гц
+	fpMaxFreq   = 3520.0 //
+	fpSmooth    = 3      //	окон в сглаживании хромы
+	fpBits      = 30     //	значащих бит кода окна
+	fpMaxTime   = 120    //	анализируется начало трека, секунд
+	fpSilence   = 1e-3   //	окно тише (RMS) — тишина, его код 0
+	fpMinFrames = 40     //	наименьшая длина сравнимого отпечатка (~5 с звука)
+	fpMaxOffset = 8      //	наибольший сдвиг при сравнении, окон (~1 с)
+	fpMinRatio  = 0.8    //	отпечатки разной длины (короче 80% другого) не сравниваются
+)
+
+//tDuplicate трек, акустически совпадающий с данным
+type tDuplicate struct {
+	AudioID    int     `json:"id"`
+	Descr      string  `json:"name"`
+	IsOwn      bool    `json:"is_owner"`
+	OwnerID    int     `json:"owner_id"`
+	OwnerName  string  `json:"owner_name"`
+	Similarity float64 `json:"similarity"` //	доля совпавших бит отпечатков, 0..1
+}
+
+type tDuplicateList struct {
+	Count int           `json:"total_count"`
+	List  []*tDuplicate `json:"records"`
+}
+
+//fingerprintChroma класс высоты (0 — ля) для каждого бина БПФ, -1 — вне диапазона
+func fingerprintChroma() []int {
+	res := make([]int, fpFrame/2)
+	for b := range res {
+		res[b] = -1
+		if f := float64(b) * fpRate / fpFrame; f >= fpMinFreq && f <= fpMaxFreq {
+			res[b] = int(math.Round(12*math.Log2(f/27.5))) % 12
+		}
+	}
+	return res
+}
+
+//fingerprintCode код окна по хроме: классы сравниваются с соседним, с большой
+//	терцией выше и (первые шесть) с тритоном
+func fingerprintCode(c *[12]float64) (code uint32) {
+	for b := 0; b < 12; b++ {
+		if c[b] > c[(b+1)%12] {
+			code |= 1 << b
+		}
+		if c[b] > c[(b+4)%12] {
+			code |= 1 << (12 + b)
+		}
+		if b < 6 && c[b] > c[b+6] {
+			code |= 1 << (24 + b)
+		}
+	}
+	return code
+}
+
+//computeFingerprint отпечаток начала потока pcm (до fpMaxTime секунд)
+//Результат: коды окон; пустой, если звука меньше fpMinFrames окон — такой
+//	отпечаток ни с чем не совпадает
+func computeFingerprint(pcm *tPCM) (fp []uint32, err error) {
+	var (
+		chroma  = fingerprintChroma()
+		window  = make([]float64, fpFrame)
+		bins    = make([]complex128, fpFrame)
+		frame   = make([]float64, 0, fpFrame)
+		history [][12]float64
+		sounds  int
+	)
+
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fpFrame-1))
+	}
+	maxFrames := fpMaxTime * fpRate / fpHop
+
+	analyze := func() {
+		var (
+			c      [12]float64
+			energy float64
+		)
+		for i, v := range frame {
+			energy += v * v
+			bins[i] = complex(v*window[i], 0)
+		}
+		if math.Sqrt(energy/fpFrame) >= fpSilence {
+			sounds++
+			fft(bins)
+			for b, cl := range chroma {
+				if cl >= 0 {
+					m := cmplx.Abs(bins[b])
+					c[cl] += m * m
+				}
+			}
+			norm := 0.0
+			for _, v := range c {
+				norm += v * v
+			}
+			if norm = math.Sqrt(norm); norm > 0 {
+				for i := range c {
+					c[i] /= norm
+				}
+			}
+		}
+		if history = append(history, c); len(history) > fpSmooth {
+			history = history[1:]
+		}
+		var avg [12]float64
+		for _, h := range history {
+			for i := range avg {
+				avg[i] += h[i] / float64(len(history))
+			}
+		}
+		fp = append(fp, fingerprintCode(&avg))
+		frame = append(frame[:0], frame[fpHop:]...)
+	}
+
+	//	передискретизация усреднением сэмплов, попавших в интервал выходного
+	//	сэмпла, — заодно грубый фильтр от наложения частот
+	var (
+		buf   = make([]float64, 4096*pcm.Channels)
+		ratio = float64(pcm.Rate) / fpRate
+		sum   float64
+		last  float64
+		cnt   int
+		in    int
+		out   int
+	)
+	for err == nil && len(fp) < maxFrames {
+		var n int
+		n, err = pcm.Read(buf)
+		for i := 0; i+pcm.Channels <= n && len(fp) < maxFrames; i += pcm.Channels {
+			v := 0.0
+			for _, s := range buf[i : i+pcm.Channels] {
+				v += s
+			}
+			sum += v / float64(pcm.Channels)
+			cnt++
+			in++
+			for float64(in) >= float64(out+1)*ratio && len(fp) < maxFrames {
+				//	при повышении частоты выходных сэмплов больше входных — повтор
+				if cnt > 0 {
+					last, sum, cnt = sum/float64(cnt), 0, 0
+				}
+				frame = append(frame, last)
+				out++
+				if len(frame) == fpFrame {
+					analyze()
+				}
+			}
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if sounds < fpMinFrames {
+		return []uint32{}, nil
+	}
+	return fp, nil
+}
+
+//fingerprintSimilarity сходство отпечатков: доля совпавших бит при лучшем сдвиге
+//	до fpMaxOffset окон. 0 — отпечатки не сравнимы (короткие, разной длины)
+func fingerprintSimilarity(a, b []uint32) float64 {
+	short, long := len(a), len(b)
+	if short > long {
+		short, long = long, short
+	}
+	if short < fpMinFrames || float64(short) < fpMinRatio*float64(long) {
+		return 0
+	}
+
+	best := 0.0
+	for off := -fpMaxOffset; off <= fpMaxOffset; off++ {
+		diff, n := 0, 0
+		for i := range a {
+			if j := i + off; j >= 0 && j < len(b) {
+				diff += bits.OnesCount32(a[i] ^ b[j])
+				n++
+			}
+		}
+		if n < fpMinFrames {
+			continue
+		}
+		if sim := 1 - float64(diff)/float64(fpBits*n); sim > best {
+			best = sim
+		}
+	}
+	return best
+}
+
+//fingerprintBytes отпечаток для хранения в audio.fingerprint: коды little-endian
+func fingerprintBytes(fp []uint32) []byte {
+	res := make([]byte, 4*len(fp))
+	for i, code := range fp {
+		binary.LittleEndian.PutUint32(res[4*i:], code)
+	}
+	return res
+}
+
+//parseFingerprint отпечаток из audio.fingerprint
+func parseFingerprint(data []byte) []uint32 {
+	res := make([]uint32, len(data)/4)
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return res
+}
+
+//fileFingerprint отпечаток файла трека в mediaDir. Форматы, кроме WAV и MP3,
+//	читаются через копию в wav (см. openPCM) — она же нужна для остального
+//	анализа загрузки
+func fileFingerprint(ctx context.Context, fileName string) ([]uint32, error) {
+	pcm, fd, err := openPCM(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return computeFingerprint(pcm)
+}
+
+//findDuplicates треки, доступные пользователю userID, с отпечатком, похожим на
+//	fp не меньше чем на fingerprintMatch, кроме самого трека tr. Отпечатки
+//	сравниваются перебором: запрос отсеивает только недоступные треки и отпечатки
+//	несравнимой длины. Рассчитано на библиотеку пользователя до ~10 тыс. треков:
+//	отпечаток до ~4 КБ (fpMaxTime), сравнение — ~35 мкс, всего ~40 МБ чтения и
+//	меньше половины секунды. Для больших библиотек нужен индекс по фрагментам кодов
+//Результат: список по убыванию сходства
+func findDuplicates(db *sql.DB, userID, tr int, fp []uint32) (list []*tDuplicate, err error) {
+	if len(fp) < fpMinFrames {
+		return nil, nil
+	}
+	//	длина в байтах — отсев заведомо несравнимых отпечатков до чтения
+	qs, err := db.Query(`SELECT a.id_audio, a.description, a.id_owner = $1, a.id_owner, `+sqlUserName("own")+`, a.fingerprint
+		FROM audio a
+		INNER JOIN users own ON (own.id_user = a.id_owner)
+		WHERE a.id_audio <> $2 AND length(a.fingerprint) BETWEEN $3 AND $4 AND `+sqlAvailable,
+		userID, tr, int(math.Ceil(fpMinRatio*float64(len(fp))))*4, int(float64(len(fp))/fpMinRatio)*4)
+	if err != nil {
+		return nil, err
+	}
+	defer qs.Close()
+
+	for qs.Next() {
+		var data []byte
+		dp := &tDuplicate{}
+		if err = qs.Scan(&dp.AudioID, &dp.Descr, &dp.IsOwn, &dp.OwnerID, &dp.OwnerName, &data); err != nil {
+			return nil, err
+		}
+		if dp.Similarity = fingerprintSimilarity(fp, parseFingerprint(data)); dp.Similarity >= fingerprintMatch {
+			dp.Similarity = math.Round(dp.Similarity*1000) / 1000
+			list = append(list, dp)
+		}
+	}
+	if err = qs.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Similarity != list[j].Similarity {
+			return list[i].Similarity > list[j].Similarity
+		}
+		return list[i].AudioID < list[j].AudioID
+	})
+	return list, nil
+}
+
+//Duplicates возможные дубликаты трека: доступные пользователю треки с похожим
+//	акустическим отпечатком (та же запись в другом формате или битрейте). Метод
+//	GET, доступен только авторизованным пользователям, которым доступен трек.
+//	Отпечаток, которого еще нет (трек загружен до появления отпечатков или фоновый
+//	разбор загрузки не закончен), считается при запросе
+//Параметры: track — id трека
+//Результат: статус ОК, json-список треков со сходством
+//Ошибка: статус NotFound если трек недоступен или дубликатов нет
+func (afl *Audiofill) Duplicates(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		tr       int
+		fileName string
+		data     []byte
+		fp       []uint32
+		list     []*tDuplicate
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+
+	err = afl.DB.QueryRow(`SELECT filename, fingerprint FROM audio a
+		WHERE id_audio = $2 AND `+sqlAvailable, afl.userID, tr).Scan(&fileName, &data)
+	if err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "track not found")
+		return
+	} else if err != nil {
+		dbError(resp, err, "Audio.Duplicates query failed:")
+		return
+	}
+
+	if data != nil {
+		fp = parseFingerprint(data)
+	} else {
+		if fp, err = fileFingerprint(req.Context(), fileName); err == errTranscodeBusy {
+			apiError(resp, http.StatusServiceUnavailable, "transcoder busy")
+			return
+		} else if err != nil {
+			internalError(resp, err, "Audio.Duplicates fingerprint failed:")
+			return
+		}
+		//	только если у трека все еще тот же файл
+		_, err = afl.DB.Exec(`UPDATE audio SET fingerprint = $3 WHERE id_audio = $1 AND filename = $2`,
+			tr, fileName, fingerprintBytes(fp))
+		if err != nil {
+			log.Println("Audio.Duplicates fingerprint saving failed:", tr, err.Error())
+		}
+	}
+
+	if list, err = findDuplicates(afl.DB, afl.userID, tr, fp); err != nil {
+		dbError(resp, err, "Audio.Duplicates query failed:")
+		return
+	}
+	if len(list) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+	jsRes, _ := json.Marshal(tDuplicateList{len(list), list})
+	resp.Write(jsRes)
+}
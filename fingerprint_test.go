@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+//testSong сэмплы моно "песни": аккорды по секунде из нот с гармониками, seed —
+//	выбор аккордов, noise — амплитуда белого шума, gain — громкость
+func testSong(rate int, seed int64, secs int, noise, gain float64) []float64 {
+	rnd := rand.New(rand.NewSource(seed))
+	chords := make([][]float64, secs)
+	for i := range chords {
+		root := 48 + rnd.Intn(12)
+		for _, step := range [][]int{{0, 4, 7}, {0, 3, 7}, {0, 5, 9}}[rnd.Intn(3)] {
+			chords[i] = append(chords[i], 440*math.Pow(2, float64(root+step-69)/12))
+		}
+	}
+	nrnd := rand.New(rand.NewSource(seed + 1000))
+	res := make([]float64, rate*secs)
+	for i := range res {
+		tm := float64(i) / float64(rate)
+		v := 0.0
+		for _, f := range chords[i/rate] {
+			for k := 1; k <= 6 && f*float64(k) < float64(rate)/2; k++ {
+				v += math.Sin(2*math.Pi*f*float64(k)*tm) / float64(k)
+			}
+		}
+		res[i] = gain*v/6 + noise*(2*nrnd.Float64()-1)
+	}
+	return res
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(rate, bits int, samples []float64) []uint32 {
+		pcm, _ := readWAV(bytes.NewReader(testWAV(rate, 1, bits, 1, samples)))
+		fp, err := computeFingerprint(pcm)
+		if err != nil {
+			t.Fatalf("computeFingerprint: failed %s", err.Error())
+		}
+		return fp
+	}
+	orig := fingerprint(44100, 16, testSong(44100, 1, 12, 0, 0.8))
+	if len(orig) != 12*fpRate/fpHop-2 {
+		t.Fatalf("computeFingerprint: wrong length %d", len(orig))
+	}
+
+	//	"перекодированные" копии: шум, другая частота и разрядность, срез высоких
+	//	частот скользящим средним, сдвиг на треть секунды тишиной в начале
+	lowpass := testSong(44100, 1, 12, 0.01, 0.8)
+	for i := len(lowpass) - 1; i >= 8; i-- {
+		lowpass[i] = (lowpass[i] + lowpass[i-2] + lowpass[i-4] + lowpass[i-6] + lowpass[i-8]) / 5
+	}
+	shifted := append(make([]float64, 7350), testSong(22050, 1, 12, 0.01, 0.6)...)
+	for _, tst := range []struct {
+		name string
+		fp   []uint32
+		dup  bool
+	}{
+		{"noise", fingerprint(44100, 16, testSong(44100, 1, 12, 0.02, 0.5)), true},
+		{"48k", fingerprint(48000, 24, testSong(48000, 1, 12, 0.01, 0.8)), true},
+		{"8k", fingerprint(8000, 8, testSong(8000, 1, 12, 0.01, 0.8)), true},
+		{"lowpass", fingerprint(44100, 16, lowpass), true},
+		{"shifted", fingerprint(22050, 16, shifted), true},
+		{"other", fingerprint(44100, 16, testSong(44100, 2, 12, 0, 0.8)), false},
+		{"short", fingerprint(44100, 16, testSong(44100, 1, 6, 0, 0.8)), false},
+		{"silence", fingerprint(44100, 16, make([]float64, 44100*12)), false},
+	} {
+		if sim := fingerprintSimilarity(orig, tst.fp); (sim >= fingerprintMatch) != tst.dup {
+			t.Errorf("fingerprintSimilarity: %s wrong result %.3f", tst.name, sim)
+		}
+	}
+
+	if fp := parseFingerprint(fingerprintBytes(orig)); fingerprintSimilarity(orig, fp) != 1 {
+		t.Errorf("parseFingerprint: wrong result")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	defer testDB.Exec(`UPDATE audio SET fingerprint = NULL`)
+
+	//	трек 3 пользователя user — перекодированный трек 1 админа, его же закрытый
+	//	трек 4 — та же запись, трек 2 — другая
+	fingerprint := func(seed int64, noise float64) []byte {
+		pcm, _ := readWAV(bytes.NewReader(testWAV(22050, 1, 16, 1, testSong(22050, seed, 12, noise, 0.8))))
+		fp, _ := computeFingerprint(pcm)
+		return fingerprintBytes(fp)
+	}
+	for tr, fp := range map[int][]byte{1: fingerprint(1, 0), 2: fingerprint(2, 0), 3: fingerprint(1, 0.02), 4: fingerprint(1, 0)} {
+		if _, err := testDB.Exec(`UPDATE audio SET fingerprint = $2 WHERE id_audio = $1`, tr, fp); err != nil {
+			t.Fatalf("Duplicates: fingerprint saving failed %s", err.Error())
+		}
+	}
+
+	tests := []struct {
+		path   string
+		cook   *http.Cookie
+		status int
+		err    string
+		res    []int //	id дубликатов по порядку
+	}{
+		{"/tracks/1/duplicates", cookAdmin, http.StatusOK, "", []int{3}},
+		{"/tracks/3/duplicates", cookUser, http.StatusOK, "", []int{1, 4}},
+		{"/tracks/2/duplicates", cookAdmin, http.StatusNotFound, "no records found", nil},
+		{"/tracks/4/duplicates", cookAdmin, http.StatusNotFound, "track not found", nil},
+		{"/tracks/x/duplicates", cookAdmin, http.StatusBadRequest, "invalid track value", nil},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+tst.path, nil)
+		req.AddCookie(tst.cook)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Duplicates: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Duplicates: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, body, tst.status, tst.err)
+			continue
+		}
+		var dpLst tDuplicateList
+		json.Unmarshal(body, &dpLst)
+		if dpLst.Count != len(tst.res) {
+			t.Errorf("Duplicates: test [%d] wrong list %s", idx, body)
+			continue
+		}
+		for i, dp := range dpLst.List {
+			if dp.AudioID != tst.res[i] || dp.Similarity < fingerprintMatch {
+				t.Errorf("Duplicates: test [%d] wrong list %s", idx, body)
+				break
+			}
+		}
+	}
+}
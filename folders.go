@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type tFolder struct {
+	FolderID int    `json:"id"`
+	ParentID int    `json:"parent,omitempty"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Count    int    `json:"track_count"`
+}
+
+type tFolderList struct {
+	Count int        `json:"total_count"`
+	List  []*tFolder `json:"records"`
+}
+
+//sqlSubfolders id собственной (пользователя $1) папки $%d и всех вложенных в нее
+const sqlSubfolders = `WITH RECURSIVE sub AS (
+				SELECT id_folder FROM folders WHERE id_folder = $%d AND id_owner = $1
+				UNION ALL
+				SELECT f.id_folder FROM folders f INNER JOIN sub ON (f.id_parent = sub.id_folder)
+			) SELECT id_folder FROM sub`
+
+//Folders класс для таблицы folders: иерархия папок владельца для его треков.
+//	Трек лежит не больше чем в одной папке, папки видны только владельцу
+type Folders struct {
+	DB     *sql.DB
+	userID int
+}
+
+//NewFolders создание нового экземпляра класса Folders
+func NewFolders(db *sql.DB) *Folders {
+	return &Folders{
+		DB: db,
+	}
+}
+
+//List дерево папок пользователя плоским списком: родитель перед вложенными,
+//	соседи по названию. Метод GET, доступен только авторизованным
+//Результат: статус ОК, json: количество и список папок с полным путем и
+//	количеством треков непосредственно в папке
+//Ошибка: статус NotFound если папок нет
+func (fld *Folders) List(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		parent sql.NullInt64
+		qs     *sql.Rows
+		fLst   tFolderList
+	)
+
+	if fld.userID, err = checkSession(fld.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+
+	qs, err = fld.DB.Query(`WITH RECURSIVE tree AS (
+			SELECT id_folder, id_parent, name, name::text AS path, ARRAY[lower(name)] AS sort_key
+			FROM folders WHERE id_owner = $1 AND id_parent IS NULL
+			UNION ALL
+			SELECT f.id_folder, f.id_parent, f.name, tree.path || '/' || f.name, tree.sort_key || lower(f.name)
+			FROM folders f INNER JOIN tree ON (f.id_parent = tree.id_folder)
+		)
+		SELECT tree.id_folder, tree.id_parent, tree.name, tree.path,
+			(SELECT count(*) FROM audio a WHERE a.id_folder = tree.id_folder)
+		FROM tree
+		ORDER BY tree.sort_key, tree.id_folder`, fld.userID)
+	if err != nil {
+		dbError(resp, err, "Folders.List query failed:")
+		return
+	}
+	defer qs.Close()
+	for qs.Next() {
+		f := &tFolder{}
+		if err = qs.Scan(&f.FolderID, &parent, &f.Name, &f.Path, &f.Count); err != nil {
+			dbError(resp, err, "Folders.List scan error:")
+			return
+		}
+		f.ParentID = int(parent.Int64)
+		fLst.List = append(fLst.List, f)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Folders.List query iteration error:")
+		return
+	}
+	if len(fLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+	fLst.Count = len(fLst.List)
+
+	jsRes, err := json.Marshal(fLst)
+	if err != nil {
+		internalError(resp, err, "Folders.List result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Add создание папки. Метод POST, доступен только авторизованным
+//Параметры: name — название, уникальное среди соседей без учета регистра;
+//	parent — необязательный, id собственной папки, по умолчанию — в корне
+//Результат: статус Created, json: id папки
+//Ошибка: статус Conflict если у родителя уже есть папка с таким названием
+//	статус NotFound если родительской папки нет, Forbidden если она чужая
+func (fld *Folders) Add(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		name   string
+		parent int
+		id     int
+	)
+
+	if fld.userID, err = checkSession(fld.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if name = strings.TrimSpace(req.Form.Get("name")); name == "" {
+		fieldError(resp, "name", "required")
+		return
+	}
+	if strings.Contains(name, "/") {
+		fieldError(resp, "name", "invalid")
+		return
+	}
+	if s := req.Form.Get("parent"); s != "" {
+		if parent, err = strconv.Atoi(s); err != nil {
+			fieldError(resp, "parent", "invalid")
+			return
+		}
+		if parent != 0 && !fld.checkOwner(fld.DB, parent, resp) {
+			return
+		}
+	}
+
+	err = fld.DB.QueryRow(`INSERT INTO folders (id_owner, id_parent, name) VALUES ($1, nullif($2, 0), $3)
+		RETURNING id_folder`, fld.userID, parent, name).Scan(&id)
+	if err != nil {
+		dbError(resp, err, "Folders.Add query failed:")
+		return
+	}
+
+	jsRes, _ := json.Marshal(struct {
+		FolderID int `json:"id"`
+	}{id})
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(jsRes)
+}
+
+//Update переименование и/или перемещение папки. Метод PATCH, доступен только владельцу
+//Параметры: folder — id папки; name, parent — необязательные, но хотя бы один
+//	должен быть. parent=0 — перенос в корень
+//Результат: статус ОК
+//Ошибка: статус BadRequest если папку переносят в нее саму или во вложенную
+//	статус Forbidden если пользователь не владелец, NotFound если папки нет
+func (fld *Folders) Update(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		id       int
+		parent   int
+		cycle    bool
+		tx       *sql.Tx
+		sqlSet   []string
+		sqlParam []interface{}
+	)
+
+	if fld.userID, err = checkSession(fld.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("folder")); err != nil {
+		fieldError(resp, "folder", "invalid")
+		return
+	}
+	sqlParam = append(sqlParam, id)
+	if frmVal, ok := req.Form["name"]; ok {
+		name := strings.TrimSpace(frmVal[0])
+		if name == "" || strings.Contains(name, "/") {
+			fieldError(resp, "name", "invalid")
+			return
+		}
+		sqlParam = append(sqlParam, name)
+		sqlSet = append(sqlSet, fmt.Sprintf("name = $%d", len(sqlParam)))
+	}
+	if frmVal, ok := req.Form["parent"]; ok {
+		if parent, err = strconv.Atoi(frmVal[0]); err != nil {
+			fieldError(resp, "parent", "invalid")
+			return
+		}
+		sqlParam = append(sqlParam, parent)
+		sqlSet = append(sqlSet, fmt.Sprintf("id_parent = nullif($%d, 0)", len(sqlParam)))
+	}
+	if len(sqlSet) == 0 {
+		apiError(resp, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	//	проверка цикла и перенос — в одной транзакции с блокировкой папок владельца
+	if tx, err = fld.DB.Begin(); err != nil {
+		dbError(resp, err, "Folders.Update begin failed:")
+		return
+	}
+	defer tx.Rollback()
+	if !fld.checkOwner(tx, id, resp) {
+		return
+	}
+	if parent != 0 {
+		if !fld.checkOwner(tx, parent, resp) {
+			return
+		}
+		err = tx.QueryRow(`SELECT $2 IN (`+fmt.Sprintf(sqlSubfolders, 3)+`)`, fld.userID, parent, id).Scan(&cycle)
+		if err != nil {
+			dbError(resp, err, "Folders.Update query subfolders failed:")
+			return
+		}
+		if cycle {
+			fieldError(resp, "parent", "invalid")
+			return
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE folders SET `+strings.Join(sqlSet, ", ")+` WHERE id_folder = $1`, sqlParam...)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(resp, err, "Folders.Update query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Delete удаление папки со всеми вложенными, треки из них остаются вне папок.
+//	Метод DELETE, доступен только владельцу
+//Параметры: folder — id папки
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если папки нет
+func (fld *Folders) Delete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		id  int
+	)
+
+	if fld.userID, err = checkSession(fld.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("folder")); err != nil {
+		fieldError(resp, "folder", "invalid")
+		return
+	}
+	if !fld.checkOwner(fld.DB, id, resp) {
+		return
+	}
+
+	if _, err = fld.DB.Exec(`DELETE FROM folders WHERE id_folder = $1`, id); err != nil {
+		dbError(resp, err, "Folders.Delete query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//PutTrack перенос трека в папку (из прежней, если был в другой). Метод PUT,
+//	доступен владельцу трека и папки
+//Параметры: folder — id папки, track — id трека
+//Результат: статус ОК
+//Ошибка: статус Forbidden если трек или папка чужие, NotFound если их нет
+func (fld *Folders) PutTrack(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		id, tr int
+	)
+
+	if fld.userID, err = checkSession(fld.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, tr, err = fld.folderTrackParams(req, resp); err != nil {
+		return
+	}
+	afl := &Audiofill{DB: fld.DB, userID: fld.userID}
+	if !afl.checkAudioOwner(tr, resp) || !fld.checkOwner(fld.DB, id, resp) {
+		return
+	}
+
+	if _, err = fld.DB.Exec(`UPDATE audio SET id_folder = $2 WHERE id_audio = $1`, tr, id); err != nil {
+		dbError(resp, err, "Folders.PutTrack query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//RemoveTrack трек из папки — вне папок. Метод DELETE, доступен владельцу трека
+//Параметры: folder — id папки, track — id трека
+//Результат: статус ОК
+//Ошибка: статус NotFound если трека нет в этой папке
+func (fld *Folders) RemoveTrack(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		id, tr int
+		qr     sql.Result
+	)
+
+	if fld.userID, err = checkSession(fld.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, tr, err = fld.folderTrackParams(req, resp); err != nil {
+		return
+	}
+
+	qr, err = fld.DB.Exec(`UPDATE audio SET id_folder = NULL
+		WHERE id_audio = $1 AND id_folder = $2 AND id_owner = $3`, tr, id, fld.userID)
+	if err != nil {
+		dbError(resp, err, "Folders.RemoveTrack query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "track not in folder")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//folderTrackParams параметры folder и track из пути, ошибка уже отправлена клиенту
+func (fld *Folders) folderTrackParams(req *http.Request, resp http.ResponseWriter) (id, tr int, err error) {
+	if id, err = strconv.Atoi(req.Form.Get("folder")); err != nil {
+		fieldError(resp, "folder", "invalid")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+	}
+	return
+}
+
+//checkOwner проверка владельца папки id. В транзакции строка папки блокируется
+//	до ее конца
+func (fld *Folders) checkOwner(db sqlQueryer, id int, resp http.ResponseWriter) (ok bool) {
+	qr := db.QueryRow(`SELECT id_owner = $1 FROM folders WHERE id_folder = $2 FOR UPDATE`, fld.userID, id)
+	if err := qr.Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			apiError(resp, http.StatusNotFound, "folder not found")
+		} else {
+			dbError(resp, err, "Folders.checkOwner query failed:")
+		}
+		return false
+	}
+	if !ok {
+		apiError(resp, http.StatusForbidden, "access denied")
+	}
+	return ok
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFolders(t *testing.T) {
+	var (
+		fLst   tFolderList
+		ad     tAudio
+		create struct {
+			FolderID int `json:"id"`
+		}
+	)
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+
+	//	listIDs id треков списка /tracks с фильтром
+	listIDs := func(query string, cook *http.Cookie) (ids []int) {
+		aLst := tAudioList{}
+		if _, body := testDo(t, http.MethodGet, "/tracks?"+query, "", cook); json.Unmarshal(body, &aLst) == nil {
+			for _, a := range aLst.List {
+				ids = append(ids, a.AudioID)
+			}
+		}
+		return ids
+	}
+	//	folders пути папок пользователя по порядку
+	folders := func(cook *http.Cookie) (paths []string) {
+		fLst = tFolderList{}
+		if _, body := testDo(t, http.MethodGet, "/folders", "", cook); json.Unmarshal(body, &fLst) == nil {
+			for _, f := range fLst.List {
+				paths = append(paths, f.Path)
+			}
+		}
+		return paths
+	}
+	addFolder := func(body string) int {
+		st, res := testDo(t, http.MethodPost, "/folders", body, cookAdmin)
+		if st != http.StatusCreated || json.Unmarshal(res, &create) != nil {
+			t.Fatalf("Folders.Add: %s wrong result %d [%s]", body, st, res)
+		}
+		return create.FolderID
+	}
+
+	if paths := folders(cookAdmin); !reflect.DeepEqual(paths, []string{"Albums", "Albums/Rock"}) ||
+		fLst.List[1].ParentID != 1 || fLst.List[0].ParentID != 0 {
+		t.Errorf("Folders.List: wrong folders %v", paths)
+	}
+
+	//	папка трека видна только владельцу, фильтр по папке включает вложенные
+	if st, body := testDo(t, http.MethodPut, "/folders/2/tracks/2", "", cookAdmin); st != http.StatusOK {
+		t.Fatalf("Folders.PutTrack: wrong result %d [%s]", st, body)
+	}
+	if _, body := testDo(t, http.MethodGet, "/tracks/2", "", cookAdmin); json.Unmarshal(body, &ad) != nil || ad.Folder != 2 {
+		t.Errorf("Audio.Detail: owner wrong folder [%s]", body)
+	}
+	ad = tAudio{}
+	if _, body := testDo(t, http.MethodGet, "/tracks/2", "", cookUser); json.Unmarshal(body, &ad) != nil || ad.Folder != 0 {
+		t.Errorf("Audio.Detail: sharee sees folder [%s]", body)
+	}
+	if ids := listIDs("folder=1", cookAdmin); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("Audio.List: folder filter wrong tracks %v", ids)
+	}
+	if ids := listIDs("folder=0", cookAdmin); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("Audio.List: out of folders wrong tracks %v", ids)
+	}
+	if ids := listIDs("folder=2", cookUser); ids != nil {
+		t.Errorf("Audio.List: foreign folder tracks %v", ids)
+	}
+
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodGet, "/folders", "", cookUser, http.StatusOK, ""},
+		{http.MethodGet, "/tracks?folder=x", "", cookAdmin, http.StatusBadRequest, "invalid folder value"},
+		{http.MethodPost, "/folders", "name=rock&parent=1", cookAdmin, http.StatusConflict, "name already used"},
+		{http.MethodPost, "/folders", "name=a/b", cookAdmin, http.StatusBadRequest, "invalid name value"},
+		{http.MethodPost, "/folders", "name=sub&parent=3", cookAdmin, http.StatusForbidden, "access denied"},
+		{http.MethodPatch, "/folders/1", "parent=2", cookAdmin, http.StatusBadRequest, "invalid parent value"},
+		{http.MethodPatch, "/folders/1", "parent=1", cookAdmin, http.StatusBadRequest, "invalid parent value"},
+		{http.MethodPatch, "/folders/2", "", cookAdmin, http.StatusBadRequest, "nothing to update"},
+		{http.MethodPatch, "/folders/99", "name=x", cookAdmin, http.StatusNotFound, "folder not found"},
+		{http.MethodDelete, "/folders/1", "", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodPut, "/folders/3/tracks/2", "", cookAdmin, http.StatusForbidden, "access denied"},
+		{http.MethodPut, "/folders/3/tracks/2", "", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodDelete, "/folders/1/tracks/1", "", cookAdmin, http.StatusNotFound, "track not in folder"},
+	}
+	for idx, tst := range tests {
+		if st, body := testDo(t, tst.method, tst.path, tst.body, tst.cook); st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Folders: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+
+	//	перенос и удаление ветки: треки из удаленных папок остаются вне папок
+	tmp := addFolder("name=Tmp")
+	sub := addFolder(fmt.Sprintf("name=Sub&parent=%d", tmp))
+	testDo(t, http.MethodPut, fmt.Sprintf("/folders/%d/tracks/1", sub), "", cookAdmin)
+	if st, _ := testDo(t, http.MethodPatch, fmt.Sprintf("/folders/%d", sub), "name=Deep&parent=2", cookAdmin); st != http.StatusOK {
+		t.Errorf("Folders.Update: wrong status %d", st)
+	}
+	if paths := folders(cookAdmin); !reflect.DeepEqual(paths, []string{"Albums", "Albums/Rock", "Albums/Rock/Deep", "Tmp"}) {
+		t.Errorf("Folders.List: after move wrong folders %v", paths)
+	}
+	if ids := listIDs("folder=2&order_by=track", cookAdmin); !reflect.DeepEqual(ids, []int{2, 1}) {
+		t.Errorf("Audio.List: nested folder filter wrong tracks %v", ids)
+	}
+	testDo(t, http.MethodPatch, fmt.Sprintf("/folders/%d", sub), fmt.Sprintf("parent=%d", tmp), cookAdmin)
+	if st, _ := testDo(t, http.MethodDelete, fmt.Sprintf("/folders/%d", tmp), "", cookAdmin); st != http.StatusOK {
+		t.Errorf("Folders.Delete: wrong status %d", st)
+	}
+	ad = tAudio{}
+	if _, body := testDo(t, http.MethodGet, "/tracks/1", "", cookAdmin); json.Unmarshal(body, &ad) != nil || ad.Folder != 0 {
+		t.Errorf("Folders.Delete: track left in deleted folder [%s]", body)
+	}
+	if paths := folders(cookAdmin); len(paths) != 2 {
+		t.Errorf("Folders.Delete: subfolders left %v", paths)
+	}
+	if st, _ := testDo(t, http.MethodDelete, "/folders/2/tracks/2", "", cookAdmin); st != http.StatusOK {
+		t.Errorf("Folders.RemoveTrack: wrong status %d", st)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//hlsTypes типы сегментов HLS (packed audio) по контейнеру потока
+var hlsTypes = map[string]string{
+	"mp3": "audio/mpeg",
+	"aac": "audio/aac",
+}
+
+//errNoFrames в файле нет потока MPEG audio или ADTS — нарезать на сегменты нечего
+var errNoFrames = errors.New("no audio frames")
+
+//tHLSSegment сегмент потока: кадры с Offset длиной Size байт. Start — номер
+//	первого сэмпла сегмента от начала потока (метка времени сегмента)
+type tHLSSegment struct {
+	Offset   int64
+	Size     int64
+	Start    int64
+	Duration float64
+}
+
+//tHLSIndex разбивка файла на сегменты по границам кадров. ModTime и Size файла —
+//	для проверки актуальности индекса в кэше
+type tHLSIndex struct {
+	Ext      string
+	Rate     int
+	Segments []tHLSSegment
+	ModTime  time.Time
+	Size     int64
+}
+
+//hlsCache индексы сегментов по имени файла. Файлы треков не изменяются
+//	(новая версия — новый файл), поэтому индекс строится один раз
+var hlsCache = struct {
+	sync.Mutex
+	m map[string]*tHLSIndex
+}{m: map[string]*tHLSIndex{}}
+
+//mp3Bitrates битрейт (кбит/с) по индексу заголовка: [MPEG1?][слой 1..3][индекс 1..14]
+var mp3Bitrates = [2][3][14]int{
+	{ //	MPEG2, MPEG2.5
+		{32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+	{ //	MPEG1
+		{32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+}
+
+//hlsSyncLimit сколько байт от начала потока искать первый кадр
+const hlsSyncLimit = 64 << 10
+
+//adtsRates частота дискретизации AAC по индексу заголовка ADTS
+var adtsRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+//mp3Frame разбор заголовка кадра MPEG audio (слои I–III)
+//Результат: длина кадра в байтах, сэмплов в кадре, частота дискретизации
+func mp3Frame(h []byte) (size, samples, rate int, ok bool) {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return
+	}
+	ver, layer := (h[1]>>3)&3, 4-int((h[1]>>1)&3)
+	brIdx, srIdx, pad := int(h[2]>>4), int((h[2]>>2)&3), int((h[2]>>1)&1)
+	if ver == 1 || layer == 4 || brIdx == 0 || brIdx == 15 || srIdx == 3 {
+		return
+	}
+
+	mpeg1 := 0
+	rate = []int{44100, 48000, 32000}[srIdx]
+	switch ver {
+	case 3:
+		mpeg1 = 1
+	case 2:
+		rate /= 2
+	default:
+		rate /= 4
+	}
+	bitrate := mp3Bitrates[mpeg1][layer-1][brIdx-1] * 1000
+
+	switch {
+	case layer == 1:
+		return (12*bitrate/rate + pad) * 4, 384, rate, true
+	case layer == 3 && mpeg1 == 0:
+		samples = 576
+	default:
+		samples = 1152
+	}
+	return samples/8*bitrate/rate + pad, samples, rate, true
+}
+
+//adtsFrame разбор заголовка кадра AAC в ADTS
+//Результат: длина кадра в байтах, сэмплов в кадре, частота дискретизации
+func adtsFrame(h []byte) (size, samples, rate int, ok bool) {
+	if len(h) < 7 || h[0] != 0xFF || h[1]&0xF6 != 0xF0 {
+		return
+	}
+	srIdx := int((h[2] >> 2) & 0xF)
+	size = int(h[3]&3)<<11 | int(h[4])<<3 | int(h[5]>>5)
+	if srIdx >= len(adtsRates) || size < 7 {
+		return
+	}
+	return size, 1024 * (int(h[6]&3) + 1), adtsRates[srIdx], true
+}
+
+//id3Size размер тега ID3v2 в начале потока (вместе с заголовком), 0 — тега нет
+func id3Size(h []byte) int {
+	if len(h) < 10 || string(h[:3]) != "ID3" {
+		return 0
+	}
+	size := 10 + syncsafe(h[6:10])
+	if h[5]&0x10 != 0 {
+		size += 10 //	footer
+	}
+	return size
+}
+
+//buildHLSIndex разбивка потока MP3 или AAC (ADTS) на сегменты не короче
+//	hlsSegmentTime по границам кадров. Тип потока определяется по первому кадру.
+//	Мусор между кадрами (и ID3v1 в конце) пропускается: после потери синхронизации
+//	кадр принимается, только если за ним следует еще один корректный заголовок
+func buildHLSIndex(r io.Reader) (idx *tHLSIndex, err error) {
+	var (
+		pos, samples int64
+		seg          *tHLSSegment
+		parse        func([]byte) (int, int, int, bool)
+	)
+
+	br := bufio.NewReaderSize(r, 32<<10)
+	if h, _ := br.Peek(10); id3Size(h) > 0 {
+		n, _ := br.Discard(id3Size(h))
+		pos = int64(n)
+	}
+	start := pos
+
+	idx = &tHLSIndex{}
+	target := hlsSegmentTime.Seconds()
+	synced := false
+	for {
+		h, _ := br.Peek(7)
+		if len(h) < 4 {
+			break
+		}
+		if parse == nil {
+			if _, _, _, ok := mp3Frame(h); ok {
+				idx.Ext, parse = "mp3", mp3Frame
+			} else if _, _, _, ok = adtsFrame(h); ok {
+				idx.Ext, parse = "aac", adtsFrame
+			}
+		}
+
+		size, cnt, rate, ok := 0, 0, 0, false
+		if parse != nil {
+			size, cnt, rate, ok = parse(h)
+		}
+		if ok && !synced {
+			next, _ := br.Peek(size + 7)
+			if len(next) > size {
+				_, _, nrate, nok := parse(next[size:])
+				ok = nok && nrate == rate
+			} else {
+				ok = len(next) == size && idx.Rate != 0
+			}
+		}
+		if ok && idx.Rate != 0 && rate != idx.Rate {
+			ok = false
+		}
+		if !ok {
+			if idx.Rate == 0 {
+				//	не MP3/AAC: не сканируем весь файл в поисках синхронизации
+				if pos-start >= hlsSyncLimit {
+					break
+				}
+				parse = nil
+			}
+			synced = false
+			br.Discard(1)
+			pos++
+			continue
+		}
+
+		n, _ := br.Discard(size)
+		if n < size {
+			break
+		}
+		synced = true
+		idx.Rate = rate
+		if seg == nil || seg.Duration >= target {
+			idx.Segments = append(idx.Segments, tHLSSegment{Offset: pos, Start: samples})
+			seg = &idx.Segments[len(idx.Segments)-1]
+		}
+		seg.Size += int64(size)
+		seg.Duration += float64(cnt) / float64(rate)
+		samples += int64(cnt)
+		pos += int64(size)
+	}
+	if len(idx.Segments) == 0 {
+		return nil, errNoFrames
+	}
+	return idx, nil
+}
+
+//hlsIndex индекс сегментов файла из кэша, либо построенный заново
+func hlsIndex(fd *os.File) (idx *tHLSIndex, err error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hlsCache.Lock()
+	idx = hlsCache.m[fd.Name()]
+	hlsCache.Unlock()
+	if idx != nil && idx.ModTime.Equal(st.ModTime()) && idx.Size == st.Size() {
+		return idx, nil
+	}
+
+	if idx, err = buildHLSIndex(fd); err != nil {
+		return nil, err
+	}
+	idx.ModTime, idx.Size = st.ModTime(), st.Size()
+
+	hlsCache.Lock()
+	if len(hlsCache.m) >= hlsCacheSize {
+		for name := range hlsCache.m {
+			delete(hlsCache.m, name)
+			break
+		}
+	}
+	hlsCache.m[fd.Name()] = idx
+	hlsCache.Unlock()
+	return idx, nil
+}
+
+//writeHLSPlaylist медиаплейлист VOD: сегменты N.mp3|N.aac, query — параметры
+//	ссылок на сегменты (токен доступа), пустая — без параметров
+func writeHLSPlaylist(w io.Writer, idx *tHLSIndex, query string) {
+	target := 0
+	for _, seg := range idx.Segments {
+		if d := int(math.Ceil(seg.Duration)); d > target {
+			target = d
+		}
+	}
+	if query != "" {
+		query = "?" + query
+	}
+
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", target)
+	for i, seg := range idx.Segments {
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n%d.%s%s\n", seg.Duration, i, idx.Ext, query)
+	}
+	fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+}
+
+//hlsTimestamp тег ID3 с меткой времени сегмента packed audio: фрейм PRIV
+//	com.apple.streaming.transportStreamTimestamp, 33-битное время в тактах 90 кГц
+func hlsTimestamp(seg *tHLSSegment, rate int) []byte {
+	const owner = "com.apple.streaming.transportStreamTimestamp\x00"
+
+	frame := make([]byte, 10, 10+len(owner)+8)
+	copy(frame, "PRIV")
+	putSyncsafe(frame[4:8], len(owner)+8)
+	frame = append(frame, owner...)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(seg.Start*90000/int64(rate))&(1<<33-1))
+
+	tag := make([]byte, 10, 10+len(frame))
+	copy(tag, "ID3\x04\x00\x00")
+	putSyncsafe(tag[6:10], len(frame))
+	return append(tag, frame...)
+}
+
+//putSyncsafe запись целого ID3v2 7-битными байтами (обратная к syncsafe)
+func putSyncsafe(b []byte, n int) {
+	for i := 3; i >= 0; i-- {
+		b[i] = byte(n & 0x7F)
+		n >>= 7
+	}
+}
+
+//HLSPlaylist медиаплейлист HLS (VOD) трека. Метод GET, доступ — как у Get:
+//	сессия либо token, токен переносится в ссылки на сегменты. Сегменты нарезаются
+//	по границам кадров MP3/AAC без перекодирования
+//Параметры: track — id трека, token — необязательный
+//Результат: статус ОК, application/vnd.apple.mpegurl
+//Ошибка: статус UnsupportedMediaType если трек не MP3/AAC (ADTS)
+func (afl *Audiofill) HLSPlaylist(resp http.ResponseWriter, req *http.Request) {
+	var (
+		ok       bool
+		fileName string
+		query    string
+	)
+
+	if _, _, _, fileName, ok = afl.mediaAccess(resp, req); !ok {
+		return
+	}
+	idx, ok := afl.hlsIndex(resp, fileName)
+	if !ok {
+		return
+	}
+	if token := req.URL.Query().Get("token"); token != "" {
+		query = url.Values{"token": {token}}.Encode()
+	}
+
+	resp.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	resp.WriteHeader(http.StatusOK)
+	writeHLSPlaylist(resp, idx, query)
+}
+
+//HLSSegment сегмент HLS трека: кадры потока с тегом ID3 метки времени впереди.
+//	Метод GET, доступ — как у Get
+//Параметры: track — id трека, segment — N.mp3|N.aac из плейлиста, token — необязательный
+//Результат: статус ОК, audio/mpeg|audio/aac
+//Ошибка: статус NotFound если сегмента нет
+func (afl *Audiofill) HLSSegment(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		ok       bool
+		n        int
+		fd       *os.File
+		fileName string
+	)
+
+	if _, _, _, fileName, ok = afl.mediaAccess(resp, req); !ok {
+		return
+	}
+	idx, ok := afl.hlsIndex(resp, fileName)
+	if !ok {
+		return
+	}
+	num, ext, _ := strings.Cut(req.Form.Get("segment"), ".")
+	if n, err = strconv.Atoi(num); err != nil || n < 0 || n >= len(idx.Segments) || ext != idx.Ext {
+		apiError(resp, http.StatusNotFound, "segment not found")
+		return
+	}
+	if fd, err = os.Open(path.Join(mediaDir, fileName)); err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
+		return
+	}
+	defer fd.Close()
+
+	seg := &idx.Segments[n]
+	ts := hlsTimestamp(seg, idx.Rate)
+	resp.Header().Set("Content-Type", hlsTypes[idx.Ext])
+	resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(ts))+seg.Size, 10))
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(ts)
+	io.Copy(resp, io.NewSectionReader(fd, seg.Offset, seg.Size))
+}
+
+//hlsIndex индекс сегментов файла трека, ошибка уже отправлена клиенту
+func (afl *Audiofill) hlsIndex(resp http.ResponseWriter, fileName string) (idx *tHLSIndex, ok bool) {
+	fd, err := os.Open(path.Join(mediaDir, fileName))
+	if err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
+		return nil, false
+	}
+	defer fd.Close()
+
+	if idx, err = hlsIndex(fd); err == errNoFrames {
+		apiError(resp, http.StatusUnsupportedMediaType, "unsupported track format")
+		return nil, false
+	} else if err != nil {
+		internalError(resp, err, "Audio.hlsIndex failed:")
+		return nil, false
+	}
+	return idx, true
+}
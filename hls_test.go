@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//testADTSFrame кадр AAC LC стерео в ADTS длиной size байт
+func testADTSFrame(srIdx, size int) []byte {
+	frame := make([]byte, size)
+	copy(frame, []byte{0xFF, 0xF1, byte(1<<6 | srIdx<<2), byte(2<<6 | size>>11), byte(size >> 3), byte(size&7<<5 | 0x1F), 0xFC})
+	return frame
+}
+
+func TestHLSIndex(t *testing.T) {
+	//	MPEG1 Layer III 128 кбит/с 44100 Гц: 417 байт, 1152 сэмпла
+	mp3 := make([]byte, 417)
+	copy(mp3, []byte{0xFF, 0xFB, 0x90, 0x00})
+
+	tag := testID3v2(4, testID3Frame(4, "TIT2", append([]byte{3}, "title"...)))
+	data := append([]byte{}, tag...)
+	for i := 0; i < 1000; i++ {
+		if i == 500 {
+			data = append(data, "junk"...)
+		}
+		data = append(data, mp3...)
+	}
+	data = append(data, append([]byte("TAG"), make([]byte, 125)...)...)
+
+	idx, err := buildHLSIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("buildHLSIndex: mp3 failed %v", err)
+	}
+	off := int64(len(tag))
+	want := []tHLSSegment{
+		{Offset: off, Size: 383 * 417, Start: 0},
+		{Offset: off + 383*417, Size: 383 * 417, Start: 383 * 1152},
+		{Offset: off + 766*417 + 4, Size: 234 * 417, Start: 766 * 1152},
+	}
+	for i := range idx.Segments {
+		idx.Segments[i].Duration = 0
+	}
+	if idx.Ext != "mp3" || idx.Rate != 44100 || !reflect.DeepEqual(idx.Segments, want) {
+		t.Errorf("buildHLSIndex: mp3 wrong index %s %d %+v", idx.Ext, idx.Rate, idx.Segments)
+	}
+
+	idx, _ = buildHLSIndex(bytes.NewReader(data))
+	buf := &bytes.Buffer{}
+	writeHLSPlaylist(buf, idx, "token=x")
+	for _, s := range []string{"#EXT-X-TARGETDURATION:11\n", "#EXTINF:10.005,\n0.mp3?token=x\n", "2.mp3?token=x\n#EXT-X-ENDLIST\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("writeHLSPlaylist: %q missing in\n%s", s, buf.String())
+		}
+	}
+
+	ts := hlsTimestamp(&idx.Segments[1], idx.Rate)
+	if len(ts) != 73 || syncsafe(ts[6:10]) != 63 || !bytes.HasPrefix(ts[10:], []byte("PRIV")) ||
+		!bytes.Equal(ts[len(ts)-8:], []byte{0, 0, 0, 0, 0, 0x0D, 0xBD, 0x58}) {
+		t.Errorf("hlsTimestamp: wrong tag % x", ts)
+	}
+
+	//	AAC LC 44100 Гц: 1024 сэмпла в кадре
+	data = nil
+	for i := 0; i < 500; i++ {
+		data = append(data, testADTSFrame(4, 300)...)
+	}
+	if idx, err = buildHLSIndex(bytes.NewReader(data)); err != nil || idx.Ext != "aac" ||
+		len(idx.Segments) != 2 || idx.Segments[1].Offset != 431*300 || idx.Segments[1].Start != 431*1024 {
+		t.Errorf("buildHLSIndex: aac wrong index %v %+v", err, idx)
+	}
+
+	if _, err = buildHLSIndex(bytes.NewReader(append([]byte("fLaC"), make([]byte, 100000)...))); err != errNoFrames {
+		t.Errorf("buildHLSIndex: flac wrong result %v", err)
+	}
+
+	//	MPEG2 Layer III 64 кбит/с 22050 Гц
+	if size, samples, rate, ok := mp3Frame([]byte{0xFF, 0xF3, 0x80, 0x00}); !ok || size != 208 || samples != 576 || rate != 22050 {
+		t.Errorf("mp3Frame: MPEG2 wrong result %d %d %d %v", size, samples, rate, ok)
+	}
+}
+
+func TestHLS(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	tests := []struct {
+		path   string
+		cook   *http.Cookie
+		status int
+		err    string
+	}{
+		{"/tracks/1/hls/index.m3u8", nil, http.StatusUnauthorized, "access denied"},
+		{"/tracks/4/hls/index.m3u8", cookAdmin, http.StatusNotFound, "track not found"},
+		{"/tracks/1/hls/index.m3u8", cookAdmin, http.StatusNotFound, "file not found"},
+		{"/tracks/1/hls/0.mp3?token=1.2.3", nil, http.StatusUnauthorized, "access denied"},
+		{"/tracks/x/hls/0.mp3", cookAdmin, http.StatusBadRequest, "invalid track value"},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+tst.path, nil)
+		if tst.cook != nil {
+			req.AddCookie(tst.cook)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("HLS: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("HLS: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, body, tst.status, tst.err)
+		}
+	}
+}
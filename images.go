@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//imagesDir каталог картинок волновой формы и спектрограмм треков в mediaDir
+const imagesDir = "images"
+
+//spectrogramFFT окно БПФ спектрограммы, сэмплов (степень двойки)
+const spectrogramFFT = 2048
+
+//spectrogramFloor нижняя граница шкалы спектрограммы, дБ относительно полной шкалы
+const spectrogramFloor = -90.0
+
+//tImageParams параметры картинки трека: вид (waveform|spectrogram), формат
+//	(png|svg), размер, цвет и фон. Background.A == 0 — прозрачный фон
+type tImageParams struct {
+	Kind       string
+	Format     string
+	Width      int
+	Height     int
+	Color      color.NRGBA
+	Background color.NRGBA
+}
+
+//imageDefaults параметры картинок по умолчанию
+var imageDefaults = map[string]tImageParams{
+	"waveform":    {Kind: "waveform", Format: "png", Width: 800, Height: 120, Color: color.NRGBA{0x33, 0x66, 0xCC, 0xFF}},
+	"spectrogram": {Kind: "spectrogram", Format: "png", Width: 800, Height: 256, Color: color.NRGBA{0xFF, 0xCC, 0x00, 0xFF}, Background: color.NRGBA{A: 0xFF}},
+}
+
+//imageTypes Content-Type картинок по формату
+var imageTypes = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+}
+
+//parseColor цвет rrggbb (допустим # впереди), transparent — если allowNone
+func parseColor(s string, allowNone bool) (c color.NRGBA, ok bool) {
+	s = strings.ToLower(strings.TrimPrefix(s, "#"))
+	if s == "transparent" {
+		return c, allowNone
+	}
+	if len(s) != 6 {
+		return c, false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return c, false
+	}
+	return color.NRGBA{b[0], b[1], b[2], 0xFF}, true
+}
+
+//hexColor цвет для имени файла и svg, прозрачный — none
+func hexColor(c color.NRGBA) string {
+	if c.A == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+}
+
+//imageParams параметры картинки вида kind из запроса: format, width (16..4096),
+//	height (16..2048), color, background
+func imageParams(req *http.Request, kind string) (p tImageParams, err error) {
+	var ok bool
+
+	p = imageDefaults[kind]
+	if s := req.Form.Get("format"); s != "" {
+		if p.Format = strings.ToLower(s); imageTypes[p.Format] == "" || (kind == "spectrogram" && p.Format != "png") {
+			return p, &tFieldError{Field: "format", Reason: "invalid"}
+		}
+	}
+	for _, dim := range []struct {
+		name     string
+		val      *int
+		min, max int
+	}{{"width", &p.Width, 16, 4096}, {"height", &p.Height, 16, 2048}} {
+		if s := req.Form.Get(dim.name); s != "" {
+			if *dim.val, err = strconv.Atoi(s); err != nil || *dim.val < dim.min || *dim.val > dim.max {
+				return p, &tFieldError{Field: dim.name, Reason: "invalid"}
+			}
+		}
+	}
+	if s := req.Form.Get("color"); s != "" {
+		if p.Color, ok = parseColor(s, false); !ok {
+			return p, &tFieldError{Field: "color", Reason: "invalid"}
+		}
+	}
+	if s := req.Form.Get("background"); s != "" {
+		if p.Background, ok = parseColor(s, true); !ok {
+			return p, &tFieldError{Field: "background", Reason: "invalid"}
+		}
+	}
+	return p, nil
+}
+
+//key часть имени файла картинки в кэше — набор параметров
+func (p tImageParams) key() string {
+	return fmt.Sprintf("%s-%dx%d-%s-%s.%s", p.Kind, p.Width, p.Height, hexColor(p.Color), hexColor(p.Background), p.Format)
+}
+
+//imagePath путь к картинке трека fileName с параметрами p
+func imagePath(fileName string, p tImageParams) string {
+	return path.Join(mediaDir, imagesDir, fileName+"."+p.key())
+}
+
+//waveformColumns min, max пиков (16 бит) на каждый из width столбцов картинки
+func waveformColumns(pk *tPeaks, width int) (lo, hi []int) {
+	lo, hi = make([]int, width), make([]int, width)
+	for x := 0; x < width && pk.Length > 0; x++ {
+		i0, i1 := x*pk.Length/width, (x+1)*pk.Length/width
+		if i1 <= i0 {
+			i1 = i0 + 1
+		}
+		lo[x], hi[x] = pk.Data[2*i0], pk.Data[2*i0+1]
+		for i := i0 + 1; i < i1; i++ {
+			if pk.Data[2*i] < lo[x] {
+				lo[x] = pk.Data[2*i]
+			}
+			if pk.Data[2*i+1] > hi[x] {
+				hi[x] = pk.Data[2*i+1]
+			}
+		}
+	}
+	return lo, hi
+}
+
+//waveformRows строки столбца x картинки высотой height: от верхней (max) до нижней (min)
+func waveformRows(lo, hi, height int) (top, bottom int) {
+	mid := float64(height-1) / 2
+	top = int(math.Round(mid - float64(hi)/32768*mid))
+	bottom = int(math.Round(mid - float64(lo)/32768*mid))
+	if bottom < top {
+		bottom = top
+	}
+	return top, bottom
+}
+
+//renderWaveformPNG волновая форма: столбец на каждый пиксель ширины
+func renderWaveformPNG(w io.Writer, pk *tPeaks, p tImageParams) error {
+	img := image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := p.Background
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	lo, hi := waveformColumns(pk, p.Width)
+	for x := range lo {
+		top, bottom := waveformRows(lo[x], hi[x], p.Height)
+		for y := top; y <= bottom; y++ {
+			img.SetNRGBA(x, y, p.Color)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+//renderWaveformSVG волновая форма одним path из вертикальных отрезков
+func renderWaveformSVG(w io.Writer, pk *tPeaks, p tImageParams) error {
+	var d strings.Builder
+
+	lo, hi := waveformColumns(pk, p.Width)
+	for x := range lo {
+		top, bottom := waveformRows(lo[x], hi[x], p.Height)
+		fmt.Fprintf(&d, "M%d.5 %dV%d", x, top, bottom+1)
+	}
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="%[2]d" viewBox="0 0 %[1]d %[2]d">`,
+		p.Width, p.Height)
+	if p.Background.A != 0 {
+		fmt.Fprintf(w, `<rect width="100%%" height="100%%" fill="#%s"/>`, hexColor(p.Background))
+	}
+	_, err := fmt.Fprintf(w, `<path d="%s" stroke="#%s" stroke-width="1" fill="none" shape-rendering="crispEdges"/></svg>`,
+		d.String(), hexColor(p.Color))
+	return err
+}
+
+//fft быстрое преобразование Фурье на месте, длина x — степень двойки
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				wk *= step
+			}
+		}
+	}
+}
+
+//computeSpectrogram спектрограмма потока pcm: width столбцов по времени
+//	(окно БПФ по центру столбца), height строк по частоте (сверху — высокие,
+//	линейная шкала). frames — длина потока в кадрах (по пикам)
+//Результат: уровни [0, 1] по столбцам: spec[x][y], 0 — spectrogramFloor и тише
+func computeSpectrogram(pcm *tPCM, frames, width, height int) (spec [][]float64, err error) {
+	const n = spectrogramFFT
+
+	window := make([]float64, n)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	hop := float64(frames) / float64(width)
+	start := func(x int) int { return int(float64(x)*hop+hop/2) - n/2 }
+
+	//	ring — последние n сэмплов моно, read — сколько сэмплов прочитано:
+	//	столбец x готов, когда прочитаны сэмплы до start(x)+n
+	ring, read := make([]float64, n), 0
+	buf := make([]float64, 4096*pcm.Channels)
+	bins := make([]complex128, n)
+	column := func() []float64 {
+		for i := range bins {
+			bins[i] = complex(ring[(read+i)%n]*window[i], 0)
+		}
+		fft(bins)
+		col := make([]float64, height)
+		for y := range col {
+			b0 := (height - 1 - y) * (n / 2) / height
+			b1 := (height - y) * (n / 2) / height
+			if b1 <= b0 {
+				b1 = b0 + 1
+			}
+			for b := b0; b < b1; b++ {
+				//	синус полной шкалы после окна Ханна дает |X| = n/4
+				db := 20 * math.Log10(cmplx.Abs(bins[b])/(n/4)+1e-12)
+				col[y] = math.Max(col[y], math.Min(1, (db-spectrogramFloor)/-spectrogramFloor))
+			}
+		}
+		return col
+	}
+	push := func(v float64) {
+		ring[read%n] = v
+		read++
+		for len(spec) < width && read >= start(len(spec))+n {
+			spec = append(spec, column())
+		}
+	}
+
+	for err == nil && len(spec) < width {
+		var cnt int
+		cnt, err = pcm.Read(buf)
+		for i := 0; i+pcm.Channels <= cnt; i += pcm.Channels {
+			v := 0.0
+			for _, s := range buf[i : i+pcm.Channels] {
+				v += s
+			}
+			push(v / float64(pcm.Channels))
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	//	последние окна выходят за конец потока — дополняем тишиной
+	for len(spec) < width {
+		push(0)
+	}
+	return spec, nil
+}
+
+//renderSpectrogramPNG спектрограмма: уровень — смешение фона и цвета
+func renderSpectrogramPNG(w io.Writer, spec [][]float64, p tImageParams) error {
+	img := image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
+	mix := func(a, b uint8, t float64) uint8 {
+		return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t))
+	}
+	bg, fg := p.Background, p.Color
+	for x, col := range spec {
+		for y, t := range col {
+			img.SetNRGBA(x, y, color.NRGBA{mix(bg.R, fg.R, t), mix(bg.G, fg.G, t), mix(bg.B, fg.B, t), mix(bg.A, fg.A, t)})
+		}
+	}
+	return png.Encode(w, img)
+}
+
+//renderImage отрисовка картинки трека в w
+func renderImage(ctx context.Context, fileName string, p tImageParams, w io.Writer) error {
+	pk, err := loadPeaks(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	if p.Kind == "waveform" {
+		if p.Format == "svg" {
+			return renderWaveformSVG(w, pk, p)
+		}
+		return renderWaveformPNG(w, pk, p)
+	}
+
+	pcm, fd, err := openPCM(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	spec, err := computeSpectrogram(pcm, pk.Length*pk.SamplesPerPixel, p.Width, p.Height)
+	if err != nil {
+		return err
+	}
+	return renderSpectrogramPNG(w, spec, p)
+}
+
+//buildImage отрисовка картинки трека в кэш с вытеснением лишних (см. evictImages)
+func buildImage(ctx context.Context, fileName string, p tImageParams) error {
+	err := saveDerived(imagePath(fileName, p), func(w io.Writer) error {
+		return renderImage(ctx, fileName, p, w)
+	})
+	if err == nil {
+		evictImages(fileName)
+	}
+	return err
+}
+
+//evictImages удаление из кэша картинок трека fileName сверх imagesPerTrack — давно
+//	не запрошенных (время изменения файла обновляется при каждой выдаче)
+func evictImages(fileName string) {
+	files, _ := filepath.Glob(path.Join(mediaDir, imagesDir, fileName+".*"))
+	if len(files) <= imagesPerTrack {
+		return
+	}
+	used := make(map[string]time.Time, len(files))
+	for _, name := range files {
+		if st, err := os.Stat(name); err == nil {
+			used[name] = st.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return used[files[i]].After(used[files[j]]) })
+	for _, name := range files[imagesPerTrack:] {
+		os.Remove(name)
+	}
+}
+
+//Waveform картинка волновой формы трека. Метод GET, доступ — как у Get
+//Параметры: track — id трека; format — png|svg; width, height — размер в пикселях;
+//	color — цвет rrggbb, background — фон rrggbb|transparent; token — необязательный
+//Результат: статус ОК, картинка с ETag (If-None-Match — статус NotModified)
+//Ошибка: статус NotFound если нет файла трека
+func (afl *Audiofill) Waveform(resp http.ResponseWriter, req *http.Request) {
+	afl.trackImage(resp, req, "waveform")
+}
+
+//Spectrogram картинка спектрограммы трека (png). Метод GET, доступ — как у Get
+//Параметры: track — id трека; width, height — размер в пикселях; color — цвет
+//	максимального уровня, background — фон (тишина); token — необязательный
+//Результат: статус ОК, картинка с ETag (If-None-Match — статус NotModified)
+//Ошибка: статус NotFound если нет файла трека
+func (afl *Audiofill) Spectrogram(resp http.ResponseWriter, req *http.Request) {
+	afl.trackImage(resp, req, "spectrogram")
+}
+
+//trackImage выдача картинки трека вида kind из кэша, при отсутствии — отрисовка в
+//	кэш. Одинаковые одновременные запросы ждут одной отрисовки. Картинка не
+//	меняется, пока у трека тот же файл, ETag — по имени файла в кэше
+func (afl *Audiofill) trackImage(resp http.ResponseWriter, req *http.Request, kind string) {
+	var (
+		err      error
+		ok       bool
+		fileName string
+		p        tImageParams
+	)
+
+	if _, _, _, fileName, ok = afl.mediaAccess(resp, req); !ok {
+		return
+	}
+	if p, err = imageParams(req, kind); err != nil {
+		paramError(resp, err)
+		return
+	}
+	if _, err = os.Stat(path.Join(mediaDir, fileName)); err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
+		return
+	}
+
+	dst := imagePath(fileName, p)
+	if _, err = os.Stat(dst); os.IsNotExist(err) {
+		job := startJob(dst, func() error {
+			return buildImage(context.Background(), fileName, p)
+		})
+		select {
+		case <-job.done:
+			err = job.err
+		case <-req.Context().Done():
+			return
+		}
+	} else if err == nil {
+		now := time.Now() //	время выдачи — для вытеснения давно не запрошенных
+		os.Chtimes(dst, now, now)
+	}
+	if err == errTranscodeBusy {
+		apiError(resp, http.StatusServiceUnavailable, "transcoder busy")
+		return
+	} else if err != nil {
+		internalError(resp, err, "Audio.trackImage failed:")
+		return
+	}
+	fd, err := os.Open(dst)
+	if err != nil {
+		internalError(resp, err, "Audio.trackImage open failed:")
+		return
+	}
+	defer fd.Close()
+
+	sum := sha1.Sum([]byte(path.Base(dst)))
+	resp.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	resp.Header().Set("Cache-Control", "private, max-age=86400")
+	resp.Header().Set("Content-Type", imageTypes[p.Format])
+	http.ServeContent(resp, req, "", time.Time{}, fd)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageParams(t *testing.T) {
+	def := imageDefaults["waveform"]
+	custom := def
+	custom.Format, custom.Width, custom.Height = "svg", 300, 40
+	custom.Color, custom.Background = color.NRGBA{0xFF, 0, 0x10, 0xFF}, color.NRGBA{0xEE, 0xEE, 0xEE, 0xFF}
+	spec := imageDefaults["spectrogram"]
+	spec.Background = color.NRGBA{}
+
+	tests := []struct {
+		kind  string
+		query string
+		res   tImageParams
+		err   error
+	}{
+		{"waveform", "", def, nil},
+		{"waveform", "format=SVG&width=300&height=40&color=%23FF0010&background=eeeeee", custom, nil},
+		{"spectrogram", "background=transparent", spec, nil},
+		{"spectrogram", "format=svg", tImageParams{}, &tFieldError{Field: "format", Reason: "invalid"}},
+		{"waveform", "format=gif", tImageParams{}, &tFieldError{Field: "format", Reason: "invalid"}},
+		{"waveform", "width=8", tImageParams{}, &tFieldError{Field: "width", Reason: "invalid"}},
+		{"waveform", "height=x", tImageParams{}, &tFieldError{Field: "height", Reason: "invalid"}},
+		{"waveform", "color=transparent", tImageParams{}, &tFieldError{Field: "color", Reason: "invalid"}},
+		{"waveform", "background=12345g", tImageParams{}, &tFieldError{Field: "background", Reason: "invalid"}},
+	}
+	for idx, tst := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/tracks/1/"+tst.kind+"?"+tst.query, nil)
+		req.ParseForm()
+		res, err := imageParams(req, tst.kind)
+		if !reflect.DeepEqual(err, tst.err) || (err == nil && res != tst.res) {
+			t.Errorf("imageParams: test [%d] wrong result %+v %v", idx, res, err)
+		}
+	}
+	if key := custom.key(); key != "waveform-300x40-ff0010-eeeeee.svg" {
+		t.Errorf("tImageParams.key: wrong result %s", key)
+	}
+	if key := def.key(); key != "waveform-800x120-3366cc-none.png" {
+		t.Errorf("tImageParams.key: wrong result %s", key)
+	}
+}
+
+func TestFFT(t *testing.T) {
+	//	сравнение с прямым расчетом ДПФ
+	x := make([]complex128, 16)
+	for i := range x {
+		x[i] = complex(math.Sin(float64(i)*0.7)+float64(i%3), 0)
+	}
+	want := make([]complex128, len(x))
+	for k := range want {
+		for i, v := range x {
+			want[k] += v * cmplx.Exp(complex(0, -2*math.Pi*float64(k*i)/float64(len(x))))
+		}
+	}
+	fft(x)
+	for k := range x {
+		if cmplx.Abs(x[k]-want[k]) > 1e-9 {
+			t.Errorf("fft: bin %d = %v, expected %v", k, x[k], want[k])
+		}
+	}
+}
+
+func TestWaveformImage(t *testing.T) {
+	//	первая половина — полная шкала, вторая — тишина
+	pk := &tPeaks{SampleRate: 8000, SamplesPerPixel: 256, Length: 8,
+		Data: []int{-32768, 32767, -32768, 32767, -32768, 32767, -32768, 32767, 0, 0, 0, 0, 0, 0, 0, 0}}
+	p := imageDefaults["waveform"]
+	p.Width, p.Height = 4, 21
+
+	buf := &bytes.Buffer{}
+	if err := renderWaveformPNG(buf, pk, p); err != nil {
+		t.Fatalf("renderWaveformPNG: failed %s", err.Error())
+	}
+	img, err := png.Decode(buf)
+	if err != nil || img.Bounds().Dx() != 4 || img.Bounds().Dy() != 21 {
+		t.Fatalf("renderWaveformPNG: wrong image %v", err)
+	}
+	for _, pt := range []struct {
+		x, y int
+		c    color.NRGBA
+	}{{0, 0, p.Color}, {1, 20, p.Color}, {2, 10, p.Color}, {2, 9, color.NRGBA{}}, {3, 0, color.NRGBA{}}} {
+		if c := color.NRGBAModel.Convert(img.At(pt.x, pt.y)); c != pt.c {
+			t.Errorf("renderWaveformPNG: pixel %d,%d = %v, expected %v", pt.x, pt.y, c, pt.c)
+		}
+	}
+
+	buf.Reset()
+	p.Format, p.Background = "svg", color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	if err := renderWaveformSVG(buf, pk, p); err != nil {
+		t.Fatalf("renderWaveformSVG: failed %s", err.Error())
+	}
+	for _, part := range []string{`width="4" height="21"`, `fill="#ffffff"`, `d="M0.5 0V21M1.5 0V21M2.5 10V11M3.5 10V11"`, `stroke="#3366cc"`} {
+		if !strings.Contains(buf.String(), part) {
+			t.Errorf("renderWaveformSVG: no %s in %s", part, buf.String())
+		}
+	}
+}
+
+func TestSpectrogram(t *testing.T) {
+	//	синус 2 кГц при 8 кГц — ровно середина шкалы частот
+	samples := make([]float64, 8000)
+	for i := range samples {
+		samples[i] = 0.5 * math.Sin(2*math.Pi*2000*float64(i)/8000)
+	}
+	pcm, _ := readWAV(bytes.NewReader(testWAV(8000, 1, 16, 1, samples)))
+	spec, err := computeSpectrogram(pcm, len(samples), 10, 64)
+	if err != nil || len(spec) != 10 {
+		t.Fatalf("computeSpectrogram: wrong result %v %d", err, len(spec))
+	}
+	for x, col := range spec {
+		top := 0
+		for y := range col {
+			if col[y] > col[top] {
+				top = y
+			}
+		}
+		//	крайние окна захватывают начало и конец сигнала — широкий спектр
+		inner := x > 0 && x < len(spec)-1
+		if top != 31 || col[top] < 0.9 || (inner && col[0] > 0.1) {
+			t.Errorf("computeSpectrogram: column %d peak at %d = %f, top row %f", x, top, col[top], col[0])
+		}
+	}
+
+	p := imageDefaults["spectrogram"]
+	p.Width, p.Height = 10, 64
+	buf := &bytes.Buffer{}
+	if err = renderSpectrogramPNG(buf, spec, p); err != nil {
+		t.Fatalf("renderSpectrogramPNG: failed %s", err.Error())
+	}
+	img, err := png.Decode(buf)
+	if err != nil || img.Bounds().Dx() != 10 || img.Bounds().Dy() != 64 {
+		t.Fatalf("renderSpectrogramPNG: wrong image %v", err)
+	}
+	if c := color.NRGBAModel.Convert(img.At(5, 0)); c != p.Background {
+		t.Errorf("renderSpectrogramPNG: silence pixel %v", c)
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	if _, err := os.Stat(mediaDir); os.IsNotExist(err) {
+		os.Mkdir(mediaDir, 0755)
+		defer os.RemoveAll(mediaDir)
+	}
+	ioutil.WriteFile(path.Join(mediaDir, "image-wav"), testWAV(8000, 1, 16, 1, make([]float64, 4000)), 0644)
+	defer removeMedia("image-wav")
+
+	//	в кэше остаются imagesPerTrack последних запрошенных
+	var sizes []tImageParams
+	os.MkdirAll(path.Join(mediaDir, imagesDir), 0755)
+	for i := 0; i < imagesPerTrack+2; i++ {
+		p := imageDefaults["waveform"]
+		p.Width = 100 + i
+		ioutil.WriteFile(imagePath("image-wav", p), []byte("png"), 0644)
+		used := time.Now().Add(time.Duration(i-100) * time.Minute)
+		os.Chtimes(imagePath("image-wav", p), used, used)
+		sizes = append(sizes, p)
+	}
+	evictImages("image-wav")
+	for i, p := range sizes {
+		if _, err := os.Stat(imagePath("image-wav", p)); os.IsNotExist(err) != (i < 2) {
+			t.Errorf("evictImages: %s wrong result %v", p.key(), err)
+		}
+	}
+
+	for _, kind := range []string{"waveform", "spectrogram"} {
+		p := imageDefaults[kind]
+		p.Width, p.Height = 32, 16
+		if err := buildImage(context.Background(), "image-wav", p); err != nil {
+			t.Fatalf("buildImage: %s failed %s", kind, err.Error())
+		}
+		data, _ := ioutil.ReadFile(imagePath("image-wav", p))
+		if img, err := png.Decode(bytes.NewReader(data)); err != nil || img.Bounds().Dx() != 32 {
+			t.Errorf("buildImage: %s wrong image %v", kind, err)
+		}
+	}
+
+	removeMedia("image-wav")
+	if _, err := os.Stat(imagePath("image-wav", imageDefaults["waveform"])); !os.IsNotExist(err) {
+		t.Errorf("removeMedia: image left")
+	}
+}
+
+func TestImages(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	tests := []struct {
+		path   string
+		status int
+		err    string
+	}{
+		{"/tracks/1/waveform", http.StatusNotFound, "file not found"},
+		{"/tracks/1/spectrogram", http.StatusNotFound, "file not found"},
+		{"/tracks/4/waveform", http.StatusNotFound, "track not found"},
+		{"/tracks/1/waveform?width=10000", http.StatusBadRequest, "invalid width value"},
+		{"/tracks/1/spectrogram?format=svg", http.StatusBadRequest, "invalid format value"},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+tst.path, nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Images: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Images: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, body, tst.status, tst.err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//startJobs запуск фоновых заданий сервера
+func startJobs(db *sql.DB) {
+	go func() {
+		client := webhookClient()
+		tick := time.NewTicker(webhookPoll)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-webhookWake:
+			}
+			//	пока пачки приходят полными — в очереди есть еще
+			for {
+				cnt, err := deliverWebhooks(db, client)
+				if err != nil {
+					log.Println("Jobs.deliverWebhooks failed:", err.Error())
+				}
+				if err != nil || cnt < webhookBatch {
+					break
+				}
+			}
+		}
+	}()
+
+	go func() {
+		tick := time.NewTicker(shareExpireInterval)
+		defer tick.Stop()
+		for range tick.C {
+			cnt, err := expireShares(db)
+			if err != nil {
+				log.Println("Jobs.expireShares failed:", err.Error())
+			} else if cnt > 0 {
+				log.Println("Jobs.expireShares: expired grants removed", cnt)
+			}
+		}
+	}()
+}
+
+//expireShares удаление просроченных "расшариваний". Каждое удаление
+//	фиксируется в журнале аудита в той же транзакции
+func expireShares(db *sql.DB) (cnt int, err error) {
+	type tExpired struct {
+		AudioID int       `json:"audio"`
+		UserID  int       `json:"user"`
+		Expires time.Time `json:"expires_at"`
+	}
+	var (
+		tx   *sql.Tx
+		qs   *sql.Rows
+		list []tExpired
+	)
+
+	if tx, err = db.Begin(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	qs, err = tx.Query(`DELETE FROM share WHERE expires_at <= now()
+		RETURNING id_audio, id_user, expires_at`)
+	if err != nil {
+		return
+	}
+	//	в рамках одной транзакции нельзя выполнять запросы, пока не прочитан
+	//	результат предыдущего — сначала собираем список, потом пишем в журнал
+	for qs.Next() {
+		var exp pq.NullTime
+		sh := tExpired{}
+		if err = qs.Scan(&sh.AudioID, &sh.UserID, &exp); err != nil {
+			qs.Close()
+			return
+		}
+		sh.Expires = exp.Time
+		list = append(list, sh)
+	}
+	qs.Close()
+	if err = qs.Err(); err != nil {
+		return
+	}
+
+	for _, sh := range list {
+		if err = auditLog(tx, 0, "share.expired", sh); err != nil {
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return len(list), nil
+}
+
+//analyzeUpload фоновый разбор загруженного файла трека: акустический отпечаток
+//	(если fpDone не nil — еще и туда, nil при ошибке), пики волновой формы,
+//	громкость, уменьшенные копии встроенной обложки. Ошибки только в лог — отпечаток,
+//	пики и копии обложки будут сделаны при запросе, громкость трека останется пустой
+func analyzeUpload(db *sql.DB, tr int, fileName string, fpDone chan<- []uint32) {
+	fp, err := fileFingerprint(context.Background(), fileName)
+	if err != nil {
+		log.Println("Jobs.analyzeUpload fingerprint failed:", tr, err.Error())
+	} else if _, err = db.Exec(`UPDATE audio SET fingerprint = $3 WHERE id_audio = $1 AND filename = $2`,
+		tr, fileName, fingerprintBytes(fp)); err != nil {
+		log.Println("Jobs.analyzeUpload fingerprint saving failed:", tr, err.Error())
+	}
+	if fpDone != nil {
+		fpDone <- fp
+	}
+
+	if _, err := os.Stat(embeddedArtworkPath(fileName)); err == nil {
+		artworkThumbs(embeddedArtworkPath(fileName))
+	}
+	if _, err := loadPeaks(context.Background(), fileName); err != nil {
+		log.Println("Jobs.analyzeUpload peaks failed:", tr, err.Error())
+	}
+	if err := analyzeLoudness(context.Background(), db, tr, fileName); err != nil {
+		log.Println("Jobs.analyzeUpload loudness failed:", tr, err.Error())
+	}
+}
+
+//tJob задание, которое уже выполняется: остальные запросы того же результата
+//	ждут его завершения (done закрывается), а не запускают свое
+type tJob struct {
+	done chan struct{}
+	err  error
+}
+
+//jobs выполняющиеся задания по ключу — обычно пути к файлу результата
+var jobs = struct {
+	sync.Mutex
+	m map[string]*tJob
+}{m: map[string]*tJob{}}
+
+//startJob запуск fn в фоне, если задание key еще не выполняется
+//Результат: новое либо уже выполняющееся задание
+func startJob(key string, fn func() error) *tJob {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if job, ok := jobs.m[key]; ok {
+		return job
+	}
+
+	job := &tJob{done: make(chan struct{})}
+	jobs.m[key] = job
+	go func() {
+		job.err = fn()
+		jobs.Lock()
+		delete(jobs.m, key)
+		jobs.Unlock()
+		close(job.done)
+	}()
+	return job
+}
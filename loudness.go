@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"math"
+	"sort"
+)
+
+//Громкость по ITU-R BS.1770-4 и EBU R128 (Tech 3341, 3342): интегральная громкость
+//	(LUFS) со стробированием, true-peak (dBTP) по сигналу с передискретизацией,
+//	диапазон громкости LRA (LU). По интегральной громкости — ReplayGain 2.0
+
+const (
+	loudnessGate     = -70.0 //	абсолютный порог блоков, LUFS
+	loudnessRelGate  = -10.0 //	относительный порог интегральной громкости, LU
+	loudnessLRAGate  = -20.0 //	относительный порог LRA, LU
+	replayGainRef    = -18.0 //	опорная громкость ReplayGain 2.0, LUFS
+	truePeakFloor    = -99.0 //	true-peak тишины, dBTP
+	loudnessStepMs   = 100   //	шаг блоков, мс: 400 мс блок — 4 шага, 3 с — 30
+	truePeakTaps     = 12    //	отводов фильтра передискретизации на фазу
+	loudnessBlockLen = 4
+	loudnessShortLen = 30
+)
+
+//tLoudness результат анализа громкости трека
+type tLoudness struct {
+	Integrated float64  `json:"integrated"`      //	LUFS, тишина — loudnessGate
+	TruePeak   float64  `json:"true_peak"`       //	dBTP
+	Range      float64  `json:"range"`           //	LRA, LU
+	TrackGain  *float64 `json:"replaygain_gain"` //	дБ до replayGainRef, nil — тишина
+	TrackPeak  float64  `json:"replaygain_peak"` //	true-peak, линейный (1 — полная шкала)
+}
+
+//tBiquad звено IIR второго порядка (прямая форма I)
+type tBiquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *tBiquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x1, f.x2, f.y1, f.y2 = x, f.x1, y, f.y1
+	return y
+}
+
+//kWeighting фильтры K-взвешивания BS.1770 для частоты rate: полка высоких частот
+//	и фильтр верхних частот RLB. Коэффициенты пересчитываются из аналоговых
+//	прототипов, на 48 кГц совпадают с таблицами стандарта
+func kWeighting(rate int) (shelf, hp tBiquad) {
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / float64(rate))
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf = tBiquad{b0: (vh + vb*k/q + k*k) / a0, b1: 2 * (k*k - vh) / a0, b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0, a2: (1 - k/q + k*k) / a0}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / float64(rate))
+	a0 = 1 + k/q + k*k
+	hp = tBiquad{b0: 1, b1: -2, b2: 1, a1: 2 * (k*k - 1) / a0, a2: (1 - k/q + k*k) / a0}
+	return shelf, hp
+}
+
+//channelWeights веса каналов BS.1770: для 5.0 и 5.1 (L R C [LFE] Ls Rs) объемные
+//	каналы 1.41, LFE не учитывается, остальные раскладки — все каналы 1
+func channelWeights(channels int) []float64 {
+	switch channels {
+	case 5:
+		return []float64{1, 1, 1, 1.41, 1.41}
+	case 6:
+		return []float64{1, 1, 1, 0, 1.41, 1.41}
+	}
+	w := make([]float64, channels)
+	for i := range w {
+		w[i] = 1
+	}
+	return w
+}
+
+//tTruePeak поиск true-peak канала: 4-кратная передискретизация (2-кратная от
+//	96 кГц, без нее от 192 кГц) полифазным FIR с окном Ханна
+type tTruePeak struct {
+	phases [][]float64
+	hist   []float64 //	последние truePeakTaps сэмплов, hist[0] — самый новый
+	peak   float64
+}
+
+func newTruePeak(rate int) *tTruePeak {
+	factor := 4
+	if rate >= 192000 {
+		factor = 1
+	} else if rate >= 96000 {
+		factor = 2
+	}
+	tp := &tTruePeak{hist: make([]float64, truePeakTaps), phases: make([][]float64, factor)}
+	n := truePeakTaps * factor
+	for ph := range tp.phases {
+		tp.phases[ph] = make([]float64, truePeakTaps)
+		if factor == 1 {
+			tp.phases[ph][0] = 1
+			continue
+		}
+		for j := range tp.phases[ph] {
+			//	отвод i = j*factor + ph фильтра длиной n, задержка (n-1)/2
+			i := j*factor + ph
+			t := float64(i) - float64(n-1)/2
+			sinc := 1.0
+			if t != 0 {
+				sinc = math.Sin(math.Pi*t/float64(factor)) / (math.Pi * t / float64(factor))
+			}
+			window := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i+1)/float64(n+1))
+			tp.phases[ph][j] = sinc * window
+		}
+	}
+	return tp
+}
+
+func (tp *tTruePeak) add(x float64) {
+	copy(tp.hist[1:], tp.hist)
+	tp.hist[0] = x
+	tp.peak = math.Max(tp.peak, math.Abs(x))
+	for _, coef := range tp.phases {
+		v := 0.0
+		for j, c := range coef {
+			v += c * tp.hist[j]
+		}
+		tp.peak = math.Max(tp.peak, math.Abs(v))
+	}
+}
+
+//blockLoudness громкость блока по сумме взвешенных средних квадратов
+func blockLoudness(z float64) float64 {
+	return -0.691 + 10*math.Log10(z)
+}
+
+//measureLoudness анализ громкости потока pcm
+func measureLoudness(pcm *tPCM) (ld *tLoudness, err error) {
+	var n int
+
+	weights := channelWeights(pcm.Channels)
+	filters := make([][2]tBiquad, pcm.Channels)
+	peaks := make([]*tTruePeak, pcm.Channels)
+	for ch := range filters {
+		filters[ch][0], filters[ch][1] = kWeighting(pcm.Rate)
+		peaks[ch] = newTruePeak(pcm.Rate)
+	}
+
+	//	steps — взвешенные средние квадраты по шагам loudnessStepMs: блоки
+	//	400 мс и 3 с — средние соседних шагов
+	stepLen := pcm.Rate * loudnessStepMs / 1000
+	var steps []float64
+	sum, cnt := 0.0, 0
+	buf := make([]float64, 4096*pcm.Channels)
+	for err == nil {
+		n, err = pcm.Read(buf)
+		for i := 0; i+pcm.Channels <= n; i += pcm.Channels {
+			for ch, x := range buf[i : i+pcm.Channels] {
+				peaks[ch].add(x)
+				y := filters[ch][1].filter(filters[ch][0].filter(x))
+				sum += weights[ch] * y * y
+			}
+			if cnt++; cnt == stepLen {
+				steps = append(steps, sum/float64(stepLen))
+				sum, cnt = 0, 0
+			}
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+
+	//	ни один блок не выше абсолютного порога (тишина, трек короче 400 мс) —
+	//	усиление до опорной громкости не определено
+	ld = &tLoudness{Integrated: loudnessGate}
+	blocks := gatedBlocks(steps, loudnessBlockLen)
+	if len(blocks) > 0 {
+		rel := blockLoudness(meanOf(blocks)) + loudnessRelGate
+		ld.Integrated = blockLoudness(meanOf(aboveGate(blocks, rel)))
+		gain := replayGainRef - ld.Integrated
+		ld.TrackGain = &gain
+	}
+
+	short := gatedBlocks(steps, loudnessShortLen)
+	if len(short) > 0 {
+		rel := blockLoudness(meanOf(short)) + loudnessLRAGate
+		var lev []float64
+		for _, z := range aboveGate(short, rel) {
+			lev = append(lev, blockLoudness(z))
+		}
+		sort.Float64s(lev)
+		ld.Range = percentile(lev, 0.95) - percentile(lev, 0.10)
+	}
+
+	for _, tp := range peaks {
+		ld.TrackPeak = math.Max(ld.TrackPeak, tp.peak)
+	}
+	ld.TruePeak = truePeakFloor
+	if ld.TrackPeak > 0 {
+		ld.TruePeak = math.Max(truePeakFloor, 20*math.Log10(ld.TrackPeak))
+	}
+	return ld.round(), nil
+}
+
+//gatedBlocks средние квадраты блоков из size шагов (шаг — четверть блока 400 мс),
+//	громкость которых выше абсолютного порога
+func gatedBlocks(steps []float64, size int) (blocks []float64) {
+	for i := 0; i+size <= len(steps); i++ {
+		z := 0.0
+		for _, v := range steps[i : i+size] {
+			z += v
+		}
+		if z /= float64(size); blockLoudness(z) > loudnessGate {
+			blocks = append(blocks, z)
+		}
+	}
+	return blocks
+}
+
+//aboveGate блоки громче порога gate, LUFS
+func aboveGate(blocks []float64, gate float64) (res []float64) {
+	for _, z := range blocks {
+		if blockLoudness(z) > gate {
+			res = append(res, z)
+		}
+	}
+	return res
+}
+
+func meanOf(v []float64) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += x
+	}
+	return sum / float64(len(v))
+}
+
+//percentile значение отсортированного списка на уровне p (линейная интерполяция)
+func percentile(sorted []float64, p float64) float64 {
+	pos := p * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(pos-float64(i))
+}
+
+//round округление до точности хранения в таблице audio
+func (ld *tLoudness) round() *tLoudness {
+	r := func(v, prec float64) float64 { return math.Round(v*prec) / prec }
+	ld.Integrated, ld.TruePeak, ld.Range = r(ld.Integrated, 100), r(ld.TruePeak, 100), r(ld.Range, 100)
+	if ld.TrackGain != nil {
+		*ld.TrackGain = r(*ld.TrackGain, 100)
+	}
+	ld.TrackPeak = r(ld.TrackPeak, 1e6)
+	return ld
+}
+
+//analyzeLoudness анализ громкости файла трека и запись в audio. Запись только если
+//	у трека все еще тот же файл — за время анализа его могли заменить
+func analyzeLoudness(ctx context.Context, db *sql.DB, tr int, fileName string) error {
+	pcm, fd, err := openPCM(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	ld, err := measureLoudness(pcm)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE audio SET loudness = $3, true_peak = $4, loudness_range = $5,
+			replaygain_gain = $6, replaygain_peak = $7
+		WHERE id_audio = $1 AND filename = $2`,
+		tr, fileName, ld.Integrated, ld.TruePeak, ld.Range, ld.TrackGain, ld.TrackPeak)
+	return err
+}
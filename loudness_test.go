@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+//testSine сэмплы синуса freq Гц амплитуды amp (доля полной шкалы) на всех каналах
+func testSine(rate, channels int, freq, amp, phase float64, secs float64) []float64 {
+	var res []float64
+	for i := 0; i < int(float64(rate)*secs); i++ {
+		v := amp * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)+phase)
+		for ch := 0; ch < channels; ch++ {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func TestKWeighting(t *testing.T) {
+	//	таблицы 1 и 2 BS.1770-4 для 48 кГц
+	shelf, hp := kWeighting(48000)
+	for _, tst := range []struct{ res, want float64 }{
+		{shelf.b0, 1.53512485958697}, {shelf.b1, -2.69169618940638}, {shelf.b2, 1.19839281085285},
+		{shelf.a1, -1.69065929318241}, {shelf.a2, 0.73248077421585},
+		{hp.a1, -1.99004745483398}, {hp.a2, 0.99007225036621},
+	} {
+		if math.Abs(tst.res-tst.want) > 1e-6 {
+			t.Errorf("kWeighting: coefficient %.14f, expected %.14f", tst.res, tst.want)
+		}
+	}
+}
+
+func TestLoudness(t *testing.T) {
+	measure := func(rate, channels int, samples []float64) *tLoudness {
+		pcm, _ := readWAV(bytes.NewReader(testWAV(rate, channels, 32, 3, samples)))
+		ld, err := measureLoudness(pcm)
+		if err != nil {
+			t.Fatalf("measureLoudness: failed %s", err.Error())
+		}
+		return ld
+	}
+	amp := func(db float64) float64 { return math.Pow(10, db/20) }
+
+	//	EBU Tech 3341: стерео синус 1 кГц -23 dBFS — -23 LUFS; моно на 3 дБ тише
+	ld := measure(48000, 2, testSine(48000, 2, 1000, amp(-23), 0, 5))
+	if math.Abs(ld.Integrated+23) > 0.1 || ld.TrackGain == nil || math.Abs(*ld.TrackGain-5) > 0.1 || ld.Range > 0.1 {
+		t.Errorf("measureLoudness: stereo sine wrong result %+v", ld)
+	}
+	ld = measure(44100, 1, testSine(44100, 1, 1000, amp(-23), 0, 5))
+	if math.Abs(ld.Integrated+26) > 0.1 {
+		t.Errorf("measureLoudness: mono sine wrong result %+v", ld)
+	}
+
+	//	EBU Tech 3342: 20 с -20 dBFS, затем 20 с -30 dBFS — LRA 10 LU. Тихая часть
+	//	выше относительного порога (-35.6), интегральная — среднее энергий -23 и -33
+	samples := append(testSine(8000, 1, 1000, amp(-20), 0, 20), testSine(8000, 1, 1000, amp(-30), 0, 20)...)
+	ld = measure(8000, 1, samples)
+	if math.Abs(ld.Range-10) > 1 || math.Abs(ld.Integrated+25.59) > 0.1 {
+		t.Errorf("measureLoudness: two levels wrong result %+v", ld)
+	}
+
+	//	синус fs/4 со сдвигом фазы 45°: сэмплы -9 dBFS, true-peak -6 dBTP
+	ld = measure(48000, 1, testSine(48000, 1, 12000, 0.5, math.Pi/4, 1))
+	if math.Abs(ld.TruePeak+6.02) > 0.5 || math.Abs(ld.TrackPeak-0.5) > 0.03 {
+		t.Errorf("measureLoudness: true-peak wrong result %+v", ld)
+	}
+
+	//	тишина и трек короче блока 400 мс — без усиления ReplayGain
+	ld = measure(8000, 2, make([]float64, 16000))
+	if *ld != (tLoudness{Integrated: loudnessGate, TruePeak: truePeakFloor}) {
+		t.Errorf("measureLoudness: silence wrong result %+v", ld)
+	}
+	ld = measure(48000, 1, testSine(48000, 1, 1000, amp(-23), 0, 0.3))
+	if ld.Integrated != loudnessGate || ld.TrackGain != nil || ld.TrackPeak == 0 {
+		t.Errorf("measureLoudness: short track wrong result %+v", ld)
+	}
+}
+
+func TestLoudnessAnalysis(t *testing.T) {
+	var fileName string
+
+	if err := testDB.QueryRow(`SELECT filename FROM audio WHERE id_audio = 1`).Scan(&fileName); err != nil {
+		t.Fatalf("Loudness: track file name failed %s", err.Error())
+	}
+	if fileName == "" {
+		fileName = "loudness-test"
+		testDB.Exec(`UPDATE audio SET filename = $1 WHERE id_audio = 1`, fileName)
+		defer testDB.Exec(`UPDATE audio SET filename = '' WHERE id_audio = 1`)
+	}
+	defer testDB.Exec(`UPDATE audio SET loudness = NULL, true_peak = NULL, loudness_range = NULL,
+		replaygain_gain = NULL, replaygain_peak = NULL WHERE id_audio = 1`)
+
+	if _, err := os.Stat(mediaDir); os.IsNotExist(err) {
+		os.Mkdir(mediaDir, 0755)
+		defer os.RemoveAll(mediaDir)
+	}
+	if _, err := os.Stat(path.Join(mediaDir, fileName)); err == nil {
+		t.Skip("Loudness: track file exists, not overwritten")
+	}
+	wav := testWAV(48000, 2, 32, 3, testSine(48000, 2, 1000, math.Pow(10, -23.0/20), 0, 2))
+	ioutil.WriteFile(path.Join(mediaDir, fileName), wav, 0644)
+	defer removeMedia(fileName)
+
+	//	файл трека уже заменен — результат не записывается
+	if err := analyzeLoudness(context.Background(), testDB, 2, fileName); err != nil {
+		t.Fatalf("analyzeLoudness: failed %s", err.Error())
+	}
+	if err := analyzeLoudness(context.Background(), testDB, 1, fileName); err != nil {
+		t.Fatalf("analyzeLoudness: failed %s", err.Error())
+	}
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	for _, tst := range []struct {
+		track int
+		set   bool
+	}{{1, true}, {2, false}} {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+"/tracks/"+[]string{"", "1", "2"}[tst.track], nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Loudness: query failed %s", err.Error())
+		}
+		ad := &tAudio{}
+		json.NewDecoder(resp.Body).Decode(ad)
+		resp.Body.Close()
+		if (ad.Loudness != nil) != tst.set || (tst.set && math.Abs(ad.Loudness.Integrated+23) > 0.1) {
+			t.Errorf("Loudness: track %d wrong result %+v", tst.track, ad.Loudness)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//lyricsFormats форматы текста трека: plain — строки без времени, lrc — строки с
+//	временем начала, vtt и srt — реплики расшифровки с началом и концом
+var lyricsFormats = map[string]bool{"plain": true, "lrc": true, "vtt": true, "srt": true}
+
+//tLyricLine строка текста трека. Время в секундах, у plain его нет, у lrc нет конца
+type tLyricLine struct {
+	Start *float64 `json:"start,omitempty"`
+	End   *float64 `json:"end,omitempty"`
+	Text  string   `json:"text"`
+}
+
+//tLyrics текст песни или расшифровка трека после разбора. Source — file
+//	(из тегов файла) или upload (загружен владельцем), Language — код ISO 639
+type tLyrics struct {
+	Format   string        `json:"format"`
+	Synced   bool          `json:"synced"`
+	Language string        `json:"language,omitempty"`
+	Source   string        `json:"source"`
+	Lines    []*tLyricLine `json:"lines"`
+}
+
+//errLyricsEmpty в тексте нет ни одной строки (для lrc, vtt, srt — ни одной
+//	строки со временем)
+var errLyricsEmpty = errors.New("lyrics are empty")
+
+var (
+	//	метка времени LRC [mm:ss.xx], тег [name:value] и сдвиг [offset:±мс]
+	lrcTimeRe   = regexp.MustCompile(`^\[(\d+:\d{1,2}(?:\.\d+)?)\]`)
+	lrcTagRe    = regexp.MustCompile(`^\[[a-zA-Z#]+:.*\]$`)
+	lrcOffsetRe = regexp.MustCompile(`(?mi)^\s*\[offset:\s*([+-]?\d+)\s*\]`)
+	//	время слова в расширенном LRC <mm:ss.xx>
+	lrcWordRe = regexp.MustCompile(`<\d+:\d{1,2}(?:\.\d+)?>`)
+	//	строка времени реплики WebVTT/SRT, после конца в WebVTT — настройки
+	cueTimeRe = regexp.MustCompile(`^(\S+)\s+-->\s+(\S+)`)
+	//	теги разметки реплик: <i>, </b>, <v Name>, <00:01.000>; {\an8} в SRT
+	cueTagRe = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+	//	код языка ISO 639-1/639-2
+	languageRe = regexp.MustCompile(`^[a-z]{2,3}$`)
+)
+
+//msec время в секундах для json из миллисекунд
+func msec(ms int) *float64 {
+	s := float64(ms) / 1000
+	return &s
+}
+
+//lyricsFormat формат текста по содержимому: заголовок WEBVTT, строка времени
+//	реплики, метка времени LRC в начале строки, иначе plain
+func lyricsFormat(text string) string {
+	if strings.HasPrefix(text, "WEBVTT") {
+		return "vtt"
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if cueTimeRe.MatchString(line) {
+			return "srt"
+		}
+		if lrcTimeRe.MatchString(line) {
+			return "lrc"
+		}
+	}
+	return "plain"
+}
+
+//parseLyrics разбор и нормализация текста трека в формате format ("" — по
+//	содержимому): переводы строк — \n, пробелы по краям строк убираются, у plain
+//	подряд идущие пустые строки (границы куплетов) схлопываются в одну, у
+//	синхронных строки сортируются по времени
+//Ошибка: текст не UTF-8, неверное время, errLyricsEmpty
+func parseLyrics(text, format string) (ly *tLyrics, err error) {
+	if !utf8.ValidString(text) {
+		return nil, errors.New("lyrics are not utf-8")
+	}
+	text = strings.TrimPrefix(text, "\uFEFF")
+	text = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text)
+	if format == "" {
+		format = lyricsFormat(text)
+	}
+
+	ly = &tLyrics{Format: format, Synced: format != "plain", Lines: []*tLyricLine{}}
+	switch format {
+	case "plain":
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" && (len(ly.Lines) == 0 || ly.Lines[len(ly.Lines)-1].Text == "") {
+				continue
+			}
+			ly.Lines = append(ly.Lines, &tLyricLine{Text: line})
+		}
+		if n := len(ly.Lines); n > 0 && ly.Lines[n-1].Text == "" {
+			ly.Lines = ly.Lines[:n-1]
+		}
+	case "lrc":
+		err = ly.parseLRC(text)
+	case "vtt", "srt":
+		err = ly.parseCues(text)
+	default:
+		return nil, fmt.Errorf("unknown lyrics format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ly.Lines) == 0 {
+		return nil, errLyricsEmpty
+	}
+	return ly, nil
+}
+
+//parseLRC строки LRC: одна или несколько меток времени и текст. Теги [ar:…]
+//	пропускаются, [offset:±мс] сдвигает время (положительный — строки раньше),
+//	время слов расширенного LRC убирается. Строки без меток пропускаются
+func (ly *tLyrics) parseLRC(text string) error {
+	var offset int
+
+	if m := lrcOffsetRe.FindStringSubmatch(text); m != nil {
+		offset, _ = strconv.Atoi(m[1])
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if lrcTagRe.MatchString(line) {
+			continue
+		}
+		var times []int
+		for m := lrcTimeRe.FindStringSubmatch(line); m != nil; m = lrcTimeRe.FindStringSubmatch(line) {
+			ms, err := parseTimestamp(m[1])
+			if err != nil {
+				return err
+			}
+			times = append(times, ms)
+			line = line[len(m[0]):]
+		}
+		line = strings.TrimSpace(lrcWordRe.ReplaceAllString(line, ""))
+		for _, ms := range times {
+			if ms -= offset; ms < 0 {
+				ms = 0
+			}
+			ly.Lines = append(ly.Lines, &tLyricLine{Start: msec(ms), Text: line})
+		}
+	}
+	sort.SliceStable(ly.Lines, func(i, j int) bool { return *ly.Lines[i].Start < *ly.Lines[j].Start })
+	return nil
+}
+
+//parseCues реплики WebVTT и SRT: блоки через пустую строку, в блоке реплики —
+//	необязательный идентификатор (номер в SRT), строка времени и текст. Блоки
+//	без строки времени (заголовок, NOTE, STYLE) пропускаются, разметка из текста
+//	убирается, реплики без текста пропускаются
+func (ly *tLyrics) parseCues(text string) error {
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			m := cueTimeRe.FindStringSubmatch(strings.TrimSpace(line))
+			if m == nil {
+				continue
+			}
+			start, err := parseTimestamp(strings.Replace(m[1], ",", ".", 1))
+			if err != nil {
+				return fmt.Errorf("invalid cue time %q", m[1])
+			}
+			end, err := parseTimestamp(strings.Replace(m[2], ",", ".", 1))
+			if err != nil || end < start {
+				return fmt.Errorf("invalid cue time %q", m[2])
+			}
+			var payload []string
+			for _, s := range lines[i+1:] {
+				if s = strings.TrimSpace(html.UnescapeString(cueTagRe.ReplaceAllString(s, ""))); s != "" {
+					payload = append(payload, s)
+				}
+			}
+			if len(payload) > 0 {
+				ly.Lines = append(ly.Lines, &tLyricLine{Start: msec(start), End: msec(end), Text: strings.Join(payload, "\n")})
+			}
+			break
+		}
+	}
+	sort.SliceStable(ly.Lines, func(i, j int) bool { return *ly.Lines[i].Start < *ly.Lines[j].Start })
+	return nil
+}
+
+//fileLyricsJSON текст трека из тегов файла name (ID3 SYLT/USLT, Vorbis LYRICS)
+//	json-объектом tLyrics для колонки audio.lyrics, нет текста — NULL
+func fileLyricsJSON(name string) sql.NullString {
+	meta, err := readMediaMeta(name)
+	if err != nil || meta.Lyrics == nil {
+		return sql.NullString{}
+	}
+	meta.Lyrics.Source = "file"
+	js, _ := json.Marshal(meta.Lyrics)
+	return sql.NullString{String: string(js), Valid: true}
+}
+
+//SetLyrics загрузка текста песни или расшифровки трека вместо текста из тегов
+//	файла. Метод PUT, доступен только владельцу
+//Параметры: track — id трека; file (multipart) или text — текст в UTF-8 до
+//	lyricsMaxSize; format — необязательный, plain|lrc|vtt|srt, по умолчанию — по
+//	расширению файла либо по содержимому; language — необязательный, код ISO 639
+//Результат: статус ОК
+//Ошибка: статус BadRequest если текст не разбирается
+//	статус Forbidden если пользователь не владелец, NotFound если записи нет
+func (afl *Audiofill) SetLyrics(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		tr       int
+		text     string
+		field    = "text"
+		format   string
+		language string
+		ly       *tLyrics
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		err = req.ParseMultipartForm(2 << 10)
+	} else {
+		err = req.ParseForm()
+	}
+	if err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if format = strings.ToLower(req.Form.Get("format")); format != "" && !lyricsFormats[format] {
+		fieldError(resp, "format", "invalid")
+		return
+	}
+	if language = strings.ToLower(strings.TrimSpace(req.Form.Get("language"))); language != "" && !languageRe.MatchString(language) {
+		fieldError(resp, "language", "invalid")
+		return
+	}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	if req.MultipartForm != nil && len(req.MultipartForm.File["file"]) > 0 {
+		field = "file"
+		fd, fh, err := req.FormFile("file")
+		if err != nil {
+			apiError(resp, http.StatusBadRequest, "file upload error")
+			return
+		}
+		defer fd.Close()
+		if fh.Size > int64(lyricsMaxSize) {
+			fieldError(resp, field, "invalid")
+			return
+		}
+		data, err := ioutil.ReadAll(fd)
+		if err != nil {
+			apiError(resp, http.StatusBadRequest, "file upload error")
+			return
+		}
+		text = string(data)
+		if ext := fileFormat(fh.Filename); format == "" && lyricsFormats[ext] {
+			format = ext
+		} else if format == "" && ext == "txt" {
+			format = "plain"
+		}
+	} else if text = req.Form.Get("text"); strings.TrimSpace(text) == "" {
+		fieldError(resp, field, "required")
+		return
+	}
+	if len(text) > lyricsMaxSize {
+		fieldError(resp, field, "invalid")
+		return
+	}
+	if ly, err = parseLyrics(text, format); err != nil {
+		fieldError(resp, field, "invalid")
+		return
+	}
+	ly.Source, ly.Language = "upload", language
+	js, _ := json.Marshal(ly)
+
+	if _, err = afl.DB.Exec(`UPDATE audio SET lyrics = $2 WHERE id_audio = $1`, tr, string(js)); err != nil {
+		dbError(resp, err, "Audio.SetLyrics query failed:")
+		return
+	}
+	publishTrackEvent(afl.DB, eventTrackUpdated, tr, afl.userID, 0)
+	resp.WriteHeader(http.StatusOK)
+}
+
+//DeleteLyrics удаление текста трека, загруженного или взятого из тегов файла.
+//	Текст из тегов снова появится с новой версией файла. Метод DELETE, доступен
+//	только владельцу
+//Параметры: track — id трека
+//Результат: статус ОК
+//Ошибка: статус NotFound если текста нет
+func (afl *Audiofill) DeleteLyrics(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		tr  int
+		qr  sql.Result
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	if qr, err = afl.DB.Exec(`UPDATE audio SET lyrics = NULL WHERE id_audio = $1 AND lyrics IS NOT NULL`, tr); err != nil {
+		dbError(resp, err, "Audio.DeleteLyrics query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "lyrics not found")
+		return
+	}
+	publishTrackEvent(afl.DB, eventTrackUpdated, tr, afl.userID, 0)
+	resp.WriteHeader(http.StatusOK)
+}
+
+//loadLyrics текст трека tr для Detail, nil — нет
+func (afl *Audiofill) loadLyrics(tr int) (ly *tLyrics, err error) {
+	var js sql.NullString
+
+	if err = afl.DB.QueryRow(`SELECT lyrics FROM audio WHERE id_audio = $1`, tr).Scan(&js); err != nil || !js.Valid {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(js.String), &ly)
+	return ly, err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//testLyricsLines строки текста одной строкой: "[start-end]text|…", время в секундах
+func testLyricsLines(ly *tLyrics) string {
+	var res []string
+	for _, l := range ly.Lines {
+		s := ""
+		if l.Start != nil {
+			s = "[" + strconv.FormatFloat(*l.Start, 'f', -1, 64)
+			if l.End != nil {
+				s += "-" + strconv.FormatFloat(*l.End, 'f', -1, 64)
+			}
+			s += "]"
+		}
+		res = append(res, s+l.Text)
+	}
+	return strings.Join(res, "|")
+}
+
+func TestParseLyrics(t *testing.T) {
+	tests := []struct {
+		text, format string
+		resFormat    string
+		res          string
+	}{
+		{"\uFEFF\r\n  First line \r\nsecond\r\n\r\n\r\n\r\nchorus\n\n", "", "plain", "First line|second||chorus"},
+		{"[ar:Artist]\n[offset:+500]\n[00:12.00][01:30.50]Chorus\n[00:05.25]<00:05.25>Hello <00:06.00>world\nno time\n", "",
+			"lrc", "[4.75]Hello world|[11.5]Chorus|[90]Chorus"},
+		{"WEBVTT - title\n\nNOTE comment\n\nintro\n00:01.000 --> 00:04.500 align:start\n<v Bob>Hi &amp; <i>welcome</i>\n\n" +
+			"00:00:05.000 --> 00:00:07.000\nsecond\nline\n\n00:08.000 --> 00:09.000\n<b></b>\n", "",
+			"vtt", "[1-4.5]Hi & welcome|[5-7]second\nline"},
+		{"2\r\n00:00:03,500 --> 00:00:05,000\r\n{\\an8}Later\r\n\r\n1\r\n00:00:01,000 --> 00:00:02,000\r\nFirst\r\n", "",
+			"srt", "[1-2]First|[3.5-5]Later"},
+		{"[00:01.00]not lrc", "plain", "plain", "[00:01.00]not lrc"},
+	}
+	for idx, tst := range tests {
+		ly, err := parseLyrics(tst.text, tst.format)
+		if err != nil {
+			t.Errorf("parseLyrics: test [%d] failed %s", idx, err.Error())
+			continue
+		}
+		if res := testLyricsLines(ly); ly.Format != tst.resFormat || ly.Synced != (tst.resFormat != "plain") || res != tst.res {
+			t.Errorf("parseLyrics: test [%d] wrong result %s [%s], expected %s [%s]", idx, ly.Format, res, tst.resFormat, tst.res)
+		}
+	}
+
+	for idx, tst := range []struct{ text, format string }{
+		{"\xFF\xFE bad", ""},
+		{"\n \n", "plain"},
+		{"[ti:Title]\nno timestamps", "lrc"},
+		{"1\n00:00:05,000 --> 00:00:01,000\nback in time", ""},
+		{"1\n00:00:05,000 --> soon\ntext", "srt"},
+	} {
+		if ly, err := parseLyrics(tst.text, tst.format); err == nil {
+			t.Errorf("parseLyrics: error test [%d] wrong result %s", idx, testLyricsLines(ly))
+		}
+	}
+}
+
+func TestMediaLyrics(t *testing.T) {
+	dir := t.TempDir()
+	read := func(data []byte) *tLyrics {
+		name := path.Join(dir, "lyrics")
+		ioutil.WriteFile(name, data, 0644)
+		meta, err := readMediaMeta(name)
+		if err != nil {
+			t.Errorf("readMediaMeta: failed %s", err.Error())
+			return nil
+		}
+		return meta.Lyrics
+	}
+	sylt := func(enc byte, texts []string, times []uint32) []byte {
+		data := append([]byte{enc}, "rus\x02\x01"...)
+		term := []byte{0}
+		if enc == 1 {
+			term = []byte{0, 0}
+		}
+		data = append(data, term...) //	пустое описание
+		for i, s := range texts {
+			if enc == 1 {
+				for _, r := range s {
+					data = append(data, byte(r), byte(r>>8))
+				}
+			} else {
+				data = append(data, s...)
+			}
+			data = append(data, term...)
+			data = binary.BigEndian.AppendUint32(data, times[i])
+		}
+		return data
+	}
+
+	uslt := append([]byte{3}, "eng\x00Line one\nLine two"...)
+	if ly := read(testID3v2(4, testID3Frame(4, "USLT", uslt))); ly == nil || ly.Synced || ly.Language != "eng" ||
+		testLyricsLines(ly) != "Line one|Line two" {
+		t.Errorf("readMediaMeta: USLT wrong lyrics %+v", ly)
+	}
+	//	синхронный текст предпочтительнее, время — по порядку
+	frames := [][]byte{testID3Frame(3, "USLT", uslt), testID3Frame(3, "SYLT", sylt(1, []string{"Второй", "Первый"}, []uint32{2500, 1000}))}
+	if ly := read(testID3v2(3, frames...)); ly == nil || !ly.Synced || ly.Format != "lrc" || ly.Language != "rus" ||
+		testLyricsLines(ly) != "[1]Первый|[2.5]Второй" {
+		t.Errorf("readMediaMeta: SYLT wrong lyrics %+v", ly)
+	}
+	//	время в кадрах MPEG не поддерживается
+	frames = [][]byte{testID3Frame(4, "TIT2", []byte{3, 'x'}), testID3Frame(4, "SYLT", append(sylt(3, []string{"a"}, []uint32{1})[:4], 1, 1, 0, 'a', 0, 0, 0, 0, 1))}
+	if ly := read(testID3v2(4, frames...)); ly != nil {
+		t.Errorf("readMediaMeta: SYLT frames wrong lyrics %+v", ly)
+	}
+
+	ogg := append(testOggPage(append([]byte("OpusHead"), make([]byte, 11)...)),
+		testOggPage(append([]byte("OpusTags"), testVorbisComment("LYRICS=[00:01.00]one\n[00:02.00]two")...))...)
+	if ly := read(ogg); ly == nil || ly.Format != "lrc" || testLyricsLines(ly) != "[1]one|[2]two" {
+		t.Errorf("readMediaMeta: opus wrong lyrics %+v", ly)
+	}
+}
+
+func TestLyrics(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	defer testDB.Exec(`UPDATE audio SET lyrics = NULL WHERE id_audio = 1`)
+
+	upload := func(name, data string) (*bytes.Buffer, string) {
+		buf := &bytes.Buffer{}
+		frm := multipart.NewWriter(buf)
+		frm.WriteField("language", "en")
+		f, _ := frm.CreateFormFile("file", name)
+		f.Write([]byte(data))
+		frm.Close()
+		return buf, frm.FormDataContentType()
+	}
+	srt := "1\n00:00:01,000 --> 00:00:02,500\nHello\n"
+	tests := []struct {
+		method, path string
+		cook         *http.Cookie
+		file, body   string //	file — имя загружаемого файла с содержимым body
+		status       int
+		err          string
+	}{
+		{http.MethodPut, "/tracks/1/lyrics", cookUser, "", `{"text": "la la"}`, http.StatusForbidden, "access denied"},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "", `{}`, http.StatusBadRequest, "text required"},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "", `{"text": "la", "format": "doc"}`, http.StatusBadRequest, "invalid format value"},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "", `{"text": "la", "language": "english"}`, http.StatusBadRequest, "invalid language value"},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "", `{"text": "la", "format": "lrc"}`, http.StatusBadRequest, "invalid text value"},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "bad.srt", "not srt", http.StatusBadRequest, "invalid file value"},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "", `{"text": "la la\nla"}`, http.StatusOK, ""},
+		{http.MethodPut, "/tracks/1/lyrics", cookAdmin, "speech.srt", srt, http.StatusOK, ""},
+		{http.MethodDelete, "/tracks/1/lyrics", cookUser, "", "", http.StatusForbidden, "access denied"},
+	}
+	for idx, tst := range tests {
+		var req *http.Request
+		if tst.file != "" {
+			buf, typ := upload(tst.file, tst.body)
+			req, _ = http.NewRequest(tst.method, testSrv.URL+tst.path, buf)
+			req.Header.Set("Content-Type", typ)
+		} else {
+			req, _ = http.NewRequest(tst.method, testSrv.URL+tst.path, strings.NewReader(tst.body))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.AddCookie(tst.cook)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Lyrics: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Lyrics: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, body, tst.status, tst.err)
+		}
+	}
+
+	detail := func() *tLyrics {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+"/tracks/1", nil)
+		req.AddCookie(cookUser)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Lyrics: detail query failed %s", err.Error())
+		}
+		defer resp.Body.Close()
+		ad := &tAudio{}
+		json.NewDecoder(resp.Body).Decode(ad)
+		return ad.Lyrics
+	}
+	if ly := detail(); ly == nil || ly.Format != "srt" || ly.Source != "upload" || ly.Language != "en" ||
+		testLyricsLines(ly) != "[1-2.5]Hello" {
+		t.Errorf("Lyrics: wrong track lyrics %+v", ly)
+	}
+
+	for idx, status := range []int{http.StatusOK, http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodDelete, testSrv.URL+"/tracks/1/lyrics", nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Lyrics: delete query failed %s", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Lyrics: delete [%d] wrong status %d, expected %d", idx, resp.StatusCode, status)
+		}
+	}
+	if ly := detail(); ly != nil {
+		t.Errorf("Lyrics: lyrics left after delete %+v", ly)
+	}
+}
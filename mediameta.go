@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+//tMediaMeta метаданные, встроенные в аудиофайл. Text — текстовые теги
+//	с нормализованными именами: title, artist, album, genre, year, comment.
+//	Picture — обложка (передняя, если их несколько), nil — нет. Lyrics — текст
+//	песни (синхронный, если есть оба), nil — нет
+type tMediaMeta struct {
+	Text    map[string]string
+	Picture *tPicture
+	Lyrics  *tLyrics
+}
+
+//tPicture картинка из метаданных: MIME-тип, тип по ID3 (3 — обложка), данные
+type tPicture struct {
+	MIME string
+	Type int
+	Data []byte
+}
+
+//errNoMeta в файле нет поддерживаемых метаданных
+var errNoMeta = errors.New("no metadata")
+
+//id3Frames текстовые фреймы ID3v2 (2.3/2.4) и соответствующие им теги
+var id3Frames = map[string]string{
+	"TIT2": "title",
+	"TPE1": "artist",
+	"TALB": "album",
+	"TCON": "genre",
+	"TYER": "year",
+	"TDRC": "year",
+	"COMM": "comment",
+}
+
+//vorbisFields поля Vorbis comment (ogg, opus, flac) и соответствующие им теги
+var vorbisFields = map[string]string{
+	"TITLE":       "title",
+	"ARTIST":      "artist",
+	"ALBUM":       "album",
+	"GENRE":       "genre",
+	"DATE":        "year",
+	"COMMENT":     "comment",
+	"DESCRIPTION": "comment",
+}
+
+//maxMetaSize ограничение на размер читаемого блока метаданных
+const maxMetaSize = 16 << 20
+
+//readMediaMeta чтение метаданных аудиофайла: ID3v2 и ID3v1 (mp3), Vorbis comment
+//	(ogg/vorbis, ogg/opus, flac), картинки APIC и FLAC PICTURE, тексты USLT/SYLT
+//	и LYRICS. Формат определяется
+//	по содержимому, а не по расширению. Нет метаданных — errNoMeta
+func readMediaMeta(name string) (meta *tMediaMeta, err error) {
+	var magic [4]byte
+
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if _, err = io.ReadFull(fd, magic[:]); err != nil {
+		return nil, errNoMeta
+	}
+	fd.Seek(0, io.SeekStart)
+
+	meta = &tMediaMeta{Text: map[string]string{}}
+	switch {
+	case bytes.Equal(magic[:3], []byte("ID3")):
+		err = meta.readID3v2(fd)
+	case bytes.Equal(magic[:], []byte("fLaC")):
+		err = meta.readFLAC(fd)
+	case bytes.Equal(magic[:], []byte("OggS")):
+		err = meta.readOgg(fd)
+	default:
+		err = errNoMeta
+	}
+	if len(meta.Text) == 0 {
+		if st, e := fd.Stat(); e == nil && st.Size() >= 128 {
+			meta.readID3v1(fd, st.Size())
+		}
+	}
+	if len(meta.Text) == 0 && meta.Picture == nil && meta.Lyrics == nil {
+		if err == nil {
+			err = errNoMeta
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+//setPicture сохранение картинки: первая, либо обложка вместо картинки другого типа
+func (meta *tMediaMeta) setPicture(pic *tPicture) {
+	if len(pic.Data) == 0 || pic.MIME == "-->" { //	"-->" — ссылка вместо данных
+		return
+	}
+	if meta.Picture == nil || (meta.Picture.Type != 3 && pic.Type == 3) {
+		meta.Picture = pic
+	}
+}
+
+//readFLACPicture разбор блока PICTURE FLAC (он же METADATA_BLOCK_PICTURE в
+//	Vorbis comment): тип, MIME, описание, размеры, данные
+func readFLACPicture(data []byte) (pic *tPicture, ok bool) {
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint32(data))
+		if n < 0 || n > len(data)-4 {
+			return nil, false
+		}
+		v := data[4 : 4+n]
+		data = data[4+n:]
+		return v, true
+	}
+
+	if len(data) < 4 {
+		return nil, false
+	}
+	pic = &tPicture{Type: int(binary.BigEndian.Uint32(data))}
+	data = data[4:]
+	mime, ok := next()
+	if _, ok2 := next(); !ok || !ok2 || len(data) < 16 { //	описание, ширина, высота, глубина, палитра
+		return nil, false
+	}
+	data = data[16:]
+	img, ok := next()
+	if !ok {
+		return nil, false
+	}
+	pic.MIME, pic.Data = string(mime), img
+	return pic, true
+}
+
+//set сохранение значения тега, первое непустое значение не перезаписывается
+func (meta *tMediaMeta) set(tag, val string) {
+	val = strings.TrimSpace(strings.TrimRight(val, "\x00"))
+	if _, ok := meta.Text[tag]; !ok && val != "" {
+		meta.Text[tag] = val
+	}
+}
+
+//syncsafe целое ID3v2 из 7-битных байт
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+//readID3v2 чтение тега ID3v2.3/2.4 в начале файла
+func (meta *tMediaMeta) readID3v2(r io.Reader) error {
+	var hdr [10]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	ver, flags, size := hdr[3], hdr[5], syncsafe(hdr[6:10])
+	if ver < 3 || ver > 4 || size > maxMetaSize {
+		return errNoMeta
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if flags&0x80 != 0 { //	unsynchronisation: FF 00 → FF
+		body = bytes.Replace(body, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 { //	extended header
+		ext := int(binary.BigEndian.Uint32(body))
+		if ver == 4 {
+			ext = syncsafe(body)
+		} else {
+			ext += 4
+		}
+		if ext > len(body) {
+			return errNoMeta
+		}
+		body = body[ext:]
+	}
+
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		fsize := int(binary.BigEndian.Uint32(body[4:8]))
+		if ver == 4 {
+			fsize = syncsafe(body[4:8])
+		}
+		if fsize < 0 || 10+fsize > len(body) {
+			break
+		}
+		meta.id3Frame(id, body[10:10+fsize])
+		body = body[10+fsize:]
+	}
+	return nil
+}
+
+//setLyrics сохранение текста: первый, либо синхронный вместо обычного
+func (meta *tMediaMeta) setLyrics(ly *tLyrics) {
+	if meta.Lyrics == nil || (!meta.Lyrics.Synced && ly.Synced) {
+		meta.Lyrics = ly
+	}
+}
+
+//id3Frame разбор фрейма ID3v2. Прочие фреймы пропускаются
+func (meta *tMediaMeta) id3Frame(id string, data []byte) {
+	switch id {
+	case "APIC":
+		meta.id3Picture(data)
+		return
+	case "USLT":
+		meta.id3Lyrics(data)
+		return
+	case "SYLT":
+		meta.id3SyncedLyrics(data)
+		return
+	}
+	tag, ok := id3Frames[id]
+	if !ok || len(data) < 2 {
+		return
+	}
+	enc, data := data[0], data[1:]
+	if id == "COMM" { //	язык (3 байта), описание, текст
+		if len(data) < 3 {
+			return
+		}
+		parts := splitID3Text(enc, data[3:])
+		if len(parts) > 1 {
+			meta.set(tag, parts[1])
+		}
+		return
+	}
+	//	в 2.4 несколько значений разделяются нулем — берем первое
+	if parts := splitID3Text(enc, data); len(parts) > 0 {
+		meta.set(tag, parts[0])
+	}
+}
+
+//id3Picture разбор фрейма APIC: кодировка, MIME (ISO-8859-1 до нуля), тип картинки,
+//	описание в кодировке фрейма до нуля (в UTF-16 — двойного), данные
+func (meta *tMediaMeta) id3Picture(data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	enc, data := data[0], data[1:]
+	end := bytes.IndexByte(data, 0)
+	if end < 0 || end+2 > len(data) {
+		return
+	}
+	pic := &tPicture{MIME: string(data[:end]), Type: int(data[end+1])}
+	data = data[end+2:]
+	if enc == 1 || enc == 2 {
+		end = 0
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i + 2
+				break
+			}
+		}
+	} else {
+		end = bytes.IndexByte(data, 0) + 1
+	}
+	if end <= 0 || end > len(data) {
+		return
+	}
+	pic.Data = data[end:]
+	//	в 2.3 допускалось "jpg"/"png" вместо MIME
+	if !strings.Contains(pic.MIME, "/") && pic.MIME != "-->" {
+		pic.MIME = "image/" + strings.ToLower(strings.Replace(pic.MIME, "jpg", "jpeg", 1))
+	}
+	meta.setPicture(pic)
+}
+
+//id3Lyrics разбор фрейма USLT: кодировка, язык (3 байта), описание до нуля, текст
+func (meta *tMediaMeta) id3Lyrics(data []byte) {
+	if len(data) < 5 {
+		return
+	}
+	enc, lang := data[0], data[1:4]
+	_, data, ok := cutID3Text(enc, data[4:])
+	if !ok {
+		return
+	}
+	parts := splitID3Text(enc, data)
+	if len(parts) == 0 {
+		return
+	}
+	if ly, err := parseLyrics(parts[0], "plain"); err == nil {
+		ly.Language = id3Language(lang)
+		meta.setLyrics(ly)
+	}
+}
+
+//id3SyncedLyrics разбор фрейма SYLT: кодировка, язык, формат времени (берется
+//	только 2 — миллисекунды), тип содержимого (0 — другое, 1 — слова песни,
+//	2 — расшифровка), описание, затем пары текст до нуля — время (4 байта)
+func (meta *tMediaMeta) id3SyncedLyrics(data []byte) {
+	if len(data) < 6 || data[4] != 2 || data[5] > 2 {
+		return
+	}
+	enc, lang := data[0], data[1:4]
+	_, data, ok := cutID3Text(enc, data[6:])
+	if !ok {
+		return
+	}
+	ly := &tLyrics{Format: "lrc", Synced: true, Language: id3Language(lang)}
+	for len(data) > 0 {
+		text, rest, ok := cutID3Text(enc, data)
+		if !ok || len(rest) < 4 {
+			break
+		}
+		ly.Lines = append(ly.Lines, &tLyricLine{Start: msec(int(binary.BigEndian.Uint32(rest))), Text: strings.TrimSpace(text)})
+		data = rest[4:]
+	}
+	if len(ly.Lines) == 0 {
+		return
+	}
+	sort.SliceStable(ly.Lines, func(i, j int) bool { return *ly.Lines[i].Start < *ly.Lines[j].Start })
+	meta.setLyrics(ly)
+}
+
+//id3Language код языка ID3 (ISO 639-2) в нижнем регистре, "" — не задан (XXX)
+func id3Language(lang []byte) string {
+	code := strings.ToLower(string(lang))
+	if code == "xxx" || !languageRe.MatchString(code) {
+		return ""
+	}
+	return code
+}
+
+//cutID3Text строка ID3v2 в кодировке enc до нулевого символа (в UTF-16 —
+//	двойного) и данные после него
+func cutID3Text(enc byte, data []byte) (text string, rest []byte, ok bool) {
+	end, size := -1, 1
+	if enc == 1 || enc == 2 {
+		size = 2
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+	} else {
+		end = bytes.IndexByte(data, 0)
+	}
+	if end < 0 {
+		return "", nil, false
+	}
+	if parts := splitID3Text(enc, data[:end]); len(parts) > 0 {
+		text = parts[0]
+	}
+	return text, data[end+size:], true
+}
+
+//splitID3Text строки ID3v2 в кодировке enc, разделенные нулевым символом:
+//	0 — ISO-8859-1, 1 — UTF-16 с BOM, 2 — UTF-16BE, 3 — UTF-8
+func splitID3Text(enc byte, data []byte) (res []string) {
+	if enc == 1 || enc == 2 {
+		for len(data) >= 2 {
+			end := len(data) &^ 1
+			for i := 0; i+1 < len(data); i += 2 {
+				if data[i] == 0 && data[i+1] == 0 {
+					end = i
+					break
+				}
+			}
+			res = append(res, decodeUTF16(data[:end], enc == 2))
+			if end+2 > len(data) {
+				break
+			}
+			data = data[end+2:]
+		}
+		return res
+	}
+	for _, s := range bytes.Split(data, []byte{0}) {
+		if enc == 0 {
+			r := make([]rune, len(s))
+			for i, c := range s {
+				r[i] = rune(c)
+			}
+			res = append(res, string(r))
+		} else {
+			res = append(res, string(s))
+		}
+	}
+	return res
+}
+
+//decodeUTF16 строка UTF-16; порядок байт — по BOM, без BOM — big endian, если be
+func decodeUTF16(b []byte, be bool) string {
+	if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+		b, be = b[2:], false
+	} else if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		b, be = b[2:], true
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if be {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		} else {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+//id3v1Genres начало списка жанров ID3v1 (остальные встречаются редко)
+var id3v1Genres = []string{"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock",
+	"Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno",
+	"Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical", "Instrumental",
+	"Acid", "House", "Game", "Sound Clip", "Gospel", "Noise", "Alternative Rock", "Bass", "Soul",
+	"Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock",
+	"Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American",
+	"Cabaret", "New Wave", "Psychedelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock"}
+
+//readID3v1 чтение тега ID3v1 в последних 128 байтах файла
+func (meta *tMediaMeta) readID3v1(r io.ReaderAt, size int64) {
+	var tag [128]byte
+
+	if _, err := r.ReadAt(tag[:], size-128); err != nil || !bytes.Equal(tag[:3], []byte("TAG")) {
+		return
+	}
+	field := func(b []byte) string {
+		return splitID3Text(0, b)[0]
+	}
+	meta.set("title", field(tag[3:33]))
+	meta.set("artist", field(tag[33:63]))
+	meta.set("album", field(tag[63:93]))
+	meta.set("year", field(tag[93:97]))
+	meta.set("comment", field(tag[97:127]))
+	if int(tag[127]) < len(id3v1Genres) {
+		meta.set("genre", id3v1Genres[tag[127]])
+	}
+}
+
+//readVorbisComment разбор блока Vorbis comment (без заголовка пакета):
+//	длина и строка vendor, количество полей, поля "ИМЯ=значение"
+func (meta *tMediaMeta) readVorbisComment(data []byte) error {
+	next := func() (string, bool) {
+		if len(data) < 4 {
+			return "", false
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		if n < 0 || n > len(data)-4 {
+			return "", false
+		}
+		s := string(data[4 : 4+n])
+		data = data[4+n:]
+		return s, true
+	}
+
+	if _, ok := next(); !ok {
+		return errNoMeta
+	}
+	if len(data) < 4 {
+		return errNoMeta
+	}
+	cnt := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	for i := 0; i < cnt; i++ {
+		field, ok := next()
+		if !ok {
+			return errNoMeta
+		}
+		if eq := strings.IndexByte(field, '='); eq > 0 {
+			name := strings.ToUpper(field[:eq])
+			if tag, ok := vorbisFields[name]; ok {
+				meta.set(tag, field[eq+1:])
+			} else if name == "LYRICS" || name == "UNSYNCEDLYRICS" {
+				if ly, err := parseLyrics(field[eq+1:], ""); err == nil {
+					meta.setLyrics(ly)
+				}
+			} else if name == "METADATA_BLOCK_PICTURE" {
+				if data, err := base64.StdEncoding.DecodeString(field[eq+1:]); err == nil {
+					if pic, ok := readFLACPicture(data); ok {
+						meta.setPicture(pic)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//readFLAC чтение блоков метаданных FLAC: VORBIS_COMMENT (тип 4), PICTURE (тип 6)
+func (meta *tMediaMeta) readFLAC(r io.Reader) error {
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil { //	fLaC
+		return err
+	}
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		last, typ := hdr[0]&0x80 != 0, hdr[0]&0x7F
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		if typ == 4 || typ == 6 {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if typ == 6 {
+				if pic, ok := readFLACPicture(data); ok {
+					meta.setPicture(pic)
+				}
+			} else if err := meta.readVorbisComment(data); err != nil {
+				return err
+			}
+		} else if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+//oggPackets первые n пакетов логического потока ogg (склейка сегментов страниц)
+func oggPackets(r io.Reader, n int) (packets [][]byte, err error) {
+	var (
+		hdr [27]byte
+		cur []byte
+	)
+
+	for len(packets) < n {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			return packets, err
+		}
+		if !bytes.Equal(hdr[:4], []byte("OggS")) {
+			return packets, errNoMeta
+		}
+		segs := make([]byte, hdr[26])
+		if _, err = io.ReadFull(r, segs); err != nil {
+			return packets, err
+		}
+		for _, l := range segs {
+			seg := make([]byte, l)
+			if _, err = io.ReadFull(r, seg); err != nil {
+				return packets, err
+			}
+			cur = append(cur, seg...)
+			if len(cur) > maxMetaSize {
+				return packets, errNoMeta
+			}
+			if l < 255 { //	сегмент короче 255 — конец пакета
+				packets = append(packets, cur)
+				cur = nil
+			}
+		}
+	}
+	return packets, nil
+}
+
+//readOgg чтение Vorbis comment из второго пакета потока ogg (vorbis или opus)
+func (meta *tMediaMeta) readOgg(r io.Reader) error {
+	packets, err := oggPackets(r, 2)
+	if len(packets) < 2 {
+		return err
+	}
+	p := packets[1]
+	switch {
+	case len(p) > 7 && p[0] == 3 && bytes.Equal(p[1:7], []byte("vorbis")):
+		return meta.readVorbisComment(p[7:])
+	case len(p) > 8 && bytes.Equal(p[:8], []byte("OpusTags")):
+		return meta.readVorbisComment(p[8:])
+	}
+	return errNoMeta
+}
+
+//metaJSON теги файла name для колонки audio.meta; нет тегов или ошибка чтения — {}
+func metaJSON(name string) string {
+	meta, err := readMediaMeta(name)
+	if err != nil {
+		return "{}"
+	}
+	js, _ := json.Marshal(meta.Text)
+	return string(js)
+}
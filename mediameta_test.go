@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+//testID3Frame фрейм ID3v2: id, размер (syncsafe для 2.4), флаги, данные
+func testID3Frame(ver byte, id string, data []byte) []byte {
+	var size [4]byte
+
+	n := len(data)
+	if ver == 4 {
+		size = [4]byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+	} else {
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+	}
+	return append(append(append([]byte(id), size[:]...), 0, 0), data...)
+}
+
+//testID3v2 тег ID3v2 из фреймов с заголовком и отступом (padding)
+func testID3v2(ver byte, frames ...[]byte) []byte {
+	body := append(bytes.Join(frames, nil), make([]byte, 16)...)
+	n := len(body)
+	hdr := []byte{'I', 'D', '3', ver, 0, 0, byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+	return append(hdr, body...)
+}
+
+//testVorbisComment блок Vorbis comment: vendor и поля
+func testVorbisComment(fields ...string) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(4))
+	buf.WriteString("test")
+	binary.Write(buf, binary.LittleEndian, uint32(len(fields)))
+	for _, f := range fields {
+		binary.Write(buf, binary.LittleEndian, uint32(len(f)))
+		buf.WriteString(f)
+	}
+	return buf.Bytes()
+}
+
+//testOggPage страница ogg с одним пакетом (таблица сегментов по 255 байт)
+func testOggPage(packet []byte) []byte {
+	var segs []byte
+
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segs = append(segs, byte(n))
+			break
+		}
+		segs = append(segs, 255)
+	}
+	hdr := append([]byte("OggS"), make([]byte, 22)...)
+	hdr = append(hdr, byte(len(segs)))
+	return append(append(hdr, segs...), packet...)
+}
+
+func TestMediaMeta(t *testing.T) {
+	utf16le := []byte{1, 0xFF, 0xFE, 0x1F, 0x04, 0x35, 0x04, 0x41, 0x04, 0x3D, 0x04, 0x4F, 0x04, 0, 0} //	"Песня"
+	id3v1 := make([]byte, 128)
+	copy(id3v1, "TAG")
+	copy(id3v1[3:], "Old Title")
+	copy(id3v1[33:], "Old Artist")
+	copy(id3v1[93:], "1999")
+	id3v1[127] = 17
+	flacComment := testVorbisComment("TITLE=Flac Title", "artist=Кино", "GENRE=рок", "DATE=1988", "UNKNOWN=x")
+	longComment := testVorbisComment("TITLE=Long", "COMMENT="+string(bytes.Repeat([]byte("x"), 600)))
+
+	tests := []struct {
+		name string
+		data []byte
+		want map[string]string
+	}{
+		{"id3v2.3", testID3v2(3,
+			testID3Frame(3, "TIT2", utf16le),
+			testID3Frame(3, "TPE1", append([]byte{0}, "Artist \xe9"...)),
+			testID3Frame(3, "APIC", []byte{0, 'x'}),
+			testID3Frame(3, "COMM", append([]byte{3}, "rus\x00Комментарий"...)),
+		), map[string]string{"title": "Песня", "artist": "Artist é", "comment": "Комментарий"}},
+		{"id3v2.4", testID3v2(4,
+			testID3Frame(4, "TIT2", append([]byte{3}, "Группа крови\x00Second"...)),
+			testID3Frame(4, "TDRC", append([]byte{3}, "1988"...)),
+			testID3Frame(4, "TCON", []byte{2, 0x04, 0x40, 0x04, 0x3E, 0x04, 0x3A}),
+		), map[string]string{"title": "Группа крови", "year": "1988", "genre": "рок"}},
+		{"id3v1", append([]byte("\xff\xfb audio frames"), id3v1...),
+			map[string]string{"title": "Old Title", "artist": "Old Artist", "year": "1999", "genre": "Rock"}},
+		{"flac", bytes.Join([][]byte{[]byte("fLaC"),
+			{0x00, 0, 0, 2}, {0, 0},
+			{0x84, 0, byte(len(flacComment) >> 8), byte(len(flacComment))}, flacComment,
+		}, nil), map[string]string{"title": "Flac Title", "artist": "Кино", "genre": "рок", "year": "1988"}},
+		{"ogg vorbis", append(testOggPage([]byte("\x01vorbis header")),
+			testOggPage(append([]byte("\x03vorbis"), longComment...))...),
+			map[string]string{"title": "Long", "comment": string(bytes.Repeat([]byte("x"), 600))}},
+		{"opus", append(testOggPage([]byte("OpusHead")),
+			testOggPage(append([]byte("OpusTags"), testVorbisComment("ALBUM=Opus Album")...))...),
+			map[string]string{"album": "Opus Album"}},
+		{"no meta", []byte("OggS broken"), nil},
+		{"empty", nil, nil},
+	}
+	for _, tst := range tests {
+		fd, err := ioutil.TempFile("", "meta")
+		if err != nil {
+			t.Fatalf("MediaMeta: temp file creating error %s", err.Error())
+		}
+		fd.Write(tst.data)
+		fd.Close()
+
+		meta, err := readMediaMeta(fd.Name())
+		os.Remove(fd.Name())
+		if tst.want == nil {
+			if err == nil {
+				t.Errorf("MediaMeta: %s >>> expected error, got %v", tst.name, meta.Text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("MediaMeta: %s >>> unexpected error %s", tst.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(meta.Text, tst.want) {
+			t.Errorf("MediaMeta: %s >>> wrong tags %v, expected %v", tst.name, meta.Text, tst.want)
+		}
+	}
+}
@@ -0,0 +1,864 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+//Декодер MPEG-1/2/2.5 Layer III (ISO/IEC 11172-3, 13818-3): разбор side info и
+//	main data с битовым резервуаром, масштабные множители, Хаффман, деквантование,
+//	стерео MS и intensity, IMDCT с окнами длинных, коротких и смешанных блоков,
+//	синтезирующий банк фильтров. Слои I и II не поддерживаются — такие файлы
+//	openPCM отдает transcoder
+
+//errNotMP3 в начале файла нет кадров MPEG Layer III
+var errNotMP3 = errors.New("not an mp3 layer iii stream")
+
+const (
+	mp3SyncLimit  = 64 << 10 //	поиск первого кадра после тега ID3, байт
+	mp3Reservoir  = 511      //	максимальный main_data_begin, байт
+	mp3MaxFrame   = 1441     //	кадр 320 кбит/с 32 кГц с padding
+	mp3Granule    = 576      //	сэмплов канала в грануле
+	mp3Subbands   = 32
+	mp3SubSamples = mp3Granule / mp3Subbands
+)
+
+//tMP3Granule side info гранулы одного канала. region1, region2 — начало областей
+//	таблиц Хаффмана в линиях спектра
+type tMP3Granule struct {
+	part23     int
+	bigValues  int
+	gain       int
+	sfCompress int
+	blockType  int
+	mixed      bool
+	table      [3]int
+	subGain    [3]int
+	region1    int
+	region2    int
+	preflag    bool
+	sfScale    bool
+	count1     int
+}
+
+//tMP3 декодер потока Layer III. Читается как io.Reader: сэмплы float32 little
+//	endian, каналы вперемешку (см. openPCM). Частота и число каналов — по первому
+//	кадру: кадры с другой частотой пропускаются, моно/стерео приводится к Channels
+type tMP3 struct {
+	Rate      int
+	Channels  int
+	r         *bufio.Reader
+	hdr       [3]byte //	версия, слой и частота первого кадра — для поиска следующих
+	lsf       bool
+	band      int //	индекс таблиц полос mp3LongBands
+	frames    int
+	corrupt   int //	гранулы, данные Хаффмана которых выходят за part2_3_length
+	frame     [mp3MaxFrame]byte
+	reservoir []byte
+	scf       [2][22]int //	множители длинных полос первой гранулы (scfsi)
+	xr        [2][mp3Granule]float64
+	overlap   [2][mp3Granule]float64
+	v         [2][1024]float64
+	vPos      [2]int
+	pcm       [2][mp3Granule]float64
+	out       []byte
+	buf       []byte
+}
+
+//tMP3Bits чтение битов старшими вперед, за концом данных — нули
+type tMP3Bits struct {
+	b   []byte
+	pos int
+}
+
+func (br *tMP3Bits) get(n int) (v int) {
+	for ; n > 0; n-- {
+		v <<= 1
+		if i := br.pos >> 3; i < len(br.b) {
+			v |= int(br.b[i]>>(7-uint(br.pos&7))) & 1
+		}
+		br.pos++
+	}
+	return v
+}
+
+//tMP3Tree дерево кода Хаффмана: узел n — пара t[2n], t[2n+1] (ветви 0 и 1),
+//	положительное значение — следующий узел, отрицательное — ^символ
+type tMP3Tree []int32
+
+func newMP3Tree(codes []uint16, bits []uint8, sym func(i int) int32) tMP3Tree {
+	t := tMP3Tree{0, 0}
+	for i, code := range codes {
+		n := int32(0)
+		for b := int(bits[i]) - 1; b > 0; b-- {
+			next := &t[2*n+int32(code>>uint(b))&1]
+			if *next == 0 {
+				*next = int32(len(t) / 2)
+				t = append(t, 0, 0)
+			}
+			n = *next
+		}
+		t[2*n+int32(code)&1] = ^sym(i)
+	}
+	return t
+}
+
+func (t tMP3Tree) decode(br *tMP3Bits) int {
+	n := int32(0)
+	for {
+		if n = t[2*n+int32(br.get(1))]; n <= 0 {
+			return int(^n)
+		}
+	}
+}
+
+//mp3Trees деревья таблиц big_values по номеру (0, 4, 14 — без кодов, все нули),
+//	символ — x<<4 | y
+var mp3Trees = func() (trees [32]tMP3Tree) {
+	for i, codes := range mp3HuffCodes {
+		if codes == nil {
+			continue
+		}
+		dim := int(math.Sqrt(float64(len(codes))))
+		trees[i] = newMP3Tree(codes, mp3HuffBits[i], func(k int) int32 { return int32(k/dim<<4 | k%dim) })
+	}
+	for i := 17; i < 32; i++ {
+		trees[i] = trees[16+i/24*8]
+	}
+	return trees
+}()
+
+//mp3QuadTree таблица A четверок count1, символ — vwxy
+var mp3QuadTree = newMP3Tree(mp3QuadCodes, mp3QuadBits, func(k int) int32 { return int32(k) })
+
+//mp3Layout полосы масштабных множителей гранулы по порядку следования в спектре:
+//	[частота][длинные, короткие, смешанные блоки]. Короткая полоса — три записи,
+//	по окну. long — число длинных полос в начале
+type tMP3Layout struct {
+	width []int
+	long  int
+}
+
+var mp3Layouts = func() (l [9][3]tMP3Layout) {
+	for b := range l {
+		short := func(from int) (w []int) {
+			for _, sw := range mp3ShortBands[b][from:] {
+				w = append(w, sw, sw, sw)
+			}
+			return w
+		}
+		mixed := 8
+		if b > 2 {
+			mixed = 6
+		}
+		l[b][0] = tMP3Layout{width: mp3LongBands[b][:], long: 22}
+		l[b][1] = tMP3Layout{width: short(0)}
+		l[b][2] = tMP3Layout{width: append(append([]int{}, mp3LongBands[b][:mixed]...), short(3)...), long: mixed}
+	}
+	return l
+}()
+
+//mp3IMDCT косинусы IMDCT длинного (36 выходов) и короткого (12) блоков,
+//	mp3Windows — окна по block_type (2 — окно короткого блока)
+var mp3IMDCTLong, mp3IMDCTShort, mp3Windows = func() (long [36][18]float64, short [12][6]float64, win [4][36]float64) {
+	for i := range long {
+		for k := range long[i] {
+			long[i][k] = math.Cos(math.Pi / 72 * float64(2*i+1+18) * float64(2*k+1))
+		}
+	}
+	for i := range short {
+		for k := range short[i] {
+			short[i][k] = math.Cos(math.Pi / 24 * float64(2*i+1+6) * float64(2*k+1))
+		}
+	}
+	for i := 0; i < 36; i++ {
+		win[0][i] = math.Sin(math.Pi / 36 * (float64(i) + 0.5))
+	}
+	win[1], win[3] = win[0], win[0]
+	for i := 18; i < 36; i++ {
+		switch {
+		case i < 24:
+			win[1][i] = 1
+		case i < 30:
+			win[1][i] = math.Sin(math.Pi / 12 * (float64(i-18) + 0.5))
+		default:
+			win[1][i] = 0
+		}
+		win[3][35-i] = win[1][i]
+	}
+	for i := 0; i < 12; i++ {
+		win[2][i] = math.Sin(math.Pi / 12 * (float64(i) + 0.5))
+	}
+	return long, short, win
+}()
+
+//mp3Synth матрица N синтезирующего банка (64×32) и окно D целиком: вторая половина
+//	D[256+k] = ∓D[256-k], знак меняется, кроме k кратных 64
+var mp3Synth, mp3Window = func() (n [64][32]float64, d [512]float64) {
+	for i := range n {
+		for k := range n[i] {
+			n[i][k] = math.Cos(float64((16+i)*(2*k+1)) * math.Pi / 64)
+		}
+	}
+	copy(d[:], mp3SynthWindow[:])
+	for k := 1; k < 256; k++ {
+		d[256+k] = -d[256-k]
+		if k%64 == 0 {
+			d[256+k] = d[256-k]
+		}
+	}
+	return n, d
+}()
+
+//mp3Header проверка заголовка кадра Layer III
+//Результат: длина кадра, индекс таблиц полос (см. mp3LongBands), MPEG2/2.5
+func mp3Header(h []byte) (size, band int, lsf, ok bool) {
+	size, _, _, ok = mp3Frame(h)
+	if !ok || (h[1]>>1)&3 != 1 {
+		return 0, 0, false, false
+	}
+	band = int((h[2] >> 2) & 3)
+	switch (h[1] >> 3) & 3 {
+	case 2:
+		band += 3
+	case 0:
+		band += 6
+	}
+	return size, band, band > 2, true
+}
+
+//openMP3 начало декодирования: пропуск тега ID3v2 и поиск первого кадра Layer III,
+//	за которым сразу идет еще один такой же кадр (защита от ложной синхронизации)
+//Ошибка: errNotMP3 — кадров нет в первых mp3SyncLimit байтах
+func openMP3(r *bufio.Reader) (mp3 *tMP3, err error) {
+	if h, _ := r.Peek(10); id3Size(h) > 0 {
+		if _, err = r.Discard(id3Size(h)); err != nil {
+			return nil, errNotMP3
+		}
+	}
+	for skipped := 0; skipped < mp3SyncLimit; skipped++ {
+		h, err := r.Peek(4)
+		if err != nil {
+			return nil, errNotMP3
+		}
+		if size, band, lsf, ok := mp3Header(h); ok {
+			next, err := r.Peek(size + 4)
+			if len(next) == size && err == io.EOF { //	единственный кадр
+				next = append(next[:size:size], h...)
+			}
+			if len(next) == size+4 {
+				if _, nextBand, _, ok := mp3Header(next[size:]); ok && nextBand == band && next[size+1]&0xFE == h[1]&0xFE {
+					mp3 = &tMP3{r: r, band: band, lsf: lsf, Channels: 2}
+					_, _, mp3.Rate, _ = mp3Frame(h)
+					copy(mp3.hdr[:], h)
+					if h[3]>>6 == 3 {
+						mp3.Channels = 1
+					}
+					return mp3, nil
+				}
+			}
+		}
+		r.Discard(1)
+	}
+	return nil, errNotMP3
+}
+
+//Read чтение декодированных сэмплов, в конце потока — io.EOF
+func (mp3 *tMP3) Read(p []byte) (n int, err error) {
+	for len(mp3.out) == 0 {
+		if err = mp3.decodeFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, mp3.out)
+	mp3.out = mp3.out[n:]
+	return n, nil
+}
+
+//nextFrame поиск и чтение следующего кадра с частотой и версией первого. Мусор
+//	между кадрами (теги, обрывки) пропускается побайтно
+func (mp3 *tMP3) nextFrame() ([]byte, error) {
+	for {
+		h, err := mp3.r.Peek(4)
+		if err != nil {
+			return nil, io.EOF
+		}
+		size, band, _, ok := mp3Header(h)
+		if !ok || band != mp3.band || h[1]&0xFE != mp3.hdr[1]&0xFE {
+			mp3.r.Discard(1)
+			continue
+		}
+		if _, err = io.ReadFull(mp3.r, mp3.frame[:size]); err != nil {
+			return nil, io.EOF //	обрезанный последний кадр
+		}
+		return mp3.frame[:size], nil
+	}
+}
+
+//decodeFrame декодирование кадра в mp3.out. Кадр, для которого в резервуаре еще нет
+//	начала main data (первые кадры после обрезки потока), выдается тишиной
+func (mp3 *tMP3) decodeFrame() error {
+	var (
+		gr    [2][2]tMP3Granule
+		scfsi [2]int
+		frame []byte
+		err   error
+	)
+
+	if frame, err = mp3.nextFrame(); err != nil {
+		return err
+	}
+	mp3.out = mp3.buf[:0]
+	mp3.frames++
+	nch, grans := 2, 2
+	if frame[3]>>6 == 3 {
+		nch = 1
+	}
+	if mp3.lsf {
+		grans = 1
+	}
+	side := 4
+	if frame[1]&1 == 0 {
+		side += 2 //	CRC
+	}
+	br := &tMP3Bits{b: frame[side:]}
+	var mainBegin int
+	if mp3.lsf {
+		mainBegin = br.get(8)
+		br.get(nch)
+	} else {
+		mainBegin = br.get(9)
+		br.get(7 - 2*nch)
+		for ch := 0; ch < nch; ch++ {
+			scfsi[ch] = br.get(4)
+		}
+	}
+	for g := 0; g < grans; g++ {
+		for ch := 0; ch < nch; ch++ {
+			gr[g][ch] = mp3.sideInfo(br)
+		}
+	}
+	side += (br.pos + 7) / 8
+	if side > len(frame) {
+		return nil
+	}
+	if mp3.frames == 1 && mp3.vbrTag(frame, side) {
+		return nil
+	}
+
+	//	main data: хвост резервуара длиной main_data_begin и данные этого кадра
+	main := frame[side:]
+	ready := mainBegin <= len(mp3.reservoir)
+	var data []byte
+	if ready {
+		data = append(append(data, mp3.reservoir[len(mp3.reservoir)-mainBegin:]...), main...)
+	}
+	mp3.reservoir = append(mp3.reservoir, main...)
+	if len(mp3.reservoir) > mp3Reservoir {
+		mp3.reservoir = append(mp3.reservoir[:0], mp3.reservoir[len(mp3.reservoir)-mp3Reservoir:]...)
+	}
+
+	br = &tMP3Bits{b: data}
+	for g := 0; g < grans; g++ {
+		var sf [2][39]int
+		var isPos [2][39]int //	позиции intensity stereo, -1 — недопустимая
+		for ch := 0; ch < nch; ch++ {
+			x := &mp3.xr[ch]
+			if !ready {
+				*x = [mp3Granule]float64{}
+				continue
+			}
+			start := br.pos
+			if mp3.lsf {
+				mp3.lsfScalefactors(br, &gr[g][ch], ch == 1 && frame[3]>>6 == 1 && frame[3]&0x10 != 0, &sf[ch], &isPos[ch])
+			} else {
+				mp3.scalefactors(br, &gr[g][ch], ch, g, scfsi[ch], &sf[ch], &isPos[ch])
+			}
+			if !mp3.huffman(br, &gr[g][ch], start+gr[g][ch].part23, x) {
+				mp3.corrupt++
+			}
+			br.pos = start + gr[g][ch].part23
+			mp3.requantize(&gr[g][ch], &sf[ch], x)
+		}
+		if nch == 2 && frame[3]>>6 == 1 {
+			mp3.stereo(&gr[g][1], int(frame[3]>>4)&3, &isPos[1])
+		}
+		for ch := 0; ch < nch; ch++ {
+			mp3.hybrid(&gr[g][ch], ch)
+			mp3.synthesis(ch)
+		}
+		mp3.emit(nch)
+	}
+	return nil
+}
+
+//vbrTag первый кадр с тегом Xing/Info или VBRI (VBR-заголовок кодировщика) — звука
+//	в нем нет, пропускается
+func (mp3 *tMP3) vbrTag(frame []byte, side int) bool {
+	if len(frame) >= side+4 {
+		if tag := string(frame[side : side+4]); tag == "Xing" || tag == "Info" {
+			return true
+		}
+	}
+	return len(frame) >= 40 && string(frame[36:40]) == "VBRI"
+}
+
+//sideInfo side info гранулы канала
+func (mp3 *tMP3) sideInfo(br *tMP3Bits) (g tMP3Granule) {
+	g.part23 = br.get(12)
+	if g.bigValues = br.get(9); g.bigValues > mp3Granule/2 {
+		g.bigValues = mp3Granule / 2
+	}
+	g.gain = br.get(8)
+	if mp3.lsf {
+		g.sfCompress = br.get(9)
+	} else {
+		g.sfCompress = br.get(4)
+	}
+	if br.get(1) == 1 { //	window switching
+		g.blockType = br.get(2)
+		g.mixed = br.get(1) == 1
+		g.table[0], g.table[1] = br.get(5), br.get(5)
+		for w := range g.subGain {
+			g.subGain[w] = br.get(3)
+		}
+		//	границы областей фиксированы: 36 линий (8 кГц — по полосам частоты)
+		switch {
+		case g.blockType == 2 && mp3.band == 8:
+			g.region1 = 72
+		case g.blockType == 2 || mp3.band < 3:
+			g.region1 = 36
+		case mp3.band == 8:
+			g.region1 = 108
+		default:
+			g.region1 = 54
+		}
+		g.region2 = mp3Granule
+	} else {
+		for i := range g.table {
+			g.table[i] = br.get(5)
+		}
+		r0 := br.get(4)
+		r1 := br.get(3)
+		for i, w := range mp3LongBands[mp3.band] {
+			if i <= r0 {
+				g.region1 += w
+			}
+			if i <= r0+r1+1 {
+				g.region2 += w
+			}
+		}
+	}
+	g.mixed = g.mixed && g.blockType == 2
+	if !mp3.lsf {
+		g.preflag = br.get(1) == 1
+	}
+	g.sfScale = br.get(1) == 1
+	g.count1 = br.get(1)
+	return g
+}
+
+//layout полосы множителей гранулы
+func (mp3 *tMP3) layout(g *tMP3Granule) *tMP3Layout {
+	switch {
+	case g.blockType != 2:
+		return &mp3Layouts[mp3.band][0]
+	case g.mixed:
+		return &mp3Layouts[mp3.band][2]
+	}
+	return &mp3Layouts[mp3.band][1]
+}
+
+//scalefactors масштабные множители MPEG1 в порядке mp3.layout. При scfsi группы
+//	длинных полос второй гранулы берутся из первой. Позиции intensity stereo —
+//	сами множители, 7 недопустима
+func (mp3 *tMP3) scalefactors(br *tMP3Bits, g *tMP3Granule, ch, gran, scfsi int, sf, isPos *[39]int) {
+	slen1, slen2 := mp3Slen[0][g.sfCompress], mp3Slen[1][g.sfCompress]
+	n := 0
+	read := func(count, slen int) {
+		for ; count > 0; count-- {
+			sf[n] = br.get(slen)
+			n++
+		}
+	}
+	switch {
+	case g.blockType == 2 && g.mixed:
+		read(17, slen1)
+		read(18, slen2)
+	case g.blockType == 2:
+		read(18, slen1)
+		read(18, slen2)
+	default:
+		for i, count := range []int{6, 5, 5, 5} {
+			if gran == 1 && scfsi&(8>>uint(i)) != 0 {
+				copy(sf[n:n+count], mp3.scf[ch][n:n+count])
+				n += count
+				continue
+			}
+			read(count, []int{slen1, slen1, slen2, slen2}[i])
+		}
+		copy(mp3.scf[ch][:], sf[:22])
+	}
+	for i := range isPos {
+		if isPos[i] = sf[i]; sf[i] >= 7 {
+			isPos[i] = -1
+		}
+	}
+}
+
+//lsfScalefactors масштабные множители MPEG2/2.5: четыре группы по mp3LSFBands.
+//	Для правого канала intensity stereo своя разбивка scalefac_compress, позиция
+//	с максимальным для разрядности значением недопустима
+func (mp3 *tMP3) lsfScalefactors(br *tMP3Bits, g *tMP3Granule, intensity bool, sf, isPos *[39]int) {
+	var (
+		slen [4]int
+		tab  int
+	)
+
+	sfc := g.sfCompress
+	switch {
+	case intensity:
+		sfc >>= 1
+		switch {
+		case sfc < 180:
+			slen = [4]int{sfc / 36, sfc % 36 / 6, sfc % 36 % 6, 0}
+			tab = 3
+		case sfc < 244:
+			sfc -= 180
+			slen = [4]int{sfc % 64 >> 4, sfc % 16 >> 2, sfc % 4, 0}
+			tab = 4
+		default:
+			sfc -= 244
+			slen = [4]int{sfc / 3, sfc % 3, 0, 0}
+			tab = 5
+		}
+	case sfc < 400:
+		slen = [4]int{(sfc >> 4) / 5, (sfc >> 4) % 5, sfc & 15 >> 2, sfc & 3}
+	case sfc < 500:
+		sfc -= 400
+		slen = [4]int{(sfc >> 2) / 5, (sfc >> 2) % 5, sfc & 3, 0}
+		tab = 1
+	default:
+		sfc -= 500
+		slen = [4]int{sfc / 3, sfc % 3, 0, 0}
+		tab = 2
+		g.preflag = true
+	}
+	kind := 0
+	if g.blockType == 2 {
+		kind = 1
+		if g.mixed {
+			kind = 2
+		}
+	}
+	n := 0
+	for i, count := range mp3LSFBands[tab][kind] {
+		for ; count > 0; count-- {
+			sf[n] = br.get(slen[i])
+			isPos[n] = sf[n]
+			if slen[i] > 0 && sf[n] == 1<<uint(slen[i])-1 {
+				isPos[n] = -1
+			}
+			n++
+		}
+	}
+}
+
+//huffman значения спектра гранулы до бита end: пары big_values по таблицам трех
+//	областей, затем четверки count1. Остаток спектра — нули
+//Результат: false, если коды вышли за end — side info не соответствует данным
+func (mp3 *tMP3) huffman(br *tMP3Bits, g *tMP3Granule, end int, x *[mp3Granule]float64) bool {
+	signed := func(v int) float64 {
+		if v != 0 && br.get(1) == 1 {
+			return float64(-v)
+		}
+		return float64(v)
+	}
+
+	i, big := 0, g.bigValues*2
+	for ; i < big; i += 2 {
+		table := g.table[0]
+		if i >= g.region2 {
+			table = g.table[2]
+		} else if i >= g.region1 {
+			table = g.table[1]
+		}
+		if mp3Trees[table] == nil {
+			x[i], x[i+1] = 0, 0
+			continue
+		}
+		s := mp3Trees[table].decode(br)
+		vx, vy := s>>4, s&15
+		if lb := mp3Linbits[table]; lb > 0 && vx == 15 {
+			vx += br.get(lb)
+		}
+		x[i] = signed(vx)
+		if lb := mp3Linbits[table]; lb > 0 && vy == 15 {
+			vy += br.get(lb)
+		}
+		x[i+1] = signed(vy)
+	}
+	ok := br.pos <= end
+	for i+4 <= mp3Granule && br.pos < end {
+		var s int
+		if g.count1 == 0 {
+			s = mp3QuadTree.decode(br)
+		} else {
+			s = 15 - br.get(4)
+		}
+		for k := 0; k < 4; k++ {
+			x[i+k] = signed(s >> uint(3-k) & 1)
+		}
+		if br.pos > end { //	четверка заходит за конец данных гранулы
+			ok = false
+			break
+		}
+		i += 4
+	}
+	for ; i < mp3Granule; i++ {
+		x[i] = 0
+	}
+	return ok
+}
+
+//requantize деквантование: |x|^(4/3) · 2^(global_gain-210)/4 с поправками полос
+func (mp3 *tMP3) requantize(g *tMP3Granule, sf *[39]int, x *[mp3Granule]float64) {
+	l := mp3.layout(g)
+	mult := 0.5
+	if g.sfScale {
+		mult = 1
+	}
+	i := 0
+	for b, width := range l.width {
+		exp := float64(g.gain-210) / 4
+		if b < l.long {
+			pre := 0
+			if g.preflag {
+				pre = mp3Pretab[b]
+			}
+			exp -= mult * float64(sf[b]+pre)
+		} else {
+			exp -= 2*float64(g.subGain[(b-l.long)%3]) + mult*float64(sf[b])
+		}
+		scale := math.Exp2(exp)
+		for end := i + width; i < end; i++ {
+			if v := x[i]; v != 0 {
+				x[i] = math.Copysign(math.Pow(math.Abs(v), 4.0/3)*scale, v)
+			}
+		}
+	}
+}
+
+//stereo совместное стерео: intensity в полосах выше последних ненулевых значений
+//	правого канала (у коротких блоков — по каждому окну), MS в остальных
+func (mp3 *tMP3) stereo(g *tMP3Granule, mode int, isPos *[39]int) {
+	l, r := &mp3.xr[0], &mp3.xr[1]
+	ms := mode&2 != 0
+	if mode&1 == 0 {
+		if ms {
+			for i := range l {
+				l[i], r[i] = (l[i]+r[i])/math.Sqrt2, (l[i]-r[i])/math.Sqrt2
+			}
+		}
+		return
+	}
+
+	lay := mp3.layout(g)
+	top := [3]int{-1, -1, -1} //	последняя полоса с ненулевым правым каналом по окну
+	for b, i := 0, 0; b < len(lay.width); b++ {
+		for k := i; k < i+lay.width[b]; k++ {
+			if r[k] != 0 {
+				top[b%3] = b
+				break
+			}
+		}
+		i += lay.width[b]
+	}
+	blocks := 3
+	if lay.long > 0 {
+		for w := 1; w < 3; w++ {
+			if top[w] > top[0] {
+				top[0] = top[w]
+			}
+		}
+		top[1], top[2] = top[0], top[0]
+		if g.blockType != 2 {
+			blocks = 1
+		}
+	}
+	//	у последней полосы множителя нет: позиция предыдущей, если та тоже intensity
+	for w := 0; w < blocks; w++ {
+		last := len(lay.width) - blocks + w
+		if prev := last - blocks; top[w] >= prev {
+			isPos[last] = 0
+			if !mp3.lsf {
+				isPos[last] = 3
+			}
+		} else {
+			isPos[last] = isPos[prev]
+		}
+	}
+
+	i := 0
+	for b, width := range lay.width {
+		pos := isPos[b]
+		switch {
+		case b > top[b%3] && pos >= 0:
+			kl, kr := mp3.intensity(pos, g.sfCompress&1)
+			for k := i; k < i+width; k++ {
+				l[k], r[k] = l[k]*kl, l[k]*kr
+			}
+		case ms:
+			for k := i; k < i+width; k++ {
+				l[k], r[k] = (l[k]+r[k])/math.Sqrt2, (l[k]-r[k])/math.Sqrt2
+			}
+		}
+		i += width
+	}
+}
+
+//intensity коэффициенты левого и правого каналов по позиции intensity stereo
+func (mp3 *tMP3) intensity(pos, scale int) (kl, kr float64) {
+	if !mp3.lsf {
+		if pos >= 6 {
+			return 1, 0
+		}
+		t := math.Tan(float64(pos) * math.Pi / 12)
+		return t / (1 + t), 1 / (1 + t)
+	}
+	step := 0.25
+	if scale == 1 {
+		step = 0.5
+	}
+	k := math.Exp2(-float64((pos+1)>>1) * step)
+	if pos&1 == 1 {
+		return k, 1
+	}
+	return 1, k
+}
+
+//hybrid перестановка коротких блоков, подавление наложения, IMDCT с перекрытием
+//	и инверсия частот нечетных подполос: mp3.xr → 18 отсчетов каждой подполосы
+func (mp3 *tMP3) hybrid(g *tMP3Granule, ch int) {
+	x := &mp3.xr[ch]
+	lay := mp3.layout(g)
+	if g.blockType == 2 {
+		var tmp [mp3Granule]float64
+		i := 0
+		for b := 0; b < len(lay.width); b++ {
+			if b < lay.long {
+				i += lay.width[b]
+				continue
+			}
+			w := lay.width[b] //	полоса: окна 0, 1, 2 по w линий → линия-окно
+			for k := 0; k < w; k++ {
+				for win := 0; win < 3; win++ {
+					tmp[i+3*k+win] = x[i+win*w+k]
+				}
+			}
+			copy(x[i:i+3*w], tmp[i:i+3*w])
+			b += 2
+			i += 3 * w
+		}
+	}
+
+	bounds := mp3Subbands
+	if g.blockType == 2 {
+		bounds = 0
+		if g.mixed {
+			bounds = 2
+		}
+	}
+	for sb := 1; sb < bounds; sb++ {
+		for k, c := range mp3AliasCoef {
+			cs, ca := 1/math.Sqrt(1+c*c), c/math.Sqrt(1+c*c)
+			a, b := x[sb*18-1-k], x[sb*18+k]
+			x[sb*18-1-k], x[sb*18+k] = a*cs-b*ca, b*cs+a*ca
+		}
+	}
+
+	var z [36]float64
+	for sb := 0; sb < mp3Subbands; sb++ {
+		in := x[sb*18 : sb*18+18]
+		bt := g.blockType
+		if g.mixed && sb < 2 {
+			bt = 0
+		}
+		if bt == 2 {
+			z = [36]float64{}
+			for win := 0; win < 3; win++ {
+				for i := 0; i < 12; i++ {
+					s := 0.0
+					for k := 0; k < 6; k++ {
+						s += in[3*k+win] * mp3IMDCTShort[i][k]
+					}
+					z[6+6*win+i] += s * mp3Windows[2][i]
+				}
+			}
+		} else {
+			for i := range z {
+				s := 0.0
+				for k := 0; k < 18; k++ {
+					s += in[k] * mp3IMDCTLong[i][k]
+				}
+				z[i] = s * mp3Windows[bt][i]
+			}
+		}
+		ov := mp3.overlap[ch][sb*18 : sb*18+18]
+		for i := 0; i < 18; i++ {
+			in[i] = z[i] + ov[i]
+			ov[i] = z[18+i]
+			if sb&1 == 1 && i&1 == 1 {
+				in[i] = -in[i]
+			}
+		}
+	}
+}
+
+//synthesis полифазный синтезирующий банк: 18 отсчетов 32 подполос → 576 сэмплов
+func (mp3 *tMP3) synthesis(ch int) {
+	v := &mp3.v[ch]
+	for t := 0; t < mp3SubSamples; t++ {
+		mp3.vPos[ch] = (mp3.vPos[ch] - 64) & 1023
+		pos := mp3.vPos[ch]
+		for i := 0; i < 64; i++ {
+			s := 0.0
+			for k := 0; k < mp3Subbands; k++ {
+				s += mp3Synth[i][k] * mp3.xr[ch][k*18+t]
+			}
+			v[(pos+i)&1023] = s
+		}
+		for j := 0; j < mp3Subbands; j++ {
+			s := 0.0
+			for i := 0; i < 8; i++ {
+				s += v[(pos+128*i+j)&1023]*mp3Window[64*i+j] + v[(pos+128*i+96+j)&1023]*mp3Window[64*i+32+j]
+			}
+			mp3.pcm[ch][t*mp3Subbands+j] = s
+		}
+	}
+}
+
+//emit гранула в mp3.out: float32 вперемешку по каналам потока
+func (mp3 *tMP3) emit(nch int) {
+	n := len(mp3.out)
+	mp3.out = append(mp3.out, make([]byte, mp3Granule*mp3.Channels*4)...)
+	mp3.buf = mp3.out
+	b := mp3.out[n:]
+	for i := 0; i < mp3Granule; i++ {
+		for ch := 0; ch < mp3.Channels; ch++ {
+			var s float64
+			switch {
+			case mp3.Channels < nch:
+				s = (mp3.pcm[0][i] + mp3.pcm[1][i]) / 2
+			case ch < nch:
+				s = mp3.pcm[ch][i]
+			default:
+				s = mp3.pcm[0][i]
+			}
+			binary.LittleEndian.PutUint32(b[(i*mp3.Channels+ch)*4:], math.Float32bits(float32(s)))
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//testBits запись битового потока старшими битами вперед
+type testBits struct {
+	b []byte
+	n int
+}
+
+func (w *testBits) put(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.b[w.n/8] |= 0x80 >> uint(w.n%8)
+		}
+		w.n++
+	}
+}
+
+//testMP3 поток MPEG1 Layer III 48 кГц моно 320 кбит/с: длинные блоки, таблица
+//	Хаффмана 15 на весь спектр, нулевые масштабные множители, без резервуара.
+//	Сэмплы дополняются нулями до целого числа кадров
+func testMP3(samples []float64) []byte {
+	const frameSize = 960 //	144 · 320000 / 48000
+	var (
+		fifo [512]float64
+		prev [32][18]float64
+		res  []byte
+	)
+	for len(samples)%1152 != 0 {
+		samples = append(samples, 0)
+	}
+
+	granule := func(in []float64, side, body *testBits) {
+		//	анализирующий банк фильтров (окно C = D/32) и MDCT с подавлением наложения
+		var xr [576]float64
+		for t := 0; t < 18; t++ {
+			copy(fifo[32:], fifo[:480])
+			for i := 0; i < 32; i++ {
+				fifo[31-i] = in[t*32+i]
+			}
+			var y [64]float64
+			for i := range y {
+				for j := 0; j < 8; j++ {
+					y[i] += mp3Window[i+64*j] / 32 * fifo[i+64*j]
+				}
+			}
+			for k := 0; k < 32; k++ {
+				v := 0.0
+				for i, yi := range y {
+					v += math.Cos(float64((2*k+1)*(i-16))*math.Pi/64) * yi
+				}
+				if k&1 == 1 && t&1 == 1 {
+					v = -v
+				}
+				xr[k*18+t] = v
+			}
+		}
+		for k := 0; k < 32; k++ {
+			var z [36]float64
+			copy(z[:], prev[k][:])
+			copy(z[18:], xr[k*18:k*18+18])
+			copy(prev[k][:], z[18:])
+			for m := 0; m < 18; m++ {
+				v := 0.0
+				for n := range z {
+					v += mp3Windows[0][n] * z[n] * math.Cos(math.Pi/72*float64(2*n+19)*float64(2*m+1))
+				}
+				xr[k*18+m] = v / 9
+			}
+		}
+		for sb := 1; sb < 32; sb++ {
+			for i, c := range mp3AliasCoef {
+				cs, ca := 1/math.Sqrt(1+c*c), c/math.Sqrt(1+c*c)
+				a, b := xr[sb*18-1-i], xr[sb*18+i]
+				xr[sb*18-1-i], xr[sb*18+i] = a*cs+b*ca, b*cs-a*ca
+			}
+		}
+
+		//	наименьший global_gain, при котором значения не больше 15
+		var q [576]int
+		gain := 0
+		for ; gain < 255; gain++ {
+			scale, ok := math.Exp2(float64(gain-210)/4), true
+			for i, v := range xr {
+				q[i] = int(math.Round(math.Pow(math.Abs(v)/scale, 0.75)))
+				if ok = q[i] <= 15; !ok {
+					break
+				}
+				if v < 0 {
+					q[i] = -q[i]
+				}
+			}
+			if ok {
+				break
+			}
+		}
+		start := body.n
+		for i := 0; i < 576; i += 2 {
+			x, y := q[i], q[i+1]
+			if x < 0 {
+				x = -x
+			}
+			if y < 0 {
+				y = -y
+			}
+			body.put(int(mp3HuffCodes[15][x*16+y]), int(mp3HuffBits[15][x*16+y]))
+			for _, v := range []int{q[i], q[i+1]} {
+				if v < 0 {
+					body.put(1, 1)
+				} else if v > 0 {
+					body.put(0, 1)
+				}
+			}
+		}
+		//	part2_3_length, big_values, global_gain, scalefac_compress, window_switching,
+		//	table_select ×3, region0_count, region1_count, preflag, scalefac_scale, count1table
+		for _, f := range [][2]int{{body.n - start, 12}, {288, 9}, {gain, 8}, {0, 4}, {0, 1},
+			{15, 5}, {15, 5}, {15, 5}, {7, 4}, {7, 3}, {0, 1}, {0, 1}, {0, 1}} {
+			side.put(f[0], f[1])
+		}
+	}
+
+	for pos := 0; pos < len(samples); pos += 1152 {
+		side, body := &testBits{}, &testBits{}
+		side.put(0, 9+5+4) //	main_data_begin, private_bits, scfsi
+		granule(samples[pos:], side, body)
+		granule(samples[pos+576:], side, body)
+		frame := make([]byte, frameSize)
+		copy(frame, []byte{0xFF, 0xFB, 14<<4 | 1<<2, 3 << 6})
+		copy(frame[4:], side.b)
+		copy(frame[4+17:], body.b)
+		res = append(res, frame...)
+	}
+	return res
+}
+
+func TestMP3Tables(t *testing.T) {
+	//	коды каждой таблицы — полный префиксный код: сумма 2^-длина равна 1
+	kraft := func(bits []uint8) (sum float64) {
+		for _, b := range bits {
+			sum += math.Exp2(-float64(b))
+		}
+		return sum
+	}
+	for i, bits := range mp3HuffBits {
+		if bits != nil && (len(bits) != len(mp3HuffCodes[i]) || kraft(bits) != 1) {
+			t.Errorf("mp3HuffBits: table %d not a complete code", i)
+		}
+	}
+	if kraft(mp3QuadBits) != 1 {
+		t.Errorf("mp3QuadBits: not a complete code")
+	}
+	for i, bands := range mp3LongBands {
+		sum := 0
+		for _, w := range bands {
+			sum += w
+		}
+		if sum != 576 {
+			t.Errorf("mp3LongBands: %d sum %d", i, sum)
+		}
+	}
+	for i, bands := range mp3ShortBands {
+		sum := 0
+		for _, w := range bands {
+			sum += w
+		}
+		if sum != 192 {
+			t.Errorf("mp3ShortBands: %d sum %d", i, sum)
+		}
+	}
+}
+
+func TestMP3(t *testing.T) {
+	in := testSine(48000, 1, 1000, 0.5, 0, 1)
+	data := testMP3(in)
+
+	//	перед первым кадром — тег ID3v2 и мусор, между кадрами — обрывок заголовка
+	stream := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x05tag..junk\xFF\xFB"), data[:960*10]...)
+	stream = append(append(stream, 0xFF, 0xFB, 0x00), data[960*10:]...)
+	mp3, err := openMP3(bufio.NewReader(bytes.NewReader(stream)))
+	if err != nil || mp3.Rate != 48000 || mp3.Channels != 1 {
+		t.Fatalf("openMP3: wrong result %v %+v", err, mp3)
+	}
+	pcm := &tPCM{Rate: mp3.Rate, Channels: mp3.Channels, bits: 32, float: true, r: mp3}
+	var out []float64
+	buf := make([]float64, 1000)
+	for {
+		n, err := pcm.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if len(out) != len(data)/960*1152 {
+		t.Fatalf("Read: %d samples, want %d", len(out), len(data)/960*1152)
+	}
+
+	//	задержка кодера и декодера — 1057 сэмплов
+	const delay = 1057
+	var sig, noise float64
+	for i := 2000; i < 40000; i++ {
+		sig += in[i] * in[i]
+		noise += (out[i+delay] - in[i]) * (out[i+delay] - in[i])
+	}
+	if snr := 10 * math.Log10(sig/noise); snr < 25 {
+		t.Errorf("Read: SNR %.1f dB", snr)
+	}
+}
+
+func TestMP3NotMP3(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("OggS not really mp3"),
+		testWAV(8000, 1, 16, 1, make([]float64, 1000)),
+		[]byte{0xFF, 0xFB, 14<<4 | 1<<2, 3 << 6}, //	заголовок без кадра
+	} {
+		if _, err := openMP3(bufio.NewReader(bytes.NewReader(data))); err != errNotMP3 {
+			t.Errorf("openMP3: %q wrong error %v", data, err)
+		}
+	}
+}
+
+//testMP3File декодирование файла из testdata/mp3 по каналам
+func testMP3File(t *testing.T, name string) (*tMP3, [][]float64) {
+	fd, err := os.Open(filepath.Join("testdata", "mp3", name))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer fd.Close()
+	mp3, err := openMP3(bufio.NewReader(fd))
+	if err != nil {
+		t.Fatalf("%s: openMP3 %v", name, err)
+	}
+	pcm := &tPCM{Rate: mp3.Rate, Channels: mp3.Channels, bits: 32, float: true, r: mp3}
+	res := make([][]float64, mp3.Channels)
+	buf := make([]float64, 1152*mp3.Channels)
+	for {
+		n, err := pcm.Read(buf)
+		for i := 0; i < n; i++ {
+			res[i%mp3.Channels] = append(res[i%mp3.Channels], buf[i])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: Read %v", name, err)
+		}
+	}
+	return mp3, res
+}
+
+//testBandAbove доля энергии x выше частоты f, дБ (окно Ханна по 1024 сэмпла)
+func testBandAbove(x []float64, rate int, f float64) float64 {
+	const n = 1024
+	var above, all float64
+	bins := make([]complex128, n)
+	for pos := 0; pos+n <= len(x); pos += n {
+		for i := range bins {
+			bins[i] = complex(x[pos+i]*(0.5-0.5*math.Cos(2*math.Pi*float64(i)/n)), 0)
+		}
+		fft(bins)
+		for b := 1; b < n/2; b++ {
+			e := real(bins[b])*real(bins[b]) + imag(bins[b])*imag(bins[b])
+			all += e
+			if float64(b*rate)/n > f {
+				above += e
+			}
+		}
+	}
+	return 10 * math.Log10(above/all)
+}
+
+//testResample передискретизация x в частоту out с фильтром нижних частот до fc
+//	(sinc с окном Ханна)
+func testResample(x []float64, in, out int, fc float64) []float64 {
+	ratio, scale := float64(in)/float64(out), 2*fc/float64(in)
+	half := int(64 * ratio)
+	res := make([]float64, int(float64(len(x))/ratio))
+	for i := range res {
+		c := float64(i) * ratio
+		for j := int(c) - half; j <= int(c)+half; j++ {
+			if j < 0 || j >= len(x) {
+				continue
+			}
+			d := float64(j) - c
+			s := 1.0
+			if d != 0 {
+				s = math.Sin(math.Pi*d*scale) / (math.Pi * d * scale)
+			}
+			res[i] += x[j] * s * scale * (0.5 + 0.5*math.Cos(math.Pi*d/float64(half)))
+		}
+	}
+	return res
+}
+
+//testCorr коэффициент корреляции a и b
+func testCorr(a, b []float64) float64 {
+	var ab, aa, bb float64
+	for i := range a {
+		ab += a[i] * b[i]
+		aa += a[i] * a[i]
+		bb += b[i] * b[i]
+	}
+	return ab / math.Sqrt(aa*bb)
+}
+
+//TestMP3Files файлы кодировщика LAME (см. testdata/mp3/README). Эталонного PCM к ним
+//	нет, поэтому проверяется то, что не зависит от нашего кодировщика из testMP3
+func TestMP3Files(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int
+		channels int
+		frames   int
+		cutoff   float64    //	срез кодировщика, Гц: выше — не громче -60 дБ
+		corr     [2]float64 //	корреляция левого и правого каналов
+	}{
+		{"lsf-22050-mono.mp3", 22050, 1, 193, 11000, [2]float64{1, 1}},
+		{"lsf-8000-mono.mp3", 8000, 1, 73, 3900, [2]float64{1, 1}},
+		//	MPEG2 joint stereo: M/S и intensity stereo, короткие блоки
+		{"lsf-22050-joint.mp3", 22050, 2, 307, 11000, [2]float64{0.8, 0.95}},
+		//	MPEG1 M/S, в файле двойное моно: без M/S правый канал — тишина
+		{"mpeg1-44100-joint.mp3", 44100, 2, 156, 16500, [2]float64{0.999, 1}},
+		{"mpeg1-32000-stereo.mp3", 32000, 2, 5, 15500, [2]float64{0.55, 0.75}},
+	}
+	decoded := map[string][]float64{}
+	for _, tst := range tests {
+		mp3, ch := testMP3File(t, tst.name)
+		//	каждая гранула разобрана ровно по своему part2_3_length: ошибка в масштабных
+		//	множителях или таблицах Хаффмана сдвигает разбор и выводит его за границу
+		if mp3.Rate != tst.rate || mp3.Channels != tst.channels || mp3.frames != tst.frames || mp3.corrupt != 0 {
+			t.Errorf("%s: rate %d channels %d frames %d corrupt %d", tst.name, mp3.Rate, mp3.Channels, mp3.frames, mp3.corrupt)
+		}
+		peak := 0.0
+		for _, x := range ch {
+			for _, v := range x {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					t.Fatalf("%s: sample %v", tst.name, v)
+				}
+				peak = math.Max(peak, math.Abs(v))
+			}
+		}
+		if peak < 0.1 || peak > 1 {
+			t.Errorf("%s: peak %.3f", tst.name, peak)
+		}
+		if db := testBandAbove(ch[0], mp3.Rate, tst.cutoff); db > -60 {
+			t.Errorf("%s: %.1f dB above %.0f Hz", tst.name, db, tst.cutoff)
+		}
+		if c := testCorr(ch[0], ch[len(ch)-1]); c < tst.corr[0]-1e-9 || c > tst.corr[1]+1e-9 {
+			t.Errorf("%s: channel correlation %.3f", tst.name, c)
+		}
+		decoded[tst.name] = ch[0]
+	}
+
+	//	один фрагмент, закодированный в MPEG2 22050 Гц и MPEG2.5 8000 Гц, служит эталоном
+	//	друг для друга: в полосе до 3 кГц после выравнивания задержки и уровня они
+	//	должны совпадать (сейчас: корреляция 0.991, SNR 17.5 дБ; ошибка масштаба
+	//	множителей в деквантовании уже дает 16.3 дБ)
+	a := testResample(decoded["lsf-22050-mono.mp3"], 22050, 8000, 3000)
+	b := testResample(decoded["lsf-8000-mono.mp3"], 8000, 8000, 3000)
+	n := len(a) - 4000
+	if len(b)-4000 < n {
+		n = len(b) - 4000
+	}
+	corr, offset := -1.0, 0
+	for off := 0; off < 2000; off++ {
+		if c := testCorr(a[2000:n], b[2000+off:n+off]); c > corr {
+			corr, offset = c, off
+		}
+	}
+	var ab, bb, aa, noise float64
+	for i := 2000; i < n; i++ {
+		ab += a[i] * b[i+offset]
+		bb += b[i+offset] * b[i+offset]
+		aa += a[i] * a[i]
+	}
+	for i := 2000; i < n; i++ {
+		d := a[i] - ab/bb*b[i+offset]
+		noise += d * d
+	}
+	if snr := 10 * math.Log10(aa/noise); corr < 0.985 || snr < 17 {
+		t.Errorf("lsf-8000-mono.mp3: correlation %.4f SNR %.1f dB against lsf-22050-mono.mp3", corr, snr)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//виды уведомлений
+const (
+	notifyShare   = "share"   //	пользователю открыт доступ к треку
+	notifyLock    = "lock"    //	доступ к треку закрыт
+	notifyVersion = "version" //	владелец загрузил новую версию трека
+)
+
+//notifyMessages шаблоны текста уведомлений: инициатор, название трека
+var notifyMessages = map[string]string{
+	notifyShare:   "%s shared track \"%s\" with you",
+	notifyLock:    "%s revoked your access to track \"%s\"",
+	notifyVersion: "%s uploaded a new version of track \"%s\"",
+}
+
+type tNotification struct {
+	NotifyID  int        `json:"id"`
+	Kind      string     `json:"kind"`
+	AudioID   int        `json:"audio,omitempty"`
+	AudioName string     `json:"audio_name,omitempty"`
+	FromID    int        `json:"from_id,omitempty"`
+	FromName  string     `json:"from_name,omitempty"`
+	Message   string     `json:"message"`
+	Created   time.Time  `json:"created"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+type tNotifyList struct {
+	Count  int              `json:"total_count"`
+	Unread int              `json:"unread_count"`
+	List   []*tNotification `json:"records"`
+}
+
+//tRecipient получатель уведомления — данные для каналов доставки
+type tRecipient struct {
+	UserID int
+	Name   string
+	Email  string
+}
+
+//notifyChannel канал доставки уведомлений пользователю. Уведомление к моменту
+//	вызова Deliver уже сохранено в таблице notifications (in-app канал)
+type notifyChannel interface {
+	Name() string
+	Deliver(n *tNotification, to *tRecipient) error
+}
+
+var (
+	notifyMu       sync.RWMutex
+	notifyChannels = []notifyChannel{inAppChannel{}}
+)
+
+//registerNotifyChannel подключение дополнительного канала доставки уведомлений
+func registerNotifyChannel(ch notifyChannel) {
+	notifyMu.Lock()
+	notifyChannels = append(notifyChannels, ch)
+	notifyMu.Unlock()
+}
+
+//unregisterNotifyChannel отключение канала доставки, подключенного registerNotifyChannel
+func unregisterNotifyChannel(ch notifyChannel) {
+	notifyMu.Lock()
+	for i, v := range notifyChannels {
+		if v == ch {
+			notifyChannels = append(notifyChannels[:i:i], notifyChannels[i+1:]...)
+			break
+		}
+	}
+	notifyMu.Unlock()
+}
+
+//inAppChannel уведомления внутри приложения: достаточно записи в таблице,
+//	пользователь получает их запросом GET /notifications
+type inAppChannel struct{}
+
+func (inAppChannel) Name() string { return "inapp" }
+
+func (inAppChannel) Deliver(n *tNotification, to *tRecipient) error { return nil }
+
+//emailChannel отправка уведомлений письмом через SMTP-сервер Addr (без авторизации,
+//	расчитано на локальный relay/заглушку). Пользователи без email пропускаются
+type emailChannel struct {
+	Addr string
+	From string
+}
+
+func (ch emailChannel) Name() string { return "email" }
+
+func (ch emailChannel) Deliver(n *tNotification, to *tRecipient) error {
+	if to.Email == "" {
+		return nil
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: audiofill: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		ch.From, to.Email, n.Kind, n.Message)
+	return smtp.SendMail(ch.Addr, nil, ch.From, []string{to.Email}, []byte(msg))
+}
+
+//webhookChannel отправка уведомлений POST-запросом в json на URL
+type webhookChannel struct {
+	URL    string
+	Client *http.Client
+}
+
+func (ch webhookChannel) Name() string { return "webhook" }
+
+func (ch webhookChannel) Deliver(n *tNotification, to *tRecipient) error {
+	client := ch.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	js, err := json.Marshal(struct {
+		UserID       int            `json:"user_id"`
+		Notification *tNotification `json:"notification"`
+	}{to.UserID, n})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(ch.URL, "application/json", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: status %d", ch.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+//sqlNotifySelect выборка уведомлений с данными трека и инициатора (алиас — n)
+const sqlNotifySelect = `SELECT n.id_notify, n.kind,
+		coalesce(n.id_audio, 0), coalesce(a.description, ''),
+		coalesce(n.id_from, 0), coalesce(nullif(f.name, ''), f.login, ''),
+		n.created, n.read_at
+	FROM notifications n
+	LEFT JOIN audio a ON (a.id_audio = n.id_audio)
+	LEFT JOIN users f ON (f.id_user = n.id_from)`
+
+//scanNotification чтение строки sqlNotifySelect, текст сообщения формируется по шаблону
+func scanNotification(sc interface{ Scan(...interface{}) error }) (n *tNotification, err error) {
+	var readAt pq.NullTime
+
+	n = &tNotification{}
+	err = sc.Scan(&n.NotifyID, &n.Kind, &n.AudioID, &n.AudioName, &n.FromID, &n.FromName, &n.Created, &readAt)
+	if err != nil {
+		return nil, err
+	}
+	if readAt.Valid {
+		n.ReadAt = &readAt.Time
+	}
+	if tmpl, ok := notifyMessages[n.Kind]; ok {
+		n.Message = fmt.Sprintf(tmpl, n.FromName, n.AudioName)
+	}
+	return n, nil
+}
+
+//addNotification сохранение уведомления для пользователя userID и рассылка
+//	по подключенным каналам. Рассылка асинхронная, ошибки каналов только логируются
+func addNotification(db *sql.DB, userID int, kind string, audioID, fromID int) error {
+	var (
+		id  int
+		err error
+		n   *tNotification
+	)
+
+	rcpt := &tRecipient{UserID: userID}
+	err = db.QueryRow(`INSERT INTO notifications (id_user, kind, id_audio, id_from)
+		VALUES ($1, $2, nullif($3, 0), nullif($4, 0)) RETURNING id_notify`,
+		userID, kind, audioID, fromID).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if n, err = scanNotification(db.QueryRow(sqlNotifySelect+` WHERE n.id_notify = $1`, id)); err != nil {
+		return err
+	}
+	err = db.QueryRow(`SELECT coalesce(nullif(name, ''), login), email FROM users WHERE id_user = $1`,
+		userID).Scan(&rcpt.Name, &rcpt.Email)
+	if err != nil {
+		return err
+	}
+
+	notifyMu.RLock()
+	channels := notifyChannels
+	notifyMu.RUnlock()
+	go func() {
+		for _, ch := range channels {
+			if err := ch.Deliver(n, rcpt); err != nil {
+				log.Println("Notify delivery failed:", ch.Name(), err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+//Notifications класс для таблицы notifications: список уведомлений пользователя,
+//	отметка о прочтении
+type Notifications struct {
+	DB     *sql.DB
+	userID int
+}
+
+//NewNotifications создание нового экземпляра класса Notifications
+func NewNotifications(db *sql.DB) *Notifications {
+	return &Notifications{
+		DB: db,
+	}
+}
+
+//List список уведомлений пользователя, новые первыми. Метод GET, доступен только
+//	авторизованным пользователям
+//Параметры: page_no, on_page — необязательные, по умолчанию 1 и 10 соответственно
+//	unread — флаг, только непрочитанные
+//Результат: статус ОК, json: общее количество, количество непрочитанных, список
+//Ошибка: статус NotFound если уведомлений нет
+//	статус Unauthorized если пользователь не авторизован
+func (ntf *Notifications) List(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		pg, ln int
+		qs     *sql.Rows
+		n      *tNotification
+		nLst   tNotifyList
+		unread bool
+	)
+
+	if ntf.userID, err = checkSession(ntf.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	pg, ln = getPageno(req)
+	unread = formFlag(req, "unread")
+
+	//	общее количество — с учетом фильтра unread, как и список
+	nLst = tNotifyList{}
+	err = ntf.DB.QueryRow(`SELECT count(*) FILTER (WHERE NOT $2 OR read_at IS NULL),
+			count(*) FILTER (WHERE read_at IS NULL)
+		FROM notifications WHERE id_user = $1`, ntf.userID, unread).Scan(&nLst.Count, &nLst.Unread)
+	if err != nil {
+		dbError(resp, err, "Notifications.List scan count failed:")
+		return
+	}
+
+	qs, err = ntf.DB.Query(sqlNotifySelect+`
+		WHERE n.id_user = $1 AND (NOT $2 OR n.read_at IS NULL)
+		ORDER BY n.created DESC, n.id_notify DESC
+		OFFSET $3 LIMIT $4`, ntf.userID, unread, pg*ln, ln)
+	if err != nil {
+		dbError(resp, err, "Notifications.List query failed:")
+		return
+	}
+	defer qs.Close()
+
+	for qs.Next() {
+		if n, err = scanNotification(qs); err != nil {
+			dbError(resp, err, "Notifications.List scan error:")
+			return
+		}
+		nLst.List = append(nLst.List, n)
+	}
+	if qs.Err() != nil {
+		dbError(resp, qs.Err(), "Notifications.List query iteration error:")
+		return
+	}
+	if len(nLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+
+	jsRes, err := json.Marshal(nLst)
+	if err != nil {
+		internalError(resp, err, "Notifications.List result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Read отметка уведомлений прочитанными. Метод POST, доступен только авторизованным
+//Параметры: id — номер уведомления, либо all — все уведомления пользователя
+//Результат: статус ОК
+//Ошибка: статус NotFound если непрочитанных уведомлений с таким id нет
+//	статус BadRequest если не указан ни id, ни all
+func (ntf *Notifications) Read(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		frmVal []string
+		ok     bool
+		id     int
+		qr     sql.Result
+	)
+
+	if ntf.userID, err = checkSession(ntf.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+
+	if formFlag(req, "all") {
+		_, err = ntf.DB.Exec(`UPDATE notifications SET read_at = now()
+			WHERE id_user = $1 AND read_at IS NULL`, ntf.userID)
+		if err != nil {
+			dbError(resp, err, "Notifications.Read query failed:")
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if frmVal, ok = req.Form["id"]; !ok {
+		fieldError(resp, "id", "required")
+		return
+	}
+	if id, err = strconv.Atoi(frmVal[0]); err != nil {
+		fieldError(resp, "id", "invalid")
+		return
+	}
+
+	qr, err = ntf.DB.Exec(`UPDATE notifications SET read_at = now()
+		WHERE id_notify = $1 AND id_user = $2 AND read_at IS NULL`, id, ntf.userID)
+	if err != nil {
+		dbError(resp, err, "Notifications.Read query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "no rows are updated")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
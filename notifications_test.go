@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testChannel канал доставки, запоминающий отправленные уведомления
+type testChannel struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (ch *testChannel) Name() string { return "test" }
+
+func (ch *testChannel) Deliver(n *tNotification, to *tRecipient) error {
+	ch.mu.Lock()
+	ch.sent = append(ch.sent, fmt.Sprintf("%d:%s:%d", to.UserID, n.Kind, n.AudioID))
+	ch.mu.Unlock()
+	return nil
+}
+
+func (ch *testChannel) wait(cnt int) []string {
+	for i := 0; i < 50; i++ {
+		ch.mu.Lock()
+		if len(ch.sent) >= cnt {
+			ch.mu.Unlock()
+			break
+		}
+		ch.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return append([]string(nil), ch.sent...)
+}
+
+func TestNotifications(t *testing.T) {
+	var (
+		err    error
+		result tNotifyList
+	)
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	sessID, err := newSession(testDB, 4)
+	if err != nil {
+		t.Fatalf("Notifications: ghost session failed %s", err.Error())
+	}
+	cookGhost := &http.Cookie{Name: "session_id", Value: sessID}
+
+	ch := &testChannel{}
+	registerNotifyChannel(ch)
+	defer unregisterNotifyChannel(ch)
+
+	if st, _ := testDo(t, http.MethodGet, "/notifications", "", cookGhost); st != http.StatusNotFound {
+		t.Errorf("Notifications: empty list wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+
+	if st, _ := testDo(t, http.MethodPost, "/audio/share", "track=1&user=4", cookAdmin); st != http.StatusOK {
+		t.Fatalf("Notifications: share wrong status %d, expected %d", st, http.StatusOK)
+	}
+	st, body := testDo(t, http.MethodGet, "/notifications", "", cookGhost)
+	if st != http.StatusOK {
+		t.Fatalf("Notifications: list wrong status %d, expected %d", st, http.StatusOK)
+	}
+	if err = json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Notifications: unmarshaling result error [%s]", err.Error())
+	}
+	if result.Count != 1 || result.Unread != 1 || result.List[0].Kind != notifyShare ||
+		result.List[0].AudioID != 1 || result.List[0].FromName != "admin" ||
+		result.List[0].Message != `admin shared track "test music" with you` {
+		t.Errorf("Notifications: wrong list %s", body)
+	}
+
+	if st, _ = testDo(t, http.MethodPost, "/notifications/read", "all", cookGhost); st != http.StatusOK {
+		t.Errorf("Notifications: read all wrong status %d, expected %d", st, http.StatusOK)
+	}
+	if st, _ = testDo(t, http.MethodGet, "/notifications", "unread", cookGhost); st != http.StatusNotFound {
+		t.Errorf("Notifications: unread list wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+
+	if st, _ = testDo(t, http.MethodPost, "/audio/lock", "track=1&user=4", cookAdmin); st != http.StatusOK {
+		t.Fatalf("Notifications: lock wrong status %d, expected %d", st, http.StatusOK)
+	}
+	st, body = testDo(t, http.MethodGet, "/notifications", "", cookGhost)
+	result = tNotifyList{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Notifications: unmarshaling result error [%s]", err.Error())
+	}
+	if result.Count != 2 || result.Unread != 1 || result.List[0].Kind != notifyLock {
+		t.Errorf("Notifications: wrong list after lock %s", body)
+	}
+	//	общее количество — только непрочитанных, как и список
+	unread := tNotifyList{}
+	st, body = testDo(t, http.MethodGet, "/notifications", "unread", cookGhost)
+	if st != http.StatusOK || json.Unmarshal(body, &unread) != nil ||
+		unread.Count != 1 || unread.Unread != 1 || len(unread.List) != 1 {
+		t.Errorf("Notifications: wrong unread list %d %s", st, body)
+	}
+
+	//	чужое уведомление отметить нельзя
+	query := fmt.Sprintf("id=%d", result.List[0].NotifyID)
+	if st, _ = testDo(t, http.MethodPost, "/notifications/read", query, cookAdmin); st != http.StatusNotFound {
+		t.Errorf("Notifications: read foreign wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+	if st, _ = testDo(t, http.MethodPost, "/notifications/read", query, cookGhost); st != http.StatusOK {
+		t.Errorf("Notifications: read wrong status %d, expected %d", st, http.StatusOK)
+	}
+
+	sent := ch.wait(2)
+	if strings.Join(sent, ",") != "4:share:1,4:lock:1" {
+		t.Errorf("Notifications: wrong channel deliveries %v", sent)
+	}
+}
+
+func TestNotifyWebhookChannel(t *testing.T) {
+	var got struct {
+		UserID       int            `json:"user_id"`
+		Notification *tNotification `json:"notification"`
+	}
+
+	rcv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&got)
+	}))
+	defer rcv.Close()
+
+	ch := webhookChannel{URL: rcv.URL, Client: rcv.Client()}
+	err := ch.Deliver(&tNotification{NotifyID: 7, Kind: notifyShare, Message: "hello"}, &tRecipient{UserID: 3})
+	if err != nil {
+		t.Fatalf("Notify.Webhook: deliver failed %s", err.Error())
+	}
+	if got.UserID != 3 || got.Notification == nil || got.Notification.NotifyID != 7 {
+		t.Errorf("Notify.Webhook: wrong payload %+v", got)
+	}
+}
+
+//testSMTP заглушка SMTP-сервера: принимает одно письмо и отдает в канал
+//	адреса конверта и текст письма
+func testSMTP(t *testing.T) (addr string, mail chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("SMTP stub: listen failed %s", err.Error())
+	}
+	mail = make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var (
+			r   = bufio.NewReader(conn)
+			msg []string
+		)
+		fmt.Fprint(conn, "220 localhost stub\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case strings.HasPrefix(cmd, "MAIL FROM:"), strings.HasPrefix(cmd, "RCPT TO:"):
+				msg = append(msg, strings.TrimSpace(line))
+				fmt.Fprint(conn, "250 ok\r\n")
+			case cmd == "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				for {
+					line, err = r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					msg = append(msg, strings.TrimRight(line, "\r\n"))
+				}
+				fmt.Fprint(conn, "250 queued\r\n")
+			case cmd == "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				mail <- strings.Join(msg, "\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 ok\r\n")
+			}
+		}
+	}()
+	return ln.Addr().String(), mail
+}
+
+func TestNotifyEmailChannel(t *testing.T) {
+	addr, mail := testSMTP(t)
+	ch := emailChannel{Addr: addr, From: "audiofill@localhost"}
+
+	//	без адреса письмо не отправляется: заглушка приняла бы только его
+	if err := ch.Deliver(&tNotification{Kind: notifyShare, Message: "skipped"}, &tRecipient{UserID: 2}); err != nil {
+		t.Fatalf("Notify.Email: deliver without email failed %s", err.Error())
+	}
+	err := ch.Deliver(&tNotification{Kind: notifyLock, Message: "hello"}, &tRecipient{UserID: 3, Email: "ghost@localhost"})
+	if err != nil {
+		t.Fatalf("Notify.Email: deliver failed %s", err.Error())
+	}
+	select {
+	case got := <-mail:
+		for _, want := range []string{"MAIL FROM:<audiofill@localhost>", "RCPT TO:<ghost@localhost>",
+			"To: ghost@localhost", "Subject: audiofill: lock", "\nhello"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("Notify.Email: %q not found in mail\n%s", want, got)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Notify.Email: mail not received")
+	}
+}
@@ -0,0 +1,1103 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//tAPIParam параметр операции API. In — path, query или body (форма/json)
+type tAPIParam struct {
+	Name     string
+	In       string
+	Type     string //	integer, string, boolean, binary (файл, только multipart)
+	Required bool
+	Descr    string
+	Enum     []string
+}
+
+//tAPIOperation описание операции API для спецификации OpenAPI. Responses — схема
+//	из components/schemas по статусу ответа: "" — без тела, "binary" — файл,
+//	"playlist" — файл плейлиста, "chapters" — файл глав, "hls" — плейлист HLS,
+//	"stream" — text/event-stream. Ошибки (Error) добавляются ко всем операциям
+type tAPIOperation struct {
+	Method     string
+	Path       string
+	Tag        string
+	Summary    string
+	Public     bool //	не требует сессии
+	Multipart  bool //	тело multipart/form-data (загрузка файла)
+	Params     []tAPIParam
+	Responses  map[int]string
+	Deprecated bool
+}
+
+//параметры, общие для нескольких операций
+var (
+	apiPageParams = []tAPIParam{
+		{Name: "page_no", In: "query", Type: "integer", Descr: "page number, starting from 1"},
+		{Name: "on_page", In: "query", Type: "integer", Descr: "records per page, default 10, at most 100"},
+	}
+	apiCursorParams = apiParams(apiPageParams, []tAPIParam{
+		{Name: "cursor", In: "query", Type: "string", Descr: "page cursor from next/prev links, replaces page_no"},
+	})
+	apiTrackFilters = []tAPIParam{
+		{Name: "scope", In: "query", Type: "string", Enum: []string{"all", "own", "shared_with_me", "shared_by_me"}},
+		{Name: "owner", In: "query", Type: "integer", Descr: "owner id"},
+		{Name: "duration_from", In: "query", Type: "string", Descr: "seconds or [hh:]mm:ss"},
+		{Name: "duration_to", In: "query", Type: "string", Descr: "seconds or [hh:]mm:ss"},
+		{Name: "uploaded_from", In: "query", Type: "string", Descr: "RFC 3339 time or date"},
+		{Name: "uploaded_to", In: "query", Type: "string", Descr: "RFC 3339 time or date (whole day)"},
+		{Name: "format", In: "query", Type: "string", Descr: "comma separated file extensions"},
+		{Name: "favorite", In: "query", Type: "boolean", Descr: "only current user's favorites"},
+		{Name: "tag", In: "query", Type: "string", Descr: "comma separated tag ids, track must have all of them"},
+		{Name: "folder", In: "query", Type: "integer", Descr: "own folder id with subfolders, 0 — tracks out of folders"},
+	}
+	apiExportParams = []tAPIParam{
+		{Name: "type", In: "query", Type: "string", Enum: []string{"m3u8", "pls", "xspf"}, Descr: "default m3u8"},
+		{Name: "auth", In: "query", Type: "string", Enum: []string{"token", "session"},
+			Descr: "token (default) — file links work without session cookie, session — plain links"},
+	}
+	apiTrackParam      = tAPIParam{Name: "track", In: "path", Type: "integer", Required: true, Descr: "track id"}
+	apiUserParam       = tAPIParam{Name: "user", In: "path", Type: "integer", Required: true, Descr: "user id"}
+	apiPlaylistParam   = tAPIParam{Name: "playlist", In: "path", Type: "integer", Required: true, Descr: "playlist id"}
+	apiTagParam        = tAPIParam{Name: "tag", In: "path", Type: "integer", Required: true, Descr: "tag id"}
+	apiFolderParam     = tAPIParam{Name: "folder", In: "path", Type: "integer", Required: true, Descr: "folder id"}
+	apiAnnotationParam = tAPIParam{Name: "annotation", In: "path", Type: "integer", Required: true, Descr: "annotation id"}
+	apiHookParam       = tAPIParam{Name: "id", In: "path", Type: "integer", Required: true, Descr: "webhook id"}
+)
+
+//apiParams объединение наборов параметров
+func apiParams(sets ...[]tAPIParam) (res []tAPIParam) {
+	for _, set := range sets {
+		res = append(res, set...)
+	}
+	return res
+}
+
+//apiOperations операции API. Порядок и пути совпадают с newRouter, тест
+//	TestOpenAPIRoutes следит, чтобы описание не расходилось с маршрутами
+var apiOperations = []*tAPIOperation{
+	{Method: http.MethodGet, Path: "/tracks", Tag: "tracks", Summary: "List own and shared tracks",
+		Params: apiParams(apiCursorParams, []tAPIParam{
+			{Name: "order_by", In: "query", Type: "string",
+				Enum: []string{"user", "track", "duration", "duration_desc", "uploaded", "uploaded_desc",
+					"rating", "plays", "recently_played"}},
+		}, apiTrackFilters),
+		Responses: map[int]string{200: "AudioList"}},
+	{Method: http.MethodGet, Path: "/tracks/search", Tag: "tracks", Summary: "Search accessible tracks by name, tags and owner",
+		Params: apiParams([]tAPIParam{
+			{Name: "q", In: "query", Type: "string", Required: true,
+				Descr: `search text, web search syntax: "phrase", -word, or`},
+		}, apiPageParams, apiTrackFilters),
+		Responses: map[int]string{200: "SearchList"}},
+	{Method: http.MethodGet, Path: "/tracks/export", Tag: "tracks",
+		Summary: "Export accessible tracks as M3U8, PLS or XSPF playlist",
+		Params:  apiParams(apiExportParams, apiTrackFilters), Responses: map[int]string{200: "playlist"}},
+	{Method: http.MethodPost, Path: "/tracks", Tag: "tracks", Summary: "Upload a track", Multipart: true,
+		Params: []tAPIParam{
+			{Name: "file", In: "body", Type: "binary", Required: true},
+			{Name: "name", In: "body", Type: "string"},
+			{Name: "duration", In: "body", Type: "string", Descr: "seconds or [hh:]mm:ss"},
+		},
+		Responses: map[int]string{201: "TrackCreated"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}", Tag: "tracks", Summary: "Track with its shares",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: "Audio"}},
+	{Method: http.MethodPatch, Path: "/tracks/{track}", Tag: "tracks", Summary: "Rename track or upload a new version",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "name", In: "body", Type: "string"},
+			{Name: "duration", In: "body", Type: "string", Descr: "seconds or [hh:]mm:ss"},
+			{Name: "file", In: "body", Type: "binary", Descr: "new version, multipart only"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}", Tag: "tracks", Summary: "Delete track",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/file", Tag: "tracks", Summary: "Download track file",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "token", In: "query", Type: "string", Descr: "link token from exported playlist, replaces session"},
+			{Name: "format", In: "query", Type: "string", Enum: []string{"mp3", "aac", "ogg", "opus", "wav"},
+				Descr: "transcoded copy, cached on server"},
+			{Name: "bitrate", In: "query", Type: "integer", Descr: "kbit/s of transcoded copy, 32..320, default 192, ignored for wav"},
+		},
+		Responses: map[int]string{200: "binary"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/hls/index.m3u8", Tag: "tracks",
+		Summary: "HLS media playlist of MP3/AAC track, segments are cut on frame boundaries",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "token", In: "query", Type: "string", Descr: "link token, passed on to segment links"},
+		},
+		Responses: map[int]string{200: "hls"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/hls/{segment}", Tag: "tracks", Summary: "HLS segment (packed audio)",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "segment", In: "path", Type: "string", Required: true, Descr: "N.mp3 or N.aac from playlist"},
+			{Name: "token", In: "query", Type: "string", Descr: "link token"},
+		},
+		Responses: map[int]string{200: "binary"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/peaks", Tag: "tracks",
+		Summary: "Waveform peaks in audiowaveform JSON format (peaks.js)",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "samples_per_pixel", In: "query", Type: "integer", Descr: "zoom level, multiple of 256, default 256"},
+			{Name: "bits", In: "query", Type: "integer", Descr: "8 or 16, default 16"},
+			{Name: "token", In: "query", Type: "string", Descr: "link token"},
+		},
+		Responses: map[int]string{200: "Peaks"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/waveform", Tag: "tracks",
+		Summary: "Waveform image, cached per parameter set, ETag",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "format", In: "query", Type: "string", Enum: []string{"png", "svg"}, Descr: "default png"},
+			{Name: "width", In: "query", Type: "integer", Descr: "pixels, 16..4096, default 800"},
+			{Name: "height", In: "query", Type: "integer", Descr: "pixels, 16..2048, default 120"},
+			{Name: "color", In: "query", Type: "string", Descr: "hex rrggbb, default 3366cc"},
+			{Name: "background", In: "query", Type: "string", Descr: "hex rrggbb or transparent, default transparent"},
+			{Name: "token", In: "query", Type: "string", Descr: "link token"},
+		},
+		Responses: map[int]string{200: "binary"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/spectrogram", Tag: "tracks",
+		Summary: "Spectrogram PNG image, linear frequency scale, cached per parameter set, ETag",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "width", In: "query", Type: "integer", Descr: "pixels, 16..4096, default 800"},
+			{Name: "height", In: "query", Type: "integer", Descr: "pixels, 16..2048, default 256"},
+			{Name: "color", In: "query", Type: "string", Descr: "hex rrggbb of loudest level, default ffcc00"},
+			{Name: "background", In: "query", Type: "string", Descr: "hex rrggbb or transparent of silence, default 000000"},
+			{Name: "token", In: "query", Type: "string", Descr: "link token"},
+		},
+		Responses: map[int]string{200: "binary"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/preview", Tag: "tracks",
+		Summary: "Preview clip without transcoding: WAV cut on samples, MP3/AAC on frame boundaries",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "start", In: "query", Type: "number", Descr: "offset in seconds, default 0"},
+			{Name: "duration", In: "query", Type: "number", Descr: "seconds, 1..120, default 30"},
+			{Name: "token", In: "query", Type: "string", Descr: "link token"},
+		},
+		Responses: map[int]string{200: "binary"}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/artwork", Tag: "tracks",
+		Summary: "Cover art: uploaded, embedded in file (ID3 APIC, FLAC PICTURE) or SVG placeholder",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "size", In: "query", Type: "integer", Descr: "JPEG thumbnail, 64, 128, 256 or 512 px, original if omitted"},
+			{Name: "token", In: "query", Type: "string", Descr: "link token"},
+		},
+		Responses: map[int]string{200: "binary"}},
+	{Method: http.MethodPut, Path: "/tracks/{track}/artwork", Tag: "tracks", Summary: "Upload cover art replacing embedded one",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "file", In: "body", Type: "binary", Required: true, Descr: "JPEG, PNG or GIF up to 10 MB, multipart"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/artwork", Tag: "tracks", Summary: "Delete uploaded cover art",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodPut, Path: "/tracks/{track}/lyrics", Tag: "tracks",
+		Summary: "Upload lyrics or transcript replacing one from file tags",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "file", In: "body", Type: "binary", Descr: "UTF-8 text up to 1 MB, multipart; format from extension .txt, .lrc, .vtt, .srt"},
+			{Name: "text", In: "body", Type: "string", Descr: "text instead of file"},
+			{Name: "format", In: "body", Type: "string", Enum: []string{"plain", "lrc", "vtt", "srt"}, Descr: "detected from content if omitted"},
+			{Name: "language", In: "body", Type: "string", Descr: "ISO 639 code"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/lyrics", Tag: "tracks", Summary: "Delete lyrics or transcript",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/duplicates", Tag: "tracks",
+		Summary: "Accessible tracks with matching acoustic fingerprint (same recording in another format or bitrate)",
+		Params:  []tAPIParam{apiTrackParam}, Responses: map[int]string{200: "DuplicateList"}},
+	{Method: http.MethodPut, Path: "/tracks/{track}/shares/{user}", Tag: "shares", Summary: "Share track with user",
+		Params: []tAPIParam{apiTrackParam, apiUserParam,
+			{Name: "expires_at", In: "body", Type: "string", Descr: "RFC 3339 time, share is permanent if omitted"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/shares/{user}", Tag: "shares", Summary: "Revoke user's access",
+		Params: []tAPIParam{apiTrackParam, apiUserParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodPut, Path: "/tracks/{track}/favorite", Tag: "tracks", Summary: "Add accessible track to favorites",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/favorite", Tag: "tracks", Summary: "Remove track from favorites",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodPut, Path: "/tracks/{track}/rating", Tag: "tracks", Summary: "Rate accessible track",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "rating", In: "body", Type: "integer", Required: true, Descr: "stars, 1..5"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/rating", Tag: "tracks", Summary: "Remove own rating",
+		Params: []tAPIParam{apiTrackParam}, Responses: map[int]string{200: ""}},
+
+	{Method: http.MethodGet, Path: "/playlists", Tag: "playlists", Summary: "List own and shared playlists",
+		Params: apiParams(apiCursorParams, []tAPIParam{
+			{Name: "order_by", In: "query", Type: "string", Enum: []string{"name", "created", "created_desc"}},
+			{Name: "scope", In: "query", Type: "string", Enum: []string{"all", "own", "shared_with_me"}},
+		}),
+		Responses: map[int]string{200: "PlaylistList"}},
+	{Method: http.MethodPost, Path: "/playlists", Tag: "playlists", Summary: "Create playlist",
+		Params:    []tAPIParam{{Name: "name", In: "body", Type: "string", Required: true}},
+		Responses: map[int]string{201: "Created"}},
+	{Method: http.MethodPost, Path: "/playlists/import", Tag: "playlists",
+		Summary: "Create playlist of uploaded tracks from M3U/M3U8, PLS or XSPF file", Multipart: true,
+		Params: []tAPIParam{
+			{Name: "file", In: "body", Type: "binary", Required: true},
+			{Name: "name", In: "body", Type: "string", Descr: "default — title from file or file name"},
+		},
+		Responses: map[int]string{201: "PlaylistImport"}},
+	{Method: http.MethodGet, Path: "/playlists/{playlist}", Tag: "playlists", Summary: "Playlist with its tracks in order",
+		Params: []tAPIParam{apiPlaylistParam}, Responses: map[int]string{200: "Playlist"}},
+	{Method: http.MethodPatch, Path: "/playlists/{playlist}", Tag: "playlists", Summary: "Rename playlist",
+		Params:    []tAPIParam{apiPlaylistParam, {Name: "name", In: "body", Type: "string", Required: true}},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/playlists/{playlist}", Tag: "playlists", Summary: "Delete playlist",
+		Params: []tAPIParam{apiPlaylistParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodGet, Path: "/playlists/{playlist}/export", Tag: "playlists",
+		Summary: "Export playlist as M3U8, PLS or XSPF",
+		Params:  apiParams([]tAPIParam{apiPlaylistParam}, apiExportParams), Responses: map[int]string{200: "playlist"}},
+	{Method: http.MethodPut, Path: "/playlists/{playlist}/tracks/{track}", Tag: "playlists",
+		Summary: "Add track to playlist or move it to another position",
+		Params: []tAPIParam{apiPlaylistParam, apiTrackParam,
+			{Name: "position", In: "body", Type: "integer", Descr: "starting from 1, the end of playlist if omitted"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/playlists/{playlist}/tracks/{track}", Tag: "playlists",
+		Summary: "Remove track from playlist",
+		Params:  []tAPIParam{apiPlaylistParam, apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodPut, Path: "/playlists/{playlist}/shares/{user}", Tag: "playlists",
+		Summary: "Share playlist and owner's tracks in it with user",
+		Params:  []tAPIParam{apiPlaylistParam, apiUserParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/playlists/{playlist}/shares/{user}", Tag: "playlists",
+		Summary: "Revoke user's access to playlist",
+		Params:  []tAPIParam{apiPlaylistParam, apiUserParam}, Responses: map[int]string{200: ""}},
+
+	{Method: http.MethodGet, Path: "/tags", Tag: "tags", Summary: "Own tags and tags of accessible tracks",
+		Params:    []tAPIParam{{Name: "owner", In: "query", Type: "integer", Descr: "owner id"}},
+		Responses: map[int]string{200: "TagList"}},
+	{Method: http.MethodPost, Path: "/tags", Tag: "tags", Summary: "Create tag",
+		Params:    []tAPIParam{{Name: "name", In: "body", Type: "string", Required: true}},
+		Responses: map[int]string{201: "Created"}},
+	{Method: http.MethodPatch, Path: "/tags/{tag}", Tag: "tags", Summary: "Rename tag",
+		Params:    []tAPIParam{apiTagParam, {Name: "name", In: "body", Type: "string", Required: true}},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tags/{tag}", Tag: "tags", Summary: "Delete tag and remove it from tracks",
+		Params: []tAPIParam{apiTagParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodPut, Path: "/tracks/{track}/tags/{tag}", Tag: "tags", Summary: "Mark own track with own tag",
+		Params: []tAPIParam{apiTrackParam, apiTagParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/tags/{tag}", Tag: "tags", Summary: "Remove tag from own track",
+		Params: []tAPIParam{apiTrackParam, apiTagParam}, Responses: map[int]string{200: ""}},
+
+	{Method: http.MethodGet, Path: "/folders", Tag: "folders", Summary: "Own folder tree, parents first",
+		Responses: map[int]string{200: "FolderList"}},
+	{Method: http.MethodPost, Path: "/folders", Tag: "folders", Summary: "Create folder",
+		Params: []tAPIParam{
+			{Name: "name", In: "body", Type: "string", Required: true},
+			{Name: "parent", In: "body", Type: "integer", Descr: "parent folder id, root if omitted"},
+		},
+		Responses: map[int]string{201: "Created"}},
+	{Method: http.MethodPatch, Path: "/folders/{folder}", Tag: "folders", Summary: "Rename or move folder",
+		Params: []tAPIParam{apiFolderParam,
+			{Name: "name", In: "body", Type: "string"},
+			{Name: "parent", In: "body", Type: "integer", Descr: "new parent folder id, 0 — root"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/folders/{folder}", Tag: "folders",
+		Summary: "Delete folder with subfolders, tracks are kept out of folders",
+		Params:  []tAPIParam{apiFolderParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodPut, Path: "/folders/{folder}/tracks/{track}", Tag: "folders", Summary: "Move own track to folder",
+		Params: []tAPIParam{apiFolderParam, apiTrackParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/folders/{folder}/tracks/{track}", Tag: "folders", Summary: "Take track out of folder",
+		Params: []tAPIParam{apiFolderParam, apiTrackParam}, Responses: map[int]string{200: ""}},
+
+	{Method: http.MethodGet, Path: "/tracks/{track}/annotations", Tag: "annotations",
+		Summary: "Comments, markers and chapters of accessible track in time order",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "kind", In: "query", Type: "string", Enum: []string{"comment", "marker", "chapter"}},
+		},
+		Responses: map[int]string{200: "AnnotationList"}},
+	{Method: http.MethodPost, Path: "/tracks/{track}/annotations", Tag: "annotations",
+		Summary: "Add timestamped comment, marker or chapter to accessible track",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "kind", In: "body", Type: "string", Required: true, Enum: []string{"comment", "marker", "chapter"}},
+			{Name: "start", In: "body", Type: "string", Required: true, Descr: "seconds or [hh:]mm:ss[.fff]"},
+			{Name: "end", In: "body", Type: "string", Descr: "seconds or [hh:]mm:ss[.fff], after start"},
+			{Name: "title", In: "body", Type: "string", Descr: "required for marker and chapter"},
+			{Name: "text", In: "body", Type: "string", Descr: "required for comment"},
+		},
+		Responses: map[int]string{201: "Created"}},
+	{Method: http.MethodPatch, Path: "/tracks/{track}/annotations/{annotation}", Tag: "annotations",
+		Summary: "Edit own annotation",
+		Params: []tAPIParam{apiTrackParam, apiAnnotationParam,
+			{Name: "start", In: "body", Type: "string", Descr: "seconds or [hh:]mm:ss[.fff]"},
+			{Name: "end", In: "body", Type: "string", Descr: "seconds or [hh:]mm:ss[.fff], empty — no end"},
+			{Name: "title", In: "body", Type: "string"},
+			{Name: "text", In: "body", Type: "string"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/tracks/{track}/annotations/{annotation}", Tag: "annotations",
+		Summary: "Delete own annotation",
+		Params:  []tAPIParam{apiTrackParam, apiAnnotationParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodGet, Path: "/tracks/{track}/chapters", Tag: "annotations",
+		Summary: "Export chapters as Podcasting 2.0 JSON, WebVTT or ID3v2.4 tag with CTOC/CHAP frames",
+		Params: []tAPIParam{apiTrackParam,
+			{Name: "type", In: "query", Type: "string", Enum: []string{"json", "vtt", "id3"}, Descr: "default json"},
+		},
+		Responses: map[int]string{200: "chapters"}},
+
+	{Method: http.MethodGet, Path: "/users", Tag: "users", Summary: "List or search users",
+		Params: apiParams([]tAPIParam{
+			{Name: "q", In: "query", Type: "string", Descr: "login or name word prefix, case insensitive"},
+		}, apiCursorParams),
+		Responses: map[int]string{200: "UserList"}},
+	{Method: http.MethodPost, Path: "/users", Tag: "users", Summary: "Register user", Public: true,
+		Params: []tAPIParam{
+			{Name: "login", In: "body", Type: "string", Required: true},
+			{Name: "passwd", In: "body", Type: "string", Required: true},
+			{Name: "name", In: "body", Type: "string"},
+			{Name: "email", In: "body", Type: "string", Descr: "address for e-mail notifications"},
+		},
+		Responses: map[int]string{201: ""}},
+	{Method: http.MethodGet, Path: "/users/sharing", Tag: "users", Summary: "Users who share tracks",
+		Params: apiCursorParams, Responses: map[int]string{200: "UserList"}},
+	{Method: http.MethodGet, Path: "/users/{user}", Tag: "users", Summary: "User's profile",
+		Params: []tAPIParam{apiUserParam}, Responses: map[int]string{200: "Profile"}},
+	{Method: http.MethodGet, Path: "/me", Tag: "users", Summary: "Own profile and privacy settings",
+		Responses: map[int]string{200: "Profile"}},
+	{Method: http.MethodPatch, Path: "/me", Tag: "users", Summary: "Edit own profile and privacy settings",
+		Params: []tAPIParam{
+			{Name: "name", In: "body", Type: "string"},
+			{Name: "email", In: "body", Type: "string"},
+			{Name: "searchable", In: "body", Type: "boolean", Descr: "listed in user list and search"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodPost, Path: "/sessions", Tag: "users", Summary: "Log in, sets session_id cookie", Public: true,
+		Params: []tAPIParam{
+			{Name: "login", In: "body", Type: "string", Required: true},
+			{Name: "passwd", In: "body", Type: "string", Required: true},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodDelete, Path: "/sessions", Tag: "users", Summary: "Log out", Public: true,
+		Responses: map[int]string{200: ""}},
+
+	{Method: http.MethodGet, Path: "/notifications", Tag: "notifications", Summary: "User's notifications, newest first",
+		Params: apiParams(apiPageParams, []tAPIParam{
+			{Name: "unread", In: "query", Type: "boolean", Descr: "only unread notifications"},
+		}),
+		Responses: map[int]string{200: "NotifyList"}},
+	{Method: http.MethodPost, Path: "/notifications/read", Tag: "notifications", Summary: "Mark notifications read",
+		Params: []tAPIParam{
+			{Name: "id", In: "body", Type: "integer"},
+			{Name: "all", In: "body", Type: "boolean", Descr: "mark all notifications read"},
+		},
+		Responses: map[int]string{200: ""}},
+	{Method: http.MethodGet, Path: "/events", Tag: "notifications", Summary: "Server-sent events stream",
+		Responses: map[int]string{200: "stream"}},
+
+	{Method: http.MethodGet, Path: "/webhooks", Tag: "webhooks", Summary: "User's webhooks",
+		Responses: map[int]string{200: "WebhookList"}},
+	{Method: http.MethodPost, Path: "/webhooks", Tag: "webhooks", Summary: "Add webhook",
+		Params: []tAPIParam{
+			{Name: "url", In: "body", Type: "string", Required: true},
+			{Name: "events", In: "body", Type: "string", Descr: "comma separated event types, all if omitted"},
+			{Name: "secret", In: "body", Type: "string", Descr: "signing secret, generated if omitted"},
+			{Name: "global", In: "body", Type: "boolean", Descr: "events of all users, admin only"},
+		},
+		Responses: map[int]string{201: "Webhook"}},
+	{Method: http.MethodDelete, Path: "/webhooks/{id}", Tag: "webhooks", Summary: "Delete webhook",
+		Params: []tAPIParam{apiHookParam}, Responses: map[int]string{200: ""}},
+	{Method: http.MethodGet, Path: "/webhooks/{id}/deliveries", Tag: "webhooks", Summary: "Webhook delivery log",
+		Params: apiParams([]tAPIParam{apiHookParam}, apiPageParams), Responses: map[int]string{200: "DeliveryList"}},
+
+	{Method: http.MethodGet, Path: "/openapi.json", Tag: "docs", Summary: "This specification", Public: true,
+		Responses: map[int]string{200: "json"}},
+	{Method: http.MethodGet, Path: "/docs", Tag: "docs", Summary: "API documentation page", Public: true,
+		Responses: map[int]string{200: "html"}},
+}
+
+//apiLegacy прежние маршруты: метод, путь и операция, которую они повторяют.
+//	Параметры пути операции передаются параметрами запроса или формы
+var apiLegacy = []struct {
+	Method, Path string
+	Target       string //	"METHOD /path" операции
+	Status       int    //	статус успешного ответа, если отличается
+}{
+	{http.MethodPut, "/registration", "POST /users", 0},
+	{http.MethodPost, "/login", "POST /sessions", 0},
+	{http.MethodGet, "/logout", "DELETE /sessions", 0},
+	{http.MethodPost, "/logout", "DELETE /sessions", 0},
+	{http.MethodGet, "/user/list", "GET /users", 0},
+	{http.MethodGet, "/user/share", "GET /users/sharing", 0},
+	{http.MethodGet, "/audio/list", "GET /tracks", 0},
+	{http.MethodPost, "/audio/share", "PUT /tracks/{track}/shares/{user}", 0},
+	{http.MethodPost, "/audio/lock", "DELETE /tracks/{track}/shares/{user}", 0},
+	{http.MethodGet, "/audio/get", "GET /tracks/{track}/file", 0},
+	{http.MethodPut, "/audio/add", "POST /tracks", http.StatusOK},
+	{http.MethodPut, "/webhook/add", "POST /webhooks", 0},
+	{http.MethodGet, "/webhook/list", "GET /webhooks", 0},
+	{http.MethodPost, "/webhook/delete", "DELETE /webhooks/{id}", 0},
+	{http.MethodGet, "/webhook/log", "GET /webhooks/{id}/deliveries", 0},
+}
+
+//apiSchemas схемы ответов (components/schemas)
+const apiSchemas = `{
+	"Error": {
+		"type": "object",
+		"required": ["error"],
+		"properties": {
+			"error": {
+				"type": "object",
+				"required": ["code", "message"],
+				"properties": {
+					"code": {"type": "string", "enum": ["bad_request", "validation_failed", "unauthorized",
+						"forbidden", "not_found", "method_not_allowed", "conflict", "internal_error"]},
+					"message": {"type": "string"},
+					"fields": {"type": "object", "additionalProperties": {"type": "string"}},
+					"request_id": {"type": "string"}
+				}
+			}
+		}
+	},
+	"Created": {
+		"type": "object",
+		"required": ["id"],
+		"properties": {"id": {"type": "integer"}}
+	},
+	"TrackCreated": {
+		"type": "object",
+		"required": ["id"],
+		"properties": {
+			"id": {"type": "integer"},
+			"duplicates": {"type": "array", "items": {"$ref": "#/components/schemas/Duplicate"},
+				"description": "warning: accessible tracks acoustically matching the upload, absent if the fingerprint is not ready in time"}
+		}
+	},
+	"Share": {
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {
+			"audio": {"type": "integer"},
+			"id": {"type": "integer", "description": "user id"},
+			"name": {"type": "string"},
+			"expires_at": {"type": "string", "format": "date-time"}
+		}
+	},
+	"Audio": {
+		"type": "object",
+		"required": ["id", "name", "is_owner", "owner_id", "owner_name", "shared_to"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string", "description": "name and duration"},
+			"is_owner": {"type": "boolean"},
+			"owner_id": {"type": "integer"},
+			"owner_name": {"type": "string"},
+			"shared_to": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/Share"}},
+			"tags": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}, "description": "owner's tags"},
+			"folder": {"type": "integer", "description": "folder id, owner only"},
+			"favorite": {"type": "boolean", "description": "in current user's favorites"},
+			"rating": {"type": "integer", "description": "current user's rating, 1..5"},
+			"plays": {"type": "integer", "description": "times current user played the track"},
+			"played_at": {"type": "string", "format": "date-time"},
+			"loudness": {"$ref": "#/components/schemas/Loudness"},
+			"lyrics": {"$ref": "#/components/schemas/Lyrics"}
+		}
+	},
+	"Loudness": {
+		"type": "object",
+		"description": "ITU-R BS.1770 / EBU R128 analysis of uploaded file, absent until analysed",
+		"required": ["integrated", "true_peak", "range", "replaygain_gain", "replaygain_peak"],
+		"properties": {
+			"integrated": {"type": "number", "description": "gated integrated loudness, LUFS, -70 for silence"},
+			"true_peak": {"type": "number", "description": "dBTP"},
+			"range": {"type": "number", "description": "loudness range (LRA), LU"},
+			"replaygain_gain": {"type": "number", "nullable": true, "description": "ReplayGain 2.0 track gain to -18 LUFS, dB, null for silence"},
+			"replaygain_peak": {"type": "number", "description": "ReplayGain track peak, linear, 1 is full scale"}
+		}
+	},
+	"Lyrics": {
+		"type": "object",
+		"description": "lyrics or transcript, only in track details",
+		"required": ["format", "synced", "source", "lines"],
+		"properties": {
+			"format": {"type": "string", "enum": ["plain", "lrc", "vtt", "srt"],
+				"description": "lrc lines have start only, vtt and srt cues have start and end"},
+			"synced": {"type": "boolean"},
+			"language": {"type": "string", "description": "ISO 639 code"},
+			"source": {"type": "string", "enum": ["file", "upload"], "description": "file tags (ID3 USLT/SYLT, LYRICS) or uploaded by owner"},
+			"lines": {"type": "array", "items": {
+				"type": "object",
+				"required": ["text"],
+				"properties": {
+					"start": {"type": "number", "description": "seconds"},
+					"end": {"type": "number", "description": "seconds"},
+					"text": {"type": "string", "description": "empty line separates verses in plain lyrics"}
+				}
+			}}
+		}
+	},
+	"Peaks": {
+		"type": "object",
+		"description": "audiowaveform JSON, channels mixed to one",
+		"required": ["version", "channels", "sample_rate", "samples_per_pixel", "bits", "length", "data"],
+		"properties": {
+			"version": {"type": "integer"},
+			"channels": {"type": "integer"},
+			"sample_rate": {"type": "integer"},
+			"samples_per_pixel": {"type": "integer"},
+			"bits": {"type": "integer"},
+			"length": {"type": "integer", "description": "points, each is a min, max pair in data"},
+			"data": {"type": "array", "items": {"type": "integer"}}
+		}
+	},
+	"Tag": {
+		"type": "object",
+		"required": ["id", "name", "is_owner", "owner_id"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"},
+			"is_owner": {"type": "boolean"},
+			"owner_id": {"type": "integer"},
+			"track_count": {"type": "integer", "description": "accessible tracks, tag list only"}
+		}
+	},
+	"TagList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}}
+		}
+	},
+	"Folder": {
+		"type": "object",
+		"required": ["id", "name", "path", "track_count"],
+		"properties": {
+			"id": {"type": "integer"},
+			"parent": {"type": "integer", "description": "parent folder id, absent for root folders"},
+			"name": {"type": "string"},
+			"path": {"type": "string", "description": "names from root, separated by /"},
+			"track_count": {"type": "integer", "description": "tracks directly in folder"}
+		}
+	},
+	"FolderList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Folder"}}
+		}
+	},
+	"Annotation": {
+		"type": "object",
+		"required": ["id", "kind", "start", "author_id", "author_name", "is_author", "created"],
+		"properties": {
+			"id": {"type": "integer"},
+			"kind": {"type": "string", "enum": ["comment", "marker", "chapter"]},
+			"start": {"type": "number", "description": "seconds"},
+			"end": {"type": "number", "description": "seconds, absent for points in time"},
+			"title": {"type": "string", "description": "marker or chapter name"},
+			"text": {"type": "string", "description": "comment text"},
+			"author_id": {"type": "integer"},
+			"author_name": {"type": "string"},
+			"is_author": {"type": "boolean", "description": "current user can edit and delete it"},
+			"created": {"type": "string", "format": "date-time"},
+			"updated": {"type": "string", "format": "date-time"}
+		}
+	},
+	"AnnotationList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Annotation"}}
+		}
+	},
+	"Duplicate": {
+		"type": "object",
+		"required": ["id", "name", "is_owner", "owner_id", "owner_name", "similarity"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"},
+			"is_owner": {"type": "boolean"},
+			"owner_id": {"type": "integer"},
+			"owner_name": {"type": "string"},
+			"similarity": {"type": "number", "description": "share of matching fingerprint bits, 0.8..1"}
+		}
+	},
+	"DuplicateList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Duplicate"}}
+		}
+	},
+	"SearchHit": {
+		"type": "object",
+		"required": ["id", "name", "is_owner", "owner_id", "owner_name", "rank", "snippet"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"},
+			"is_owner": {"type": "boolean"},
+			"owner_id": {"type": "integer"},
+			"owner_name": {"type": "string"},
+			"rank": {"type": "number"},
+			"snippet": {"type": "string", "description": "HTML-escaped text, matched words wrapped in <mark></mark>"}
+		}
+	},
+	"SearchList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/SearchHit"}}
+		}
+	},
+	"AudioList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Audio"}},
+			"next": {"type": "string", "description": "link to the next page"},
+			"prev": {"type": "string", "description": "link to the previous page"}
+		}
+	},
+	"User": {
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"},
+			"shared_records": {"type": "integer"}
+		}
+	},
+	"PlaylistEntry": {
+		"type": "object",
+		"required": ["position", "id", "name", "owner_id", "owner_name"],
+		"properties": {
+			"position": {"type": "integer"},
+			"id": {"type": "integer", "description": "track id"},
+			"name": {"type": "string", "description": "name and duration"},
+			"owner_id": {"type": "integer"},
+			"owner_name": {"type": "string"}
+		}
+	},
+	"Playlist": {
+		"type": "object",
+		"required": ["id", "name", "is_owner", "owner_id", "owner_name", "track_count", "created"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"},
+			"is_owner": {"type": "boolean"},
+			"owner_id": {"type": "integer"},
+			"owner_name": {"type": "string"},
+			"track_count": {"type": "integer", "description": "tracks available to the caller"},
+			"created": {"type": "string", "format": "date-time"},
+			"shared_to": {"type": "array", "items": {"$ref": "#/components/schemas/Share"}},
+			"tracks": {"type": "array", "items": {"$ref": "#/components/schemas/PlaylistEntry"}}
+		}
+	},
+	"PlaylistList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Playlist"}},
+			"next": {"type": "string", "description": "link to the next page"},
+			"prev": {"type": "string", "description": "link to the previous page"}
+		}
+	},
+	"PlaylistImport": {
+		"type": "object",
+		"required": ["id", "imported"],
+		"properties": {
+			"id": {"type": "integer"},
+			"imported": {"type": "integer", "description": "tracks added to playlist"},
+			"skipped": {"type": "array", "items": {"type": "string"}, "description": "entries without matching track"}
+		}
+	},
+	"Profile": {
+		"type": "object",
+		"required": ["id", "name", "tracks"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string", "description": "display name, \"user {id}\" when not set"},
+			"tracks": {"type": "integer", "description": "user's tracks available to the caller"},
+			"login": {"type": "string", "description": "own profile only"},
+			"email": {"type": "string", "description": "own profile only"},
+			"searchable": {"type": "boolean", "description": "own profile only"}
+		}
+	},
+	"UserList": {
+		"type": "object",
+		"required": ["users"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"users": {"type": "array", "items": {"$ref": "#/components/schemas/User"}},
+			"next": {"type": "string", "description": "link to the next page"},
+			"prev": {"type": "string", "description": "link to the previous page"}
+		}
+	},
+	"Notification": {
+		"type": "object",
+		"required": ["id", "kind", "message", "created"],
+		"properties": {
+			"id": {"type": "integer"},
+			"kind": {"type": "string", "enum": ["share", "lock", "version"]},
+			"audio": {"type": "integer"},
+			"audio_name": {"type": "string"},
+			"from_id": {"type": "integer"},
+			"from_name": {"type": "string"},
+			"message": {"type": "string"},
+			"created": {"type": "string", "format": "date-time"},
+			"read_at": {"type": "string", "format": "date-time"}
+		}
+	},
+	"NotifyList": {
+		"type": "object",
+		"required": ["total_count", "unread_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"unread_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Notification"}}
+		}
+	},
+	"Webhook": {
+		"type": "object",
+		"required": ["id", "url", "events", "global"],
+		"properties": {
+			"id": {"type": "integer"},
+			"url": {"type": "string"},
+			"events": {"type": "array", "nullable": true, "items": {"type": "string"}},
+			"secret": {"type": "string"},
+			"global": {"type": "boolean"},
+			"created": {"type": "string", "format": "date-time"}
+		}
+	},
+	"WebhookList": {
+		"type": "object",
+		"required": ["records"],
+		"properties": {
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}
+		}
+	},
+	"Delivery": {
+		"type": "object",
+		"required": ["id", "event", "status", "attempts", "created"],
+		"properties": {
+			"id": {"type": "integer"},
+			"event": {"type": "string"},
+			"status": {"type": "string", "enum": ["pending", "delivered", "failed"]},
+			"attempts": {"type": "integer"},
+			"response_code": {"type": "integer"},
+			"last_error": {"type": "string"},
+			"created": {"type": "string", "format": "date-time"},
+			"next_try": {"type": "string", "format": "date-time"},
+			"delivered": {"type": "string", "format": "date-time"}
+		}
+	},
+	"DeliveryList": {
+		"type": "object",
+		"required": ["total_count", "records"],
+		"properties": {
+			"total_count": {"type": "integer"},
+			"records": {"type": "array", "items": {"$ref": "#/components/schemas/Delivery"}}
+		}
+	}
+}`
+
+//apiSchemaRef ссылка на схему из components
+func apiSchemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+//apiParamSchema схема значения параметра
+func apiParamSchema(p tAPIParam) map[string]interface{} {
+	sch := map[string]interface{}{"type": p.Type}
+	if p.Type == "binary" {
+		sch = map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	if len(p.Enum) > 0 {
+		sch["enum"] = p.Enum
+	}
+	if p.Descr != "" {
+		sch["description"] = p.Descr
+	}
+	return sch
+}
+
+//apiOperationSpec объект Operation спецификации
+func apiOperationSpec(op *tAPIOperation) map[string]interface{} {
+	var (
+		params   []interface{}
+		required []string
+	)
+
+	props := map[string]interface{}{}
+	for _, p := range op.Params {
+		if p.In == "body" {
+			props[p.Name] = apiParamSchema(p)
+			if p.Required {
+				required = append(required, p.Name)
+			}
+			continue
+		}
+		params = append(params, map[string]interface{}{
+			"name":     p.Name,
+			"in":       p.In,
+			"required": p.Required,
+			"schema":   apiParamSchema(p),
+		})
+	}
+
+	spec := map[string]interface{}{
+		"tags":        []string{op.Tag},
+		"summary":     op.Summary,
+		"operationId": strings.ToLower(op.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_").Replace(op.Path),
+	}
+	if params != nil {
+		spec["parameters"] = params
+	}
+	if len(props) > 0 {
+		body := map[string]interface{}{"type": "object", "properties": props}
+		if required != nil {
+			body["required"] = required
+		}
+		content := map[string]interface{}{"multipart/form-data": map[string]interface{}{"schema": body}}
+		if !op.Multipart {
+			content = map[string]interface{}{
+				"application/x-www-form-urlencoded": map[string]interface{}{"schema": body},
+				"application/json":                  map[string]interface{}{"schema": body},
+			}
+			if _, ok := props["file"]; ok {
+				content["multipart/form-data"] = map[string]interface{}{"schema": body}
+			}
+		}
+		spec["requestBody"] = map[string]interface{}{"required": required != nil, "content": content}
+	}
+
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": apiSchemaRef("Error")}},
+		},
+	}
+	for status, schema := range op.Responses {
+		r := map[string]interface{}{"description": http.StatusText(status)}
+		switch schema {
+		case "":
+		case "binary":
+			r["content"] = map[string]interface{}{"audio/*": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string", "format": "binary"}}}
+		case "playlist":
+			content := map[string]interface{}{}
+			for _, ct := range playlistTypes {
+				content[strings.Split(ct, ";")[0]] = map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"}}
+			}
+			r["content"] = content
+		case "chapters":
+			content := map[string]interface{}{}
+			for _, ct := range chapterTypes {
+				content[strings.Split(ct, ";")[0]] = map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"}}
+			}
+			r["content"] = content
+		case "hls":
+			r["content"] = map[string]interface{}{"application/vnd.apple.mpegurl": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"}}}
+		case "stream":
+			r["content"] = map[string]interface{}{"text/event-stream": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"}}}
+		case "json":
+			r["content"] = map[string]interface{}{"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "object"}}}
+		case "html":
+			r["content"] = map[string]interface{}{"text/html": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"}}}
+		default:
+			r["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": apiSchemaRef(schema)}}
+		}
+		responses[strconv.Itoa(status)] = r
+	}
+	spec["responses"] = responses
+
+	if op.Public {
+		spec["security"] = []interface{}{}
+	}
+	if op.Deprecated {
+		spec["deprecated"] = true
+	}
+	return spec
+}
+
+//apiLegacyOperation операция прежнего маршрута: копия target, параметры пути
+//	переходят в строку запроса (GET) или в тело
+func apiLegacyOperation(method, path string, target *tAPIOperation, status int) *tAPIOperation {
+	op := *target
+	op.Method, op.Path, op.Deprecated = method, path, true
+	op.Summary = target.Summary + " (deprecated alias of " + target.Method + " " + target.Path + ")"
+	op.Params = nil
+	for _, p := range target.Params {
+		if p.In == "path" {
+			if method == http.MethodGet {
+				p.In = "query"
+			} else {
+				p.In = "body"
+			}
+		}
+		op.Params = append(op.Params, p)
+	}
+	if status != 0 {
+		op.Responses = map[int]string{}
+		for _, schema := range target.Responses {
+			op.Responses[status] = schema
+		}
+	}
+	return &op
+}
+
+//openAPIDoc спецификация OpenAPI 3 по apiOperations, apiLegacy и apiSchemas
+func openAPIDoc() map[string]interface{} {
+	var schemas map[string]interface{}
+
+	if err := json.Unmarshal([]byte(apiSchemas), &schemas); err != nil {
+		log.Panicln("OpenAPI schemas are broken:", err.Error())
+	}
+
+	ops := append([]*tAPIOperation{}, apiOperations...)
+	for _, l := range apiLegacy {
+		for _, op := range apiOperations {
+			if op.Method+" "+op.Path == l.Target {
+				ops = append(ops, apiLegacyOperation(l.Method, l.Path, op, l.Status))
+			}
+		}
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range ops {
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = apiOperationSpec(op)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "audiofill",
+			"version": "1.0",
+			"description": "Audio library with sharing. Request bodies are accepted as form data or JSON, " +
+				"errors are returned as {\"error\": {...}} with a stable code.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session_id"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"session": []string{}}},
+	}
+}
+
+//OpenAPI спецификация API в json. Метод GET, доступен без авторизации
+func OpenAPI(resp http.ResponseWriter, req *http.Request) {
+	jsRes, err := json.Marshal(openAPIDoc())
+	if err != nil {
+		internalError(resp, err, "OpenAPI marshaling error:")
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//APIDocs страница документации: строится в браузере по /openapi.json,
+//	без внешних скриптов и стилей
+func APIDocs(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(apiDocsPage))
+}
+
+const apiDocsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>audiofill API</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+h2 { border-bottom: 1px solid #ccc; margin-top: 2em; }
+.op { margin: 1em 0; padding: .5em 1em; border-left: 4px solid #4a8; background: #f6f8f7; }
+.op.deprecated { border-color: #aaa; opacity: .7; }
+.method { font-weight: bold; text-transform: uppercase; display: inline-block; width: 5em; }
+table { border-collapse: collapse; margin: .5em 0; }
+td, th { border: 1px solid #ddd; padding: 2px 8px; text-align: left; font-size: 90%; }
+pre { background: #fff; border: 1px solid #ddd; padding: .5em; overflow: auto; font-size: 85%; }
+</style>
+</head>
+<body>
+<h1>audiofill API</h1>
+<p id="descr"></p>
+<div id="ops"></div>
+<h2>Schemas</h2>
+<div id="schemas"></div>
+<script>
+function el(tag, text, cls) {
+	var e = document.createElement(tag);
+	if (text) e.textContent = text;
+	if (cls) e.className = cls;
+	return e;
+}
+function table(rows, head) {
+	var t = el("table"), tr = el("tr");
+	head.forEach(function(h) { tr.appendChild(el("th", h)); });
+	t.appendChild(tr);
+	rows.forEach(function(r) {
+		tr = el("tr");
+		r.forEach(function(c) { tr.appendChild(el("td", String(c))); });
+		t.appendChild(tr);
+	});
+	return t;
+}
+function typeOf(s) {
+	if (!s) return "";
+	if (s.$ref) return s.$ref.split("/").pop();
+	return (s.format || s.type || "") + (s.enum ? " (" + s.enum.join(", ") + ")" : "");
+}
+fetch("/openapi.json").then(function(r) { return r.json(); }).then(function(spec) {
+	document.getElementById("descr").textContent = spec.info.description;
+	var ops = document.getElementById("ops"), byTag = {};
+	Object.keys(spec.paths).forEach(function(path) {
+		Object.keys(spec.paths[path]).forEach(function(m) {
+			var op = spec.paths[path][m], tag = op.tags[0];
+			(byTag[tag] = byTag[tag] || []).push([m, path, op]);
+		});
+	});
+	Object.keys(byTag).forEach(function(tag) {
+		ops.appendChild(el("h2", tag));
+		byTag[tag].forEach(function(x) {
+			var op = x[2], div = el("div", "", "op" + (op.deprecated ? " deprecated" : ""));
+			div.appendChild(el("span", x[0], "method"));
+			div.appendChild(el("code", x[1]));
+			div.appendChild(el("p", op.summary + (op.security && !op.security.length ? " — no session required" : "")));
+			var rows = (op.parameters || []).map(function(p) {
+				return [p.name, p.in, typeOf(p.schema), p.required ? "yes" : "", p.schema.description || ""];
+			});
+			if (op.requestBody) {
+				var ct = Object.keys(op.requestBody.content), body = op.requestBody.content[ct[0]].schema;
+				Object.keys(body.properties).forEach(function(name) {
+					var s = body.properties[name];
+					rows.push([name, "body", typeOf(s), (body.required || []).indexOf(name) >= 0 ? "yes" : "", s.description || ""]);
+				});
+			}
+			if (rows.length) div.appendChild(table(rows, ["parameter", "in", "type", "required", "description"]));
+			div.appendChild(table(Object.keys(op.responses).map(function(code) {
+				var r = op.responses[code], ct = r.content ? Object.keys(r.content)[0] : "";
+				return [code, ct, ct ? typeOf(r.content[ct].schema) : ""];
+			}), ["status", "content", "schema"]));
+			ops.appendChild(div);
+		});
+	});
+	var schemas = document.getElementById("schemas");
+	Object.keys(spec.components.schemas).forEach(function(name) {
+		schemas.appendChild(el("h3", name));
+		schemas.appendChild(el("pre", JSON.stringify(spec.components.schemas[name], null, 2)));
+	});
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testSpec спецификация, как ее получает клиент
+func testSpec(t *testing.T) map[string]interface{} {
+	var spec map[string]interface{}
+
+	resp, err := testSrv.Client().Get(testSrv.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("OpenAPI: query failed %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(&spec); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("OpenAPI: wrong result %d %v", resp.StatusCode, err)
+	}
+	return spec
+}
+
+//validateSchema проверка значения v по схеме sch (подмножество OpenAPI 3.0:
+//	$ref, type, nullable, required, properties, additionalProperties, items, enum,
+//	format date-time). Свойства, не описанные в схеме, считаются ошибкой —
+//	так новые поля ответов не проходят мимо спецификации
+func validateSchema(spec map[string]interface{}, sch map[string]interface{}, v interface{}, at string) (errs []string) {
+	if ref, ok := sch["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		target, ok := schemas[name].(map[string]interface{})
+		if !ok {
+			return []string{at + ": unknown schema " + ref}
+		}
+		return validateSchema(spec, target, v, at)
+	}
+	if v == nil {
+		if nullable, _ := sch["nullable"].(bool); !nullable {
+			errs = append(errs, at+": null is not allowed")
+		}
+		return errs
+	}
+	if enum, ok := sch["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not in enum", at, v))
+		}
+	}
+
+	switch sch["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return append(errs, at+": object expected")
+		}
+		props, _ := sch["properties"].(map[string]interface{})
+		if req, ok := sch["required"].([]interface{}); ok {
+			for _, name := range req {
+				if _, ok = obj[name.(string)]; !ok {
+					errs = append(errs, fmt.Sprintf("%s: required property %s missing", at, name))
+				}
+			}
+		}
+		for name, val := range obj {
+			if p, ok := props[name].(map[string]interface{}); ok {
+				errs = append(errs, validateSchema(spec, p, val, at+"."+name)...)
+			} else if p, ok := sch["additionalProperties"].(map[string]interface{}); ok {
+				errs = append(errs, validateSchema(spec, p, val, at+"."+name)...)
+			} else if props != nil {
+				errs = append(errs, fmt.Sprintf("%s: property %s not described", at, name))
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return append(errs, at+": array expected")
+		}
+		items, _ := sch["items"].(map[string]interface{})
+		for i, item := range arr {
+			errs = append(errs, validateSchema(spec, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			errs = append(errs, at+": integer expected")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			errs = append(errs, at+": number expected")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs = append(errs, at+": boolean expected")
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			errs = append(errs, at+": string expected")
+		} else if sch["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				errs = append(errs, at+": date-time expected")
+			}
+		}
+	}
+	return errs
+}
+
+//specOperation операция спецификации для метода и пути запроса
+func specOperation(spec map[string]interface{}, method, path string) (map[string]interface{}, string) {
+	parts := splitPath(path)
+	for tmpl, item := range spec["paths"].(map[string]interface{}) {
+		if _, ok := (&tRoute{parts: splitPath(tmpl)}).match(parts); !ok {
+			continue
+		}
+		if op, ok := item.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{}); ok {
+			return op, tmpl
+		}
+	}
+	return nil, ""
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	var routes, documented []string
+
+	spec := testSpec(t)
+	for _, r := range newRouter(testDB).routes {
+		for method := range r.handlers {
+			routes = append(routes, method+" /"+strings.Join(r.parts, "/"))
+		}
+	}
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if strings.Join(routes, "\n") != strings.Join(documented, "\n") {
+		t.Errorf("OpenAPI: routes and specification differ\nroutes:\n%s\nspecification:\n%s",
+			strings.Join(routes, "\n"), strings.Join(documented, "\n"))
+	}
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	spec := testSpec(t)
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+	}{
+		{http.MethodGet, "/tracks", "", cookAdmin},
+		{http.MethodGet, "/tracks?scope=own&order_by=uploaded_desc", "", cookUser},
+		{http.MethodGet, "/tracks?scope=nothing", "", cookUser},
+		{http.MethodGet, "/tracks", "", nil},
+		{http.MethodGet, "/tracks/search?q=music", "", cookAdmin},
+		{http.MethodGet, "/tracks/search", "", cookAdmin},
+		{http.MethodGet, "/tracks/1", "", cookUser},
+		{http.MethodGet, "/tracks/4", "", cookAdmin},
+		{http.MethodPatch, "/tracks/1", `{}`, cookAdmin},
+		{http.MethodPut, "/tracks/1/shares/2", `{"expires_at": "2100-01-01T00:00:00Z"}`, cookAdmin},
+		{http.MethodPut, "/tracks/1/shares/2", `{}`, cookAdmin},
+		{http.MethodGet, "/users", "", cookUser},
+		{http.MethodGet, "/users/sharing", "", cookUser},
+		{http.MethodGet, "/playlists", "", cookUser},
+		{http.MethodGet, "/playlists/1", "", cookUser},
+		{http.MethodGet, "/playlists/1/export?type=xspf", "", cookUser},
+		{http.MethodGet, "/tags", "", cookAdmin},
+		{http.MethodGet, "/folders", "", cookAdmin},
+		{http.MethodGet, "/tracks/1/annotations", "", cookUser},
+		{http.MethodGet, "/tracks/4/duplicates", "", cookAdmin},
+		{http.MethodGet, "/tracks?folder=0&tag=1", "", cookAdmin},
+		{http.MethodGet, "/tracks?order_by=recently_played", "", cookUser},
+		{http.MethodGet, "/users/1", "", cookUser},
+		{http.MethodGet, "/me", "", cookUser},
+		{http.MethodGet, "/users?q=gu", "", cookUser},
+		{http.MethodPost, "/users", `{"login": "admin", "passwd": "x"}`, nil},
+		{http.MethodGet, "/notifications", "", cookUser},
+		{http.MethodPost, "/notifications/read", `{"all": true}`, cookUser},
+		{http.MethodGet, "/webhooks", "", cookAdmin},
+		{http.MethodGet, "/webhooks/999/deliveries", "", cookAdmin},
+		{http.MethodGet, "/audio/list", "", cookAdmin},
+		{http.MethodGet, "/user/share", "", cookAdmin},
+		{http.MethodDelete, "/tracks/1/shares/99", "", cookAdmin},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(tst.method, testSrv.URL+tst.path, strings.NewReader(tst.body))
+		if tst.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if tst.cook != nil {
+			req.AddCookie(tst.cook)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("OpenAPI: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		name := fmt.Sprintf("OpenAPI: test [%d] %s %s -> %d", idx, tst.method, tst.path, resp.StatusCode)
+		op, _ := specOperation(spec, tst.method, req.URL.Path)
+		if op == nil {
+			t.Errorf("%s >>> operation not described", name)
+			continue
+		}
+		responses := op["responses"].(map[string]interface{})
+		r, ok := responses[strconv.Itoa(resp.StatusCode)].(map[string]interface{})
+		if !ok && resp.StatusCode < 300 {
+			t.Errorf("%s >>> success status not described", name)
+			continue
+		} else if !ok {
+			r = responses["default"].(map[string]interface{})
+		}
+
+		content, _ := r["content"].(map[string]interface{})
+		media, ok := content["application/json"].(map[string]interface{})
+		if !ok {
+			if len(body) > 0 && content == nil {
+				t.Errorf("%s >>> body [%s] not described", name, body)
+			}
+			continue
+		}
+		var v interface{}
+		if err = json.Unmarshal(body, &v); err != nil {
+			t.Errorf("%s >>> body is not json [%s]", name, body)
+			continue
+		}
+		for _, e := range validateSchema(spec, media["schema"].(map[string]interface{}), v, "body") {
+			t.Errorf("%s >>> %s", name, e)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//tSortKey ключ сортировки списка: выражение в запросе, направление и тип,
+//	к которому приводится значение из курсора. Набор ключей списка должен
+//	однозначно упорядочивать записи (последний ключ — id)
+type tSortKey struct {
+	Col  string
+	Desc bool
+	Type string
+}
+
+//tCursor курсор постраничного вывода: значения ключей сортировки крайней записи
+//	страницы. Order — вариант сортировки, для которого получен курсор,
+//	Prev — страница перед записью (листаем назад)
+type tCursor struct {
+	Order string        `json:"o,omitempty"`
+	Prev  bool          `json:"p,omitempty"`
+	Keys  []interface{} `json:"k"`
+}
+
+//encodeCursor курсор для клиента — непрозрачная строка
+func encodeCursor(c *tCursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+//decodeCursor разбор курсора, числа остаются строками (json.Number)
+func decodeCursor(s string) (c *tCursor, err error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	c = &tCursor{}
+	if err = dec.Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//cursorKeys значения ключей сортировки записи из json-массива, выбранного
+//	запросом списка (json_build_array), числа остаются строками (json.Number)
+func cursorKeys(js string) (keys []interface{}, err error) {
+	dec := json.NewDecoder(strings.NewReader(js))
+	dec.UseNumber()
+	err = dec.Decode(&keys)
+	return keys, err
+}
+
+//tPage страница списка: по курсору (keyset), либо по номеру страницы (OFFSET)
+//	для прежних клиентов. Limit не больше maxPageSize
+type tPage struct {
+	Order  string
+	Offset int
+	Limit  int
+	Cursor *tCursor
+}
+
+//getPage параметры страницы из запроса: cursor, либо page_no; on_page.
+//	Курсор, полученный для другой сортировки, — ошибка параметра cursor
+func getPage(req *http.Request, order string, keys []tSortKey) (pg *tPage, err error) {
+	pgNo, ln := getPageno(req)
+	pg = &tPage{Order: order, Offset: pgNo * ln, Limit: ln}
+
+	if s := req.Form.Get("cursor"); s != "" {
+		pg.Cursor, err = decodeCursor(s)
+		if err != nil || pg.Cursor.Order != order || len(pg.Cursor.Keys) != len(keys) {
+			return nil, &tFieldError{Field: "cursor", Reason: "invalid"}
+		}
+		pg.Offset = 0
+	}
+	return pg, nil
+}
+
+//where условие отбора записей после курсора (перед курсором для Prev):
+//	(k1 > v1) OR (k1 = v1 AND k2 > v2) OR …, знак — по направлению ключа.
+//	Значения курсора добавляются в sqlParam. Без курсора — true
+func (pg *tPage) where(keys []tSortKey, sqlParam *[]interface{}) string {
+	var (
+		or, eq []string
+	)
+
+	if pg.Cursor == nil {
+		return "true"
+	}
+	for i, k := range keys {
+		*sqlParam = append(*sqlParam, pg.Cursor.Keys[i])
+		val := fmt.Sprintf("$%d::%s", len(*sqlParam), k.Type)
+		op := ">"
+		if k.Desc != pg.Cursor.Prev {
+			op = "<"
+		}
+		or = append(or, "("+strings.Join(append(eq[:len(eq):len(eq)], k.Col+" "+op+" "+val), " AND ")+")")
+		eq = append(eq, k.Col+" = "+val)
+	}
+	return "(" + strings.Join(or, " OR ") + ")"
+}
+
+//sortOrder ORDER BY по ключам, reverse — в обратном порядке
+func sortOrder(keys []tSortKey, reverse bool) string {
+	var cols []string
+
+	for _, k := range keys {
+		if k.Desc != reverse {
+			cols = append(cols, k.Col+" desc")
+		} else {
+			cols = append(cols, k.Col)
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+//sortKeyCols колонки ключей через запятую (с префиксом-алиасом таблицы)
+func sortKeyCols(keys []tSortKey, prefix string) string {
+	var cols []string
+
+	for _, k := range keys {
+		cols = append(cols, prefix+k.Col)
+	}
+	return strings.Join(cols, ", ")
+}
+
+//order порядок выборки страницы; для Prev — обратный, чтобы LIMIT отрезал
+//	ближайшие к курсору записи
+func (pg *tPage) order(keys []tSortKey) string {
+	return sortOrder(keys, pg.isPrev())
+}
+
+//isPrev страница запрошена курсором "назад" — записи выбраны в обратном порядке
+func (pg *tPage) isPrev() bool {
+	return pg.Cursor != nil && pg.Cursor.Prev
+}
+
+//links ссылки на соседние страницы. first, last — ключи первой и последней записей
+//	страницы (в прямом порядке), more — за страницей в направлении чтения есть
+//	еще записи (выбрано больше Limit). Параметры запроса сохраняются, page_no
+//	заменяется курсором
+func (pg *tPage) links(req *http.Request, first, last []interface{}, more bool) (next, prev string) {
+	link := func(c *tCursor) string {
+		q := req.URL.Query()
+		q.Del("page_no")
+		q.Set("cursor", encodeCursor(c))
+		return req.URL.Path + "?" + q.Encode()
+	}
+
+	hasNext, hasPrev := more, pg.Cursor != nil || pg.Offset > 0
+	if pg.isPrev() {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext && last != nil {
+		next = link(&tCursor{Order: pg.Order, Keys: last})
+	}
+	if hasPrev && first != nil {
+		prev = link(&tCursor{Order: pg.Order, Prev: true, Keys: first})
+	}
+	return next, prev
+}
+
+//setLinks заголовок Link (RFC 8288) со ссылками на соседние страницы
+func setLinks(resp http.ResponseWriter, next, prev string) {
+	if next != "" {
+		resp.Header().Add("Link", "<"+next+`>; rel="next"`)
+	}
+	if prev != "" {
+		resp.Header().Add("Link", "<"+prev+`>; rel="prev"`)
+	}
+}
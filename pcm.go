@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path"
+)
+
+//errNotWAV файл не RIFF/WAVE либо кодирование сэмплов не поддерживается
+var errNotWAV = errors.New("not a pcm wav file")
+
+//tPCM поток сэмплов из WAV: каналы вперемешку (interleaved), значения в [-1, 1].
+//	Поддерживаются целые 8 (без знака), 16, 24, 32 бита и float 32, 64 бита
+type tPCM struct {
+	Rate     int
+	Channels int
+	bits     int
+	float    bool
+	r        io.Reader
+	buf      []byte
+}
+
+//readWAV разбор заголовка WAV до начала данных. Размер data 0 или 0xFFFFFFFF
+//	(запись потоком) — данные до конца файла
+func readWAV(r io.Reader) (pcm *tPCM, err error) {
+	var (
+		hdr   [12]byte
+		chunk [8]byte
+	)
+
+	if _, err = io.ReadFull(r, hdr[:]); err != nil || string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return nil, errNotWAV
+	}
+	for {
+		if _, err = io.ReadFull(r, chunk[:]); err != nil {
+			return nil, errNotWAV
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return nil, errNotWAV
+			}
+			data := make([]byte, size+size&1)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return nil, errNotWAV
+			}
+			tag := binary.LittleEndian.Uint16(data)
+			if tag == 0xFFFE && size >= 26 { //	WAVE_FORMAT_EXTENSIBLE: тег — начало GUID подформата
+				tag = binary.LittleEndian.Uint16(data[24:])
+			}
+			pcm = &tPCM{
+				Channels: int(binary.LittleEndian.Uint16(data[2:])),
+				Rate:     int(binary.LittleEndian.Uint32(data[4:])),
+				bits:     int(binary.LittleEndian.Uint16(data[14:])),
+				float:    tag == 3,
+			}
+			ok := (tag == 1 && (pcm.bits == 8 || pcm.bits == 16 || pcm.bits == 24 || pcm.bits == 32)) ||
+				(tag == 3 && (pcm.bits == 32 || pcm.bits == 64))
+			if !ok || pcm.Channels < 1 || pcm.Rate < 1 {
+				return nil, errNotWAV
+			}
+		case "data":
+			if pcm == nil {
+				return nil, errNotWAV
+			}
+			pcm.r = r
+			if size != 0 && size != math.MaxUint32 {
+				pcm.r = io.LimitReader(r, size)
+			}
+			return pcm, nil
+		default:
+			if _, err = io.CopyN(io.Discard, r, size+size&1); err != nil {
+				return nil, errNotWAV
+			}
+		}
+	}
+}
+
+//wavHeader заголовок WAV с форматом сэмплов pcm и данными длиной size байт
+func wavHeader(pcm *tPCM, size int64) []byte {
+	tag, width := uint16(1), pcm.bits/8
+	if pcm.float {
+		tag = 3
+	}
+	h := make([]byte, 44)
+	copy(h, "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+size))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], tag)
+	binary.LittleEndian.PutUint16(h[22:], uint16(pcm.Channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(pcm.Rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(pcm.Rate*pcm.Channels*width))
+	binary.LittleEndian.PutUint16(h[32:], uint16(pcm.Channels*width))
+	binary.LittleEndian.PutUint16(h[34:], uint16(pcm.bits))
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(size))
+	return h
+}
+
+//Read чтение целого числа кадров (по сэмплу каждого канала) в dst
+//Результат: количество прочитанных сэмплов, в конце данных — io.EOF
+func (pcm *tPCM) Read(dst []float64) (n int, err error) {
+	width := pcm.bits / 8
+	frames := len(dst) / pcm.Channels
+	if frames == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	if need := frames * pcm.Channels * width; cap(pcm.buf) < need {
+		pcm.buf = make([]byte, need)
+	} else {
+		pcm.buf = pcm.buf[:need]
+	}
+
+	got, err := io.ReadFull(pcm.r, pcm.buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	n = got / (width * pcm.Channels) * pcm.Channels
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+
+	b := pcm.buf
+	for i := 0; i < n; i++ {
+		s := b[i*width:]
+		switch {
+		case pcm.float && width == 4:
+			dst[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(s)))
+		case pcm.float:
+			dst[i] = math.Float64frombits(binary.LittleEndian.Uint64(s))
+		case width == 1:
+			dst[i] = float64(int(s[0])-128) / 128
+		case width == 2:
+			dst[i] = float64(int16(binary.LittleEndian.Uint16(s))) / (1 << 15)
+		case width == 3:
+			dst[i] = float64(int32(uint32(s[0])<<8|uint32(s[1])<<16|uint32(s[2])<<24)>>8) / (1 << 23)
+		default:
+			dst[i] = float64(int32(binary.LittleEndian.Uint32(s))) / (1 << 31)
+		}
+	}
+	return n, err
+}
+
+//openPCM поток сэмплов файла трека. WAV и MP3 (Layer III) декодируются напрямую,
+//	остальные форматы (ogg, flac…) — через копию в wav от transcoder
+//Результат: поток и файл, который нужно закрыть после чтения
+func openPCM(ctx context.Context, fileName string) (pcm *tPCM, fd *os.File, err error) {
+	if fd, err = os.Open(path.Join(mediaDir, fileName)); err != nil {
+		return nil, nil, err
+	}
+	if pcm, err = readWAV(bufio.NewReader(fd)); err == nil {
+		return pcm, fd, nil
+	}
+	if err != errNotWAV {
+		fd.Close()
+		return nil, nil, err
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	if mp3, err := openMP3(bufio.NewReader(fd)); err == nil {
+		return &tPCM{Rate: mp3.Rate, Channels: mp3.Channels, bits: 32, float: true, r: mp3}, fd, nil
+	}
+	fd.Close()
+
+	wav, err := rendition(ctx, fileName, tRendition{Format: "wav"})
+	if err != nil {
+		return nil, nil, err
+	}
+	if fd, err = os.Open(wav); err != nil {
+		return nil, nil, err
+	}
+	if pcm, err = readWAV(bufio.NewReader(fd)); err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	return pcm, fd, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+//peaksDir каталог пиков волновой формы треков в mediaDir
+const peaksDir = "peaks"
+
+//peaksZoom сэмплов на точку базового уровня пиков, который хранится в файле.
+//	Остальные уровни — кратные ему, собираются из базового при выдаче
+const peaksZoom = 256
+
+//tPeaks пики волновой формы в формате audiowaveform (BBC peaks.js): пары
+//	min, max на каждые SamplesPerPixel сэмплов, каналы сведены в один
+type tPeaks struct {
+	Version         int   `json:"version"`
+	Channels        int   `json:"channels"`
+	SampleRate      int   `json:"sample_rate"`
+	SamplesPerPixel int   `json:"samples_per_pixel"`
+	Bits            int   `json:"bits"`
+	Length          int   `json:"length"`
+	Data            []int `json:"data"`
+}
+
+var errBadPeaks = errors.New("bad peaks file")
+
+//computePeaks пики потока pcm, zoom — сэмплов (кадров) на точку. Значения
+//	16-битные, последняя точка — по неполному блоку
+func computePeaks(pcm *tPCM, zoom int) (pk *tPeaks, err error) {
+	var n int
+
+	pk = &tPeaks{Version: 2, Channels: 1, SampleRate: pcm.Rate, SamplesPerPixel: zoom, Bits: 16}
+	buf := make([]float64, 4096*pcm.Channels)
+	lo, hi, cnt := math.Inf(1), math.Inf(-1), 0
+	for err == nil {
+		n, err = pcm.Read(buf)
+		for i := 0; i+pcm.Channels <= n; i += pcm.Channels {
+			v := 0.0
+			for _, s := range buf[i : i+pcm.Channels] {
+				v += s
+			}
+			v /= float64(pcm.Channels)
+			lo, hi, cnt = math.Min(lo, v), math.Max(hi, v), cnt+1
+			if cnt == zoom {
+				pk.Data = append(pk.Data, peakValue(lo), peakValue(hi))
+				lo, hi, cnt = math.Inf(1), math.Inf(-1), 0
+			}
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	if cnt > 0 {
+		pk.Data = append(pk.Data, peakValue(lo), peakValue(hi))
+	}
+	pk.Length = len(pk.Data) / 2
+	return pk, nil
+}
+
+//peakValue сэмпл [-1, 1] 16-битным целым
+func peakValue(v float64) int {
+	return int(math.Max(-32768, math.Min(32767, math.Round(v*32767))))
+}
+
+//zoom пики с уровнем zoom, кратным SamplesPerPixel, и разрядностью bits (8|16)
+func (pk *tPeaks) zoom(zoom, bits int) *tPeaks {
+	k := zoom / pk.SamplesPerPixel
+	res := *pk
+	res.SamplesPerPixel, res.Bits, res.Data = zoom, bits, nil
+	for i := 0; i < pk.Length; i += k {
+		lo, hi := pk.Data[2*i], pk.Data[2*i+1]
+		for j := i + 1; j < i+k && j < pk.Length; j++ {
+			if pk.Data[2*j] < lo {
+				lo = pk.Data[2*j]
+			}
+			if pk.Data[2*j+1] > hi {
+				hi = pk.Data[2*j+1]
+			}
+		}
+		if bits == 8 {
+			lo, hi = lo>>8, hi>>8
+		}
+		res.Data = append(res.Data, lo, hi)
+	}
+	res.Length = len(res.Data) / 2
+	return &res
+}
+
+//writePeaksDat запись пиков в двоичном формате audiowaveform (.dat версии 1,
+//	16 бит): version, flags, sample_rate, samples_per_pixel, length, пары min, max
+func writePeaksDat(w io.Writer, pk *tPeaks) error {
+	hdr := []int32{1, 0, int32(pk.SampleRate), int32(pk.SamplesPerPixel), int32(pk.Length)}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	data := make([]int16, len(pk.Data))
+	for i, v := range pk.Data {
+		data[i] = int16(v)
+	}
+	return binary.Write(w, binary.LittleEndian, data)
+}
+
+//readPeaksDat чтение пиков, записанных writePeaksDat
+func readPeaksDat(r io.Reader) (pk *tPeaks, err error) {
+	var hdr [5]int32
+
+	if err = binary.Read(r, binary.LittleEndian, &hdr); err != nil || hdr[0] != 1 || hdr[1] != 0 ||
+		hdr[3] < 1 || hdr[4] < 0 || hdr[4] > 1<<28 {
+		return nil, errBadPeaks
+	}
+	data := make([]int16, 2*hdr[4])
+	if err = binary.Read(r, binary.LittleEndian, data); err != nil {
+		return nil, errBadPeaks
+	}
+
+	pk = &tPeaks{Version: 2, Channels: 1, SampleRate: int(hdr[2]), SamplesPerPixel: int(hdr[3]),
+		Bits: 16, Length: int(hdr[4]), Data: make([]int, len(data))}
+	for i, v := range data {
+		pk.Data[i] = int(v)
+	}
+	return pk, nil
+}
+
+//peaksPath путь к файлу пиков трека fileName
+func peaksPath(fileName string) string {
+	return path.Join(mediaDir, peaksDir, fileName+".dat")
+}
+
+//buildPeaks расчет пиков файла трека и запись через временный файл
+func buildPeaks(ctx context.Context, fileName string) error {
+	pcm, fd, err := openPCM(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	pk, err := computePeaks(pcm, peaksZoom)
+	if err != nil {
+		return err
+	}
+
+	return saveDerived(peaksPath(fileName), func(w io.Writer) error {
+		return writePeaksDat(w, pk)
+	})
+}
+
+//loadPeaks пики трека из файла, если их еще нет (файл загружен до появления
+//	пиков, либо расчет после загрузки не закончен) — расчет
+func loadPeaks(ctx context.Context, fileName string) (pk *tPeaks, err error) {
+	dst := peaksPath(fileName)
+	fd, err := os.Open(dst)
+	if os.IsNotExist(err) {
+		job := startJob(dst, func() error {
+			return buildPeaks(context.Background(), fileName)
+		})
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if job.err != nil {
+			return nil, job.err
+		}
+		fd, err = os.Open(dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return readPeaksDat(bufio.NewReader(fd))
+}
+
+//Peaks пики волновой формы трека в json audiowaveform (peaks.js). Метод GET,
+//	доступ — как у Get
+//Параметры: track — id трека; samples_per_pixel — уровень детализации, кратный
+//	peaksZoom, default — peaksZoom; bits — 8|16, default — 16; token — необязательный
+//Результат: статус ОК, json tPeaks
+//Ошибка: статус NotFound если нет файла трека
+func (afl *Audiofill) Peaks(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		ok         bool
+		fileName   string
+		pk         *tPeaks
+		zoom, bits = peaksZoom, 16
+	)
+
+	if _, _, _, fileName, ok = afl.mediaAccess(resp, req); !ok {
+		return
+	}
+	if s := req.Form.Get("samples_per_pixel"); s != "" {
+		if zoom, err = strconv.Atoi(s); err != nil || zoom < peaksZoom || zoom%peaksZoom != 0 {
+			fieldError(resp, "samples_per_pixel", "invalid")
+			return
+		}
+	}
+	if s := req.Form.Get("bits"); s != "" {
+		if bits, err = strconv.Atoi(s); err != nil || (bits != 8 && bits != 16) {
+			fieldError(resp, "bits", "invalid")
+			return
+		}
+	}
+	if _, err = os.Stat(path.Join(mediaDir, fileName)); err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
+		return
+	}
+
+	if pk, err = loadPeaks(req.Context(), fileName); err == errTranscodeBusy {
+		apiError(resp, http.StatusServiceUnavailable, "transcoder busy")
+		return
+	} else if err != nil {
+		internalError(resp, err, "Audio.Peaks failed:")
+		return
+	}
+
+	jsRes, err := json.Marshal(pk.zoom(zoom, bits))
+	if err != nil {
+		internalError(resp, err, "Audio.Peaks result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
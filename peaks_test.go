@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//testWAV файл WAV: tag 1 — целые, 3 — float; перед data — чанк LIST нечетной
+//	длины (проверка выравнивания чанков)
+func testWAV(rate, channels, bits int, tag uint16, samples []float64) []byte {
+	data := &bytes.Buffer{}
+	for _, v := range samples {
+		switch {
+		case tag == 3 && bits == 32:
+			binary.Write(data, binary.LittleEndian, float32(v))
+		case tag == 3:
+			binary.Write(data, binary.LittleEndian, v)
+		case bits == 8:
+			data.WriteByte(byte(int(math.Round(v*127)) + 128))
+		case bits == 16:
+			binary.Write(data, binary.LittleEndian, int16(math.Round(v*32767)))
+		case bits == 24:
+			n := int32(math.Round(v * 8388607))
+			data.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16)})
+		default:
+			binary.Write(data, binary.LittleEndian, int32(math.Round(v*2147483647)))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(4+8+16+8+4+8+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	for _, v := range []interface{}{uint32(16), tag, uint16(channels), uint32(rate),
+		uint32(rate * channels * bits / 8), uint16(channels * bits / 8), uint16(bits)} {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+	buf.WriteString("LIST")
+	binary.Write(buf, binary.LittleEndian, uint32(3))
+	buf.WriteString("abc\x00data")
+	binary.Write(buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestPCM(t *testing.T) {
+	samples := []float64{0, 0.5, -0.5, 1, -1, 0.25}
+	tests := []struct {
+		bits int
+		tag  uint16
+		eps  float64
+	}{
+		{8, 1, 1.0 / 64},
+		{16, 1, 1.0 / 16384},
+		{24, 1, 1e-6},
+		{32, 1, 1e-8},
+		{32, 3, 1e-7},
+		{64, 3, 0},
+	}
+	for idx, tst := range tests {
+		pcm, err := readWAV(bytes.NewReader(testWAV(8000, 2, tst.bits, tst.tag, samples)))
+		if err != nil || pcm.Rate != 8000 || pcm.Channels != 2 {
+			t.Errorf("readWAV: test [%d] wrong header %v %+v", idx, err, pcm)
+			continue
+		}
+		//	буфер не кратен каналам — читаются целые кадры
+		buf := make([]float64, 5)
+		var res []float64
+		for err == nil {
+			var n int
+			n, err = pcm.Read(buf)
+			res = append(res, buf[:n]...)
+		}
+		if err != io.EOF || len(res) != len(samples) {
+			t.Errorf("tPCM.Read: test [%d] wrong result %v %v", idx, err, res)
+			continue
+		}
+		for i, v := range res {
+			if math.Abs(v-samples[i]) > tst.eps {
+				t.Errorf("tPCM.Read: test [%d] sample %d = %f, expected %f", idx, i, v, samples[i])
+			}
+		}
+	}
+
+	for _, data := range [][]byte{[]byte("fLaC"), testWAV(8000, 1, 12, 1, nil), testWAV(8000, 1, 16, 2, nil)} {
+		if _, err := readWAV(bytes.NewReader(data)); err != errNotWAV {
+			t.Errorf("readWAV: % x wrong result %v", data[:4], err)
+		}
+	}
+}
+
+func TestPeaks(t *testing.T) {
+	//	стерео: каналы в противофазе кроме первых 256 кадров, сведение — среднее
+	var samples []float64
+	for i := 0; i < 1000; i++ {
+		l, r := float64(i)/1000, -float64(i)/1000
+		if i < 256 {
+			r = l
+		}
+		samples = append(samples, l, r)
+	}
+	pcm, _ := readWAV(bytes.NewReader(testWAV(44100, 2, 32, 3, samples)))
+	pk, err := computePeaks(pcm, 256)
+	want := []int{0, 8356, 0, 0, 0, 0, 0, 0}
+	if err != nil || pk.Length != 4 || pk.SampleRate != 44100 || !reflect.DeepEqual(pk.Data, want) {
+		t.Fatalf("computePeaks: wrong result %v %+v", err, pk)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = writePeaksDat(buf, pk); err != nil || buf.Len() != 20+4*4 {
+		t.Errorf("writePeaksDat: wrong result %v %d", err, buf.Len())
+	}
+	if res, err := readPeaksDat(buf); err != nil || !reflect.DeepEqual(res, pk) {
+		t.Errorf("readPeaksDat: wrong result %v %+v", err, res)
+	}
+
+	if res := pk.zoom(768, 8); res.Length != 2 || res.SamplesPerPixel != 768 || res.Bits != 8 ||
+		!reflect.DeepEqual(res.Data, []int{0, 32, 0, 0}) {
+		t.Errorf("tPeaks.zoom: wrong result %+v", res)
+	}
+}
+
+func TestPeaksFile(t *testing.T) {
+	if _, err := os.Stat(mediaDir); os.IsNotExist(err) {
+		os.Mkdir(mediaDir, 0755)
+		defer os.RemoveAll(mediaDir)
+	}
+	wav := testWAV(8000, 1, 16, 1, make([]float64, 1000))
+	ioutil.WriteFile(path.Join(mediaDir, "peaks-wav"), wav, 0644)
+	defer removeMedia("peaks-wav")
+
+	ioutil.WriteFile(path.Join(mediaDir, "peaks-mp3"), testMP3(make([]float64, 1000)), 0644)
+	defer removeMedia("peaks-mp3")
+
+	//	остальные форматы — через копию от transcoder: скрипт вместо ffmpeg выдает готовый wav
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "out.wav"), wav, 0644)
+	bin := filepath.Join(dir, "ffmpeg")
+	ioutil.WriteFile(bin, []byte("#!/bin/sh\nfor last; do :; done\ncp "+filepath.Join(dir, "out.wav")+" \"$last\"\n"), 0755)
+	saved := transcoder
+	transcoder = &ffmpegTranscoder{Bin: bin}
+	defer func() { transcoder = saved }()
+	ioutil.WriteFile(path.Join(mediaDir, "peaks-ogg"), []byte("OggS not really ogg"), 0644)
+	defer removeMedia("peaks-ogg")
+
+	for _, c := range []struct {
+		name         string
+		length, rate int
+	}{{"peaks-wav", 4, 8000}, {"peaks-mp3", 5, 48000}, {"peaks-ogg", 4, 8000}} {
+		pk, err := loadPeaks(context.Background(), c.name)
+		if err != nil || pk.Length != c.length || pk.SampleRate != c.rate {
+			t.Errorf("loadPeaks: %s wrong result %v %+v", c.name, err, pk)
+		}
+		if _, err = os.Stat(peaksPath(c.name)); err != nil {
+			t.Errorf("loadPeaks: %s peaks file not saved", c.name)
+		}
+	}
+	for _, name := range []string{"peaks-wav", "peaks-mp3"} {
+		if _, err := os.Stat(renditionPath(name, tRendition{Format: "wav"})); !os.IsNotExist(err) {
+			t.Errorf("loadPeaks: %s transcoded", name)
+		}
+	}
+
+	removeMedia("peaks-ogg")
+	if _, err := os.Stat(peaksPath("peaks-ogg")); !os.IsNotExist(err) {
+		t.Errorf("removeMedia: peaks file left")
+	}
+}
+
+func TestPeaksAccess(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	tests := []struct {
+		path   string
+		status int
+		err    string
+	}{
+		{"/tracks/1/peaks", http.StatusNotFound, "file not found"},
+		{"/tracks/4/peaks", http.StatusNotFound, "track not found"},
+		{"/tracks/1/peaks?samples_per_pixel=100", http.StatusBadRequest, "invalid samples_per_pixel value"},
+		{"/tracks/1/peaks?bits=12", http.StatusBadRequest, "invalid bits value"},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+tst.path, nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Peaks: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Peaks: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, body, tst.status, tst.err)
+		}
+	}
+}
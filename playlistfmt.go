@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//форматы выгрузки плейлистов и их типы содержимого
+var playlistTypes = map[string]string{
+	"m3u8": "audio/x-mpegurl; charset=utf-8",
+	"pls":  "audio/x-scpls; charset=utf-8",
+	"xspf": "application/xspf+xml; charset=utf-8",
+}
+
+//maxPlaylistSize наибольший размер загружаемого файла плейлиста
+const maxPlaylistSize = 1 << 20
+
+var errNoEntries = errors.New("playlist has no entries")
+
+//tExportEntry запись выгружаемого плейлиста
+type tExportEntry struct {
+	AudioID  int
+	Title    string
+	Artist   string
+	Album    string
+	Seconds  int
+	Location string
+}
+
+//sqlExportSelect колонки трека (алиас audio — a) в порядке полей tExportEntry
+const sqlExportSelect = `a.id_audio, a.description, coalesce(a.meta->>'artist', ''),
+		coalesce(a.meta->>'album', ''), extract(epoch from a.duration)::int`
+
+//scanExportEntries чтение строк выборки sqlExportSelect
+func scanExportEntries(qs *sql.Rows) (list []*tExportEntry, err error) {
+	for qs.Next() {
+		e := &tExportEntry{}
+		if err = qs.Scan(&e.AudioID, &e.Title, &e.Artist, &e.Album, &e.Seconds); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, qs.Err()
+}
+
+//display название для M3U/PLS: "исполнитель - название", как их показывают плееры
+func (e *tExportEntry) display() string {
+	s := e.Title
+	if e.Artist != "" {
+		s = e.Artist + " - " + s
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+//tImportEntry запись загружаемого плейлиста: ссылка на файл и название
+//	(для M3U/PLS — строка "исполнитель - название" как есть)
+type tImportEntry struct {
+	Location string
+	Title    string
+	Artist   string
+}
+
+//trackFilePath путь файла трека: /tracks/{id}/file
+var trackFilePath = regexp.MustCompile(`/tracks/(\d+)/file$`)
+
+//trackID id трека из ссылки на /audio/get или /tracks/{track}/file (выгрузка
+//	этого же сервера), 0 — ссылка на внешний файл
+func (e *tImportEntry) trackID() int {
+	u, err := url.Parse(e.Location)
+	if err != nil {
+		return 0
+	}
+	if m := trackFilePath.FindStringSubmatch(u.Path); m != nil {
+		id, _ := strconv.Atoi(m[1])
+		return id
+	}
+	if strings.HasSuffix(u.Path, "/audio/get") {
+		id, _ := strconv.Atoi(u.Query().Get("track"))
+		return id
+	}
+	return 0
+}
+
+//name название для поиска трека: из плейлиста, иначе имя файла без расширения
+func (e *tImportEntry) name() string {
+	if e.Title != "" || e.Location == "" {
+		return e.Title
+	}
+	loc := e.Location
+	if u, err := url.Parse(loc); err == nil && u.Path != "" {
+		loc = u.Path
+	}
+	base := path.Base(strings.Replace(loc, `\`, "/", -1))
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+//xspfPlaylist XML Shareable Playlist Format (http://xspf.org/ns/0/). При чтении
+//	пространство имен не проверяется
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Xmlns   string      `xml:"xmlns,attr,omitempty"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location []string `xml:"location"`
+	Title    string   `xml:"title,omitempty"`
+	Creator  string   `xml:"creator,omitempty"`
+	Album    string   `xml:"album,omitempty"`
+	Duration int      `xml:"duration,omitempty"` //	миллисекунды
+}
+
+//writePlaylist вывод плейлиста name в формате typ (m3u8, pls, xspf)
+func writePlaylist(w io.Writer, typ, name string, list []*tExportEntry) error {
+	buf := &bytes.Buffer{}
+
+	switch typ {
+	case "m3u8":
+		buf.WriteString("#EXTM3U\n")
+		if name != "" {
+			fmt.Fprintf(buf, "#PLAYLIST:%s\n", strings.Join(strings.Fields(name), " "))
+		}
+		for _, e := range list {
+			fmt.Fprintf(buf, "#EXTINF:%d,%s\n%s\n", e.Seconds, e.display(), e.Location)
+		}
+	case "pls":
+		buf.WriteString("[playlist]\n")
+		for i, e := range list {
+			fmt.Fprintf(buf, "File%[1]d=%[2]s\nTitle%[1]d=%[3]s\nLength%[1]d=%[4]d\n", i+1, e.Location, e.display(), e.Seconds)
+		}
+		fmt.Fprintf(buf, "NumberOfEntries=%d\nVersion=2\n", len(list))
+	case "xspf":
+		pl := xspfPlaylist{Xmlns: "http://xspf.org/ns/0/", Version: "1", Title: name}
+		for _, e := range list {
+			pl.Tracks = append(pl.Tracks, xspfTrack{
+				Location: []string{e.Location},
+				Title:    e.Title,
+				Creator:  e.Artist,
+				Album:    e.Album,
+				Duration: e.Seconds * 1000,
+			})
+		}
+		buf.WriteString(xml.Header)
+		enc := xml.NewEncoder(buf)
+		enc.Indent("", "  ")
+		if err := enc.Encode(pl); err != nil {
+			return err
+		}
+		buf.WriteString("\n")
+	default:
+		return fmt.Errorf("unknown playlist type %s", typ)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+//parsePlaylist разбор плейлиста M3U/M3U8, PLS или XSPF, формат определяется
+//	по содержимому. Возвращает название плейлиста (если есть в файле) и записи
+func parsePlaylist(data []byte) (name string, list []*tImportEntry, err error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	head := bytes.TrimSpace(data)
+	if len(head) > 16 {
+		head = head[:16]
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("<")):
+		name, list, err = parseXSPF(data)
+	case bytes.HasPrefix(bytes.ToLower(head), []byte("[playlist]")):
+		list, err = parsePLS(data)
+	default:
+		name, list, err = parseM3U(data)
+	}
+	if err == nil && len(list) == 0 {
+		err = errNoEntries
+	}
+	return name, list, err
+}
+
+//parseM3U разбор M3U/M3U8: строки-ссылки, #EXTINF задает название следующей записи
+func parseM3U(data []byte) (name string, list []*tImportEntry, err error) {
+	var title string
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			title = ""
+			if i := strings.Index(line, ","); i >= 0 {
+				title = strings.TrimSpace(line[i+1:])
+			}
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#"):
+		default:
+			list = append(list, &tImportEntry{Location: line, Title: title})
+			title = ""
+		}
+	}
+	return name, list, sc.Err()
+}
+
+//parsePLS разбор PLS: ключи FileN, TitleN, порядок — по номеру N
+func parsePLS(data []byte) (list []*tImportEntry, err error) {
+	var (
+		nums    []int
+		entries = map[int]*tImportEntry{}
+	)
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(sc.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(kv[0])
+		for _, prefix := range []string{"file", "title"} {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			n, err := strconv.Atoi(key[len(prefix):])
+			if err != nil {
+				continue
+			}
+			e, ok := entries[n]
+			if !ok {
+				e = &tImportEntry{}
+				entries[n] = e
+				nums = append(nums, n)
+			}
+			if prefix == "file" {
+				e.Location = strings.TrimSpace(kv[1])
+			} else {
+				e.Title = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Ints(nums)
+	for _, n := range nums {
+		if e := entries[n]; e.Location != "" {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+//parseXSPF разбор XSPF, из нескольких location берется первая
+func parseXSPF(data []byte) (name string, list []*tImportEntry, err error) {
+	var pl xspfPlaylist
+
+	if err = xml.Unmarshal(data, &pl); err != nil {
+		return "", nil, err
+	}
+	for _, tr := range pl.Tracks {
+		e := &tImportEntry{Title: strings.TrimSpace(tr.Title), Artist: strings.TrimSpace(tr.Creator)}
+		if len(tr.Location) > 0 {
+			e.Location = strings.TrimSpace(tr.Location[0])
+		}
+		if e.Location != "" || e.Title != "" {
+			list = append(list, e)
+		}
+	}
+	return strings.TrimSpace(pl.Title), list, nil
+}
+
+//playlistType формат выгрузки из параметра type, по умолчанию m3u8
+func playlistType(req *http.Request) (typ string, ok bool) {
+	if typ = strings.ToLower(req.Form.Get("type")); typ == "" {
+		typ = "m3u8"
+	}
+	_, ok = playlistTypes[typ]
+	return typ, ok
+}
+
+//baseURL адрес сервера для абсолютных ссылок: внешним плеерам нужны полные URL.
+//	За прокси учитываются X-Forwarded-Proto и X-Forwarded-Host
+func baseURL(req *http.Request) string {
+	scheme, host := "http", req.Host
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if s := req.Header.Get("X-Forwarded-Proto"); s != "" {
+		scheme = s
+	}
+	if h := req.Header.Get("X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+//sendPlaylist ответ с плейлистом для скачивания. Ссылки записей — /audio/get с
+//	токеном пользователя userID (auth=token, по умолчанию), либо без него
+//	(auth=session — плеер передает куку сессии сам)
+func sendPlaylist(resp http.ResponseWriter, req *http.Request, userID int, typ, name string, list []*tExportEntry) {
+	var withToken bool
+
+	switch req.Form.Get("auth") {
+	case "", "token":
+		withToken = true
+	case "session":
+	default:
+		fieldError(resp, "auth", "invalid")
+		return
+	}
+	expires := time.Now().Add(mediaTokenTTL)
+	base := baseURL(req)
+	for _, e := range list {
+		e.Location = fmt.Sprintf("%s/audio/get?track=%d", base, e.AudioID)
+		if withToken {
+			e.Location += "&token=" + mediaToken(userID, e.AudioID, expires)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writePlaylist(buf, typ, name, list); err != nil {
+		internalError(resp, err, "Playlist export error:")
+		return
+	}
+	resp.Header().Set("Content-Type", playlistTypes[typ])
+	resp.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + typ}))
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(buf.Bytes())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlaylistFormats(t *testing.T) {
+	export := []*tExportEntry{
+		{AudioID: 3, Title: "Группа крови", Artist: "Кино", Album: "Группа крови", Seconds: 285,
+			Location: "http://host/audio/get?track=3&token=1.2.ab"},
+		{AudioID: 1, Title: "Music\nbox", Seconds: 61, Location: "http://host/audio/get?track=1"},
+	}
+	want := map[string][]*tImportEntry{
+		"m3u8": {{Location: export[0].Location, Title: "Кино - Группа крови"}, {Location: export[1].Location, Title: "Music box"}},
+		"pls":  {{Location: export[0].Location, Title: "Кино - Группа крови"}, {Location: export[1].Location, Title: "Music box"}},
+		"xspf": {{Location: export[0].Location, Title: "Группа крови", Artist: "Кино"},
+			{Location: export[1].Location, Title: "Music\nbox"}},
+	}
+	for typ := range playlistTypes {
+		buf := &bytes.Buffer{}
+		if err := writePlaylist(buf, typ, "my mix", export); err != nil {
+			t.Fatalf("PlaylistFormats: %s >>> write error %s", typ, err.Error())
+		}
+		name, list, err := parsePlaylist(buf.Bytes())
+		if err != nil {
+			t.Errorf("PlaylistFormats: %s >>> parse error %s [%s]", typ, err.Error(), buf)
+			continue
+		}
+		if typ != "pls" && name != "my mix" {
+			t.Errorf("PlaylistFormats: %s >>> wrong name %q", typ, name)
+		}
+		if !reflect.DeepEqual(list, want[typ]) {
+			t.Errorf("PlaylistFormats: %s >>> wrong entries [%s]", typ, buf)
+		}
+		if id := list[0].trackID(); id != 3 {
+			t.Errorf("PlaylistFormats: %s >>> wrong track id %d", typ, id)
+		}
+	}
+	if err := writePlaylist(&bytes.Buffer{}, "asx", "", export); err == nil {
+		t.Errorf("PlaylistFormats: unknown type >>> expected error")
+	}
+
+	//	плейлисты других программ: без #EXTINF, PLS не по порядку, XSPF с namespace
+	tests := []struct {
+		name string
+		data string
+		want []*tImportEntry
+	}{
+		{"plain m3u", "\xef\xbb\xbfC:\\Music\\Old Song.mp3\r\n\r\n# comment\r\nhttp://x/tracks/7/file\r\n",
+			[]*tImportEntry{{Location: `C:\Music\Old Song.mp3`}, {Location: "http://x/tracks/7/file"}}},
+		{"pls", "[Playlist]\nTitle2=Second\nFile2=b.ogg\nFile1=a.mp3\nNumberOfEntries=2\n",
+			[]*tImportEntry{{Location: "a.mp3"}, {Location: "b.ogg", Title: "Second"}}},
+		{"xspf", `<?xml version="1.0"?><playlist version="1" xmlns="http://xspf.org/ns/0/">
+			<trackList><track><location>file:///m/a.flac</location><location>b</location></track>
+			<track><title> Only title </title></track><track></track></trackList></playlist>`,
+			[]*tImportEntry{{Location: "file:///m/a.flac"}, {Title: "Only title"}}},
+		{"empty", "#EXTM3U\n", nil},
+		{"broken xml", "<playlist><trackList>", nil},
+	}
+	for _, tst := range tests {
+		_, list, err := parsePlaylist([]byte(tst.data))
+		if tst.want == nil {
+			if err == nil {
+				t.Errorf("PlaylistFormats: %s >>> expected error", tst.name)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(list, tst.want) {
+			t.Errorf("PlaylistFormats: %s >>> wrong result %v %v", tst.name, list, err)
+		}
+	}
+
+	names := map[string]string{`C:\Music\Old Song.mp3`: "Old Song", "file:///m/a.flac": "a", "": ""}
+	for loc, name := range names {
+		if e := (&tImportEntry{Location: loc}); e.name() != name {
+			t.Errorf("PlaylistFormats: name of %q >>> %q, expected %q", loc, e.name(), name)
+		}
+	}
+}
+
+func TestMediaToken(t *testing.T) {
+	token := mediaToken(2, 3, time.Now().Add(time.Hour))
+	if uid, err := checkMediaToken(token, 3); err != nil || uid != 2 {
+		t.Errorf("MediaToken: valid token >>> %d %v", uid, err)
+	}
+
+	tests := map[string]struct {
+		token string
+		track int
+	}{
+		"other track": {token, 4},
+		"other user":  {"1" + token[1:], 3},
+		"expired":     {mediaToken(2, 3, time.Now().Add(-time.Second)), 3},
+		"malformed":   {"2.abc", 3},
+	}
+	for name, tst := range tests {
+		if _, err := checkMediaToken(tst.token, tst.track); err == nil {
+			t.Errorf("MediaToken: %s >>> expected error", name)
+		}
+	}
+}
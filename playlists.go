@@ -0,0 +1,900 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type tPlaylistEntry struct {
+	Position  int    `json:"position"`
+	AudioID   int    `json:"id"`
+	Descr     string `json:"name"`
+	OwnerID   int    `json:"owner_id"`
+	OwnerName string `json:"owner_name"`
+}
+
+type tPlaylist struct {
+	PlaylistID int       `json:"id"`
+	Name       string    `json:"name"`
+	IsOwn      bool      `json:"is_owner"`
+	OwnerID    int       `json:"owner_id"`
+	OwnerName  string    `json:"owner_name"`
+	Count      int       `json:"track_count"`
+	Created    time.Time `json:"created"`
+
+	Shared []*tShare         `json:"shared_to,omitempty"`
+	Tracks []*tPlaylistEntry `json:"tracks,omitempty"`
+
+	cursor string //	json-массив значений ключей сортировки (для курсора списка)
+}
+
+type tPlaylistList struct {
+	Count int          `json:"total_count"`
+	List  []*tPlaylist `json:"records"`
+	Next  string       `json:"next,omitempty"`
+	Prev  string       `json:"prev,omitempty"`
+}
+
+//tPlaylistImport результат загрузки плейлиста: записи, для которых не нашлось
+//	доступного трека, перечислены в skipped
+type tPlaylistImport struct {
+	PlaylistID int      `json:"id"`
+	Imported   int      `json:"imported"`
+	Skipped    []string `json:"skipped,omitempty"`
+}
+
+//sqlPlaylistAvailable условие доступности плейлиста (алиас playlists — p)
+//	пользователю $1: собственные и открытые ему владельцем
+const sqlPlaylistAvailable = `(p.id_owner = $1 OR exists (
+		SELECT id_playlist FROM playlist_share ps
+		WHERE ps.id_playlist = p.id_playlist AND ps.id_user = $1
+	))`
+
+//sqlPlaylistSelect колонки плейлиста в порядке полей tPlaylist (алиасы: playlists — p,
+//	users владельца — own). В track_count — только записи, доступные пользователю $1
+const sqlPlaylistSelect = `p.id_playlist, p.name, p.id_owner = $1 AS is_owner, p.id_owner,
+		coalesce(nullif(own.name,''), own.login) AS owner_name,
+		(SELECT count(*) FROM playlist_tracks pt
+			INNER JOIN audio a ON (a.id_audio = pt.id_audio)
+			WHERE pt.id_playlist = p.id_playlist AND ` + sqlAvailable + `) AS track_count,
+		p.created`
+
+//sqlQueryer общий интерфейс *sql.DB и *sql.Tx для выборки одной строки
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+//Playlists класс для таблиц playlists/playlist_tracks/playlist_share:
+//	упорядоченные списки треков пользователя и доступ к ним для других
+type Playlists struct {
+	DB     *sql.DB
+	userID int
+}
+
+//NewPlaylists создание нового экземпляра класса Playlists
+func NewPlaylists(db *sql.DB) *Playlists {
+	return &Playlists{
+		DB: db,
+	}
+}
+
+//List список доступных пользователю плейлистов: собственные и открытые ему.
+//	Метод GET, доступен только для авторизованных
+//Параметры: cursor либо page_no, on_page — как в Audiofill.List
+//	order_by — name|created|created_desc, default — name
+//	scope — own|shared_with_me|all, default — all
+//Результат: статус ОК, json список (без треков, track_count — количество доступных)
+//Ошибка: статус NotFound если плейлистов нет
+func (pls *Playlists) List(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		ok       bool
+		pg       *tPage
+		ordName  string
+		ordKeys  []tSortKey
+		scope    string
+		sqlParam []interface{}
+		first    []interface{}
+		last     []interface{}
+		qs       *sql.Rows
+		pLst     tPlaylistList
+	)
+
+	orderBy := map[string][]tSortKey{
+		"name":         {{"name", false, "text"}, {"id_playlist", false, "int"}},
+		"created":      {{"created", false, "timestamptz"}, {"id_playlist", false, "int"}},
+		"created_desc": {{"created", true, "timestamptz"}, {"id_playlist", true, "int"}},
+	}
+	scopes := map[string]string{
+		"all":            "true",
+		"own":            "p.id_owner = $1",
+		"shared_with_me": "p.id_owner <> $1",
+	}
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+
+	ordName = "name"
+	if req.Form.Get("order_by") != "" {
+		ordName = req.Form.Get("order_by")
+	}
+	if ordKeys = orderBy[ordName]; ordKeys == nil {
+		fieldError(resp, "order_by", "invalid")
+		return
+	}
+	scope = "true"
+	if req.Form.Get("scope") != "" {
+		if scope, ok = scopes[req.Form.Get("scope")]; !ok {
+			fieldError(resp, "scope", "invalid")
+			return
+		}
+	}
+	if pg, err = getPage(req, ordName, ordKeys); err != nil {
+		paramError(resp, err)
+		return
+	}
+
+	pLst = tPlaylistList{}
+	err = pls.DB.QueryRow(`SELECT count(*) FROM playlists p
+		WHERE `+sqlPlaylistAvailable+` AND `+scope, pls.userID).Scan(&pLst.Count)
+	if err != nil {
+		dbError(resp, err, "Playlists.List scan count failed:")
+		return
+	}
+
+	sqlParam = []interface{}{pls.userID}
+	sqlWhere := pg.where(ordKeys, &sqlParam)
+	qs, err = pls.DB.Query(fmt.Sprintf(`-- список плейлистов с постраничной разбивкой
+		WITH base AS (
+			SELECT `+sqlPlaylistSelect+`
+			FROM playlists p
+			INNER JOIN users own ON (p.id_owner = own.id_user)
+			WHERE `+sqlPlaylistAvailable+` AND %s
+			)
+		SELECT b.*, json_build_array(%s)::text
+		FROM base b
+		WHERE %s
+		ORDER BY %s
+		OFFSET $%d LIMIT $%d`, scope, sortKeyCols(ordKeys, "b."), sqlWhere, pg.order(ordKeys),
+		len(sqlParam)+1, len(sqlParam)+2), append(sqlParam, pg.Offset, pg.Limit+1)...)
+	if err != nil {
+		dbError(resp, err, "Playlists.List query failed:")
+		return
+	}
+	defer qs.Close()
+
+	for qs.Next() {
+		pl := &tPlaylist{}
+		err = qs.Scan(&pl.PlaylistID, &pl.Name, &pl.IsOwn, &pl.OwnerID, &pl.OwnerName, &pl.Count, &pl.Created, &pl.cursor)
+		if err != nil {
+			dbError(resp, err, "Playlists.List scan error:")
+			return
+		}
+		pLst.List = append(pLst.List, pl)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Playlists.List query iteration error:")
+		return
+	}
+	if len(pLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+
+	//	лишняя запись — последняя выбранная; при чтении назад записи выбраны
+	//	в обратном порядке — возвращаем прямой
+	more := len(pLst.List) > pg.Limit
+	if more {
+		pLst.List = pLst.List[:pg.Limit]
+	}
+	if pg.isPrev() {
+		for i, j := 0, len(pLst.List)-1; i < j; i, j = i+1, j-1 {
+			pLst.List[i], pLst.List[j] = pLst.List[j], pLst.List[i]
+		}
+	}
+	if first, err = cursorKeys(pLst.List[0].cursor); err == nil {
+		last, err = cursorKeys(pLst.List[len(pLst.List)-1].cursor)
+	}
+	if err != nil {
+		internalError(resp, err, "Playlists.List cursor keys error:")
+		return
+	}
+	pLst.Next, pLst.Prev = pg.links(req, first, last, more)
+	setLinks(resp, pLst.Next, pLst.Prev)
+
+	jsRes, err := json.Marshal(pLst)
+	if err != nil {
+		internalError(resp, err, "Playlists.List result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Add создание плейлиста. Метод POST, доступен только для авторизованных
+//Параметры: name — обязательный
+//Результат: статус Created, {"id": <id плейлиста>}, заголовок Location
+func (pls *Playlists) Add(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		name string
+		id   int
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if name = strings.TrimSpace(req.Form.Get("name")); name == "" {
+		fieldError(resp, "name", "required")
+		return
+	}
+
+	err = pls.DB.QueryRow(`INSERT INTO playlists (id_owner, name) VALUES ($1, $2)
+		RETURNING id_playlist`, pls.userID, name).Scan(&id)
+	if err != nil {
+		dbError(resp, err, "Playlists.Add query failed:")
+		return
+	}
+
+	jsRes, _ := json.Marshal(struct {
+		PlaylistID int `json:"id"`
+	}{id})
+	resp.Header().Set("Location", fmt.Sprintf("/playlists/%d", id))
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(jsRes)
+}
+
+//Import создание плейлиста из файла M3U/M3U8, PLS или XSPF (напр. выгруженного из
+//	VLC или foobar2000). Записи сопоставляются с уже загруженными и доступными
+//	пользователю треками: по ссылке этого сервера (/audio/get?track=, /tracks/{track}/file),
+//	иначе по названию ("исполнитель - название" либо имя файла). Метод POST
+//	multipart, доступен только авторизованным
+//Параметры: file — файл плейлиста; name — необязательный, по умолчанию название
+//	из файла либо имя файла
+//Результат: статус Created, json: id плейлиста, количество добавленных треков и
+//	записи, для которых трек не найден
+//Ошибка: статус BadRequest если файл не разобран, NotFound если ни один трек не найден
+func (pls *Playlists) Import(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		data    []byte
+		name    string
+		entries []*tImportEntry
+		added   = map[int]bool{}
+		tx      *sql.Tx
+		res     tPlaylistImport
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseMultipartForm(2 << 10); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	fd, fh, err := req.FormFile("file")
+	if err != nil {
+		apiError(resp, http.StatusBadRequest, "file upload error")
+		return
+	}
+	defer fd.Close()
+	if data, err = ioutil.ReadAll(io.LimitReader(fd, maxPlaylistSize+1)); err != nil || len(data) > maxPlaylistSize {
+		fieldError(resp, "file", "invalid")
+		return
+	}
+	if name, entries, err = parsePlaylist(data); err != nil {
+		fieldError(resp, "file", "invalid")
+		return
+	}
+	if s := strings.TrimSpace(req.Form.Get("name")); s != "" {
+		name = s
+	} else if name == "" {
+		name = strings.TrimSuffix(fh.Filename, path.Ext(fh.Filename))
+	}
+	if name == "" {
+		fieldError(resp, "name", "required")
+		return
+	}
+
+	if tx, err = pls.DB.Begin(); err != nil {
+		dbError(resp, err, "Playlists.Import begin failed:")
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`INSERT INTO playlists (id_owner, name) VALUES ($1, $2)
+		RETURNING id_playlist`, pls.userID, name).Scan(&res.PlaylistID)
+	if err != nil {
+		dbError(resp, err, "Playlists.Import query failed:")
+		return
+	}
+	for _, e := range entries {
+		tr, err := pls.findTrack(tx, e)
+		if err != nil {
+			dbError(resp, err, "Playlists.Import query track failed:")
+			return
+		}
+		if tr == 0 || added[tr] {
+			if tr == 0 && e.Location != "" {
+				res.Skipped = append(res.Skipped, e.Location)
+			} else if tr == 0 {
+				res.Skipped = append(res.Skipped, e.name())
+			}
+			continue
+		}
+		added[tr] = true
+		res.Imported++
+		_, err = tx.Exec(`INSERT INTO playlist_tracks (id_playlist, id_audio, position)
+			VALUES ($1, $2, $3)`, res.PlaylistID, tr, res.Imported)
+		if err != nil {
+			dbError(resp, err, "Playlists.Import query failed:")
+			return
+		}
+	}
+	if res.Imported == 0 {
+		apiError(resp, http.StatusNotFound, "no tracks found")
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		dbError(resp, err, "Playlists.Import commit failed:")
+		return
+	}
+
+	jsRes, err := json.Marshal(res)
+	if err != nil {
+		internalError(resp, err, "Playlists.Import result marshaling error:")
+		return
+	}
+	resp.Header().Set("Location", fmt.Sprintf("/playlists/%d", res.PlaylistID))
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(jsRes)
+}
+
+//Detail плейлист с треками по порядку и списком пользователей, которым он открыт.
+//	Метод GET, доступен владельцу и тем, кому плейлист открыт
+//Параметры: playlist — id плейлиста
+//Результат: статус ОК, json плейлиста. Треки, недоступные пользователю (чужие,
+//	не расшаренные ему), в списке не показываются
+//Ошибка: статус NotFound если плейлиста нет или он недоступен
+func (pls *Playlists) Detail(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		id  int
+		pl  tPlaylist
+		qs  *sql.Rows
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+
+	err = pls.DB.QueryRow(`SELECT `+sqlPlaylistSelect+`
+		FROM playlists p
+		INNER JOIN users own ON (p.id_owner = own.id_user)
+		WHERE p.id_playlist = $2 AND `+sqlPlaylistAvailable, pls.userID, id).Scan(
+		&pl.PlaylistID, &pl.Name, &pl.IsOwn, &pl.OwnerID, &pl.OwnerName, &pl.Count, &pl.Created)
+	if err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "playlist not found")
+		return
+	} else if err != nil {
+		dbError(resp, err, "Playlists.Detail query failed:")
+		return
+	}
+
+	qs, err = pls.DB.Query(`SELECT pt.position, a.id_audio,
+			concat(a.description,' (',a.duration,')'),
+			a.id_owner,
+			coalesce(nullif(own.name,''), own.login)
+		FROM playlist_tracks pt
+		INNER JOIN audio a ON (a.id_audio = pt.id_audio)
+		INNER JOIN users own ON (a.id_owner = own.id_user)
+		WHERE pt.id_playlist = $2 AND `+sqlAvailable+`
+		ORDER BY pt.position`, pls.userID, id)
+	if err != nil {
+		dbError(resp, err, "Playlists.Detail query tracks failed:")
+		return
+	}
+	defer qs.Close()
+	for qs.Next() {
+		e := &tPlaylistEntry{}
+		if err = qs.Scan(&e.Position, &e.AudioID, &e.Descr, &e.OwnerID, &e.OwnerName); err != nil {
+			dbError(resp, err, "Playlists.Detail scan tracks error:")
+			return
+		}
+		pl.Tracks = append(pl.Tracks, e)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Playlists.Detail query tracks iteration error:")
+		return
+	}
+
+	qs, err = pls.DB.Query(`SELECT u.id_user, coalesce(nullif(u.name,''), u.login)
+		FROM playlist_share ps
+		INNER JOIN users u ON (u.id_user = ps.id_user)
+		WHERE ps.id_playlist = $1
+		ORDER BY u.id_user`, id)
+	if err != nil {
+		dbError(resp, err, "Playlists.Detail query shares failed:")
+		return
+	}
+	defer qs.Close()
+	for qs.Next() {
+		sh := &tShare{}
+		if err = qs.Scan(&sh.UserID, &sh.UserName); err != nil {
+			dbError(resp, err, "Playlists.Detail scan shares error:")
+			return
+		}
+		pl.Shared = append(pl.Shared, sh)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Playlists.Detail query shares iteration error:")
+		return
+	}
+
+	jsRes, err := json.Marshal(pl)
+	if err != nil {
+		internalError(resp, err, "Playlists.Detail result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Export выгрузка плейлиста для внешних плееров. Метод GET, доступен владельцу и тем,
+//	кому плейлист открыт
+//Параметры: playlist — id плейлиста; type — m3u8|pls|xspf, default — m3u8;
+//	auth — token|session, default — token (см. Audiofill.Export)
+//Результат: статус ОК, файл плейлиста; недоступные пользователю треки пропускаются
+//Ошибка: статус NotFound если плейлиста нет или он недоступен
+func (pls *Playlists) Export(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		ok   bool
+		id   int
+		typ  string
+		name string
+		qs   *sql.Rows
+		list []*tExportEntry
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if typ, ok = playlistType(req); !ok {
+		fieldError(resp, "type", "invalid")
+		return
+	}
+
+	err = pls.DB.QueryRow(`SELECT p.name FROM playlists p
+		WHERE p.id_playlist = $2 AND `+sqlPlaylistAvailable, pls.userID, id).Scan(&name)
+	if err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "playlist not found")
+		return
+	} else if err != nil {
+		dbError(resp, err, "Playlists.Export query failed:")
+		return
+	}
+
+	qs, err = pls.DB.Query(`SELECT `+sqlExportSelect+`
+		FROM playlist_tracks pt
+		INNER JOIN audio a ON (a.id_audio = pt.id_audio)
+		WHERE pt.id_playlist = $2 AND `+sqlAvailable+`
+		ORDER BY pt.position`, pls.userID, id)
+	if err != nil {
+		dbError(resp, err, "Playlists.Export query tracks failed:")
+		return
+	}
+	defer qs.Close()
+	if list, err = scanExportEntries(qs); err != nil {
+		dbError(resp, err, "Playlists.Export scan tracks error:")
+		return
+	}
+	sendPlaylist(resp, req, pls.userID, typ, name, list)
+}
+
+//Update переименование плейлиста. Метод PATCH, доступен только владельцу
+//Параметры: playlist — id плейлиста, name — новое название
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если плейлиста нет
+func (pls *Playlists) Update(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		id   int
+		name string
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if name = strings.TrimSpace(req.Form.Get("name")); name == "" {
+		fieldError(resp, "name", "required")
+		return
+	}
+	if !pls.checkOwner(pls.DB, id, resp) {
+		return
+	}
+
+	if _, err = pls.DB.Exec(`UPDATE playlists SET name = $2 WHERE id_playlist = $1`, id, name); err != nil {
+		dbError(resp, err, "Playlists.Update query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Delete удаление плейлиста (треки остаются). Метод DELETE, доступен только владельцу
+//Параметры: playlist — id плейлиста
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если плейлиста нет
+func (pls *Playlists) Delete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		id  int
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if !pls.checkOwner(pls.DB, id, resp) {
+		return
+	}
+
+	//	записи и "расшаривания" удаляются каскадно
+	if _, err = pls.DB.Exec(`DELETE FROM playlists WHERE id_playlist = $1`, id); err != nil {
+		dbError(resp, err, "Playlists.Delete query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//PutTrack добавление трека в плейлист или перемещение на другую позицию. Метод PUT,
+//	доступен только владельцу плейлиста. Добавить можно только доступный ему трек
+//Параметры: playlist — id плейлиста, track — id трека
+//	position — необязательный, позиция с 1; новый трек по умолчанию — в конец,
+//	позиция за пределами списка — тоже в конец. Остальные треки сдвигаются
+//Результат: статус ОК
+//Ошибка: статус NotFound если трека нет или он недоступен
+//	статус Forbidden если пользователь не владелец плейлиста
+func (pls *Playlists) PutTrack(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		id, tr    int
+		pos       int
+		cnt, old  int
+		available bool
+		tx        *sql.Tx
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if s := req.Form.Get("position"); s != "" {
+		if pos, err = strconv.Atoi(s); err != nil || pos < 1 {
+			fieldError(resp, "position", "invalid")
+			return
+		}
+	}
+
+	if tx, err = pls.DB.Begin(); err != nil {
+		dbError(resp, err, "Playlists.PutTrack begin failed:")
+		return
+	}
+	defer tx.Rollback()
+	if !pls.checkOwner(tx, id, resp) {
+		return
+	}
+
+	err = tx.QueryRow(`SELECT exists(SELECT id_audio FROM audio a WHERE a.id_audio = $2 AND `+sqlAvailable+`)`,
+		pls.userID, tr).Scan(&available)
+	if err != nil {
+		dbError(resp, err, "Playlists.PutTrack query track failed:")
+		return
+	}
+	if !available {
+		apiError(resp, http.StatusNotFound, "track not found")
+		return
+	}
+
+	err = tx.QueryRow(`SELECT count(*), coalesce(max(position) FILTER (WHERE id_audio = $2), 0)
+		FROM playlist_tracks WHERE id_playlist = $1`, id, tr).Scan(&cnt, &old)
+	if err != nil {
+		dbError(resp, err, "Playlists.PutTrack query positions failed:")
+		return
+	}
+
+	//	позиции уникальны, но проверка отложена до конца транзакции — сдвиг
+	//	соседей и установка позиции трека делаются отдельными запросами
+	switch {
+	case old == 0: //	новый трек
+		if pos == 0 || pos > cnt+1 {
+			pos = cnt + 1
+		}
+		_, err = tx.Exec(`UPDATE playlist_tracks SET position = position + 1
+			WHERE id_playlist = $1 AND position >= $2`, id, pos)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO playlist_tracks (id_playlist, id_audio, position)
+				VALUES ($1, $2, $3)`, id, tr, pos)
+		}
+	case pos != 0 && pos != old: //	перемещение
+		if pos > cnt {
+			pos = cnt
+		}
+		if pos < old {
+			_, err = tx.Exec(`UPDATE playlist_tracks SET position = position + 1
+				WHERE id_playlist = $1 AND position >= $2 AND position < $3`, id, pos, old)
+		} else {
+			_, err = tx.Exec(`UPDATE playlist_tracks SET position = position - 1
+				WHERE id_playlist = $1 AND position > $3 AND position <= $2`, id, pos, old)
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE playlist_tracks SET position = $3
+				WHERE id_playlist = $1 AND id_audio = $2`, id, tr, pos)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(resp, err, "Playlists.PutTrack query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//RemoveTrack удаление трека из плейлиста, следующие треки сдвигаются. Метод DELETE,
+//	доступен только владельцу плейлиста
+//Параметры: playlist — id плейлиста, track — id трека
+//Результат: статус ОК
+//Ошибка: статус NotFound если трека в плейлисте нет
+//	статус Forbidden если пользователь не владелец плейлиста
+func (pls *Playlists) RemoveTrack(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		id, tr int
+		old    int
+		tx     *sql.Tx
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+
+	if tx, err = pls.DB.Begin(); err != nil {
+		dbError(resp, err, "Playlists.RemoveTrack begin failed:")
+		return
+	}
+	defer tx.Rollback()
+	if !pls.checkOwner(tx, id, resp) {
+		return
+	}
+
+	err = tx.QueryRow(`DELETE FROM playlist_tracks WHERE id_playlist = $1 AND id_audio = $2
+		RETURNING position`, id, tr).Scan(&old)
+	if err == sql.ErrNoRows {
+		apiError(resp, http.StatusNotFound, "track not in playlist")
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE playlist_tracks SET position = position - 1
+			WHERE id_playlist = $1 AND position > $2`, id, old)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		dbError(resp, err, "Playlists.RemoveTrack query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Share открыть плейлист пользователю. Метод PUT, доступен только владельцу.
+//	Пользователь получает доступ к трекам владельца из плейлиста (пока они в нем),
+//	чужие треки плейлиста остаются ему доступны только по их собственным правилам
+//Параметры: playlist — id плейлиста, user — пользователь
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если плейлиста нет
+func (pls *Playlists) Share(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		id, usr int
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if usr, err = strconv.Atoi(req.Form.Get("user")); err != nil {
+		fieldError(resp, "user", "invalid")
+		return
+	}
+	if !pls.checkOwner(pls.DB, id, resp) {
+		return
+	}
+
+	_, err = pls.DB.Exec(`INSERT INTO playlist_share (id_playlist, id_user) VALUES ($1, $2)
+		ON CONFLICT (id_playlist, id_user) DO NOTHING`, id, usr)
+	if err != nil {
+		dbError(resp, err, "Playlists.Share query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Lock закрыть пользователю доступ к плейлисту. Метод DELETE, доступен только владельцу
+//Параметры: playlist — id плейлиста, user — пользователь
+//Результат: статус ОК
+//Ошибка: статус NotFound если плейлист пользователю не открыт
+func (pls *Playlists) Lock(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		id, usr int
+		qr      sql.Result
+	)
+
+	if pls.userID, err = checkSession(pls.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("playlist")); err != nil {
+		fieldError(resp, "playlist", "invalid")
+		return
+	}
+	if usr, err = strconv.Atoi(req.Form.Get("user")); err != nil {
+		fieldError(resp, "user", "invalid")
+		return
+	}
+	if !pls.checkOwner(pls.DB, id, resp) {
+		return
+	}
+
+	if qr, err = pls.DB.Exec(`DELETE FROM playlist_share WHERE id_playlist = $1 AND id_user = $2`, id, usr); err != nil {
+		dbError(resp, err, "Playlists.Lock query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "no rows are deleted")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//findTrack доступный пользователю трек для записи загружаемого плейлиста, 0 — не
+//	найден. При совпадении названий предпочтение собственным трекам
+func (pls *Playlists) findTrack(db sqlQueryer, e *tImportEntry) (id int, err error) {
+	if tr := e.trackID(); tr != 0 {
+		err = db.QueryRow(`SELECT a.id_audio FROM audio a WHERE a.id_audio = $2 AND `+sqlAvailable,
+			pls.userID, tr).Scan(&id)
+		if err != sql.ErrNoRows {
+			return id, err
+		}
+	}
+
+	title, display := e.name(), e.name()
+	if title == "" {
+		return 0, nil
+	}
+	if e.Artist != "" {
+		display = e.Artist + " - " + title
+	}
+	err = db.QueryRow(`SELECT a.id_audio FROM audio a
+		WHERE `+sqlAvailable+` AND (lower(a.description) = lower($2)
+			OR lower(concat_ws(' - ', a.meta->>'artist', a.description)) = lower($3))
+		ORDER BY a.id_owner = $1 DESC, a.id_audio
+		LIMIT 1`, pls.userID, title, display).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+//checkOwner проверка владельца плейлиста id. В транзакции строка плейлиста
+//	блокируется до ее конца — изменения порядка треков не пересекаются
+func (pls *Playlists) checkOwner(db sqlQueryer, id int, resp http.ResponseWriter) (ok bool) {
+	qr := db.QueryRow(`SELECT id_owner = $1 FROM playlists WHERE id_playlist = $2 FOR UPDATE`, pls.userID, id)
+	if err := qr.Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			apiError(resp, http.StatusNotFound, "playlist not found")
+		} else {
+			dbError(resp, err, "Playlists.checkOwner query failed:")
+		}
+		return false
+	}
+	if !ok {
+		apiError(resp, http.StatusForbidden, "access denied")
+	}
+	return ok
+}
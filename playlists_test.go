@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlaylists(t *testing.T) {
+	var (
+		pLst   tPlaylistList
+		pl     tPlaylist
+		create struct {
+			PlaylistID int `json:"id"`
+		}
+	)
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	cookGuest := &http.Cookie{Name: "session_id", Value: "0414d6d5d923b0f4998556df2fe2e351"}
+
+	//	tracks id треков плейлиста по порядку, позиции должны идти подряд с 1
+	tracks := func(id int, cook *http.Cookie) (ids []int) {
+		pl = tPlaylist{}
+		st, body := testDo(t, http.MethodGet, fmt.Sprintf("/playlists/%d", id), "", cook)
+		if st != http.StatusOK || json.Unmarshal(body, &pl) != nil {
+			t.Fatalf("Playlists.Detail: %d wrong result %d [%s]", id, st, body)
+		}
+		for i, e := range pl.Tracks {
+			if e.Position != i+1 {
+				t.Errorf("Playlists.Detail: %d wrong positions [%s]", id, body)
+			}
+			ids = append(ids, e.AudioID)
+		}
+		return ids
+	}
+
+	//	список: свои и открытые пользователю, количество — только доступных треков
+	st, body := testDo(t, http.MethodGet, "/playlists", "", cookUser)
+	if st != http.StatusOK || json.Unmarshal(body, &pLst) != nil || pLst.Count != 2 ||
+		pLst.List[0].Name != "admin mix" || pLst.List[0].IsOwn || pLst.List[0].Count != 3 ||
+		pLst.List[1].Name != "user mix" || !pLst.List[1].IsOwn {
+		t.Errorf("Playlists.List: wrong result %d [%s]", st, body)
+	}
+	if st, body = testDo(t, http.MethodGet, "/playlists?on_page=1&order_by=created_desc", "", cookUser); st != http.StatusOK {
+		t.Fatalf("Playlists.List: wrong status %d [%s]", st, body)
+	}
+	pLst = tPlaylistList{}
+	json.Unmarshal(body, &pLst)
+	if len(pLst.List) != 1 || pLst.List[0].PlaylistID != 2 || pLst.Next == "" {
+		t.Errorf("Playlists.List: wrong first page [%s]", body)
+	}
+	_, body = testDo(t, http.MethodGet, pLst.Next, "", cookUser)
+	pLst = tPlaylistList{}
+	if json.Unmarshal(body, &pLst); len(pLst.List) != 1 || pLst.List[0].PlaylistID != 1 || pLst.Next != "" || pLst.Prev == "" {
+		t.Errorf("Playlists.List: wrong second page [%s]", body)
+	}
+
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodGet, "/playlists", "", cookGuest, http.StatusNotFound, "no records found"},
+		{http.MethodGet, "/playlists?scope=nothing", "", cookUser, http.StatusBadRequest, "invalid scope value"},
+		{http.MethodGet, "/playlists/1", "", cookGuest, http.StatusNotFound, "playlist not found"},
+		{http.MethodPost, "/playlists", "name=+", cookUser, http.StatusBadRequest, "name required"},
+		{http.MethodPatch, "/playlists/1", "name=mine", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodPatch, "/playlists/99", "name=mine", cookUser, http.StatusNotFound, "playlist not found"},
+		{http.MethodPut, "/playlists/1/tracks/4", "", cookAdmin, http.StatusNotFound, "track not found"},
+		{http.MethodPut, "/playlists/1/tracks/1", "position=0", cookAdmin, http.StatusBadRequest, "invalid position value"},
+		{http.MethodPut, "/playlists/2/tracks/1", "", cookAdmin, http.StatusForbidden, "access denied"},
+		{http.MethodDelete, "/playlists/2/tracks/1", "", cookUser, http.StatusNotFound, "track not in playlist"},
+		{http.MethodPut, "/playlists/1/shares/99", "", cookAdmin, http.StatusBadRequest, "user not exists"},
+		{http.MethodDelete, "/playlists/1/shares/3", "", cookAdmin, http.StatusNotFound, "no rows are deleted"},
+	}
+	for idx, tst := range tests {
+		if st, body = testDo(t, tst.method, tst.path, tst.body, tst.cook); st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Playlists: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+
+	//	перестановки: соседи сдвигаются, позиции остаются сплошными
+	steps := []struct {
+		method, path, body string
+		ids                []int
+	}{
+		{http.MethodGet, "", "", []int{2, 1, 3}},
+		{http.MethodPut, "/playlists/1/tracks/3", "position=1", []int{3, 2, 1}},
+		{http.MethodPut, "/playlists/1/tracks/2", "position=99", []int{3, 1, 2}},
+		{http.MethodPut, "/playlists/1/tracks/1", "", []int{3, 1, 2}},
+		{http.MethodDelete, "/playlists/1/tracks/1", "", []int{3, 2}},
+		{http.MethodPut, "/playlists/1/tracks/1", "", []int{3, 2, 1}},
+		{http.MethodPut, "/playlists/1/tracks/2", "position=1", []int{2, 3, 1}},
+		{http.MethodPut, "/playlists/1/tracks/1", "position=2", []int{2, 1, 3}},
+	}
+	for idx, step := range steps {
+		if step.method != http.MethodGet {
+			if st, body = testDo(t, step.method, step.path, step.body, cookAdmin); st != http.StatusOK {
+				t.Fatalf("Playlists: step [%d] %s %s wrong result %d [%s]", idx, step.method, step.path, st, body)
+			}
+		}
+		if ids := tracks(1, cookUser); !reflect.DeepEqual(ids, step.ids) {
+			t.Errorf("Playlists: step [%d] tracks %v, expected %v", idx, ids, step.ids)
+		}
+	}
+
+	//	открытый плейлист дает доступ к трекам владельца, но не к чужим трекам в нем
+	st, body = testDo(t, http.MethodPost, "/playlists", "name=private+mix", cookUser)
+	if st != http.StatusCreated || json.Unmarshal(body, &create) != nil {
+		t.Fatalf("Playlists.Add: wrong result %d [%s]", st, body)
+	}
+	path := fmt.Sprintf("/playlists/%d", create.PlaylistID)
+	testDo(t, http.MethodPut, path+"/tracks/4", "", cookUser)
+	if st, _ = testDo(t, http.MethodGet, "/tracks/4/file", "", cookGuest); st != http.StatusNotFound {
+		t.Errorf("Playlists: track before share wrong status %d", st)
+	}
+	if st, _ = testDo(t, http.MethodPut, path+"/shares/3", "", cookUser); st != http.StatusOK {
+		t.Errorf("Playlists.Share: wrong status %d", st)
+	}
+	if st, body = testDo(t, http.MethodGet, "/tracks/4", "", cookGuest); st != http.StatusOK {
+		t.Errorf("Playlists: shared track wrong result %d [%s]", st, body)
+	}
+	if ids := tracks(create.PlaylistID, cookGuest); !reflect.DeepEqual(ids, []int{4}) || len(pl.Shared) != 1 {
+		t.Errorf("Playlists.Detail: shared playlist tracks %v, shares %v", ids, pl.Shared)
+	}
+	testDo(t, http.MethodPut, "/playlists/1/shares/3", "", cookAdmin)
+	if ids := tracks(1, cookGuest); !reflect.DeepEqual(ids, []int{2, 1}) {
+		t.Errorf("Playlists.Detail: foreign track shown %v", ids)
+	}
+
+	if st, _ = testDo(t, http.MethodDelete, path+"/shares/3", "", cookUser); st != http.StatusOK {
+		t.Errorf("Playlists.Lock: wrong status %d", st)
+	}
+	if st, _ = testDo(t, http.MethodGet, "/tracks/4", "", cookGuest); st != http.StatusNotFound {
+		t.Errorf("Playlists: track after lock wrong status %d", st)
+	}
+	testDo(t, http.MethodDelete, "/playlists/1/shares/3", "", cookAdmin)
+	if st, _ = testDo(t, http.MethodPatch, path, "name=renamed", cookUser); st != http.StatusOK {
+		t.Errorf("Playlists.Update: wrong status %d", st)
+	}
+	if st, _ = testDo(t, http.MethodDelete, path, "", cookUser); st != http.StatusOK {
+		t.Errorf("Playlists.Delete: wrong status %d", st)
+	}
+	if st, _ = testDo(t, http.MethodGet, path, "", cookUser); st != http.StatusNotFound {
+		t.Errorf("Playlists.Delete: deleted playlist wrong status %d", st)
+	}
+}
+
+func TestPlaylistExport(t *testing.T) {
+	var res tPlaylistImport
+
+	client := testSrv.Client()
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+
+	get := func(path string, cook *http.Cookie) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+path, nil)
+		if cook != nil {
+			req.AddCookie(cook)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Playlists.Export: GET %s query failed %s", path, err.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	upload := func(name, data string) (int, []byte) {
+		buf := &bytes.Buffer{}
+		frmData := multipart.NewWriter(buf)
+		if name != "" {
+			frmData.WriteField("name", name)
+		}
+		frmFile, _ := frmData.CreateFormFile("file", "imported.m3u8")
+		frmFile.Write([]byte(data))
+		frmData.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, testSrv.URL+"/playlists/import", buf)
+		req.Header.Add("Content-Type", frmData.FormDataContentType())
+		req.AddCookie(cookUser)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Playlists.Import: query failed %s", err.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	resp, m3u := get("/playlists/1/export", cookUser)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "audio/x-mpegurl") ||
+		!strings.HasPrefix(string(m3u), "#EXTM3U\n#PLAYLIST:admin mix\n#EXTINF:840,best music\n") ||
+		!strings.Contains(string(m3u), "\n#EXTINF:60,Кино - bad music\n") {
+		t.Fatalf("Playlists.Export: wrong result %d [%s]", resp.StatusCode, m3u)
+	}
+	for typ, ct := range map[string]string{"pls": "audio/x-scpls", "xspf": "application/xspf+xml"} {
+		if resp, body := get("/playlists/1/export?type="+typ, cookUser); resp.StatusCode != http.StatusOK ||
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), ct) {
+			t.Errorf("Playlists.Export: %s wrong result %d [%s]", typ, resp.StatusCode, body)
+		}
+	}
+	if resp, body := get("/tracks/export?type=xspf&scope=own", cookUser); resp.StatusCode != http.StatusOK ||
+		!strings.Contains(string(body), "<creator>Кино</creator>") || strings.Contains(string(body), "best music") {
+		t.Errorf("Audio.Export: wrong result %d [%s]", resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		err    string
+	}{
+		{"/playlists/1/export?type=wma", http.StatusBadRequest, "invalid type value"},
+		{"/playlists/1/export?auth=basic", http.StatusBadRequest, "invalid auth value"},
+		{"/playlists/99/export", http.StatusNotFound, "playlist not found"},
+		{"/tracks/export?scope=nothing", http.StatusBadRequest, "invalid scope value"},
+	}
+	for idx, tst := range tests {
+		if resp, body := get(tst.path, cookUser); resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Playlists.Export: test [%d] wrong result %d [%s], expected %d [%s]",
+				idx, resp.StatusCode, body, tst.status, tst.err)
+		}
+	}
+
+	//	ссылка с токеном открывает файл без куки (файла в тестовом окружении может не быть)
+	link := strings.Split(string(m3u), "\n")[3]
+	u, _ := url.Parse(link)
+	if resp, body := get(u.RequestURI(), nil); resp.StatusCode != http.StatusOK && errMessage(body) != "file not found" {
+		t.Errorf("Audio.Get: token link wrong result %d [%s]", resp.StatusCode, body)
+	}
+	if resp, _ := get(strings.Replace(u.RequestURI(), "track=2", "track=4", 1), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Audio.Get: token of other track wrong status %d", resp.StatusCode)
+	}
+
+	imports := []struct {
+		name, data string
+		status     int
+		ids        []int
+		skipped    int
+	}{
+		{"", string(m3u) + "#EXTINF:10,Unknown\nhttp://elsewhere/song.mp3\n", http.StatusCreated, []int{2, 1, 3}, 1},
+		{"by title", "#EXTM3U\n#EXTINF:60,Кино - Bad Music\nD:\\somewhere.ogg\n/home/me/private music.ogg\n" +
+			"#EXTINF:1,bad music\nbad.ogg\n", http.StatusCreated, []int{3, 4}, 0},
+		{"", "#EXTM3U\nnothing.mp3\n", http.StatusNotFound, nil, 0},
+		{"", "<playlist", http.StatusBadRequest, nil, 0},
+	}
+	for idx, tst := range imports {
+		st, body := upload(tst.name, tst.data)
+		if st != tst.status {
+			t.Errorf("Playlists.Import: test [%d] wrong result %d [%s]", idx, st, body)
+			continue
+		}
+		if st != http.StatusCreated {
+			continue
+		}
+		res = tPlaylistImport{}
+		json.Unmarshal(body, &res)
+		if res.Imported != len(tst.ids) || len(res.Skipped) != tst.skipped {
+			t.Errorf("Playlists.Import: test [%d] wrong result [%s]", idx, body)
+		}
+		path := fmt.Sprintf("/playlists/%d", res.PlaylistID)
+		var pl tPlaylist
+		_, body = get(path, cookUser)
+		json.Unmarshal(body, &pl)
+		var ids []int
+		for _, e := range pl.Tracks {
+			ids = append(ids, e.AudioID)
+		}
+		if !reflect.DeepEqual(ids, tst.ids) || (tst.name == "" && pl.Name != "admin mix") {
+			t.Errorf("Playlists.Import: test [%d] wrong playlist [%s]", idx, body)
+		}
+		req, _ := http.NewRequest(http.MethodDelete, testSrv.URL+path, nil)
+		req.AddCookie(cookUser)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
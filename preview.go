@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+//errClipStart начало фрагмента за концом трека
+var errClipStart = errors.New("clip start beyond end of track")
+
+//tClip фрагмент файла трека: Size байт с Offset, для WAV впереди новый заголовок
+type tClip struct {
+	Type   string
+	Header []byte
+	Offset int64
+	Size   int64
+}
+
+//tCountReader чтение с подсчетом прочитанных байт
+type tCountReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *tCountReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+//wavClip фрагмент WAV с секунды start длительностью dur по границам сэмплов
+func wavClip(fd *os.File, start, dur float64) (clip *tClip, err error) {
+	cr := &tCountReader{r: fd}
+	pcm, err := readWAV(cr)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(-1)
+	if lr, ok := pcm.r.(*io.LimitedReader); ok {
+		size = lr.N
+	}
+	if st, err := fd.Stat(); err != nil {
+		return nil, err
+	} else if rest := st.Size() - cr.n; size < 0 || size > rest {
+		size = rest
+	}
+
+	frame := int64(pcm.Channels * pcm.bits / 8)
+	total := size / frame
+	if start*float64(pcm.Rate) >= float64(total) { //	до перевода в int64: огромный start переполняет
+		return nil, errClipStart
+	}
+	first := int64(start * float64(pcm.Rate))
+	cnt := int64(math.Min(dur*float64(pcm.Rate), float64(total-first)))
+	return &tClip{Type: "audio/wav", Header: wavHeader(pcm, cnt*frame), Offset: cr.n + first*frame, Size: cnt * frame}, nil
+}
+
+//frameClip фрагмент потока MP3 или AAC (ADTS) по границам кадров: от кадра, в
+//	который попадает start, до кадра, в котором набирается dur. Поиск начинается
+//	с сегмента индекса HLS, мусор между кадрами пропускается
+func frameClip(fd *os.File, idx *tHLSIndex, start, dur float64) (clip *tClip, err error) {
+	parse := mp3Frame
+	if idx.Ext == "aac" {
+		parse = adtsFrame
+	}
+	end := &idx.Segments[len(idx.Segments)-1]
+	if start*float64(idx.Rate) >= float64(end.Start)+end.Duration*float64(idx.Rate) {
+		return nil, errClipStart
+	}
+	first := int64(start * float64(idx.Rate))
+	last := first + int64(dur*float64(idx.Rate))
+	seg := &idx.Segments[0]
+	for i := range idx.Segments {
+		if idx.Segments[i].Start <= first {
+			seg = &idx.Segments[i]
+		}
+	}
+
+	clip = &tClip{Type: hlsTypes[idx.Ext], Offset: -1}
+	pos, samples := seg.Offset, seg.Start
+	br := bufio.NewReaderSize(io.NewSectionReader(fd, seg.Offset, idx.Size-seg.Offset), 32<<10)
+	for samples < last {
+		h, _ := br.Peek(7)
+		if len(h) < 4 {
+			break
+		}
+		size, cnt, rate, ok := parse(h)
+		if !ok || rate != idx.Rate {
+			br.Discard(1)
+			pos++
+			continue
+		}
+		if n, _ := br.Discard(size); n < size {
+			break
+		}
+		if clip.Offset < 0 && samples+int64(cnt) > first {
+			clip.Offset = pos
+		}
+		pos, samples = pos+int64(size), samples+int64(cnt)
+		if clip.Offset >= 0 {
+			clip.Size = pos - clip.Offset
+		}
+	}
+	if clip.Offset < 0 {
+		return nil, errClipStart
+	}
+	return clip, nil
+}
+
+//previewClip фрагмент файла трека: WAV по сэмплам, MP3/AAC по кадрам
+//Ошибка: errNoFrames — другой формат
+func previewClip(fd *os.File, start, dur float64) (clip *tClip, err error) {
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if clip, err = wavClip(fd, start, dur); err != errNotWAV {
+		return clip, err
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	idx, err := hlsIndex(fd)
+	if err != nil {
+		return nil, err
+	}
+	return frameClip(fd, idx, start, dur)
+}
+
+//Preview фрагмент трека для прослушивания без перекодирования. Метод GET,
+//	доступ — как у Get: сессия либо token (ссылки из экспорта плейлистов).
+//	Прослушивание фрагмента не учитывается в plays
+//Параметры: track — id трека; start — начало в секундах, default 0; duration —
+//	длительность в секундах, до previewMaxTime, default previewTime
+//Результат: статус ОК, audio/wav|audio/mpeg|audio/aac
+//Ошибка: статус UnsupportedMediaType если трек не WAV/MP3/AAC (ADTS)
+func (afl *Audiofill) Preview(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		ok         bool
+		fileName   string
+		fd         *os.File
+		clip       *tClip
+		start, dur = 0.0, previewTime.Seconds()
+	)
+
+	if _, _, _, fileName, ok = afl.mediaAccess(resp, req); !ok {
+		return
+	}
+	if s := req.Form.Get("start"); s != "" {
+		if start, err = strconv.ParseFloat(s, 64); err != nil || !(start >= 0) || math.IsInf(start, 0) {
+			fieldError(resp, "start", "invalid")
+			return
+		}
+	}
+	if s := req.Form.Get("duration"); s != "" {
+		if dur, err = strconv.ParseFloat(s, 64); err != nil || !(dur >= 1) || dur > previewMaxTime.Seconds() {
+			fieldError(resp, "duration", "invalid")
+			return
+		}
+	}
+	if fd, err = os.Open(path.Join(mediaDir, fileName)); err != nil {
+		apiError(resp, http.StatusNotFound, "file not found")
+		return
+	}
+	defer fd.Close()
+
+	if clip, err = previewClip(fd, start, dur); err == errClipStart {
+		fieldError(resp, "start", "invalid")
+		return
+	} else if err == errNoFrames {
+		apiError(resp, http.StatusUnsupportedMediaType, "unsupported track format")
+		return
+	} else if err != nil {
+		internalError(resp, err, "Audio.Preview failed:")
+		return
+	}
+
+	resp.Header().Set("Content-Type", clip.Type)
+	resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(clip.Header))+clip.Size, 10))
+	resp.Header().Set("Cache-Control", "private, max-age=3600")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(clip.Header)
+	io.Copy(resp, io.NewSectionReader(fd, clip.Offset, clip.Size))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//testClipFile временный файл с data
+func testClipFile(t *testing.T, data []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "clip")
+	ioutil.WriteFile(name, data, 0644)
+	fd, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("Preview: test file failed %s", err.Error())
+	}
+	t.Cleanup(func() { fd.Close() })
+	return fd
+}
+
+//testClipData содержимое фрагмента: заголовок и байты файла
+func testClipData(fd *os.File, clip *tClip) []byte {
+	data, _ := ioutil.ReadAll(io.NewSectionReader(fd, clip.Offset, clip.Size))
+	return append(append([]byte{}, clip.Header...), data...)
+}
+
+func TestWAVClip(t *testing.T) {
+	//	стерео 24 бит 8000 Гц, 1 с: сэмпл кадра i — i/10000
+	var samples []float64
+	for i := 0; i < 8000; i++ {
+		samples = append(samples, float64(i)/10000, -float64(i)/10000)
+	}
+	fd := testClipFile(t, testWAV(8000, 2, 24, 1, samples))
+
+	tests := []struct {
+		start, dur float64
+		first, cnt int
+		err        error
+	}{
+		{0.5, 0.1, 4000, 800, nil},
+		{0.9, 30, 7200, 800, nil},
+		{1, 30, 0, 0, errClipStart},
+		{1e300, 30, 0, 0, errClipStart},
+	}
+	for idx, tst := range tests {
+		clip, err := previewClip(fd, tst.start, tst.dur)
+		if err != tst.err {
+			t.Errorf("previewClip: wav test [%d] wrong error %v", idx, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		pcm, err := readWAV(bytes.NewReader(testClipData(fd, clip)))
+		if err != nil || clip.Type != "audio/wav" || pcm.Rate != 8000 || pcm.Channels != 2 {
+			t.Errorf("previewClip: wav test [%d] wrong header %v %+v", idx, err, clip)
+			continue
+		}
+		var res []float64
+		buf := make([]float64, 256)
+		for err == nil {
+			var n int
+			n, err = pcm.Read(buf)
+			res = append(res, buf[:n]...)
+		}
+		if len(res) != 2*tst.cnt || math.Abs(res[0]-float64(tst.first)/10000) > 1e-6 || math.Abs(res[1]+float64(tst.first)/10000) > 1e-6 {
+			t.Errorf("previewClip: wav test [%d] wrong data %d %v", idx, len(res), res[:2])
+		}
+	}
+}
+
+func TestFrameClip(t *testing.T) {
+	//	MPEG1 Layer III 128 кбит/с 44100 Гц, номер кадра во втором байте данных,
+	//	ID3 впереди и мусор в середине
+	tag := testID3v2(4, testID3Frame(4, "TIT2", append([]byte{3}, "title"...)))
+	data := append([]byte{}, tag...)
+	for i := 0; i < 1000; i++ {
+		if i == 500 {
+			data = append(data, "junk"...)
+		}
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00, byte(i >> 8), byte(i)})
+		data = append(data, frame...)
+	}
+	fd := testClipFile(t, data)
+
+	frameAt := func(clip *tClip, off int64) int {
+		b := make([]byte, 2)
+		fd.ReadAt(b, clip.Offset+off+4)
+		return int(b[0])<<8 | int(b[1])
+	}
+	const frame = 1152.0 / 44100
+	tests := []struct {
+		start, dur float64
+		first, cnt int
+		junk       bool
+	}{
+		{0, 10 * frame, 0, 10, false},
+		{100.5 * frame, 2 * frame, 100, 3, false},
+		{495 * frame, 10 * frame, 495, 10, true},
+		{990 * frame, 30, 990, 10, false},
+	}
+	for idx, tst := range tests {
+		clip, err := previewClip(fd, tst.start, tst.dur)
+		if err != nil || clip.Type != "audio/mpeg" {
+			t.Errorf("previewClip: mp3 test [%d] failed %v", idx, err)
+			continue
+		}
+		size := int64(tst.cnt * 417)
+		if tst.junk {
+			size += 4
+		}
+		if clip.Size != size || frameAt(clip, 0) != tst.first || frameAt(clip, size-417) != tst.first+tst.cnt-1 {
+			t.Errorf("previewClip: mp3 test [%d] wrong clip %+v first %d", idx, clip, frameAt(clip, 0))
+		}
+	}
+	for _, start := range []float64{1000 * frame, 1e300} {
+		if _, err := previewClip(fd, start, 1); err != errClipStart {
+			t.Errorf("previewClip: mp3 start %g wrong result %v", start, err)
+		}
+	}
+
+	fd = testClipFile(t, append([]byte("fLaC"), make([]byte, 100000)...))
+	if _, err := previewClip(fd, 0, 1); err != errNoFrames {
+		t.Errorf("previewClip: flac wrong result %v", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	tests := []struct {
+		path   string
+		status int
+		err    string
+	}{
+		{"/tracks/1/preview", http.StatusNotFound, "file not found"},
+		{"/tracks/4/preview", http.StatusNotFound, "track not found"},
+		{"/tracks/1/preview?start=-1", http.StatusBadRequest, "invalid start value"},
+		{"/tracks/1/preview?start=NaN", http.StatusBadRequest, "invalid start value"},
+		{"/tracks/1/preview?duration=0.5", http.StatusBadRequest, "invalid duration value"},
+		{"/tracks/1/preview?duration=1000", http.StatusBadRequest, "invalid duration value"},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+tst.path, nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Preview: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Preview: test [%d] wrong result %d [%s], expected %d [%s]", idx, resp.StatusCode, body, tst.status, tst.err)
+		}
+	}
+}
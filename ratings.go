@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Favorite добавить трек в избранное. Метод PUT, доступен тем, кому трек доступен
+//Параметры: track — id трека
+//Результат: статус ОК, повторное добавление — тоже ОК
+//Ошибка: статус NotFound если трека нет или он недоступен
+func (afl *Audiofill) Favorite(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		tr  int
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if !afl.checkAvailable(tr, resp) {
+		return
+	}
+
+	_, err = afl.DB.Exec(`INSERT INTO user_audio (id_user, id_audio, favorite) VALUES ($1, $2, true)
+		ON CONFLICT (id_user, id_audio) DO UPDATE SET favorite = true`, afl.userID, tr)
+	if err != nil {
+		dbError(resp, err, "Audio.Favorite query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Unfavorite убрать трек из избранного. Метод DELETE, доступен только авторизованным
+//Параметры: track — id трека
+//Результат: статус ОК
+//Ошибка: статус NotFound если трека нет в избранном
+func (afl *Audiofill) Unfavorite(resp http.ResponseWriter, req *http.Request) {
+	afl.clearMark(resp, req, "favorite = false", "favorite", "Audio.Unfavorite")
+}
+
+//Rate оценить трек от 1 до 5. Метод PUT, доступен тем, кому трек доступен
+//Параметры: track — id трека, rating — оценка 1..5
+//Результат: статус ОК
+//Ошибка: статус NotFound если трека нет или он недоступен
+func (afl *Audiofill) Rate(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		tr, rating int
+		frmVal     []string
+		ok         bool
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if frmVal, ok = req.Form["rating"]; !ok || strings.TrimSpace(frmVal[0]) == "" {
+		fieldError(resp, "rating", "required")
+		return
+	}
+	if rating, err = strconv.Atoi(strings.TrimSpace(frmVal[0])); err != nil || rating < 1 || rating > 5 {
+		fieldError(resp, "rating", "invalid")
+		return
+	}
+	if !afl.checkAvailable(tr, resp) {
+		return
+	}
+
+	_, err = afl.DB.Exec(`INSERT INTO user_audio (id_user, id_audio, rating) VALUES ($1, $2, $3)
+		ON CONFLICT (id_user, id_audio) DO UPDATE SET rating = EXCLUDED.rating`, afl.userID, tr, rating)
+	if err != nil {
+		dbError(resp, err, "Audio.Rate query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Unrate снять оценку трека. Метод DELETE, доступен только авторизованным
+//Параметры: track — id трека
+//Результат: статус ОК
+//Ошибка: статус NotFound если трек не оценен
+func (afl *Audiofill) Unrate(resp http.ResponseWriter, req *http.Request) {
+	afl.clearMark(resp, req, "rating = null", "rating IS NOT NULL", "Audio.Unrate")
+}
+
+//clearMark снять отметку пользователя с трека: set — присваивание, cond — условие,
+//	что отметка стоит. Доступ к треку не проверяется — отметка собственная
+func (afl *Audiofill) clearMark(resp http.ResponseWriter, req *http.Request, set, cond, name string) {
+	var (
+		err error
+		tr  int
+		qr  sql.Result
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+
+	qr, err = afl.DB.Exec(`UPDATE user_audio SET `+set+`
+		WHERE id_user = $1 AND id_audio = $2 AND `+cond, afl.userID, tr)
+	if err != nil {
+		dbError(resp, err, name+" query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "no rows are updated")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//checkAvailable трек id есть и доступен пользователю
+func (afl *Audiofill) checkAvailable(id int, resp http.ResponseWriter) (ok bool) {
+	qr := afl.DB.QueryRow(`SELECT exists(SELECT id_audio FROM audio a
+		WHERE a.id_audio = $2 AND `+sqlAvailable+`)`, afl.userID, id)
+	if err := qr.Scan(&ok); err != nil {
+		dbError(resp, err, "Audio.checkAvailable query failed:")
+		return false
+	}
+	if !ok {
+		apiError(resp, http.StatusNotFound, "track not found")
+	}
+	return ok
+}
+
+//isPlayStart запрос файла — прослушивание с начала: GET без Range, либо первый
+//	диапазон Range начинается с 0. Докачка с середины и HEAD не считаются
+func isPlayStart(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	rng := strings.TrimSpace(req.Header.Get("Range"))
+	if rng == "" {
+		return true
+	}
+	if !strings.HasPrefix(rng, "bytes=") {
+		return false
+	}
+	first := strings.SplitN(rng[len("bytes="):], ",", 2)[0]
+	return strings.HasPrefix(strings.TrimSpace(first), "0-")
+}
+
+//countPlay учет прослушивания трека пользователем. Ошибка только в лог —
+//	выдача файла не должна от нее зависеть
+func countPlay(db *sql.DB, userID, track int) {
+	_, err := db.Exec(`INSERT INTO user_audio (id_user, id_audio, plays, played_at) VALUES ($1, $2, 1, now())
+		ON CONFLICT (id_user, id_audio) DO UPDATE SET plays = user_audio.plays + 1, played_at = now()`,
+		userID, track)
+	if err != nil {
+		log.Println("Audio.Get play count failed:", err.Error())
+	}
+}
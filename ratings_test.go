@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRatings(t *testing.T) {
+	var (
+		ad tAudio
+	)
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+
+	//	listIDs id треков списка /tracks с фильтром
+	listIDs := func(query string, cook *http.Cookie) (ids []int) {
+		aLst := tAudioList{}
+		if _, body := testDo(t, http.MethodGet, "/tracks?"+query, "", cook); json.Unmarshal(body, &aLst) == nil {
+			for _, a := range aLst.List {
+				ids = append(ids, a.AudioID)
+			}
+		}
+		return ids
+	}
+
+	marks := []struct{ method, path, body string }{
+		{http.MethodPut, "/tracks/2/favorite", ""},
+		{http.MethodPut, "/tracks/2/favorite", ""},
+		{http.MethodPut, "/tracks/1/rating", "rating=5"},
+		{http.MethodPut, "/tracks/3/rating", "rating=2"},
+	}
+	for _, m := range marks {
+		if st, body := testDo(t, m.method, m.path, m.body, cookUser); st != http.StatusOK {
+			t.Fatalf("Ratings: %s %s wrong result %d [%s]", m.method, m.path, st, body)
+		}
+	}
+
+	//	отметки видны только поставившему их пользователю
+	if _, body := testDo(t, http.MethodGet, "/tracks/2", "", cookUser); json.Unmarshal(body, &ad) != nil ||
+		!ad.Favorite || ad.Rating != 0 {
+		t.Errorf("Audio.Detail: wrong user marks [%s]", body)
+	}
+	ad = tAudio{}
+	if _, body := testDo(t, http.MethodGet, "/tracks/2", "", cookAdmin); json.Unmarshal(body, &ad) != nil || ad.Favorite {
+		t.Errorf("Audio.Detail: foreign marks visible [%s]", body)
+	}
+	if ids := listIDs("favorite=true", cookUser); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("Audio.List: favorite filter wrong tracks %v", ids)
+	}
+	if ids := listIDs("order_by=rating", cookUser); len(ids) < 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Errorf("Audio.List: rating order wrong tracks %v", ids)
+	}
+	if ids := listIDs("order_by=rating&on_page=1", cookAdmin); len(ids) != 1 {
+		t.Errorf("Audio.List: rating order without marks wrong tracks %v", ids)
+	}
+
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodPut, "/tracks/1/rating", "", cookUser, http.StatusBadRequest, "rating required"},
+		{http.MethodPut, "/tracks/1/rating", "rating=6", cookUser, http.StatusBadRequest, "invalid rating value"},
+		{http.MethodPut, "/tracks/4/rating", "rating=3", cookAdmin, http.StatusNotFound, "track not found"},
+		{http.MethodPut, "/tracks/4/favorite", "", cookAdmin, http.StatusNotFound, "track not found"},
+		{http.MethodDelete, "/tracks/2/favorite", "", cookAdmin, http.StatusNotFound, "no rows are updated"},
+		{http.MethodDelete, "/tracks/2/rating", "", cookUser, http.StatusNotFound, "no rows are updated"},
+		{http.MethodGet, "/tracks?order_by=plays&favorite=x", "", cookUser, http.StatusOK, ""},
+	}
+	for idx, tst := range tests {
+		if st, body := testDo(t, tst.method, tst.path, tst.body, tst.cook); st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Ratings: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+
+	for _, path := range []string{"/tracks/2/favorite", "/tracks/1/rating", "/tracks/3/rating"} {
+		if st, _ := testDo(t, http.MethodDelete, path, "", cookUser); st != http.StatusOK {
+			t.Errorf("Ratings: DELETE %s wrong status %d", path, st)
+		}
+	}
+	if ids := listIDs("favorite=true", cookUser); ids != nil {
+		t.Errorf("Audio.List: favorites left %v", ids)
+	}
+}
+
+func TestPlayStart(t *testing.T) {
+	tests := []struct {
+		method, rng string
+		res         bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodGet, "bytes=0-", true},
+		{http.MethodGet, "bytes=0-1023, 4096-", true},
+		{http.MethodGet, "bytes=1024-", false},
+		{http.MethodGet, "bytes=-500", false},
+		{http.MethodGet, "items=0-", false},
+		{http.MethodHead, "", false},
+	}
+	for idx, tst := range tests {
+		req := httptest.NewRequest(tst.method, "/tracks/1/file", nil)
+		if tst.rng != "" {
+			req.Header.Set("Range", tst.rng)
+		}
+		if res := isPlayStart(req); res != tst.res {
+			t.Errorf("isPlayStart: test [%d] %s %q result %v", idx, tst.method, tst.rng, res)
+		}
+	}
+}
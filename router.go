@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//requestIDHeader заголовок с идентификатором запроса. Берется из запроса клиента
+//	(или прокси), если он там корректный, иначе генерируется; возвращается в ответе
+//	и в ошибках API
+const requestIDHeader = "X-Request-ID"
+
+//maxJSONBody ограничение размера json-тела запроса
+const maxJSONBody = 1 << 20
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+//tRoute шаблон пути с обработчиками по методам. Сегменты вида {name} —
+//	параметры пути
+type tRoute struct {
+	parts    []string
+	handlers map[string]http.HandlerFunc
+}
+
+//Router маршрутизатор запросов: выбор обработчика по пути и методу. Параметры
+//	пути добавляются в req.Form под своими именами, поэтому обработчики читают их
+//	так же, как параметры формы (напр. {track} в /tracks/{track} — req.Form["track"]).
+//	Если путь найден, а метод нет — статус MethodNotAllowed с заголовком Allow.
+//	Тело application/json разбирается так же в req.Form, т.е. любой обработчик
+//	принимает и форму, и json
+type Router struct {
+	routes []*tRoute
+}
+
+//NewRouter создание нового экземпляра класса Router
+func NewRouter() *Router {
+	return &Router{}
+}
+
+//splitPath разбиение пути на сегменты без пустых (лишние и концевые "/")
+func splitPath(p string) []string {
+	var parts []string
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return parts
+}
+
+//Handle регистрация обработчика h для метода method и шаблона пути pattern
+func (rt *Router) Handle(method, pattern string, h http.HandlerFunc) {
+	parts := splitPath(pattern)
+	for _, r := range rt.routes {
+		if strings.Join(r.parts, "/") == strings.Join(parts, "/") {
+			r.handlers[method] = h
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &tRoute{parts: parts, handlers: map[string]http.HandlerFunc{method: h}})
+}
+
+//match сопоставление сегментов пути с шаблоном, возвращает параметры пути
+func (r *tRoute) match(parts []string) (params map[string]string, ok bool) {
+	if len(parts) != len(r.parts) {
+		return nil, false
+	}
+	params = map[string]string{}
+	for i, p := range r.parts {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			params[p[1:len(p)-1]] = parts[i]
+		} else if p != parts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+//moreSpecific true, если шаблон r точнее other: в первом различающемся
+//	сегменте у r постоянная часть, а у other — параметр
+func (r *tRoute) moreSpecific(other *tRoute) bool {
+	for i := range r.parts {
+		rp, op := strings.HasPrefix(r.parts[i], "{"), strings.HasPrefix(other.parts[i], "{")
+		if rp != op {
+			return op
+		}
+	}
+	return false
+}
+
+//allow список допустимых методов для заголовка Allow
+func (r *tRoute) allow() string {
+	var methods []string
+	for m := range r.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := r.handlers[http.MethodGet]; ok {
+		if _, ok = r.handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+//newRequestID случайный идентификатор запроса
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+//jsonValue значение параметра формы для значения json. Массивы — через запятую,
+//	как в форме (events=a,b), вложенные объекты — исходным json. null означает
+//	отсутствие параметра, true/false передаются как есть (см. formFlag)
+func jsonValue(v interface{}) (val string, ok bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			if s, ok := jsonValue(item); ok {
+				items = append(items, s)
+			}
+		}
+		return strings.Join(items, ","), true
+	}
+	js, _ := json.Marshal(v)
+	return string(js), true
+}
+
+//parseJSONBody разбор тела application/json (объект) в req.Form и req.PostForm,
+//	параметры строки запроса тоже попадают в req.Form
+func parseJSONBody(req *http.Request) error {
+	var body map[string]interface{}
+
+	dec := json.NewDecoder(io.LimitReader(req.Body, maxJSONBody))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil && err != io.EOF {
+		return err
+	}
+
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	req.Form, req.PostForm = query, url.Values{}
+	for k, v := range body {
+		if val, ok := jsonValue(v); ok {
+			req.Form.Set(k, val)
+			req.PostForm.Set(k, val)
+		}
+	}
+	return nil
+}
+
+//isJSON true, если тело запроса — json
+func isJSON(req *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+func (rt *Router) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var (
+		best   *tRoute
+		params map[string]string
+		err    error
+	)
+
+	reqID := req.Header.Get(requestIDHeader)
+	if !requestIDRe.MatchString(reqID) {
+		reqID = newRequestID()
+	}
+	resp.Header().Set(requestIDHeader, reqID)
+
+	parts := splitPath(req.URL.Path)
+	for _, r := range rt.routes {
+		if p, ok := r.match(parts); ok && (best == nil || r.moreSpecific(best)) {
+			best, params = r, p
+		}
+	}
+	if best == nil {
+		apiError(resp, http.StatusNotFound, "not found")
+		return
+	}
+
+	h, ok := best.handlers[req.Method]
+	if !ok && req.Method == http.MethodHead {
+		h, ok = best.handlers[http.MethodGet]
+	}
+	if !ok {
+		resp.Header().Set("Allow", best.allow())
+		apiError(resp, http.StatusMethodNotAllowed, "bad method")
+		return
+	}
+
+	if isJSON(req) {
+		if err = parseJSONBody(req); err != nil {
+			apiError(resp, http.StatusBadRequest, "wrong json data")
+			return
+		}
+	} else if len(params) > 0 {
+		err = req.ParseForm()
+	}
+	if err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	for k, v := range params {
+		req.Form[k] = []string{v}
+	}
+	h(resp, req)
+}
+
+//newRouter маршруты сервера. Ресурсные маршруты (/tracks, /users, /sessions…)
+//	и прежние (/audio/list, /user/list…), оставленные на переходный период
+func newRouter(db *sql.DB) *Router {
+	ad := NewAudiofill(db)
+	usr := NewUsers(db)
+	ntf := NewNotifications(db)
+	evs := NewEvents(db)
+	hk := NewWebhooks(db)
+	pl := NewPlaylists(db)
+	tg := NewTags(db)
+	fld := NewFolders(db)
+	an := NewAnnotations(db)
+
+	rt := NewRouter()
+	rt.Handle(http.MethodGet, "/tracks", ad.List)
+	rt.Handle(http.MethodGet, "/tracks/search", ad.Search)
+	rt.Handle(http.MethodGet, "/tracks/export", ad.Export)
+	rt.Handle(http.MethodPost, "/tracks", ad.Add)
+	rt.Handle(http.MethodGet, "/tracks/{track}", ad.Detail)
+	rt.Handle(http.MethodPatch, "/tracks/{track}", ad.Update)
+	rt.Handle(http.MethodDelete, "/tracks/{track}", ad.Delete)
+	rt.Handle(http.MethodGet, "/tracks/{track}/file", ad.Get)
+	rt.Handle(http.MethodGet, "/tracks/{track}/hls/index.m3u8", ad.HLSPlaylist)
+	rt.Handle(http.MethodGet, "/tracks/{track}/hls/{segment}", ad.HLSSegment)
+	rt.Handle(http.MethodGet, "/tracks/{track}/peaks", ad.Peaks)
+	rt.Handle(http.MethodGet, "/tracks/{track}/waveform", ad.Waveform)
+	rt.Handle(http.MethodGet, "/tracks/{track}/spectrogram", ad.Spectrogram)
+	rt.Handle(http.MethodGet, "/tracks/{track}/preview", ad.Preview)
+	rt.Handle(http.MethodGet, "/tracks/{track}/artwork", ad.Artwork)
+	rt.Handle(http.MethodPut, "/tracks/{track}/artwork", ad.SetArtwork)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/artwork", ad.DeleteArtwork)
+	rt.Handle(http.MethodPut, "/tracks/{track}/lyrics", ad.SetLyrics)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/lyrics", ad.DeleteLyrics)
+	rt.Handle(http.MethodGet, "/tracks/{track}/duplicates", ad.Duplicates)
+	rt.Handle(http.MethodPut, "/tracks/{track}/shares/{user}", ad.Share)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/shares/{user}", ad.Lock)
+	rt.Handle(http.MethodPut, "/tracks/{track}/favorite", ad.Favorite)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/favorite", ad.Unfavorite)
+	rt.Handle(http.MethodPut, "/tracks/{track}/rating", ad.Rate)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/rating", ad.Unrate)
+
+	rt.Handle(http.MethodGet, "/playlists", pl.List)
+	rt.Handle(http.MethodPost, "/playlists", pl.Add)
+	rt.Handle(http.MethodPost, "/playlists/import", pl.Import)
+	rt.Handle(http.MethodGet, "/playlists/{playlist}", pl.Detail)
+	rt.Handle(http.MethodPatch, "/playlists/{playlist}", pl.Update)
+	rt.Handle(http.MethodDelete, "/playlists/{playlist}", pl.Delete)
+	rt.Handle(http.MethodGet, "/playlists/{playlist}/export", pl.Export)
+	rt.Handle(http.MethodPut, "/playlists/{playlist}/tracks/{track}", pl.PutTrack)
+	rt.Handle(http.MethodDelete, "/playlists/{playlist}/tracks/{track}", pl.RemoveTrack)
+	rt.Handle(http.MethodPut, "/playlists/{playlist}/shares/{user}", pl.Share)
+	rt.Handle(http.MethodDelete, "/playlists/{playlist}/shares/{user}", pl.Lock)
+
+	rt.Handle(http.MethodGet, "/tags", tg.List)
+	rt.Handle(http.MethodPost, "/tags", tg.Add)
+	rt.Handle(http.MethodPatch, "/tags/{tag}", tg.Update)
+	rt.Handle(http.MethodDelete, "/tags/{tag}", tg.Delete)
+	rt.Handle(http.MethodPut, "/tracks/{track}/tags/{tag}", tg.Mark)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/tags/{tag}", tg.Unmark)
+
+	rt.Handle(http.MethodGet, "/folders", fld.List)
+	rt.Handle(http.MethodPost, "/folders", fld.Add)
+	rt.Handle(http.MethodPatch, "/folders/{folder}", fld.Update)
+	rt.Handle(http.MethodDelete, "/folders/{folder}", fld.Delete)
+	rt.Handle(http.MethodPut, "/folders/{folder}/tracks/{track}", fld.PutTrack)
+	rt.Handle(http.MethodDelete, "/folders/{folder}/tracks/{track}", fld.RemoveTrack)
+
+	rt.Handle(http.MethodGet, "/tracks/{track}/annotations", an.List)
+	rt.Handle(http.MethodPost, "/tracks/{track}/annotations", an.Add)
+	rt.Handle(http.MethodPatch, "/tracks/{track}/annotations/{annotation}", an.Update)
+	rt.Handle(http.MethodDelete, "/tracks/{track}/annotations/{annotation}", an.Delete)
+	rt.Handle(http.MethodGet, "/tracks/{track}/chapters", an.Chapters)
+
+	rt.Handle(http.MethodGet, "/users", usr.List)
+	rt.Handle(http.MethodPost, "/users", usr.Registration)
+	rt.Handle(http.MethodGet, "/users/sharing", usr.Share)
+	rt.Handle(http.MethodGet, "/users/{user}", usr.Profile)
+	rt.Handle(http.MethodGet, "/me", usr.Me)
+	rt.Handle(http.MethodPatch, "/me", usr.UpdateMe)
+	rt.Handle(http.MethodPost, "/sessions", usr.Login)
+	rt.Handle(http.MethodDelete, "/sessions", usr.Logout)
+
+	rt.Handle(http.MethodGet, "/notifications", ntf.List)
+	rt.Handle(http.MethodPost, "/notifications/read", ntf.Read)
+	rt.Handle(http.MethodGet, "/events", evs.Stream)
+
+	rt.Handle(http.MethodGet, "/webhooks", hk.List)
+	rt.Handle(http.MethodPost, "/webhooks", hk.Add)
+	rt.Handle(http.MethodDelete, "/webhooks/{id}", hk.Delete)
+	rt.Handle(http.MethodGet, "/webhooks/{id}/deliveries", hk.Log)
+
+	rt.Handle(http.MethodGet, "/openapi.json", OpenAPI)
+	rt.Handle(http.MethodGet, "/docs", APIDocs)
+
+	//	прежние маршруты
+	rt.Handle(http.MethodPut, "/registration", usr.Registration)
+	rt.Handle(http.MethodPost, "/login", usr.Login)
+	rt.Handle(http.MethodGet, "/logout", usr.Logout)
+	rt.Handle(http.MethodPost, "/logout", usr.Logout)
+	rt.Handle(http.MethodGet, "/user/list", usr.List)
+	rt.Handle(http.MethodGet, "/user/share", usr.Share)
+	rt.Handle(http.MethodGet, "/audio/list", ad.List)
+	rt.Handle(http.MethodPost, "/audio/share", ad.Share)
+	rt.Handle(http.MethodPost, "/audio/lock", ad.Lock)
+	rt.Handle(http.MethodGet, "/audio/get", ad.Get)
+	rt.Handle(http.MethodPut, "/audio/add", ad.Add)
+	rt.Handle(http.MethodPut, "/webhook/add", hk.Add)
+	rt.Handle(http.MethodGet, "/webhook/list", hk.List)
+	rt.Handle(http.MethodPost, "/webhook/delete", hk.Delete)
+	rt.Handle(http.MethodGet, "/webhook/log", hk.Log)
+	return rt
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var got string
+
+	handler := func(name string) http.HandlerFunc {
+		return func(resp http.ResponseWriter, req *http.Request) {
+			req.ParseForm()
+			got = name + ":" + req.Form.Get("track") + ":" + req.Form.Get("user")
+		}
+	}
+	rt := NewRouter()
+	rt.Handle(http.MethodGet, "/tracks/{track}", handler("detail"))
+	rt.Handle(http.MethodDelete, "/tracks/{track}", handler("delete"))
+	rt.Handle(http.MethodGet, "/tracks/{track}/shares/{user}", handler("share"))
+	rt.Handle(http.MethodGet, "/tracks/new", handler("new"))
+
+	tests := []struct {
+		method, path string
+		status       int
+		got, allow   string
+	}{
+		{http.MethodGet, "/tracks/5", http.StatusOK, "detail:5:", ""},
+		{http.MethodHead, "/tracks/5/", http.StatusOK, "detail:5:", ""},
+		{http.MethodGet, "/tracks/new", http.StatusOK, "new::", ""},
+		{http.MethodGet, "/tracks/5/shares/2?track=9", http.StatusOK, "share:5:2", ""},
+		{http.MethodPost, "/tracks/5", http.StatusMethodNotAllowed, "", "DELETE, GET, HEAD"},
+		{http.MethodGet, "/tracks", http.StatusNotFound, "", ""},
+	}
+	for idx, tst := range tests {
+		got = ""
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(tst.method, tst.path, nil))
+		if rec.Code != tst.status || got != tst.got || rec.Header().Get("Allow") != tst.allow {
+			t.Errorf("Router: test [%d] %s %s wrong result %d [%s] allow [%s]", idx, tst.method, tst.path,
+				rec.Code, got, rec.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestTracksResource(t *testing.T) {
+	var (
+		err    error
+		req    *http.Request
+		resp   *http.Response
+		ad     tAudio
+		create struct {
+			AudioID int `json:"id"`
+		}
+	)
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	cookGuest := &http.Cookie{Name: "session_id", Value: "0414d6d5d923b0f4998556df2fe2e351"}
+
+	st, body := testDo(t, http.MethodGet, "/tracks/1", "", cookUser)
+	if st != http.StatusOK {
+		t.Fatalf("Tracks.Detail: wrong status %d, expected %d", st, http.StatusOK)
+	}
+	if err = json.Unmarshal(body, &ad); err != nil || ad.AudioID != 1 || ad.IsOwn || ad.OwnerID != 1 {
+		t.Errorf("Tracks.Detail: wrong result [%s] %v", body, err)
+	}
+	if st, _ = testDo(t, http.MethodGet, "/tracks/4", "", cookGuest); st != http.StatusNotFound {
+		t.Errorf("Tracks.Detail: foreign track wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+
+	tests := []struct {
+		query  string
+		cook   *http.Cookie
+		status int
+		err    string
+	}{
+		{"name=renamed", cookUser, http.StatusForbidden, "access denied"},
+		{"", cookAdmin, http.StatusBadRequest, "nothing to update"},
+		{"duration=ten", cookAdmin, http.StatusBadRequest, "invalid duration value"},
+	}
+	for idx, tst := range tests {
+		if st, body = testDo(t, http.MethodPatch, "/tracks/1", tst.query, tst.cook); st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Tracks.Update: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+	if st, _ = testDo(t, http.MethodPatch, "/tracks/1", "name=renamed", cookAdmin); st != http.StatusOK {
+		t.Errorf("Tracks.Update: wrong status %d, expected %d", st, http.StatusOK)
+	}
+	_, body = testDo(t, http.MethodGet, "/tracks/1", "", cookAdmin)
+	if !bytes.Contains(body, []byte(`"renamed (`)) {
+		t.Errorf("Tracks.Update: name not changed [%s]", body)
+	}
+	testDo(t, http.MethodPatch, "/tracks/1", "name=test music", cookAdmin)
+
+	//	создание и удаление трека
+	buf := &bytes.Buffer{}
+	frmData := multipart.NewWriter(buf)
+	frmData.WriteField("name", "router test")
+	frmData.WriteField("duration", "00:00:10")
+	frmFile, _ := frmData.CreateFormFile("file", "router.ogg")
+	frmFile.Write([]byte("OggS"))
+	frmData.Close()
+	req, _ = http.NewRequest(http.MethodPost, testSrv.URL+"/tracks", buf)
+	req.Header.Add("Content-Type", frmData.FormDataContentType())
+	req.AddCookie(cookUser)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatalf("Tracks.Add: query failed %s", err.Error())
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &create) != nil || create.AudioID == 0 {
+		t.Fatalf("Tracks.Add: wrong result %d [%s]", resp.StatusCode, body)
+	}
+	path := resp.Header.Get("Location")
+
+	if st, _ = testDo(t, http.MethodDelete, path, "", cookAdmin); st != http.StatusForbidden {
+		t.Errorf("Tracks.Delete: foreign track wrong status %d, expected %d", st, http.StatusForbidden)
+	}
+	if st, _ = testDo(t, http.MethodDelete, path, "", cookUser); st != http.StatusOK {
+		t.Errorf("Tracks.Delete: wrong status %d, expected %d", st, http.StatusOK)
+	}
+	if st, _ = testDo(t, http.MethodGet, path, "", cookUser); st != http.StatusNotFound {
+		t.Errorf("Tracks.Detail: deleted track wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	var env struct {
+		Error tAPIError `json:"error"`
+	}
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code, message      string
+		fields             map[string]string
+	}{
+		{http.MethodPut, "/tracks/1/shares/99", `{}`, http.StatusBadRequest, errValidation, "user not exists",
+			map[string]string{"user": "not_exists"}},
+		{http.MethodPost, "/users", `{"login": "admin", "passwd": "secret"}`, http.StatusConflict, errConflict, "login already used",
+			map[string]string{"login": "already_used"}},
+		{http.MethodPost, "/users", `{"passwd": "secret"}`, http.StatusBadRequest, errValidation, "login required",
+			map[string]string{"login": "required"}},
+		{http.MethodPatch, "/tracks/1", `{"name": `, http.StatusBadRequest, errBadRequest, "wrong json data", nil},
+		{http.MethodPatch, "/tracks/1", `{"duration": "1:2:3:4"}`, http.StatusBadRequest, errValidation, "invalid duration value",
+			map[string]string{"duration": "invalid"}},
+		{http.MethodPost, "/tracks/1", `{}`, http.StatusMethodNotAllowed, errMethod, "bad method", nil},
+		{http.MethodGet, "/nowhere", ``, http.StatusNotFound, errNotFound, "not found", nil},
+	}
+	for idx, tst := range tests {
+		req, _ := http.NewRequest(tst.method, testSrv.URL+tst.path, strings.NewReader(tst.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(requestIDHeader, "test-"+strconv.Itoa(idx))
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Errors: test [%d] query failed %s", idx, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		env.Error = tAPIError{}
+		if err = json.Unmarshal(body, &env); err != nil || resp.StatusCode != tst.status {
+			t.Errorf("Errors: test [%d] wrong result %d [%s], expected %d", idx, resp.StatusCode, body, tst.status)
+			continue
+		}
+		if env.Error.Code != tst.code || env.Error.Message != tst.message ||
+			!reflect.DeepEqual(env.Error.Fields, tst.fields) || env.Error.RequestID != "test-"+strconv.Itoa(idx) {
+			t.Errorf("Errors: test [%d] wrong envelope [%s]", idx, body)
+		}
+	}
+}
+
+func TestJSONBody(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	patch := func(body string) int {
+		req, _ := http.NewRequest(http.MethodPatch, testSrv.URL+"/tracks/1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("JSON: query failed %s", err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if st := patch(`{"name": "json music", "duration": 245}`); st != http.StatusOK {
+		t.Fatalf("JSON: patch wrong status %d, expected %d", st, http.StatusOK)
+	}
+	req, _ := http.NewRequest(http.MethodGet, testSrv.URL+"/tracks/1", nil)
+	req.AddCookie(cookAdmin)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("JSON: query failed %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(body, []byte(`"json music (00:04:05)`)) {
+		t.Errorf("JSON: track not updated [%s]", body)
+	}
+	patch(`{"name": "test music", "duration": "00:04:00"}`)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+type tSearchHit struct {
+	AudioID   int     `json:"id"`
+	Descr     string  `json:"name"`
+	IsOwn     bool    `json:"is_owner"`
+	OwnerID   int     `json:"owner_id"`
+	OwnerName string  `json:"owner_name"`
+	Rank      float64 `json:"rank"`
+	Snippet   string  `json:"snippet"`
+}
+
+type tSearchList struct {
+	Count int           `json:"total_count"`
+	List  []*tSearchHit `json:"records"`
+}
+
+//sqlSearchQuery запрос поиска (алиас — q): словоформы русского и английского
+//	(конфигурация russian), плюс слова как есть (simple) — для имен и латиницы
+//	без стемминга. %d — номер параметра со строкой поиска
+const sqlSearchQuery = `(SELECT websearch_to_tsquery('russian', $%[1]d) ||
+			websearch_to_tsquery('simple', $%[1]d) AS tsq) q`
+
+//sqlSearchMatch условие совпадения: полнотекстовое по названию и тегам файла,
+//	по логину/имени владельца, либо нечеткое (pg_trgm) по названию и имени владельца
+const sqlSearchMatch = `(a.search @@ q.tsq
+			OR to_tsvector('simple', own.login || ' ' || own.name) @@ q.tsq
+			OR $%[1]d <%% a.description
+			OR $%[1]d <%% own.name)`
+
+//searchMarkStart, searchMarkStop границы найденных слов во фрагменте ts_headline:
+//	управляющие символы вместо <mark>, чтобы экранировать текст уже после выделения
+const (
+	searchMarkStart = "\x01"
+	searchMarkStop  = "\x02"
+)
+
+//searchSnippet фрагмент для вывода как HTML: текст экранирован, найденные слова —
+//	в <mark>…</mark>
+func searchSnippet(s string) string {
+	return strings.NewReplacer(searchMarkStart, "<mark>", searchMarkStop, "</mark>").Replace(html.EscapeString(s))
+}
+
+//Search поиск по доступным пользователю аудиозаписям: название, теги файла
+//	(исполнитель, альбом, жанр…), владелец. Метод GET, доступен только для авторизованных
+//Параметры: q — строка поиска, обязательный (синтаксис websearch: "фраза", -исключить, or);
+//	page_no, on_page — как в List; фильтры — как в List (scope, owner, duration_…,
+//	uploaded_…, format)
+//Результат: список, упорядоченный по релевантности; snippet — HTML-фрагмент
+//	(текст экранирован) с найденными словами, выделенными <mark>…</mark>
+//Ошибка: статус NotFound если ничего не найдено
+func (afl *Audiofill) Search(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		pgNo, ln int
+		text     string
+		sqlWhere string
+		sqlParam []interface{}
+		qs       *sql.Rows
+		sLst     tSearchList
+		jsRes    []byte
+	)
+
+	if afl.userID, err = checkSession(afl.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if text = strings.TrimSpace(req.Form.Get("q")); text == "" {
+		fieldError(resp, "q", "required")
+		return
+	}
+	pgNo, ln = getPageno(req)
+
+	if sqlWhere, sqlParam, err = afl.listFilter(req); err != nil {
+		paramError(resp, err)
+		return
+	}
+	sqlParam = append(sqlParam, text)
+	sqlFrom := fmt.Sprintf(`audio a
+		INNER JOIN users own ON (a.id_owner = own.id_user),
+		`+sqlSearchQuery+`
+		WHERE %s
+			AND `+sqlSearchMatch, len(sqlParam), sqlWhere)
+
+	sLst = tSearchList{}
+	err = afl.DB.QueryRow(`SELECT count(*) FROM `+sqlFrom, sqlParam...).Scan(&sLst.Count)
+	if err != nil {
+		dbError(resp, err, "Audio.Search scan count failed:")
+		return
+	}
+
+	qs, err = afl.DB.Query(fmt.Sprintf(`-- найденные записи по убыванию релевантности
+		SELECT a.id_audio,
+			concat(a.description,' (',a.duration,')'),
+			a.id_owner = $1,
+			a.id_owner,
+			coalesce(nullif(own.name,''), own.login),
+			ts_rank_cd(a.search, q.tsq) + word_similarity($%[1]d, a.description) AS rank,
+			ts_headline('russian', translate(concat_ws(' / ', a.description,
+					nullif(a.meta->>'artist', ''), nullif(a.meta->>'title', ''), nullif(a.meta->>'album', '')),
+					chr(1) || chr(2), ''),
+				q.tsq, 'StartSel=' || chr(1) || ', StopSel=' || chr(2) || ', MaxWords=20, MinWords=5')
+		FROM %s
+		ORDER BY rank desc, a.id_audio
+		OFFSET $%[3]d LIMIT $%[4]d`, len(sqlParam), sqlFrom, len(sqlParam)+1, len(sqlParam)+2),
+		append(sqlParam, pgNo*ln, ln)...)
+	if err != nil {
+		dbError(resp, err, "Audio.Search query list failed:")
+		return
+	}
+	defer qs.Close()
+
+	for qs.Next() {
+		hit := &tSearchHit{}
+		err = qs.Scan(&hit.AudioID, &hit.Descr, &hit.IsOwn, &hit.OwnerID, &hit.OwnerName, &hit.Rank, &hit.Snippet)
+		if err != nil {
+			dbError(resp, err, "Audio.Search query scan error:")
+			return
+		}
+		hit.Snippet = searchSnippet(hit.Snippet)
+		sLst.List = append(sLst.List, hit)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Audio.Search query scan error:")
+		return
+	}
+	if len(sLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+
+	jsRes, err = json.Marshal(sLst)
+	if err != nil {
+		internalError(resp, err, "Audio.Search result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAudioSearch(t *testing.T) {
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+	cookGuest := &http.Cookie{Name: "session_id", Value: "0414d6d5d923b0f4998556df2fe2e351"}
+
+	tests := []struct {
+		query   string
+		cook    *http.Cookie
+		status  int
+		err     string
+		ids     []int  //	найденные записи в любом порядке
+		snippet string //	фрагмент первой записи
+	}{
+		{"q=music", nil, http.StatusUnauthorized, "access denied", nil, ""},
+		{"", cookAdmin, http.StatusBadRequest, "q required", nil, ""},
+		{"q=+", cookAdmin, http.StatusBadRequest, "q required", nil, ""},
+		{"q=music", cookGuest, http.StatusNotFound, "no records found", nil, ""},
+		{"q=music&scope=nothing", cookAdmin, http.StatusBadRequest, "invalid scope value", nil, ""},
+		//	приватная запись user не находится для других
+		{"q=music", cookAdmin, http.StatusOK, "", []int{1, 2, 3}, "<mark>music</mark>"},
+		{"q=private", cookAdmin, http.StatusNotFound, "no records found", nil, ""},
+		{"q=private", cookUser, http.StatusOK, "", []int{4}, "<mark>private</mark>"},
+		{"q=music&scope=own", cookUser, http.StatusOK, "", []int{3, 4}, ""},
+		//	стемминг: словоформа из тегов файла, исполнитель из тегов
+		{"q=" + url.QueryEscape("кровь"), cookUser, http.StatusOK, "", []int{3}, "<mark>крови</mark>"},
+		{"q=" + url.QueryEscape("кино"), cookAdmin, http.StatusOK, "", []int{3}, "<mark>Кино</mark>"},
+		{"q=musics", cookAdmin, http.StatusOK, "", []int{1, 2, 3}, ""},
+		//	опечатка — нечеткое совпадение
+		{"q=musik", cookAdmin, http.StatusOK, "", []int{1, 2, 3}, ""},
+		{"q=prvate", cookUser, http.StatusOK, "", []int{4}, ""},
+		//	владелец
+		{"q=lorem", cookAdmin, http.StatusOK, "", []int{3}, ""},
+	}
+	for idx, tst := range tests {
+		var sLst tSearchList
+
+		testName := fmt.Sprintf("Audio.Search: test [%d] %s", idx, tst.query)
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+"/tracks/search?"+tst.query, nil)
+		if tst.cook != nil {
+			req.AddCookie(tst.cook)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s >>> query failed %s", testName, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tst.status {
+			t.Errorf("%s >>> wrong status %d [%s], expected %d", testName, resp.StatusCode, body, tst.status)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			if errMessage(body) != tst.err {
+				t.Errorf("%s >>> wrong body [%s], expected [%s]", testName, body, tst.err)
+			}
+			continue
+		}
+		if err = json.Unmarshal(body, &sLst); err != nil {
+			t.Errorf("%s >>> wrong body [%s] %s", testName, body, err.Error())
+			continue
+		}
+		found := map[int]bool{}
+		for _, hit := range sLst.List {
+			found[hit.AudioID] = true
+		}
+		ok := sLst.Count == len(tst.ids) && len(found) == len(tst.ids)
+		for _, id := range tst.ids {
+			ok = ok && found[id]
+		}
+		if !ok {
+			t.Errorf("%s >>> wrong result [%s], expected %v", testName, body, tst.ids)
+		}
+		if tst.snippet != "" && !strings.Contains(sLst.List[0].Snippet, tst.snippet) {
+			t.Errorf("%s >>> wrong snippet [%s], expected [%s]", testName, sLst.List[0].Snippet, tst.snippet)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	if got := searchSnippet("a <b> & \x01c\x02"); got != "a &lt;b&gt; &amp; <mark>c</mark>" {
+		t.Errorf("searchSnippet: wrong result %s", got)
+	}
+}
+
+func TestAudioSearchMarkup(t *testing.T) {
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	//	разметка в названии трека выводится текстом, логин владельца во фрагмент не попадает
+	testDB.Exec(`UPDATE audio SET description = $1 WHERE id_audio = 2`, "<script>alert(1)</script> \x01song")
+	defer testDB.Exec(`UPDATE audio SET description = 'best music' WHERE id_audio = 2`)
+	st, body := testDo(t, http.MethodGet, "/tracks/search", "q=song", cookAdmin)
+	var sLst tSearchList
+	if st != http.StatusOK || json.Unmarshal(body, &sLst) != nil || len(sLst.List) != 1 {
+		t.Fatalf("Audio.Search: wrong result %d [%s]", st, body)
+	}
+	snippet := sLst.List[0].Snippet
+	if !strings.Contains(snippet, "<mark>song</mark>") || strings.ContainsAny(snippet, "\x01\x02") ||
+		strings.Count(snippet, "<") != 2*strings.Count(snippet, "<mark>") || strings.Contains(snippet, "admin") {
+		t.Errorf("Audio.Search: wrong snippet %s", snippet)
+	}
+}
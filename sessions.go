@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -43,6 +50,56 @@ func checkSession(db *sql.DB, r *http.Request) (userID int, err error) {
 	return
 }
 
+//mediaTokenKey ключ подписи токенов ссылок на файлы треков. Если mediaTokenSecret
+//	не задан, ключ случайный — выданные ссылки перестают работать после перезапуска
+var mediaTokenKey = func() []byte {
+	if mediaTokenSecret != "" {
+		return []byte(mediaTokenSecret)
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+var errBadToken = errors.New("invalid or expired media token")
+
+//mediaTokenSign подпись пользователя, трека и срока действия токена
+func mediaTokenSign(userID, track int, expires int64) string {
+	mac := hmac.New(sha256.New, mediaTokenKey)
+	fmt.Fprintf(mac, "%d:%d:%d", userID, track, expires)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+//mediaToken токен ссылки на файл трека track для пользователя userID, действует
+//	до expires. Позволяет внешним плеерам скачивать файл без куки сессии
+//	(формат: userID.expires.подпись)
+func mediaToken(userID, track int, expires time.Time) string {
+	exp := expires.Unix()
+	return fmt.Sprintf("%d.%d.%s", userID, exp, mediaTokenSign(userID, track, exp))
+}
+
+//checkMediaToken проверка токена ссылки на трек track, возвращает userID, для
+//	которого токен выдан. Доступ к треку проверяется отдельно — отозванный
+//	"шаринг" закрывает и ссылки с токеном
+func checkMediaToken(token string, track int) (userID int, err error) {
+	var exp int64
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errBadToken
+	}
+	if userID, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, errBadToken
+	}
+	if exp, err = strconv.ParseInt(parts[1], 10, 64); err != nil || time.Now().Unix() > exp {
+		return 0, errBadToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(mediaTokenSign(userID, track, exp))) {
+		return 0, errBadToken
+	}
+	return userID, nil
+}
+
 //getPageno получает из параметров запроса номер страницы и кол-во строк на странице
 func getPageno(r *http.Request) (pg, ln int) {
 	var (
@@ -72,9 +129,68 @@ func getPageno(r *http.Request) (pg, ln int) {
 			ln = 10
 		} else if ln <= 0 { // отрицательные значения игнорируем/исправляем
 			ln = 10
+		} else if ln > maxPageSize {
+			ln = maxPageSize
 		}
 	} else {
 		ln = 10
 	}
 	return
 }
+
+//parseTime разбор даты/времени из параметров запроса. Допустимые форматы:
+//	RFC3339 (2006-01-02T15:04:05Z07:00), "2006-01-02 15:04:05" и "2006-01-02",
+//	последние два — в локальной зоне сервера
+func parseTime(s string) (t time.Time, err error) {
+	if t, err = time.Parse(time.RFC3339, s); err == nil {
+		return
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return
+		}
+	}
+	return
+}
+
+//parseSeconds разбор длительности из параметров запроса: целое число секунд
+//	либо [hh:]mm:ss
+func parseSeconds(s string) (secs int, err error) {
+	var v int
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	for _, p := range parts {
+		if v, err = strconv.Atoi(p); err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		secs = secs*60 + v
+	}
+	return secs, nil
+}
+
+//formFlag флаг из параметров запроса: задан без значения либо со значением
+//	true/1/t… (strconv.ParseBool). Нет параметра, false/0 — false
+func formFlag(r *http.Request, name string) bool {
+	val, ok := r.Form[name]
+	if !ok {
+		return false
+	}
+	if val[0] == "" {
+		return true
+	}
+	flag, _ := strconv.ParseBool(val[0])
+	return flag
+}
+
+//likePrefix шаблон LIKE для поиска по началу строки s: спецсимволы % _ \ экранируются
+func likePrefix(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
+
+//fileFormat формат аудиофайла по расширению имени: "mp3", "ogg"…
+func fileFormat(name string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+}
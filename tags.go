@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type tTag struct {
+	TagID   int    `json:"id"`
+	Name    string `json:"name"`
+	IsOwn   bool   `json:"is_owner"`
+	OwnerID int    `json:"owner_id"`
+	Count   int    `json:"track_count,omitempty"`
+}
+
+type tTagList struct {
+	Count int     `json:"total_count"`
+	List  []*tTag `json:"records"`
+}
+
+//Tags класс для таблиц tags/audio_tags: пользовательские метки треков. Метки
+//	ставит владелец трека своими тегами, те, кому трек открыт, видят их без
+//	права изменения
+type Tags struct {
+	DB     *sql.DB
+	userID int
+}
+
+//NewTags создание нового экземпляра класса Tags
+func NewTags(db *sql.DB) *Tags {
+	return &Tags{
+		DB: db,
+	}
+}
+
+//List список тегов, доступных пользователю: собственные и теги других владельцев
+//	на открытых ему треках, сначала собственные. Метод GET, доступен только авторизованным
+//Параметры: owner — необязательный, id владельца тегов
+//Результат: статус ОК, json: количество и список тегов с количеством доступных
+//	пользователю треков
+//Ошибка: статус NotFound если тегов нет
+func (tg *Tags) List(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		owner  int
+		qs     *sql.Rows
+		tagLst tTagList
+	)
+
+	if tg.userID, err = checkSession(tg.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if s := req.Form.Get("owner"); s != "" {
+		if owner, err = strconv.Atoi(s); err != nil {
+			fieldError(resp, "owner", "invalid")
+			return
+		}
+	}
+
+	//	count по доступным трекам: чужой тег виден, пока открыт хоть один трек с ним
+	qs, err = tg.DB.Query(`SELECT t.id_tag, t.name, t.id_owner = $1, t.id_owner, count(a.id_audio)
+		FROM tags t
+		LEFT JOIN audio_tags atg ON (atg.id_tag = t.id_tag)
+		LEFT JOIN audio a ON (a.id_audio = atg.id_audio AND `+sqlAvailable+`)
+		WHERE ($2 = 0 OR t.id_owner = $2)
+		GROUP BY t.id_tag
+		HAVING t.id_owner = $1 OR count(a.id_audio) > 0
+		ORDER BY t.id_owner <> $1, t.id_owner, lower(t.name)`, tg.userID, owner)
+	if err != nil {
+		dbError(resp, err, "Tags.List query failed:")
+		return
+	}
+	defer qs.Close()
+	for qs.Next() {
+		t := &tTag{}
+		if err = qs.Scan(&t.TagID, &t.Name, &t.IsOwn, &t.OwnerID, &t.Count); err != nil {
+			dbError(resp, err, "Tags.List scan error:")
+			return
+		}
+		tagLst.List = append(tagLst.List, t)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Tags.List query iteration error:")
+		return
+	}
+	if len(tagLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+	tagLst.Count = len(tagLst.List)
+
+	jsRes, err := json.Marshal(tagLst)
+	if err != nil {
+		internalError(resp, err, "Tags.List result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Add создание тега. Метод POST, доступен только авторизованным
+//Параметры: name — название, уникальное среди тегов пользователя без учета регистра
+//Результат: статус Created, json: id тега
+//Ошибка: статус Conflict если тег с таким названием уже есть
+func (tg *Tags) Add(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		name string
+		id   int
+	)
+
+	if tg.userID, err = checkSession(tg.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if name = strings.TrimSpace(req.Form.Get("name")); name == "" {
+		fieldError(resp, "name", "required")
+		return
+	}
+
+	err = tg.DB.QueryRow(`INSERT INTO tags (id_owner, name) VALUES ($1, $2) RETURNING id_tag`,
+		tg.userID, name).Scan(&id)
+	if err != nil {
+		dbError(resp, err, "Tags.Add query failed:")
+		return
+	}
+
+	jsRes, _ := json.Marshal(struct {
+		TagID int `json:"id"`
+	}{id})
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(jsRes)
+}
+
+//Update переименование тега. Метод PATCH, доступен только владельцу
+//Параметры: tag — id тега, name — новое название
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если тега нет
+//	статус Conflict если тег с таким названием уже есть
+func (tg *Tags) Update(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		id   int
+		name string
+	)
+
+	if tg.userID, err = checkSession(tg.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("tag")); err != nil {
+		fieldError(resp, "tag", "invalid")
+		return
+	}
+	if name = strings.TrimSpace(req.Form.Get("name")); name == "" {
+		fieldError(resp, "name", "required")
+		return
+	}
+	if !tg.checkOwner(id, resp) {
+		return
+	}
+
+	if _, err = tg.DB.Exec(`UPDATE tags SET name = $2 WHERE id_tag = $1`, id, name); err != nil {
+		dbError(resp, err, "Tags.Update query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Delete удаление тега, метки треков снимаются. Метод DELETE, доступен только владельцу
+//Параметры: tag — id тега
+//Результат: статус ОК
+//Ошибка: статус Forbidden если пользователь не владелец, NotFound если тега нет
+func (tg *Tags) Delete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		id  int
+	)
+
+	if tg.userID, err = checkSession(tg.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("tag")); err != nil {
+		fieldError(resp, "tag", "invalid")
+		return
+	}
+	if !tg.checkOwner(id, resp) {
+		return
+	}
+
+	if _, err = tg.DB.Exec(`DELETE FROM tags WHERE id_tag = $1`, id); err != nil {
+		dbError(resp, err, "Tags.Delete query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Mark пометить трек тегом. Метод PUT, доступен владельцу трека, тег — собственный
+//Параметры: track — id трека, tag — id тега
+//Результат: статус ОК, повторная метка — тоже ОК
+//Ошибка: статус Forbidden если трек или тег чужие, NotFound если их нет
+func (tg *Tags) Mark(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		tr, tag int
+	)
+
+	if tg.userID, err = checkSession(tg.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, tag, err = tg.trackTagParams(req, resp); err != nil {
+		return
+	}
+	afl := &Audiofill{DB: tg.DB, userID: tg.userID}
+	if !afl.checkAudioOwner(tr, resp) || !tg.checkOwner(tag, resp) {
+		return
+	}
+
+	_, err = tg.DB.Exec(`INSERT INTO audio_tags (id_audio, id_tag) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, tr, tag)
+	if err != nil {
+		dbError(resp, err, "Tags.Mark query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Unmark снять тег с трека. Метод DELETE, доступен владельцу трека
+//Параметры: track — id трека, tag — id тега
+//Результат: статус ОК
+//Ошибка: статус NotFound если трек не помечен тегом
+//	статус Forbidden если трек чужой
+func (tg *Tags) Unmark(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		tr, tag int
+		qr      sql.Result
+	)
+
+	if tg.userID, err = checkSession(tg.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if tr, tag, err = tg.trackTagParams(req, resp); err != nil {
+		return
+	}
+	afl := &Audiofill{DB: tg.DB, userID: tg.userID}
+	if !afl.checkAudioOwner(tr, resp) {
+		return
+	}
+
+	qr, err = tg.DB.Exec(`DELETE FROM audio_tags WHERE id_audio = $1 AND id_tag = $2`, tr, tag)
+	if err != nil {
+		dbError(resp, err, "Tags.Unmark query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "no rows are deleted")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//trackTagParams параметры track и tag из пути, ошибка уже отправлена клиенту
+func (tg *Tags) trackTagParams(req *http.Request, resp http.ResponseWriter) (tr, tag int, err error) {
+	if tr, err = strconv.Atoi(req.Form.Get("track")); err != nil {
+		fieldError(resp, "track", "invalid")
+		return
+	}
+	if tag, err = strconv.Atoi(req.Form.Get("tag")); err != nil {
+		fieldError(resp, "tag", "invalid")
+	}
+	return
+}
+
+//checkOwner проверка владельца тега id
+func (tg *Tags) checkOwner(id int, resp http.ResponseWriter) (ok bool) {
+	qr := tg.DB.QueryRow(`SELECT id_owner = $1 FROM tags WHERE id_tag = $2`, tg.userID, id)
+	if err := qr.Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			apiError(resp, http.StatusNotFound, "tag not found")
+		} else {
+			dbError(resp, err, "Tags.checkOwner query failed:")
+		}
+		return false
+	}
+	if !ok {
+		apiError(resp, http.StatusForbidden, "access denied")
+	}
+	return ok
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	var (
+		tagLst tTagList
+		ad     tAudio
+		aLst   tAudioList
+		create struct {
+			TagID int `json:"id"`
+		}
+	)
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+
+	//	listIDs id треков списка /tracks с фильтром
+	listIDs := func(query string, cook *http.Cookie) (ids []int) {
+		aLst = tAudioList{}
+		if _, body := testDo(t, http.MethodGet, "/tracks?"+query, "", cook); json.Unmarshal(body, &aLst) == nil {
+			for _, a := range aLst.List {
+				ids = append(ids, a.AudioID)
+			}
+		}
+		return ids
+	}
+
+	for _, path := range []string{"/tracks/2/tags/1", "/tracks/2/tags/1"} {
+		if st, body := testDo(t, http.MethodPut, path, "", cookAdmin); st != http.StatusOK {
+			t.Fatalf("Tags.Mark: wrong result %d [%s]", st, body)
+		}
+	}
+
+	//	владелец трека пометил его, тот, кому трек открыт, видит тег
+	st, body := testDo(t, http.MethodGet, "/tracks/2", "", cookUser)
+	if json.Unmarshal(body, &ad); st != http.StatusOK || len(ad.Tags) != 1 ||
+		!reflect.DeepEqual(*ad.Tags[0], tTag{TagID: 1, Name: "rock", OwnerID: 1}) || ad.Folder != 0 {
+		t.Errorf("Audio.Detail: wrong tags %d [%s]", st, body)
+	}
+	st, body = testDo(t, http.MethodGet, "/tags", "", cookUser)
+	if json.Unmarshal(body, &tagLst); st != http.StatusOK || tagLst.Count != 2 ||
+		!reflect.DeepEqual(*tagLst.List[0], tTag{TagID: 3, Name: "favorite", IsOwn: true, OwnerID: 2}) ||
+		!reflect.DeepEqual(*tagLst.List[1], tTag{TagID: 1, Name: "rock", OwnerID: 1, Count: 1}) {
+		t.Errorf("Tags.List: wrong result %d [%s]", st, body)
+	}
+	if ids := listIDs("tag=1", cookUser); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("Audio.List: tag filter wrong tracks %v", ids)
+	}
+
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodGet, "/tags?owner=x", "", cookUser, http.StatusBadRequest, "invalid owner value"},
+		{http.MethodGet, "/tracks?tag=1,x", "", cookUser, http.StatusBadRequest, "invalid tag value"},
+		{http.MethodPost, "/tags", "name=+", cookAdmin, http.StatusBadRequest, "name required"},
+		{http.MethodPost, "/tags", "name=ROCK", cookAdmin, http.StatusConflict, "name already used"},
+		{http.MethodPatch, "/tags/2", "name=Rock", cookAdmin, http.StatusConflict, "name already used"},
+		{http.MethodPatch, "/tags/1", "name=mine", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodDelete, "/tags/99", "", cookUser, http.StatusNotFound, "tag not found"},
+		{http.MethodPut, "/tracks/2/tags/3", "", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodPut, "/tracks/3/tags/1", "", cookUser, http.StatusForbidden, "access denied"},
+		{http.MethodPut, "/tracks/2/tags/99", "", cookAdmin, http.StatusNotFound, "tag not found"},
+		{http.MethodDelete, "/tracks/2/tags/2", "", cookAdmin, http.StatusNotFound, "no rows are deleted"},
+		{http.MethodDelete, "/tracks/2/tags/1", "", cookUser, http.StatusForbidden, "access denied"},
+	}
+	for idx, tst := range tests {
+		if st, body = testDo(t, tst.method, tst.path, tst.body, tst.cook); st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Tags: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+
+	//	фильтр по нескольким тегам — нужны все
+	st, body = testDo(t, http.MethodPost, "/tags", "name=temp", cookAdmin)
+	if st != http.StatusCreated || json.Unmarshal(body, &create) != nil {
+		t.Fatalf("Tags.Add: wrong result %d [%s]", st, body)
+	}
+	tagPath := fmt.Sprintf("/tags/%d", create.TagID)
+	testDo(t, http.MethodPut, "/tracks/1"+tagPath, "", cookAdmin)
+	testDo(t, http.MethodPut, "/tracks/1/tags/1", "", cookAdmin)
+	if ids := listIDs(fmt.Sprintf("scope=own&tag=1,%d", create.TagID), cookAdmin); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("Audio.List: tags filter wrong tracks %v", ids)
+	}
+	if st, _ = testDo(t, http.MethodDelete, tagPath, "", cookAdmin); st != http.StatusOK {
+		t.Errorf("Tags.Delete: wrong status %d", st)
+	}
+	for _, path := range []string{"/tracks/1/tags/1", "/tracks/2/tags/1"} {
+		if st, _ = testDo(t, http.MethodDelete, path, "", cookAdmin); st != http.StatusOK {
+			t.Errorf("Tags.Unmark: %s wrong status %d", path, st)
+		}
+	}
+	ad = tAudio{}
+	if _, body = testDo(t, http.MethodGet, "/tracks/1", "", cookAdmin); json.Unmarshal(body, &ad) != nil || ad.Tags != nil {
+		t.Errorf("Tags: tags left on track [%s]", body)
+	}
+}
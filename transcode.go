@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//renditionDir каталог перекодированных копий треков в mediaDir
+const renditionDir = "renditions"
+
+//tTranscodeFormat формат перекодирования: кодек и контейнер ffmpeg, расширение
+//	файла копии и Content-Type при выдаче. Lossless — без битрейта
+type tTranscodeFormat struct {
+	Codec    string
+	Mux      string
+	Ext      string
+	Type     string
+	Lossless bool
+}
+
+//transcodeFormats форматы, в которые можно перекодировать трек (параметр format)
+var transcodeFormats = map[string]tTranscodeFormat{
+	"mp3":  {"libmp3lame", "mp3", "mp3", "audio/mpeg", false},
+	"aac":  {"aac", "adts", "aac", "audio/aac", false},
+	"ogg":  {"libvorbis", "ogg", "ogg", "audio/ogg", false},
+	"opus": {"libopus", "ogg", "opus", "audio/ogg; codecs=opus", false},
+	"wav":  {"pcm_s16le", "wav", "wav", "audio/wav", true},
+}
+
+//tRendition профиль перекодированной копии: формат из transcodeFormats и битрейт,
+//	кбит/с (0 — для форматов без потерь)
+type tRendition struct {
+	Format  string
+	Bitrate int
+}
+
+//key часть имени файла копии, по которой она находится в кэше
+func (p tRendition) key() string {
+	return p.Format + "-" + strconv.Itoa(p.Bitrate)
+}
+
+//Transcoder перекодирование файла src в dst по профилю. dst перезаписывается,
+//	при ошибке его содержимое не определено
+type Transcoder interface {
+	Transcode(ctx context.Context, src, dst string, p tRendition) error
+}
+
+//ffmpegTranscoder перекодирование внешней программой ffmpeg. Bin — путь к ней
+type ffmpegTranscoder struct {
+	Bin string
+}
+
+//Transcode запуск ffmpeg, ошибка содержит его сообщения (stderr)
+func (ff *ffmpegTranscoder) Transcode(ctx context.Context, src, dst string, p tRendition) error {
+	var stderr bytes.Buffer
+
+	f, ok := transcodeFormats[p.Format]
+	if !ok {
+		return fmt.Errorf("unknown format %s", p.Format)
+	}
+	args := []string{"-nostdin", "-v", "error", "-y", "-i", src, "-vn", "-map_metadata", "0", "-c:a", f.Codec}
+	if p.Bitrate > 0 {
+		args = append(args, "-b:a", strconv.Itoa(p.Bitrate)+"k")
+	}
+	cmd := exec.CommandContext(ctx, ff.Bin, append(args, "-f", f.Mux, dst)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+//transcoder текущая реализация перекодирования
+var transcoder Transcoder = &ffmpegTranscoder{Bin: ffmpegPath}
+
+//errTranscodeBusy все слоты перекодирования заняты дольше transcodeWait
+var errTranscodeBusy = errors.New("transcoder busy")
+
+//transcodeSlots не больше transcodeMax одновременных перекодирований
+var transcodeSlots = make(chan struct{}, transcodeMax)
+
+//renditionPath путь к копии файла трека fileName по профилю
+func renditionPath(fileName string, p tRendition) string {
+	return path.Join(mediaDir, renditionDir, fileName+"."+p.key()+"."+transcodeFormats[p.Format].Ext)
+}
+
+//rendition копия файла трека по профилю: из кэша, либо перекодированная. Само
+//	перекодирование не прерывается, если клиент ушел (ctx) — копия пригодится
+//	следующему запросу, его ограничивает transcodeTimeout
+//Результат: путь к файлу копии
+func rendition(ctx context.Context, fileName string, p tRendition) (dst string, err error) {
+	dst = renditionPath(fileName, p)
+	if _, err = os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	job := startJob(dst, func() error {
+		return runTranscode(path.Join(mediaDir, fileName), dst, p)
+	})
+	select {
+	case <-job.done:
+		return dst, job.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+//runTranscode перекодирование во временный файл и переименование в dst, чтобы
+//	незаконченная копия не попала в кэш
+func runTranscode(src, dst string, p tRendition) (err error) {
+	select {
+	case transcodeSlots <- struct{}{}:
+		defer func() { <-transcodeSlots }()
+	case <-time.After(transcodeWait):
+		return errTranscodeBusy
+	}
+
+	if err = os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(dst), "tmp-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	if err = transcoder.Transcode(ctx, src, tmp.Name(), p); err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//transcodeProfile профиль перекодирования из параметров format и bitrate (кбит/с,
+//	default — transcodeBitrate, для wav не учитывается). Без format — nil: выдается
+//	исходный файл
+func transcodeProfile(req *http.Request) (p *tRendition, err error) {
+	format := strings.ToLower(req.Form.Get("format"))
+	if format == "" {
+		if req.Form.Get("bitrate") != "" {
+			return nil, &tFieldError{Field: "format", Reason: "required"}
+		}
+		return nil, nil
+	}
+	f, ok := transcodeFormats[format]
+	if !ok {
+		return nil, &tFieldError{Field: "format", Reason: "invalid"}
+	}
+
+	p = &tRendition{Format: format, Bitrate: transcodeBitrate}
+	if f.Lossless {
+		p.Bitrate = 0
+	} else if s := req.Form.Get("bitrate"); s != "" {
+		if p.Bitrate, err = strconv.Atoi(s); err != nil || p.Bitrate < 32 || p.Bitrate > 320 {
+			return nil, &tFieldError{Field: "bitrate", Reason: "invalid"}
+		}
+	}
+	return p, nil
+}
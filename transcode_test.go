@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//testFakeFFmpeg скрипт вместо ffmpeg: копирует входной файл в выходной (последний
+//	аргумент), пишет в log начало и конец работы. Битрейт 64k — ошибка
+func testFakeFFmpeg(t *testing.T) (bin, log string) {
+	dir := t.TempDir()
+	bin, log = filepath.Join(dir, "ffmpeg"), filepath.Join(dir, "ffmpeg.log")
+	script := `#!/bin/sh
+while [ $# -gt 1 ]; do
+	[ "$1" = "-i" ] && src=$2
+	[ "$1" = "-b:a" ] && br=$2
+	shift
+done
+echo "start $br" >> ` + log + `
+sleep 0.2
+echo "end $br" >> ` + log + `
+if [ "$br" = "64k" ]; then echo "bad bitrate" >&2; exit 1; fi
+cp "$src" "$1"
+`
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("Transcode: fake ffmpeg failed %s", err.Error())
+	}
+	return bin, log
+}
+
+func TestTranscode(t *testing.T) {
+	bin, log := testFakeFFmpeg(t)
+	saved := transcoder
+	transcoder = &ffmpegTranscoder{Bin: bin}
+	defer func() { transcoder = saved }()
+
+	if _, err := os.Stat(mediaDir); os.IsNotExist(err) {
+		os.Mkdir(mediaDir, 0755)
+		defer os.RemoveAll(mediaDir)
+	}
+	src := "transcode-test"
+	if err := ioutil.WriteFile(path.Join(mediaDir, src), []byte("source audio"), 0644); err != nil {
+		t.Fatalf("Transcode: source file failed %s", err.Error())
+	}
+	defer removeMedia(src)
+
+	//	одновременные запросы одной копии — одно перекодирование
+	prof := tRendition{Format: "mp3", Bitrate: 128}
+	var wg sync.WaitGroup
+	res := make([]string, 3)
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dst, err := rendition(context.Background(), src, prof)
+			if err != nil {
+				t.Errorf("rendition: failed %s", err.Error())
+			}
+			res[i] = dst
+		}(i)
+	}
+	wg.Wait()
+	rendition(context.Background(), src, prof)
+	if data, _ := ioutil.ReadFile(res[0]); string(data) != "source audio" || res[1] != res[0] || res[2] != res[0] {
+		t.Errorf("rendition: wrong copy %v [%s]", res, data)
+	}
+	if data, _ := ioutil.ReadFile(log); string(data) != "start 128k\nend 128k\n" {
+		t.Errorf("rendition: wrong transcoder runs [%s]", data)
+	}
+
+	//	ошибка ffmpeg с его сообщением, копия не сохраняется
+	bad := tRendition{Format: "ogg", Bitrate: 64}
+	if _, err := rendition(context.Background(), src, bad); err == nil || !strings.Contains(err.Error(), "bad bitrate") {
+		t.Errorf("rendition: wrong error %v", err)
+	}
+	if _, err := os.Stat(renditionPath(src, bad)); !os.IsNotExist(err) {
+		t.Errorf("rendition: failed copy left in cache")
+	}
+
+	//	не больше transcodeMax перекодирований одновременно
+	os.Remove(log)
+	for _, br := range []int{96, 160, 192, 256} {
+		wg.Add(1)
+		go func(br int) {
+			defer wg.Done()
+			rendition(context.Background(), src, tRendition{Format: "opus", Bitrate: br})
+		}(br)
+	}
+	wg.Wait()
+	data, _ := ioutil.ReadFile(log)
+	running, peak := 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "start") {
+			running++
+		} else {
+			running--
+		}
+		if running > peak {
+			peak = running
+		}
+	}
+	if peak != transcodeMax {
+		t.Errorf("rendition: %d transcodes at once, expected %d [%s]", peak, transcodeMax, data)
+	}
+
+	removeMedia(src)
+	if copies, _ := filepath.Glob(path.Join(mediaDir, renditionDir, src+".*")); copies != nil {
+		t.Errorf("removeMedia: copies left %v", copies)
+	}
+}
+
+func TestTranscodeProfile(t *testing.T) {
+	tests := []struct {
+		query string
+		res   *tRendition
+		err   error
+	}{
+		{"", nil, nil},
+		{"format=MP3", &tRendition{"mp3", transcodeBitrate}, nil},
+		{"format=opus&bitrate=96", &tRendition{"opus", 96}, nil},
+		{"format=wav&bitrate=96", &tRendition{"wav", 0}, nil},
+		{"format=flac", nil, &tFieldError{Field: "format", Reason: "invalid"}},
+		{"format=aac&bitrate=1000", nil, &tFieldError{Field: "bitrate", Reason: "invalid"}},
+		{"bitrate=128", nil, &tFieldError{Field: "format", Reason: "required"}},
+	}
+	for idx, tst := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/tracks/1/file?"+tst.query, nil)
+		req.ParseForm()
+		if res, err := transcodeProfile(req); !reflect.DeepEqual(res, tst.res) || !reflect.DeepEqual(err, tst.err) {
+			t.Errorf("transcodeProfile: test [%d] wrong result %v %v", idx, res, err)
+		}
+	}
+}
@@ -6,27 +6,57 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 )
 
 type tUser struct {
 	UserID int    `json:"id"`
 	Name   string `json:"name"`
-	Login  string `json:"login,omitempty"`
 	Shared int    `json:"shared_records,omitempty"`
 }
 
 type tUsrList struct {
 	Count int      `json:"total_count,omitempty"`
 	List  []*tUser `json:"users"`
+	Next  string   `json:"next,omitempty"`
+	Prev  string   `json:"prev,omitempty"`
+}
+
+//sqlUserName отображаемое имя пользователя u для других пользователей: имя, без
+//	имени — нейтральная заглушка "user N". Логин не раскрывается — это половина
+//	учетных данных
+func sqlUserName(u string) string {
+	return fmt.Sprintf(`coalesce(nullif(%[1]s.name, ''), 'user ' || %[1]s.id_user)`, u)
+}
+
+//usrSortKeys ключи сортировки списков пользователей (курсор), id — колонка запроса
+func usrSortKeys(id string) []tSortKey {
+	return []tSortKey{{Col: id, Type: "int"}}
+}
+
+//page ссылки на соседние страницы списка пользователей, выбранного с запасом
+//	в одну запись. Записи, выбранные в обратном порядке, возвращаются в прямой
+func (uLst *tUsrList) page(req *http.Request, pg *tPage) {
+	more := len(uLst.List) > pg.Limit
+	if more {
+		uLst.List = uLst.List[:pg.Limit]
+	}
+	if pg.isPrev() {
+		for i, j := 0, len(uLst.List)-1; i < j; i, j = i+1, j-1 {
+			uLst.List[i], uLst.List[j] = uLst.List[j], uLst.List[i]
+		}
+	}
+	first := []interface{}{uLst.List[0].UserID}
+	last := []interface{}{uLst.List[len(uLst.List)-1].UserID}
+	uLst.Next, uLst.Prev = pg.links(req, first, last, more)
 }
 
 //Users класс для обслуживания запросов к таблице "users":
-//	добавление нового (регистрация), проверка логина/пароля, список
+//	добавление нового (регистрация), проверка логина/пароля, список и поиск, профили
 type Users struct {
 	DB     *sql.DB `json:"-"`
 	userID int
@@ -40,11 +70,12 @@ func NewUsers(db *sql.DB) *Users {
 }
 
 //Registration регистрация нового пользователя в системе. Метод PUT
-//Параметры: login, passwd обязательные, name. Login должен быть уникальным
+//Параметры: login, passwd обязательные, name, email. Login должен быть уникальным
+//	email используется для доставки уведомлений (см. emailChannel)
 //Результат: статус "Created", назначенный id новому пользователю {"id":<ddd>, }
 //Ошибка: статус "MethodNotAllowed" если метод не PUT
-//	статус "BadRequest" если отсутствуют обязательные параметры или логин занят,
-//	статус "InternalServerError" в остальных случаях
+//	статус "BadRequest" если отсутствуют обязательные параметры,
+//	статус "Conflict" если логин занят, "InternalServerError" в остальных случаях
 func (usr *Users) Registration(resp http.ResponseWriter, req *http.Request) {
 	var (
 		sqlQuery string        //	текст запроса
@@ -56,31 +87,25 @@ func (usr *Users) Registration(resp http.ResponseWriter, req *http.Request) {
 		userID   int
 	)
 
-	resp.Header().Set("Content-Type", "text/plain")
-	if req.Method != http.MethodPut {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
-
 	err = req.ParseForm()
 	if err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
 
-	sqlQuery = `INSERT INTO users (login, password, name) 
+	sqlQuery = `INSERT INTO users (login, password, name, email) 
 		VALUES ($1, md5($2),`
 
 	frmVal, isSet = req.Form["login"]
 	if !isSet {
-		http.Error(resp, "login required", http.StatusBadRequest)
+		fieldError(resp, "login", "required")
 		return
 	}
 	sqlParam = append(sqlParam, frmVal[0])
 
 	frmVal, isSet = req.Form["passwd"]
 	if !isSet {
-		http.Error(resp, "password required", http.StatusBadRequest)
+		fieldError(resp, "passwd", "required")
 		return
 	}
 	sqlParam = append(sqlParam, frmVal[0])
@@ -93,25 +118,20 @@ func (usr *Users) Registration(resp http.ResponseWriter, req *http.Request) {
 		sqlQuery += "default,"
 	}
 
+	frmVal, isSet = req.Form["email"]
+	if isSet {
+		sqlParam = append(sqlParam, frmVal[0])
+		sqlQuery += fmt.Sprintf("$%d,", len(sqlParam))
+	} else {
+		sqlQuery += "default,"
+	}
+
 	sqlQuery = strings.TrimRight(sqlQuery, ",") + ") RETURNING id_user"
 
 	qr = usr.DB.QueryRow(sqlQuery, sqlParam...)
 	err = qr.Scan(&userID)
 	if err != nil {
-		if pgErr, ok := err.(*pq.Error); ok {
-			switch pgErr.Code {
-			case "23505": // unique constraint violation
-				http.Error(resp, "login already used", http.StatusBadRequest)
-				log.Println("Users.Registration query failed:", pgErr.Message, pgErr.Detail)
-			default:
-				http.Error(resp, pgErr.Message, http.StatusBadRequest)
-				log.Println("Users.Registration query failed:", pgErr.Message, pgErr.Detail)
-			}
-
-		} else {
-			http.Error(resp, "internal error", http.StatusInternalServerError)
-			log.Println("Users.Registration query failed:", err.Error())
-		}
+		dbError(resp, err, "Users.Registration query failed:")
 		return
 	}
 
@@ -135,28 +155,22 @@ func (usr *Users) Login(resp http.ResponseWriter, req *http.Request) {
 		userID   int
 	)
 
-	resp.Header().Set("Content-Type", "text/plain")
-	if req.Method != http.MethodPost {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
-
 	err = req.ParseForm()
 	if err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
 		return
 	}
 
 	frmVal, isSet = req.Form["login"]
 	if !isSet {
-		http.Error(resp, "login required", http.StatusBadRequest)
+		fieldError(resp, "login", "required")
 		return
 	}
 	sqlParam = append(sqlParam, frmVal[0])
 
 	frmVal, isSet = req.Form["passwd"]
 	if !isSet {
-		http.Error(resp, "password required", http.StatusBadRequest)
+		fieldError(resp, "passwd", "required")
 		return
 	}
 	sqlParam = append(sqlParam, frmVal[0])
@@ -167,18 +181,16 @@ func (usr *Users) Login(resp http.ResponseWriter, req *http.Request) {
 	err = qr.Scan(&userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(resp, "wrong login or password", http.StatusNotFound)
+			apiError(resp, http.StatusNotFound, "wrong login or password")
 		} else {
-			http.Error(resp, "internal error", http.StatusInternalServerError)
-			log.Println("Users.Login query failed:", err.Error())
+			dbError(resp, err, "Users.Login query failed:")
 		}
 		return
 	}
 
 	sessID, err := newSession(usr.DB, userID)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		log.Println("Users.Login make session failed:", err.Error())
+		dbError(resp, err, "Users.Login make session failed:")
 		return
 	}
 
@@ -207,65 +219,72 @@ func (usr *Users) Logout(resp http.ResponseWriter, req *http.Request) {
 	http.SetCookie(resp, sessCook)
 
 	if err != nil { //	сессия была, но userID прочитать не удалось?
-		http.Error(resp, "internal error", http.StatusInternalServerError)
+		internalError(resp, err, "Users.Logout check session failed:")
 		return
 	}
 
 	//	есть сессия, есть userID: правим в базе
 	_, err = usr.DB.Exec("DELETE FROM sessions WHERE id_user = $1", usr.userID)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
+		dbError(resp, err, "Users.Logout query failed:")
 		return
 	}
 	resp.WriteHeader(http.StatusOK)
 }
 
-//List список зарегистрированных в системе пользователей. Метод GET,
+//List список (поиск) зарегистрированных в системе пользователей. Пользователи,
+//	скрывшие себя настройкой searchable, в список не попадают. Метод GET,
 //	доступен для авторизованных пользователей
-//Параметры: page_no — номер страницы, on_page — кол-во записей на странице
-//	необязательные, по умолчанию 1 и 10 соответственно
-//Результат: статус ОК, json список пользователей
+//Параметры: q — необязательный, начало логина или любого слова имени, без учета регистра
+//	page_no — номер страницы, on_page — кол-во записей на странице
+//	необязательные, по умолчанию 1 и 10 соответственно; cursor — вместо page_no,
+//	из ссылок next/prev предыдущего ответа
+//Результат: статус ОК, json список пользователей: id и имя, логин — только в своем профиле (Me)
 //Ошибка: статус MethodNotAllowed если метод не равен GET
 //	статус Unauthorized если пользователь не авторизован
 //	статус BadRequest, InternalServerError при прочих ошибках
 func (usr *Users) List(resp http.ResponseWriter, req *http.Request) {
 	var (
-		pg, ln int // номер страницы и кол-во строк ("длина" страницы)
-		qr     *sql.Rows
-		err    error
-		u      *tUser
-		uLst   tUsrList
-		jsRes  []byte
+		pg    *tPage
+		qr    *sql.Rows
+		err   error
+		u     *tUser
+		uLst  tUsrList
+		jsRes []byte
 	)
 
-	if req.Method != http.MethodGet {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
-
 	usr.userID, err = checkSession(usr.DB, req)
 	if err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+		apiError(resp, http.StatusUnauthorized, "access denied")
 		return
 	}
 
 	err = req.ParseForm()
 	if err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	keys := usrSortKeys("id_user")
+	if pg, err = getPage(req, "id", keys); err != nil {
+		paramError(resp, err)
 		return
 	}
-	pg, ln = getPageno(req)
 
-	qr, err = usr.DB.Query(`SELECT id_user, login, name 
-		FROM users ORDER BY id_user
-		OFFSET $1 LIMIT $2`, pg*ln, ln)
+	sqlParam := []interface{}{pg.Offset, pg.Limit + 1, usr.userID}
+	sqlWhere := "(searchable OR id_user = $3)"
+	if q := strings.TrimSpace(req.Form.Get("q")); q != "" {
+		sqlParam = append(sqlParam, likePrefix(strings.ToLower(q)))
+		sqlWhere += fmt.Sprintf(` AND (lower(login) LIKE $%[1]d
+			OR lower(name) LIKE $%[1]d OR lower(name) LIKE '%% ' || $%[1]d)`, len(sqlParam))
+	}
+	sqlWhere += " AND " + pg.where(keys, &sqlParam)
+	qr, err = usr.DB.Query(`SELECT id_user, name
+		FROM users
+		WHERE `+sqlWhere+`
+		ORDER BY `+pg.order(keys)+`
+		OFFSET $1 LIMIT $2`, sqlParam...)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		if pgErr, ok := err.(*pq.Error); ok {
-			log.Println("Users.List query failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			log.Println("Users.List query failed:", err.Error())
-		}
+		dbError(resp, err, "Users.List query failed:")
 		return
 	}
 	defer qr.Close()
@@ -275,7 +294,7 @@ func (usr *Users) List(resp http.ResponseWriter, req *http.Request) {
 	if qr.Next() {
 		for {
 			u = &tUser{}
-			err = qr.Scan(&u.UserID, &u.Login, &u.Name)
+			err = qr.Scan(&u.UserID, &u.Name)
 			if err != nil {
 				log.Println("Users.List query iteration error:", err.Error())
 				continue
@@ -286,19 +305,20 @@ func (usr *Users) List(resp http.ResponseWriter, req *http.Request) {
 			}
 		}
 	} else {
-		http.Error(resp, "", http.StatusNotFound)
+		apiError(resp, http.StatusNotFound, "no records found")
 		return
 	}
-	if qr.Err() != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		log.Println("Users.List query iteration error:", err.Error())
+	if err = qr.Err(); err != nil {
+		dbError(resp, err, "Users.List query iteration error:")
 		return
 	}
 
+	uLst.page(req, pg)
+	setLinks(resp, uLst.Next, uLst.Prev)
+
 	jsRes, err = json.Marshal(uLst)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		log.Println("Users.List result marshaling error:", err.Error())
+		internalError(resp, err, "Users.List result marshaling error:")
 		return
 	}
 
@@ -309,37 +329,38 @@ func (usr *Users) List(resp http.ResponseWriter, req *http.Request) {
 //Share список пользователей, имеющих "расшаренные" треки с количеством таких треков
 //	Метод GET, доступен только для авторизованных пользователей
 //Параметры: page_no — номер страницы, on_page — кол-во записей на странице
-//	необязательные, по умолчанию 1 и 10 соответственно
+//	необязательные, по умолчанию 1 и 10 соответственно; cursor — вместо page_no,
+//	из ссылок next/prev предыдущего ответа
 //Результат: статус ОК, json список пользователей
 //Ошибка: статус MethodNotAllowed если метод не равен GET
 //	статус Unauthorized если пользователь не авторизован
 //	статус BadRequest, InternalServerError при прочих ошибках
 func (usr *Users) Share(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err    error
-		pg, ln int
-		qr     *sql.Row
-		qs     *sql.Rows
-		u      *tUser
-		uLst   tUsrList
+		err  error
+		pg   *tPage
+		qr   *sql.Row
+		qs   *sql.Rows
+		u    *tUser
+		uLst tUsrList
 	)
-	if req.Method != http.MethodGet {
-		http.Error(resp, "bad method", http.StatusMethodNotAllowed)
-		return
-	}
 
 	usr.userID, err = checkSession(usr.DB, req)
 	if err != nil {
-		http.Error(resp, "access denied", http.StatusUnauthorized)
+		apiError(resp, http.StatusUnauthorized, "access denied")
 		return
 	}
 
 	err = req.ParseForm()
 	if err != nil {
-		http.Error(resp, "wrong form data", http.StatusBadRequest)
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	keys := usrSortKeys("a.id_owner")
+	if pg, err = getPage(req, "id", keys); err != nil {
+		paramError(resp, err)
 		return
 	}
-	pg, ln = getPageno(req)
 
 	uLst = tUsrList{}
 	//	список и общее количество расшаривших пользователей можно бы подсчитать
@@ -349,43 +370,36 @@ func (usr *Users) Share(resp http.ResponseWriter, req *http.Request) {
 	//	(т.к.: cannot insert multiple commands into a prepared statement)
 	qr = usr.DB.QueryRow(`-- общее количество пользователей, расшаривших треки
 		SELECT count(distinct id_owner)
-		FROM audio
-		WHERE id_audio in (SELECT distinct id_audio FROM share)`)
+		FROM audio a
+		WHERE exists(SELECT id_audio FROM share s WHERE s.id_audio = a.id_audio AND ` + sqlShareActive + `)`)
 
 	err = qr.Scan(&uLst.Count)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		if pgErr, ok := err.(*pq.Error); ok {
-			log.Println("Users.Share scan count failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			log.Println("Users.Share scan count failed:", err.Error())
-		}
+		dbError(resp, err, "Users.Share scan count failed:")
 		return
 	}
 
+	sqlParam := []interface{}{pg.Offset, pg.Limit + 1}
+	sqlWhere := pg.where(keys, &sqlParam)
 	qs, err = usr.DB.Query(`-- список пользователей
-		SELECT a.id_owner, coalesce(nullif(u.name,''),u.login) as name, count(id_audio)
+		SELECT a.id_owner, `+sqlUserName("u")+` as name, count(id_audio)
 		FROM audio a
 		INNER JOIN users u on (a.id_owner  = u.id_user)
-		WHERE exists(SELECT id_audio from share s where s.id_audio = a.id_audio)
-		GROUP BY id_owner, coalesce(nullif(u.name,''),u.login)
-		ORDER BY id_owner
-		OFFSET $1 LIMIT $2`, pg*ln, ln)
+		WHERE exists(SELECT id_audio FROM share s WHERE s.id_audio = a.id_audio AND `+sqlShareActive+`)
+			AND `+sqlWhere+`
+		GROUP BY id_owner, u.id_user
+		ORDER BY `+pg.order(keys)+`
+		OFFSET $1 LIMIT $2`, sqlParam...)
 
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		if pgErr, ok := err.(*pq.Error); ok {
-			log.Println("Users.Share query list failed:", pgErr.Message, pgErr.Detail)
-		} else {
-			log.Println("Users.Share query list failed:", err.Error())
-		}
+		dbError(resp, err, "Users.Share query list failed:")
 		return
 	}
 	defer qs.Close()
 
 	//	sql.Rows в случае пустого списка не генерит ошибку ErrNoRows, проверяем сами
 	if !qs.Next() {
-		http.Error(resp, "", http.StatusNotFound)
+		apiError(resp, http.StatusNotFound, "no records found")
 		return
 	}
 	for {
@@ -400,19 +414,176 @@ func (usr *Users) Share(resp http.ResponseWriter, req *http.Request) {
 			break
 		}
 	}
-	if qs.Err() != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		log.Println("Users.Share query iteration error:", err.Error())
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Users.Share query iteration error:")
 		return
 	}
 
+	uLst.page(req, pg)
+	setLinks(resp, uLst.Next, uLst.Prev)
+
 	jsRes, err := json.Marshal(uLst)
 	if err != nil {
-		http.Error(resp, "internal error", http.StatusInternalServerError)
-		log.Println("Users.Share result marshaling error:", err.Error())
+		internalError(resp, err, "Users.Share result marshaling error:")
 		return
 	}
 
 	resp.WriteHeader(http.StatusOK)
 	resp.Write(jsRes)
 }
+
+//tProfile профиль пользователя. Login, Email и Searchable — только в своем профиле (/me)
+type tProfile struct {
+	UserID     int    `json:"id"`
+	Name       string `json:"name"`
+	Tracks     int    `json:"tracks"`
+	Login      string `json:"login,omitempty"`
+	Email      string `json:"email,omitempty"`
+	Searchable *bool  `json:"searchable,omitempty"`
+}
+
+//loadProfile профиль пользователя id, каким его видит текущий пользователь:
+//	Tracks — количество записей id, доступных текущему (для себя — все свои)
+func (usr *Users) loadProfile(id int) (prof *tProfile, err error) {
+	var (
+		login, email string
+		searchable   bool
+	)
+
+	prof = &tProfile{}
+	err = usr.DB.QueryRow(`SELECT u.id_user, `+sqlUserName("u")+`,
+			(SELECT count(*) FROM audio a WHERE a.id_owner = u.id_user AND `+sqlAvailable+`),
+			u.login, u.email, u.searchable
+		FROM users u
+		WHERE u.id_user = $2`, usr.userID, id).Scan(&prof.UserID, &prof.Name, &prof.Tracks, &login, &email, &searchable)
+	if err != nil {
+		return nil, err
+	}
+	if id == usr.userID {
+		prof.Login, prof.Email, prof.Searchable = login, email, &searchable
+	}
+	return prof, nil
+}
+
+//Profile профиль пользователя: отображаемое имя и количество его записей, доступных
+//	запрашивающему. Метод GET, доступен только для авторизованных
+//Параметры: user — id пользователя
+//Результат: статус ОК, json профиля
+//Ошибка: статус NotFound если пользователя нет
+func (usr *Users) Profile(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		id   int
+		prof *tProfile
+	)
+
+	if usr.userID, err = checkSession(usr.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = strconv.Atoi(req.Form.Get("user")); err != nil {
+		fieldError(resp, "user", "invalid")
+		return
+	}
+
+	if prof, err = usr.loadProfile(id); err != nil {
+		if err == sql.ErrNoRows {
+			apiError(resp, http.StatusNotFound, "user not found")
+		} else {
+			dbError(resp, err, "Users.Profile query failed:")
+		}
+		return
+	}
+
+	jsRes, err := json.Marshal(prof)
+	if err != nil {
+		internalError(resp, err, "Users.Profile result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Me собственный профиль пользователя вместе с логином, email и настройками
+//	приватности. Метод GET, доступен только для авторизованных
+//Результат: статус ОК, json профиля
+func (usr *Users) Me(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		prof *tProfile
+	)
+
+	if usr.userID, err = checkSession(usr.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if prof, err = usr.loadProfile(usr.userID); err != nil {
+		dbError(resp, err, "Users.Me query failed:")
+		return
+	}
+
+	jsRes, err := json.Marshal(prof)
+	if err != nil {
+		internalError(resp, err, "Users.Me result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//UpdateMe изменение собственного профиля. Метод PATCH, доступен только для авторизованных
+//Параметры: name, email, searchable (true|false — виден ли пользователь в списке
+//	и поиске пользователей) — необязательные, но хотя бы один должен быть
+//Результат: статус ОК
+//Ошибка: статус BadRequest при неверных параметрах
+func (usr *Users) UpdateMe(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		frmVal   []string
+		isSet    bool
+		flag     bool
+		sqlQuery string
+		sqlParam []interface{}
+	)
+
+	if usr.userID, err = checkSession(usr.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+
+	sqlParam = append(sqlParam, usr.userID)
+	for _, col := range []string{"name", "email"} {
+		if frmVal, isSet = req.Form[col]; isSet {
+			sqlParam = append(sqlParam, strings.TrimSpace(frmVal[0]))
+			sqlQuery += fmt.Sprintf("%s = $%d,", col, len(sqlParam))
+		}
+	}
+	if frmVal, isSet = req.Form["searchable"]; isSet {
+		if flag, err = strconv.ParseBool(frmVal[0]); err != nil {
+			fieldError(resp, "searchable", "invalid")
+			return
+		}
+		sqlParam = append(sqlParam, flag)
+		sqlQuery += fmt.Sprintf("searchable = $%d,", len(sqlParam))
+	}
+	if sqlQuery == "" {
+		apiError(resp, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	_, err = usr.DB.Exec(`UPDATE users SET `+strings.TrimRight(sqlQuery, ",")+`
+		WHERE id_user = $1`, sqlParam...)
+	if err != nil {
+		dbError(resp, err, "Users.UpdateMe query failed:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
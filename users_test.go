@@ -27,12 +27,13 @@ type testUser struct {
 var (
 	testSrv *httptest.Server
 	junkSrv *httptest.Server
+	testDB  *sql.DB
 )
 
 func (usr tUsrList) String() (s string) {
 	s = fmt.Sprintf("Count: %d,\nList: [\n", usr.Count)
 	for _, v := range usr.List {
-		s += fmt.Sprintf("\t{UserID: %d,\tName: %s,\tLogin: %s,\tShared: %d},\n", v.UserID, v.Name, v.Login, v.Shared)
+		s += fmt.Sprintf("\t{UserID: %d,\tName: %s,\tShared: %d},\n", v.UserID, v.Name, v.Shared)
 	}
 	s += "]\n"
 	return s
@@ -57,20 +58,20 @@ func TestUserRegistred(t *testing.T) {
 			Method: http.MethodGet,
 			Path:   "/registration",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testUser{ //	1 отсутствуют обязательные параметры
 			Method: http.MethodPut,
 			Path:   "/registration",
 			Status: http.StatusBadRequest,
-			Error:  "login required\n",
+			Error:  "login required",
 		},
 		testUser{ //	2 отсутствуют обязательные параметры
 			Method: http.MethodPut,
 			Path:   "/registration",
 			Query:  "login=user",
 			Status: http.StatusBadRequest,
-			Error:  "password required\n",
+			Error:  "passwd required",
 		},
 		testUser{ //	3 успешная регистрация
 			Method: http.MethodPut,
@@ -88,35 +89,35 @@ func TestUserRegistred(t *testing.T) {
 			Method: http.MethodPut,
 			Path:   "/registration",
 			Query:  "login=admin&passwd=othersecret",
-			Status: http.StatusBadRequest,
-			Error:  "login already used\n",
+			Status: http.StatusConflict,
+			Error:  "login already used",
 		},
 		// ********** АВТОРИЗАЦИЯ ***********
 		testUser{ //	6 недопустимый метод
 			Method: http.MethodGet,
 			Path:   "/login",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testUser{ //	7 отсутствуют обязательные параметры
 			Method: http.MethodPost,
 			Path:   "/login",
 			Status: http.StatusBadRequest,
-			Error:  "login required\n",
+			Error:  "login required",
 		},
 		testUser{ //	8 отсутствуют обязательные параметры
 			Method: http.MethodPost,
 			Path:   "/login",
 			Query:  "login=admin",
 			Status: http.StatusBadRequest,
-			Error:  "password required\n",
+			Error:  "passwd required",
 		},
 		testUser{ //	9 неуспешная авторизация
 			Method: http.MethodPost,
 			Path:   "/login",
 			Query:  "login=user&passwd=wrongpwd",
 			Status: http.StatusNotFound,
-			Error:  "wrong login or password\n",
+			Error:  "wrong login or password",
 		},
 		testUser{ //	10 успешная авторизация нового
 			Method: http.MethodPost,
@@ -156,7 +157,7 @@ func TestUserRegistred(t *testing.T) {
 
 		if !((resp.StatusCode == http.StatusOK) || (resp.StatusCode == http.StatusCreated)) {
 			respBody, _ := ioutil.ReadAll(resp.Body)
-			if tst.Error != string(respBody) {
+			if tst.Error != errMessage(respBody) {
 				t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Body)
 				continue
 			}
@@ -174,8 +175,8 @@ func TestUserRegistred(t *testing.T) {
 	} else {
 		respBody, _ := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
-		if string(respBody) != "wrong form data\n" {
-			t.Errorf("Users.Login test bad parameters >>> wrong body [%s], expected [wrong form data\n]\n", respBody)
+		if errMessage(respBody) != "wrong form data" {
+			t.Errorf("Users.Login test bad parameters >>> wrong body [%s], expected [wrong form data]\n", respBody)
 		}
 	}
 
@@ -226,7 +227,7 @@ func TestUserList(t *testing.T) {
 			Method: http.MethodPut,
 			Path:   "/user/list",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testUser{ //	1 отсутствуют параметры, д.б. по умолчанию
 			Method: http.MethodGet,
@@ -235,12 +236,12 @@ func TestUserList(t *testing.T) {
 			Status: http.StatusOK,
 			Body: tUsrList{
 				List: []*tUser{
-					&tUser{UserID: 1, Name: "", Login: "admin"},
-					&tUser{UserID: 2, Name: "Lorem Ipsum", Login: "user"},
-					&tUser{UserID: 3, Name: "Uninvited T", Login: "guest"},
-					&tUser{UserID: 4, Name: "Dutchman Flying", Login: "ghost"},
-					&tUser{UserID: 5, Name: "", Login: "noname"},
-					&tUser{UserID: 6, Name: "Ghost Buster", Login: "hunter"},
+					&tUser{UserID: 1, Name: ""},
+					&tUser{UserID: 2, Name: "Lorem Ipsum"},
+					&tUser{UserID: 3, Name: "Uninvited T"},
+					&tUser{UserID: 4, Name: "Dutchman Flying"},
+					&tUser{UserID: 5, Name: ""},
+					&tUser{UserID: 6, Name: "Ghost Buster"},
 				},
 			},
 		},
@@ -252,12 +253,12 @@ func TestUserList(t *testing.T) {
 			Status: http.StatusOK,
 			Body: tUsrList{
 				List: []*tUser{
-					&tUser{UserID: 1, Name: "", Login: "admin"},
-					&tUser{UserID: 2, Name: "Lorem Ipsum", Login: "user"},
-					&tUser{UserID: 3, Name: "Uninvited T", Login: "guest"},
-					&tUser{UserID: 4, Name: "Dutchman Flying", Login: "ghost"},
-					&tUser{UserID: 5, Name: "", Login: "noname"},
-					&tUser{UserID: 6, Name: "Ghost Buster", Login: "hunter"},
+					&tUser{UserID: 1, Name: ""},
+					&tUser{UserID: 2, Name: "Lorem Ipsum"},
+					&tUser{UserID: 3, Name: "Uninvited T"},
+					&tUser{UserID: 4, Name: "Dutchman Flying"},
+					&tUser{UserID: 5, Name: ""},
+					&tUser{UserID: 6, Name: "Ghost Buster"},
 				},
 			},
 		},
@@ -269,12 +270,12 @@ func TestUserList(t *testing.T) {
 			Status: http.StatusOK,
 			Body: tUsrList{
 				List: []*tUser{
-					&tUser{UserID: 1, Name: "", Login: "admin"},
-					&tUser{UserID: 2, Name: "Lorem Ipsum", Login: "user"},
-					&tUser{UserID: 3, Name: "Uninvited T", Login: "guest"},
-					&tUser{UserID: 4, Name: "Dutchman Flying", Login: "ghost"},
-					&tUser{UserID: 5, Name: "", Login: "noname"},
-					&tUser{UserID: 6, Name: "Ghost Buster", Login: "hunter"},
+					&tUser{UserID: 1, Name: ""},
+					&tUser{UserID: 2, Name: "Lorem Ipsum"},
+					&tUser{UserID: 3, Name: "Uninvited T"},
+					&tUser{UserID: 4, Name: "Dutchman Flying"},
+					&tUser{UserID: 5, Name: ""},
+					&tUser{UserID: 6, Name: "Ghost Buster"},
 				},
 			},
 		},
@@ -286,8 +287,8 @@ func TestUserList(t *testing.T) {
 			Status: http.StatusOK,
 			Body: tUsrList{
 				List: []*tUser{
-					&tUser{UserID: 3, Name: "Uninvited T", Login: "guest"},
-					&tUser{UserID: 4, Name: "Dutchman Flying", Login: "ghost"},
+					&tUser{UserID: 3, Name: "Uninvited T"},
+					&tUser{UserID: 4, Name: "Dutchman Flying"},
 				},
 			},
 		},
@@ -297,14 +298,14 @@ func TestUserList(t *testing.T) {
 			Cookie: sessCook,
 			Query:  "page_no=3",
 			Status: http.StatusNotFound,
-			Error:  "\n",
+			Error:  "no records found",
 		},
 		// ********* СПИСОК РАСШАРЕННЫХ *************
 		testUser{ //	6 недопустимый метод
 			Method: http.MethodPut,
 			Path:   "/user/share",
 			Status: http.StatusMethodNotAllowed,
-			Error:  "bad method\n",
+			Error:  "bad method",
 		},
 		testUser{ //	7 отсутствуют параметры, д.б. по умолчанию
 			Method: http.MethodGet,
@@ -314,7 +315,7 @@ func TestUserList(t *testing.T) {
 			Body: tUsrList{
 				Count: 2,
 				List: []*tUser{
-					&tUser{UserID: 1, Name: "admin", Shared: 2},
+					&tUser{UserID: 1, Name: "user 1", Shared: 2},
 					&tUser{UserID: 2, Name: "Lorem Ipsum", Shared: 1},
 				},
 			},
@@ -328,7 +329,7 @@ func TestUserList(t *testing.T) {
 			Body: tUsrList{
 				Count: 2,
 				List: []*tUser{
-					&tUser{UserID: 1, Name: "admin", Shared: 2},
+					&tUser{UserID: 1, Name: "user 1", Shared: 2},
 					&tUser{UserID: 2, Name: "Lorem Ipsum", Shared: 1},
 				},
 			},
@@ -342,7 +343,7 @@ func TestUserList(t *testing.T) {
 			Body: tUsrList{
 				Count: 2,
 				List: []*tUser{
-					&tUser{UserID: 1, Name: "admin", Shared: 2},
+					&tUser{UserID: 1, Name: "user 1", Shared: 2},
 					&tUser{UserID: 2, Name: "Lorem Ipsum", Shared: 1},
 				},
 			},
@@ -353,7 +354,7 @@ func TestUserList(t *testing.T) {
 			Cookie: sessCook,
 			Query:  "page_no=3",
 			Status: http.StatusNotFound,
-			Error:  "\n",
+			Error:  "no records found",
 		},
 	}
 
@@ -390,24 +391,65 @@ func TestUserList(t *testing.T) {
 				t.Errorf("%s >>> unmarshaling result error [%s]", testName, err.Error())
 				continue
 			}
+			result.Next, result.Prev = "", "" //	ссылки на страницы проверяются в TestUsersListCursor
 			if !reflect.DeepEqual(tst.Body, result) {
 				t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, result.String(), tst.Body.String())
 			}
 
-		} else if tst.Error != string(respBody) {
+		} else if tst.Error != errMessage(respBody) {
 			t.Errorf("%s >>> wrong body [%s], expected [%s]\n", testName, respBody, tst.Error)
 			continue
 		}
 	}
 }
+
+//errMessage текст ошибки из json-ответа {"error": {"message": ...}}
+func errMessage(body []byte) string {
+	var env struct {
+		Error tAPIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return string(body)
+	}
+	return env.Error.Message
+}
+
+//testDo запрос к тестовому серверу: body для GET — строка запроса, для остальных
+//	методов — тело (json, если начинается с "{", иначе форма); cook nil — без сессии
+//Результат: статус и тело ответа
+func testDo(t *testing.T, method, path, body string, cook *http.Cookie) (int, []byte) {
+	var req *http.Request
+
+	t.Helper()
+	if method == http.MethodGet {
+		if body != "" {
+			path += "?" + body
+		}
+		req, _ = http.NewRequest(method, testSrv.URL+path, nil)
+	} else {
+		req, _ = http.NewRequest(method, testSrv.URL+path, strings.NewReader(body))
+		if strings.HasPrefix(body, "{") {
+			req.Header.Add("Content-Type", "application/json")
+		} else if body != "" {
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if cook != nil {
+		req.AddCookie(cook)
+	}
+	resp, err := testSrv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s query failed %s", method, path, err.Error())
+	}
+	defer resp.Body.Close()
+	res, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, res
+}
+
 func TestMain(m *testing.M) {
 	var (
 		err error
 		db  *sql.DB
-
-		usr *Users
-		ad  *Audiofill
-		mux *http.ServeMux
 	)
 
 	db, err = sql.Open("postgres", connStr)
@@ -424,24 +466,161 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal("database dump failed ", err)
 	}
+	testDB = db
 
-	usr = NewUsers(db)
-	ad = NewAudiofill(db)
-	mux = http.NewServeMux()
-	mux.HandleFunc("/registration", usr.Registration)
-	mux.HandleFunc("/login", usr.Login)
-	mux.HandleFunc("/logout", usr.Logout)
-	mux.HandleFunc("/user/list", usr.List)
-	mux.HandleFunc("/user/share", usr.Share)
-	mux.HandleFunc("/audio/list", ad.List)
-	mux.HandleFunc("/audio/share", ad.Share)
-	mux.HandleFunc("/audio/lock", ad.Lock)
-	mux.HandleFunc("/audio/get", ad.Get)
-	mux.HandleFunc("/audio/add", ad.Add)
-	testSrv = httptest.NewServer(mux)
+	testSrv = httptest.NewServer(newRouter(db))
 	defer testSrv.Close()
 
 	codeRun := m.Run()
 	db.Close()
 	os.Exit(codeRun)
 }
+
+func TestUsersListCursor(t *testing.T) {
+	var (
+		page tUsrList
+		ids  []int
+	)
+
+	client := testSrv.Client()
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+
+	get := func(path string) int {
+		req, _ := http.NewRequest(http.MethodGet, testSrv.URL+path, nil)
+		req.AddCookie(cookAdmin)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Users.List cursor: query failed %s", err.Error())
+		}
+		defer resp.Body.Close()
+		page = tUsrList{}
+		json.NewDecoder(resp.Body).Decode(&page)
+		if page.Next != "" && !strings.Contains(resp.Header.Get("Link"), `rel="next"`) {
+			t.Errorf("Users.List cursor: %s no Link header", path)
+		}
+		return resp.StatusCode
+	}
+
+	//	по две записи: 1,2 → 3,4 → 5,6 и назад к 3,4
+	next := "/users?on_page=2"
+	for next != "" {
+		if st := get(next); st != http.StatusOK {
+			t.Fatalf("Users.List cursor: %s wrong status %d", next, st)
+		}
+		for _, u := range page.List {
+			ids = append(ids, u.UserID)
+		}
+		next = page.Next
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2, 3, 4, 5, 6}) || page.Prev == "" {
+		t.Fatalf("Users.List cursor: forward %v, prev [%s]", ids, page.Prev)
+	}
+	if get(page.Prev); len(page.List) != 2 || page.List[0].UserID != 3 || page.List[1].UserID != 4 ||
+		page.Next == "" || page.Prev == "" {
+		t.Errorf("Users.List cursor: backward page %+v", page)
+	}
+
+	//	старый постраничный вывод тоже отдает ссылки, размер страницы ограничен
+	if get("/user/list?page_no=2&on_page=2"); page.Next == "" || page.Prev == "" {
+		t.Errorf("Users.List cursor: offset page links next [%s] prev [%s]", page.Next, page.Prev)
+	}
+	if get("/users?on_page=100000"); len(page.List) != 6 || page.Next != "" {
+		t.Errorf("Users.List cursor: on_page over limit %+v", page)
+	}
+}
+
+func TestUserProfile(t *testing.T) {
+	var prof tProfile
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookGuest := &http.Cookie{Name: "session_id", Value: "0414d6d5d923b0f4998556df2fe2e351"}
+
+	//	found id найденных поиском пользователей
+	found := func(q string, cook *http.Cookie) (ids []int) {
+		var uLst tUsrList
+
+		st, body := testDo(t, http.MethodGet, "/users?q="+q, "", cook)
+		if st == http.StatusOK {
+			json.Unmarshal(body, &uLst)
+			for _, u := range uLst.List {
+				ids = append(ids, u.UserID)
+			}
+		} else if st != http.StatusNotFound {
+			t.Errorf("Users.List: search %s wrong status %d [%s]", q, st, body)
+		}
+		return ids
+	}
+
+	//	поиск по началу логина, имени и слова имени
+	for _, tst := range []struct {
+		q   string
+		ids []int
+	}{
+		{"gu", []int{3}},
+		{"GH", []int{4, 6}},
+		{"ips", []int{2}},
+		{"bus", []int{6}},
+		{"%25", nil},
+		{"nobody", nil},
+	} {
+		if ids := found(tst.q, cookAdmin); !reflect.DeepEqual(ids, tst.ids) {
+			t.Errorf("Users.List: search %s found %v, expected %v", tst.q, ids, tst.ids)
+		}
+	}
+
+	tests := []struct {
+		method, path, body string
+		cook               *http.Cookie
+		status             int
+		err                string
+	}{
+		{http.MethodGet, "/me", "", nil, http.StatusUnauthorized, "access denied"},
+		{http.MethodGet, "/users/2", "", nil, http.StatusUnauthorized, "access denied"},
+		{http.MethodGet, "/users/999", "", cookAdmin, http.StatusNotFound, "user not found"},
+		{http.MethodGet, "/users/abc", "", cookAdmin, http.StatusBadRequest, "invalid user value"},
+		{http.MethodPatch, "/me", "{}", cookGuest, http.StatusBadRequest, "nothing to update"},
+		{http.MethodPatch, "/me", "searchable=maybe", cookGuest, http.StatusBadRequest, "invalid searchable value"},
+	}
+	for idx, tst := range tests {
+		if st, body := testDo(t, tst.method, tst.path, tst.body, tst.cook); st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Users.Profile: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+
+	//	чужой профиль: только имя и доступные записи
+	st, body := testDo(t, http.MethodGet, "/users/2", "", cookAdmin)
+	if st != http.StatusOK || json.Unmarshal(body, &prof) != nil ||
+		prof != (tProfile{UserID: 2, Name: "Lorem Ipsum", Tracks: 1}) {
+		t.Errorf("Users.Profile: wrong result %d [%s]", st, body)
+	}
+	//	у admin имя не задано: вместо логина — заглушка
+	prof = tProfile{}
+	st, body = testDo(t, http.MethodGet, "/users/1", "", cookGuest)
+	if st != http.StatusOK || json.Unmarshal(body, &prof) != nil || prof.Name != "user 1" || prof.Login != "" {
+		t.Errorf("Users.Profile: unnamed user wrong result %d [%s]", st, body)
+	}
+
+	//	гость скрывается из поиска (false в json — тоже значение)
+	if st, body = testDo(t, http.MethodPatch, "/me", `{"name": "Invited T", "searchable": false}`, cookGuest); st != http.StatusOK {
+		t.Fatalf("Users.UpdateMe: wrong result %d [%s]", st, body)
+	}
+	prof = tProfile{}
+	st, body = testDo(t, http.MethodGet, "/me", "", cookGuest)
+	if st != http.StatusOK || json.Unmarshal(body, &prof) != nil || prof.Name != "Invited T" ||
+		prof.Login != "guest" || prof.Searchable == nil || *prof.Searchable {
+		t.Errorf("Users.Me: wrong result %d [%s]", st, body)
+	}
+	if ids := found("gu", cookAdmin); ids != nil {
+		t.Errorf("Users.List: hidden user found %v", ids)
+	}
+	if ids := found("gu", cookGuest); !reflect.DeepEqual(ids, []int{3}) {
+		t.Errorf("Users.List: own record not found %v", ids)
+	}
+	if st, _ = testDo(t, http.MethodGet, "/users/3", "", cookAdmin); st != http.StatusOK {
+		t.Errorf("Users.Profile: hidden user profile wrong status %d", st)
+	}
+	testDo(t, http.MethodPatch, "/me", "name=Uninvited+T&searchable=true", cookGuest)
+	if ids := found("gu", cookAdmin); !reflect.DeepEqual(ids, []int{3}) {
+		t.Errorf("Users.List: user not found after unhide %v", ids)
+	}
+}
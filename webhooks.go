@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//webhookEvents события, на которые можно подписать webhook
+var webhookEvents = map[string]bool{
+	eventTrackAdded:   true,
+	eventTrackUpdated: true,
+	eventTrackDeleted: true,
+	eventShareGranted: true,
+	eventShareRevoked: true,
+}
+
+type tWebhook struct {
+	HookID  int        `json:"id"`
+	URL     string     `json:"url"`
+	Events  []string   `json:"events"`
+	Secret  string     `json:"secret,omitempty"`
+	Global  bool       `json:"global"`
+	Created *time.Time `json:"created,omitempty"`
+}
+
+type tHookList struct {
+	List []*tWebhook `json:"records"`
+}
+
+type tDelivery struct {
+	DeliveryID int        `json:"id"`
+	Event      string     `json:"event"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Code       int        `json:"response_code,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	Created    time.Time  `json:"created"`
+	NextTry    *time.Time `json:"next_try,omitempty"`
+	Delivered  *time.Time `json:"delivered,omitempty"`
+}
+
+type tDeliveryList struct {
+	Count int          `json:"total_count"`
+	List  []*tDelivery `json:"records"`
+}
+
+//webhookWake сигнал обработчику очереди о новых доставках (чтобы не ждать тика)
+var webhookWake = make(chan struct{}, 1)
+
+//enqueueWebhooks постановка события в очередь доставки всем подходящим webhook'ам:
+//	личным — получателей события, и глобальным (администраторским)
+func enqueueWebhooks(db *sql.DB, ev *tEvent) {
+	out := *ev
+	out.Recipients = nil
+	js, err := json.Marshal(struct {
+		Event string  `json:"event"`
+		Data  *tEvent `json:"data"`
+	}{ev.Kind, &out})
+	if err != nil {
+		log.Println("Webhooks.enqueue marshaling error:", err.Error())
+		return
+	}
+
+	qr, err := db.Exec(`INSERT INTO webhook_deliveries (id_hook, event, payload)
+		SELECT id_hook, $1, $2 FROM webhooks
+		WHERE (global OR id_user = ANY($3))
+			AND (cardinality(events) = 0 OR $1 = ANY(events))`,
+		ev.Kind, string(js), pq.Array(ev.Recipients))
+	if err != nil {
+		log.Println("Webhooks.enqueue query failed:", err.Error())
+		return
+	}
+	if cnt, _ := qr.RowsAffected(); cnt > 0 {
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//errWebhookAddress адрес получателя webhook'а в локальной сети
+var errWebhookAddress = errors.New("webhook address not allowed")
+
+//webhookPrivateNets частные сети (кроме loopback и link-local, см. privateIP)
+var webhookPrivateNets = func() (nets []*net.IPNet) {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+//privateIP адрес локальной сети: loopback, частный, link-local или неуказанный
+func privateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range webhookPrivateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//webhookClient клиент доставки webhook'ов. Адрес получателя проверяется при каждом
+//	соединении, уже после разрешения имени (и при переадресации): проверка URL в Add
+//	не защищает от имени, которое позже указывает во внутреннюю сеть. Прокси из
+//	окружения не используется — иначе проверялся бы адрес прокси
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || (!webhookAllowPrivate && privateIP(ip)) {
+				return errWebhookAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: webhookTimeout},
+	}
+}
+
+//signPayload подпись тела запроса: hex(HMAC-SHA256(secret, body))
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//deliverWebhooks один проход по очереди доставки: забирает до webhookBatch
+//	созревших доставок и отправляет их по очереди. Доставки "арендуются" сдвигом
+//	next_try на время отправки всей пачки (запрос client — не дольше webhookTimeout)
+//	с запасом, поэтому несколько экземпляров сервера не отправят одно и то же дважды.
+//	Неудачные попытки повторяются с экспоненциальной задержкой, после
+//	webhookMaxAttempts доставка помечается failed
+func deliverWebhooks(db *sql.DB, client *http.Client) (cnt int, err error) {
+	type tTask struct {
+		id, attempts int
+		event, url   string
+		secret       string
+		payload      []byte
+	}
+	var (
+		qs    *sql.Rows
+		tasks []tTask
+	)
+
+	qs, err = db.Query(`UPDATE webhook_deliveries d SET next_try = now() + $2::interval
+		FROM webhooks h
+		WHERE h.id_hook = d.id_hook AND d.id_delivery IN (
+			SELECT id_delivery FROM webhook_deliveries
+			WHERE status = 'pending' AND next_try <= now()
+			ORDER BY next_try
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id_delivery, d.attempts, d.event, h.url, h.secret, d.payload`,
+		webhookBatch, fmt.Sprintf("%d seconds", int(webhookTimeout.Seconds())*(webhookBatch+1)))
+	if err != nil {
+		return
+	}
+	for qs.Next() {
+		tk := tTask{}
+		if err = qs.Scan(&tk.id, &tk.attempts, &tk.event, &tk.url, &tk.secret, &tk.payload); err != nil {
+			qs.Close()
+			return
+		}
+		tasks = append(tasks, tk)
+	}
+	qs.Close()
+	if err = qs.Err(); err != nil {
+		return
+	}
+
+	for _, tk := range tasks {
+		var (
+			code    int
+			errText string
+			resp    *http.Response
+			req     *http.Request
+		)
+
+		req, err = http.NewRequest(http.MethodPost, tk.url, bytes.NewReader(tk.payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", "audiofill-webhook")
+			req.Header.Set("X-Audiofill-Event", tk.event)
+			req.Header.Set("X-Audiofill-Delivery", strconv.Itoa(tk.id))
+			req.Header.Set("X-Audiofill-Signature", "sha256="+signPayload(tk.secret, tk.payload))
+			resp, err = client.Do(req)
+		}
+		if err != nil {
+			errText = err.Error()
+		} else {
+			code = resp.StatusCode
+			resp.Body.Close()
+			if code < 200 || code >= 300 {
+				errText = fmt.Sprintf("status %d", code)
+			}
+		}
+
+		tk.attempts++
+		switch {
+		case errText == "":
+			_, err = db.Exec(`UPDATE webhook_deliveries SET status = 'delivered', attempts = $2,
+				response_code = $3, last_error = '', delivered = now()
+				WHERE id_delivery = $1`, tk.id, tk.attempts, code)
+			cnt++
+		case tk.attempts >= webhookMaxAttempts:
+			_, err = db.Exec(`UPDATE webhook_deliveries SET status = 'failed', attempts = $2,
+				response_code = nullif($3, 0), last_error = $4
+				WHERE id_delivery = $1`, tk.id, tk.attempts, code, errText)
+		default:
+			//	экспоненциальная задержка: base, 2*base, 4*base…
+			delay := webhookBackoff << uint(tk.attempts-1)
+			_, err = db.Exec(`UPDATE webhook_deliveries SET attempts = $2,
+				response_code = nullif($3, 0), last_error = $4,
+				next_try = now() + $5::interval
+				WHERE id_delivery = $1`, tk.id, tk.attempts, code, errText,
+				fmt.Sprintf("%d milliseconds", delay.Nanoseconds()/int64(time.Millisecond)))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return cnt, nil
+}
+
+//Webhooks класс для таблиц webhooks/webhook_deliveries: регистрация
+//	пользователем URL'ов для событий библиотеки и журнал доставок
+type Webhooks struct {
+	DB     *sql.DB
+	userID int
+}
+
+//NewWebhooks создание нового экземпляра класса Webhooks
+func NewWebhooks(db *sql.DB) *Webhooks {
+	return &Webhooks{
+		DB: db,
+	}
+}
+
+//Add регистрация webhook'а. Метод PUT, доступен только авторизованным пользователям
+//Параметры: url — обязательный, http(s) адрес получателя
+//	events — необязательный, список событий через запятую (track.added, share.granted,
+//	share.revoked…), по умолчанию все
+//	secret — необязательный, ключ подписи HMAC-SHA256, по умолчанию генерируется
+//	global — необязательный, только для администраторов: события всех пользователей
+//Результат: статус Created, json зарегистрированного webhook'а вместе с secret
+//	Подпись передается в заголовке X-Audiofill-Signature: sha256=<hex>
+//Ошибка: статус BadRequest при неверных параметрах
+//	статус Forbidden если global запрошен не администратором
+func (hk *Webhooks) Add(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		frmVal []string
+		ok     bool
+		hook   tWebhook
+		uri    *url.URL
+		admin  bool
+	)
+
+	if hk.userID, err = checkSession(hk.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+
+	if frmVal, ok = req.Form["url"]; !ok {
+		fieldError(resp, "url", "required")
+		return
+	}
+	uri, err = url.Parse(frmVal[0])
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+		fieldError(resp, "url", "invalid")
+		return
+	}
+	hook.URL = uri.String()
+
+	hook.Events = []string{}
+	if frmVal, ok = req.Form["events"]; ok {
+		for _, ev := range strings.Split(frmVal[0], ",") {
+			if ev = strings.TrimSpace(ev); ev == "" {
+				continue
+			}
+			if !webhookEvents[ev] {
+				fieldError(resp, "events", "invalid")
+				return
+			}
+			hook.Events = append(hook.Events, ev)
+		}
+	}
+
+	if frmVal, ok = req.Form["secret"]; ok && frmVal[0] != "" {
+		hook.Secret = frmVal[0]
+	} else {
+		b := make([]byte, 20)
+		if _, err = rand.Read(b); err != nil {
+			internalError(resp, err, "Webhooks.Add secret generation failed:")
+			return
+		}
+		hook.Secret = hex.EncodeToString(b)
+	}
+
+	if frmVal, ok = req.Form["global"]; ok && frmVal[0] != "" && frmVal[0] != "0" && frmVal[0] != "false" {
+		err = hk.DB.QueryRow(`SELECT is_admin FROM users WHERE id_user = $1`, hk.userID).Scan(&admin)
+		if err != nil {
+			dbError(resp, err, "Webhooks.Add query failed:")
+			return
+		}
+		if !admin {
+			apiError(resp, http.StatusForbidden, "access denied")
+			return
+		}
+		hook.Global = true
+	}
+
+	err = hk.DB.QueryRow(`INSERT INTO webhooks (id_user, url, secret, events, global)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id_hook`,
+		hk.userID, hook.URL, hook.Secret, pq.Array(hook.Events), hook.Global).Scan(&hook.HookID)
+	if err != nil {
+		dbError(resp, err, "Webhooks.Add query failed:")
+		return
+	}
+
+	jsRes, err := json.Marshal(hook)
+	if err != nil {
+		internalError(resp, err, "Webhooks.Add result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(jsRes)
+}
+
+//List список webhook'ов пользователя (без ключей подписи). Метод GET
+//Результат: статус ОК, json список
+//Ошибка: статус NotFound если webhook'ов нет
+func (hk *Webhooks) List(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err  error
+		qs   *sql.Rows
+		hLst tHookList
+	)
+
+	if hk.userID, err = checkSession(hk.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+
+	qs, err = hk.DB.Query(`SELECT id_hook, url, events, global, created
+		FROM webhooks WHERE id_user = $1 ORDER BY id_hook`, hk.userID)
+	if err != nil {
+		dbError(resp, err, "Webhooks.List query failed:")
+		return
+	}
+	defer qs.Close()
+
+	for qs.Next() {
+		h := &tWebhook{Created: &time.Time{}}
+		if err = qs.Scan(&h.HookID, &h.URL, pq.Array(&h.Events), &h.Global, h.Created); err != nil {
+			dbError(resp, err, "Webhooks.List scan error:")
+			return
+		}
+		hLst.List = append(hLst.List, h)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Webhooks.List query iteration error:")
+		return
+	}
+	if len(hLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+
+	jsRes, err := json.Marshal(hLst)
+	if err != nil {
+		internalError(resp, err, "Webhooks.List result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//Delete удаление webhook'а вместе с журналом доставок. Метод POST
+//Параметры: id — номер webhook'а
+//Результат: статус ОК
+//Ошибка: статус NotFound если у пользователя нет webhook'а с таким id
+func (hk *Webhooks) Delete(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err error
+		id  int
+		qr  sql.Result
+	)
+
+	if hk.userID, err = checkSession(hk.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = hk.hookParam(req, resp); err != nil {
+		return
+	}
+
+	qr, err = hk.DB.Exec(`DELETE FROM webhooks WHERE id_hook = $1 AND id_user = $2`, id, hk.userID)
+	if err != nil {
+		dbError(resp, err, "Webhooks.Delete query failed:")
+		return
+	}
+	if res, _ := qr.RowsAffected(); res == 0 {
+		apiError(resp, http.StatusNotFound, "no rows are deleted")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+//Log журнал доставок webhook'а, новые первыми. Метод GET
+//Параметры: id — номер webhook'а, page_no, on_page — необязательные
+//Результат: статус ОК, json: общее количество и список доставок
+//Ошибка: статус NotFound если webhook не найден или доставок не было
+func (hk *Webhooks) Log(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		id     int
+		pg, ln int
+		qs     *sql.Rows
+		dLst   tDeliveryList
+	)
+
+	if hk.userID, err = checkSession(hk.DB, req); err != nil {
+		apiError(resp, http.StatusUnauthorized, "access denied")
+		return
+	}
+	if err = req.ParseForm(); err != nil {
+		apiError(resp, http.StatusBadRequest, "wrong form data")
+		return
+	}
+	if id, err = hk.hookParam(req, resp); err != nil {
+		return
+	}
+	pg, ln = getPageno(req)
+
+	err = hk.DB.QueryRow(`SELECT count(d.id_delivery)
+		FROM webhook_deliveries d
+		INNER JOIN webhooks h ON (h.id_hook = d.id_hook)
+		WHERE h.id_hook = $1 AND h.id_user = $2`, id, hk.userID).Scan(&dLst.Count)
+	if err != nil {
+		dbError(resp, err, "Webhooks.Log scan count failed:")
+		return
+	}
+
+	qs, err = hk.DB.Query(`SELECT d.id_delivery, d.event, d.status, d.attempts,
+			coalesce(d.response_code, 0), d.last_error, d.created,
+			CASE WHEN d.status = 'pending' THEN d.next_try END, d.delivered
+		FROM webhook_deliveries d
+		INNER JOIN webhooks h ON (h.id_hook = d.id_hook)
+		WHERE h.id_hook = $1 AND h.id_user = $2
+		ORDER BY d.id_delivery DESC
+		OFFSET $3 LIMIT $4`, id, hk.userID, pg*ln, ln)
+	if err != nil {
+		dbError(resp, err, "Webhooks.Log query failed:")
+		return
+	}
+	defer qs.Close()
+
+	for qs.Next() {
+		var next, done pq.NullTime
+		d := &tDelivery{}
+		err = qs.Scan(&d.DeliveryID, &d.Event, &d.Status, &d.Attempts, &d.Code, &d.LastError, &d.Created, &next, &done)
+		if err != nil {
+			dbError(resp, err, "Webhooks.Log scan error:")
+			return
+		}
+		if next.Valid {
+			d.NextTry = &next.Time
+		}
+		if done.Valid {
+			d.Delivered = &done.Time
+		}
+		dLst.List = append(dLst.List, d)
+	}
+	if err = qs.Err(); err != nil {
+		dbError(resp, err, "Webhooks.Log query iteration error:")
+		return
+	}
+	if len(dLst.List) == 0 {
+		apiError(resp, http.StatusNotFound, "no records found")
+		return
+	}
+
+	jsRes, err := json.Marshal(dLst)
+	if err != nil {
+		internalError(resp, err, "Webhooks.Log result marshaling error:")
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsRes)
+}
+
+//hookParam номер webhook'а из параметра id. При ошибке ответ клиенту уже отправлен
+func (hk *Webhooks) hookParam(req *http.Request, resp http.ResponseWriter) (id int, err error) {
+	frmVal, ok := req.Form["id"]
+	if !ok {
+		fieldError(resp, "id", "required")
+		return 0, fmt.Errorf("id required")
+	}
+	if id, err = strconv.Atoi(frmVal[0]); err != nil {
+		fieldError(resp, "id", "invalid")
+	}
+	return
+}
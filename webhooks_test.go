@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//testReceiver получатель webhook'ов: запоминает запросы, отвечает статусом status
+type testReceiver struct {
+	mu     sync.Mutex
+	status int
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (rc *testReceiver) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	rc.mu.Lock()
+	rc.reqs = append(rc.reqs, req)
+	rc.bodies = append(rc.bodies, body)
+	status := rc.status
+	rc.mu.Unlock()
+	resp.WriteHeader(status)
+}
+
+func TestWebhookClient(t *testing.T) {
+	rcvSrv := httptest.NewServer(&testReceiver{status: http.StatusOK})
+	defer rcvSrv.Close()
+
+	//	loopback по IP и по имени — отказ до соединения
+	for _, uri := range []string{rcvSrv.URL, strings.Replace(rcvSrv.URL, "127.0.0.1", "localhost", 1)} {
+		if _, err := webhookClient().Get(uri); !errors.Is(err, errWebhookAddress) {
+			t.Errorf("webhookClient: %s wrong error %v", uri, err)
+		}
+	}
+	for _, tst := range []struct {
+		ip  string
+		res bool
+	}{{"10.1.2.3", true}, {"172.31.0.1", true}, {"192.168.0.10", true}, {"169.254.169.254", true},
+		{"::1", true}, {"fd00::1", true}, {"fe80::1", true}, {"0.0.0.0", true},
+		{"8.8.8.8", false}, {"172.32.0.1", false}, {"2a00:1450::1", false}} {
+		if privateIP(net.ParseIP(tst.ip)) != tst.res {
+			t.Errorf("privateIP: %s wrong result", tst.ip)
+		}
+	}
+
+	webhookAllowPrivate = true
+	defer func() { webhookAllowPrivate = false }()
+	if resp, err := webhookClient().Get(rcvSrv.URL); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("webhookClient: allowed loopback wrong result %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	var (
+		err  error
+		hook tWebhook
+		dLst tDeliveryList
+		cnt  int
+	)
+
+	cookAdmin := &http.Cookie{Name: "session_id", Value: "3d73274ac8b18ab09528075c7fee1213"}
+	cookUser := &http.Cookie{Name: "session_id", Value: "b00f30ecdfa4d5bd2e5280ab59be492a"}
+
+	rcv := &testReceiver{status: http.StatusOK}
+	rcvSrv := httptest.NewServer(rcv)
+	defer rcvSrv.Close()
+	//	получатель слушает на loopback
+	webhookAllowPrivate = true
+	defer func() { webhookAllowPrivate = false }()
+
+	tests := []struct {
+		query  string
+		cook   *http.Cookie
+		status int
+		err    string
+	}{
+		{"", cookAdmin, http.StatusBadRequest, "url required"},
+		{"url=ftp://example.com", cookAdmin, http.StatusBadRequest, "invalid url value"},
+		{"url=http://example.com&events=track.exploded", cookAdmin, http.StatusBadRequest, "invalid events value"},
+		{"url=http://example.com&global=1", cookUser, http.StatusForbidden, "access denied"},
+	}
+	for idx, tst := range tests {
+		st, body := testDo(t, http.MethodPut, "/webhook/add", tst.query, tst.cook)
+		if st != tst.status || errMessage(body) != tst.err {
+			t.Errorf("Webhooks.Add: test [%d] wrong result %d [%s], expected %d [%s]", idx, st, body, tst.status, tst.err)
+		}
+	}
+
+	//	webhook администратора на открытие доступа к своим трекам
+	st, body := testDo(t, http.MethodPut, "/webhook/add", "url="+rcvSrv.URL+"&events=share.granted&secret=s3cret", cookAdmin)
+	if st != http.StatusCreated {
+		t.Fatalf("Webhooks.Add: wrong status %d, expected %d", st, http.StatusCreated)
+	}
+	if err = json.Unmarshal(body, &hook); err != nil || hook.Secret != "s3cret" {
+		t.Fatalf("Webhooks.Add: wrong result [%s] %v", body, err)
+	}
+
+	//	событие, на которое webhook не подписан, и событие по чужому треку
+	testDo(t, http.MethodPost, "/audio/share", "track=2&user=3", cookAdmin)
+	testDo(t, http.MethodPost, "/audio/lock", "track=2&user=3", cookAdmin)
+	testDo(t, http.MethodPost, "/audio/share", "track=4&user=3", cookUser)
+	testDo(t, http.MethodPost, "/audio/lock", "track=4&user=3", cookUser)
+
+	if cnt, err = deliverWebhooks(testDB, webhookClient()); err != nil || cnt != 1 {
+		t.Fatalf("Webhooks.deliver: delivered %d, expected 1 (%v)", cnt, err)
+	}
+	rcv.mu.Lock()
+	if len(rcv.reqs) != 1 {
+		t.Fatalf("Webhooks.deliver: received %d requests, expected 1", len(rcv.reqs))
+	}
+	got, gotBody := rcv.reqs[0], rcv.bodies[0]
+	rcv.mu.Unlock()
+	if got.Header.Get("X-Audiofill-Event") != eventShareGranted {
+		t.Errorf("Webhooks.deliver: wrong event header %s", got.Header.Get("X-Audiofill-Event"))
+	}
+	if got.Header.Get("X-Audiofill-Signature") != "sha256="+signPayload("s3cret", gotBody) {
+		t.Errorf("Webhooks.deliver: wrong signature %s", got.Header.Get("X-Audiofill-Signature"))
+	}
+	payload := struct {
+		Event string `json:"event"`
+		Data  tEvent `json:"data"`
+	}{}
+	if err = json.Unmarshal(gotBody, &payload); err != nil || payload.Data.AudioID != 2 || payload.Data.TargetID != 3 {
+		t.Errorf("Webhooks.deliver: wrong payload [%s] %v", gotBody, err)
+	}
+
+	//	получатель недоступен — доставка откладывается с увеличением счетчика попыток
+	rcv.mu.Lock()
+	rcv.status = http.StatusInternalServerError
+	rcv.mu.Unlock()
+	testDo(t, http.MethodPost, "/audio/share", "track=2&user=3", cookAdmin)
+	testDo(t, http.MethodPost, "/audio/lock", "track=2&user=3", cookAdmin)
+	if cnt, err = deliverWebhooks(testDB, webhookClient()); err != nil || cnt != 0 {
+		t.Errorf("Webhooks.deliver: delivered %d, expected 0 (%v)", cnt, err)
+	}
+	//	повтор еще не созрел
+	if cnt, err = deliverWebhooks(testDB, webhookClient()); err != nil || cnt != 0 {
+		t.Errorf("Webhooks.deliver: delivered %d, expected 0 (%v)", cnt, err)
+	}
+
+	st, body = testDo(t, http.MethodGet, "/webhook/log", "id="+strconv.Itoa(hook.HookID), cookAdmin)
+	if st != http.StatusOK {
+		t.Fatalf("Webhooks.Log: wrong status %d, expected %d", st, http.StatusOK)
+	}
+	if err = json.Unmarshal(body, &dLst); err != nil {
+		t.Fatalf("Webhooks.Log: unmarshaling result error [%s]", err.Error())
+	}
+	if dLst.Count != 2 || dLst.List[0].Status != "pending" || dLst.List[0].Attempts != 1 ||
+		dLst.List[0].Code != http.StatusInternalServerError || dLst.List[0].NextTry == nil ||
+		dLst.List[1].Status != "delivered" || dLst.List[1].Delivered == nil {
+		t.Errorf("Webhooks.Log: wrong log [%s]", body)
+	}
+
+	//	журнал чужого webhook'а недоступен
+	if st, _ = testDo(t, http.MethodGet, "/webhook/log", "id="+strconv.Itoa(hook.HookID), cookUser); st != http.StatusNotFound {
+		t.Errorf("Webhooks.Log: foreign log wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+	if st, _ = testDo(t, http.MethodPost, "/webhook/delete", "id="+strconv.Itoa(hook.HookID), cookAdmin); st != http.StatusOK {
+		t.Errorf("Webhooks.Delete: wrong status %d, expected %d", st, http.StatusOK)
+	}
+	if st, _ = testDo(t, http.MethodGet, "/webhook/list", "", cookAdmin); st != http.StatusNotFound {
+		t.Errorf("Webhooks.List: wrong status %d, expected %d", st, http.StatusNotFound)
+	}
+}